@@ -23,6 +23,8 @@ ITERATIONS = 3
 PARALLEL_IMPLS: List[Tuple[str, str]] = [
     ("bsp", "BSP (Static)"),
     ("ws",  "Work Stealing"),
+    ("fj",  "Fork-Join"),
+    ("pool", "Channel Pool"),
 ]
 
 # Two datasets: fragmented (your real-world pick) + mixed real-worldish
@@ -161,6 +163,8 @@ def run_compress(in_file: str, impl: str, threads: int, output_file: str) -> Tup
     if os.path.exists(output_file):
         os.remove(output_file)
     start = time.time()
+    # No -tune: its choice depends on measured speed, and check_determinism
+    # compares archives across runs.
     cmd = [
         _exe_path(), "-mode", "compress", "-in", in_file,
         "-out", output_file, "-impl", impl, "-threads", str(threads),
@@ -197,6 +201,16 @@ def verify_integrity(in_file: str, compressed_file: str) -> bool:
             os.remove(out)
     return ok
 
+def check_determinism(dataset_key: str, reference: str, outputs: List[str]) -> bool:
+    """Every implementation and thread count must write the same archive."""
+    want = _md5sum(reference)
+    ok = True
+    for path in outputs:
+        if _md5sum(path) != want:
+            print(f"[{dataset_key}] {path} differs from {reference}")
+            ok = False
+    return ok
+
 def delete_all_pcz(tracked: List[str]) -> None:
     """Tracked delete + sweep any *.pcz left."""
     for path in tracked:
@@ -267,6 +281,7 @@ def main() -> None:
             raise SystemExit(1)
 
         # Collect speedups
+        dataset_outputs: List[str] = []
         speedups_by_impl: Dict[str, List[float]] = {}
         labels_by_impl: Dict[str, str] = {}
 
@@ -283,6 +298,7 @@ def main() -> None:
                     total_time += dur
                     last_ratio = ratio
                     tracked_artifacts.append(out_file)
+                    dataset_outputs.append(out_file)
                 avg_time = total_time / ITERATIONS
                 impl_speedups.append(seq_time / avg_time if avg_time > 0 else 0.0)
 
@@ -290,6 +306,10 @@ def main() -> None:
             img = plot_speedup_for_impl(dataset_key, dataset_label, impl_key, impl_label, THREAD_COUNTS, impl_speedups)
             images_written.append(img)
 
+        if not check_determinism(dataset_key, seq_out, dataset_outputs):
+            delete_all_pcz(tracked_artifacts)
+            raise SystemExit(1)
+
         comp_img = plot_speedup_comparison(dataset_key, dataset_label, speedups_by_impl, labels_by_impl)
         images_written.append(comp_img)
 
@@ -0,0 +1,46 @@
+//go:build js && wasm
+
+// Command pczwasm exposes the in-memory compressor to JavaScript:
+//
+//	GOOS=js GOARCH=wasm go build -o pcz.wasm ./cmd/pczwasm
+//
+// After the module starts, pczCompress(bytes) and pczDecompress(bytes) are
+// available on the global object. Both take a Uint8Array and return a
+// Uint8Array, or an Error object when the input cannot be processed. Only
+// the codec package is linked, not core with its files, processes and
+// network.
+package main
+
+import (
+	"syscall/js"
+
+	"proj3/core/codec"
+)
+
+func main() {
+	js.Global().Set("pczCompress", bytesFunc(func(in []byte) ([]byte, error) {
+		return codec.CompressBytes(in, 1<<20, "ws", 4)
+	}))
+	js.Global().Set("pczDecompress", bytesFunc(func(in []byte) ([]byte, error) {
+		return codec.DecompressBytes(in, "ws", 4)
+	}))
+	select {}
+}
+
+// bytesFunc wraps fn as a JavaScript function from Uint8Array to Uint8Array.
+func bytesFunc(fn func([]byte) ([]byte, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) != 1 {
+			return js.Global().Get("Error").New("expected one Uint8Array argument")
+		}
+		in := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(in, args[0])
+		out, err := fn(in)
+		if err != nil {
+			return js.Global().Get("Error").New(err.Error())
+		}
+		arr := js.Global().Get("Uint8Array").New(len(out))
+		js.CopyBytesToJS(arr, out)
+		return arr
+	})
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// SetAdaptiveThreads makes the parallel schedulers yield to other work on
+// the machine (see codec.SetAdaptiveThreads). It relies on /proc/loadavg;
+// elsewhere the workers are simply never parked.
+func SetAdaptiveThreads(on bool) {
+	codec.SetAdaptiveThreads(on, runQueueLength)
+}
+
+// runQueueLength reads the number of currently runnable tasks from the
+// fourth field ("running/total") of /proc/loadavg.
+func runQueueLength() (int, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 4 {
+		return 0, false
+	}
+	r, _, _ := strings.Cut(fields[3], "/")
+	n, err := strconv.Atoi(r)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"io"
+
+	"proj3/core/codec"
+)
+
+// DefaultAlign pads the header and every compressed block of an archive to
+// a multiple of this many bytes, so blocks can be read with O_DIRECT or
+// straight off a block device. 0 packs blocks back to back.
+var DefaultAlign uint32
+
+func SetAlign(n uint64) error {
+	if n != 0 && (n&(n-1) != 0 || n > codec.MaxAlign) {
+		return fmt.Errorf("alignment %d is not a power of two up to 1G", n)
+	}
+	DefaultAlign = uint32(n)
+	return nil
+}
+
+// setAlignment lays out the blocks of h at multiples of align and records
+// their offsets in the header.
+func setAlignment(h *codec.FileHeader, align uint32) {
+	h.Flags |= codec.FlagAlign
+	h.Align = align
+	h.BlockOffsets = make([]uint64, h.NumBlocks)
+	off := int64(0)
+	for i, s := range h.BlockCompSizes {
+		h.BlockOffsets[i] = uint64(off)
+		off = codec.AlignUp(off+int64(s), align)
+	}
+}
+
+// unpadReader reads the compressed blocks of an aligned member back to back,
+// as if they were packed, by skipping the padding between them. Once the
+// last block is read it also consumes the padding after it, leaving the
+// underlying reader at the next member.
+type unpadReader struct {
+	r     io.Reader
+	comp  []int64 // padded block offsets, from CompOffsets
+	sizes []uint64
+	i     int   // current block
+	pos   int64 // offset in the padded payload
+}
+
+// newUnpadReader returns an unpadReader over the payload of h, with r
+// positioned at the start of block first.
+func newUnpadReader(r io.Reader, h *codec.FileHeader, first int) *unpadReader {
+	comp := h.CompOffsets()
+	return &unpadReader{r: r, comp: comp, sizes: h.BlockCompSizes, i: first, pos: comp[first]}
+}
+
+func (u *unpadReader) skip(to int64) error {
+	if to <= u.pos {
+		return nil
+	}
+	n, err := io.CopyN(io.Discard, u.r, to-u.pos)
+	u.pos += n
+	return noEOF(err)
+}
+
+func (u *unpadReader) Read(p []byte) (int, error) {
+	for u.i < len(u.sizes) && u.pos >= u.comp[u.i]+int64(u.sizes[u.i]) {
+		u.i++
+	}
+	if u.i == len(u.sizes) {
+		return 0, io.EOF
+	}
+	if err := u.skip(u.comp[u.i]); err != nil {
+		return 0, err
+	}
+	end := u.comp[u.i] + int64(u.sizes[u.i])
+	if int64(len(p)) > end-u.pos {
+		p = p[:end-u.pos]
+	}
+	n, err := u.r.Read(p)
+	u.pos += int64(n)
+	if err == io.EOF {
+		err = nil
+		if u.pos < u.comp[len(u.sizes)] {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err == nil && u.i == len(u.sizes)-1 && u.pos == end {
+		err = u.skip(u.comp[len(u.sizes)])
+	}
+	return n, err
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// BlockReport is how one block of a file compressed, as AnalyzeFile saw it.
+type BlockReport struct {
+	Index    int
+	Offset   int64 // in the input
+	Size     int   // uncompressed
+	CompSize int   // encoded, mode byte included
+	Codec    string
+	Worker   int           // scheduler worker that compressed it; 0 for seq
+	Stolen   bool          // ws, fj: taken from another worker's deque
+	Time     time.Duration // spent encoding it
+}
+
+// Ratio returns the block's uncompressed size over its compressed size.
+func (b *BlockReport) Ratio() float64 {
+	if b.CompSize == 0 {
+		return 0
+	}
+	return float64(b.Size) / float64(b.CompSize)
+}
+
+// AnalyzeFile compresses every block of inputPath with the scheduler named
+// by impl, under the -codec, -level and -filter settings, and reports what
+// became of each block and which worker did it. The check for inputs that
+// are already compressed is skipped, so the report shows what the codec
+// makes of every block. Nothing is written.
+func AnalyzeFile(inputPath, impl string, threads int) ([]BlockReport, error) {
+	in, err := openFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("input is not a regular file")
+	}
+
+	originalSize := info.Size()
+	blockSize := int64(DefaultBlockSize)
+	numBlocks := int((originalSize + blockSize - 1) / blockSize)
+	reports := make([]BlockReport, numBlocks)
+
+	// The scheduler trace says which worker ran each block. Turn it on for
+	// this run, and leave no events behind unless -trace asked for them.
+	evs, err := codec.TraceRun(func() error {
+		return codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+			off := int64(idx) * blockSize
+			n := blockSize
+			if idx == numBlocks-1 {
+				n = originalSize - off
+			}
+			buf := make([]byte, n)
+			if _, err := in.ReadAt(buf, off); err != nil && err != io.EOF {
+				return fmt.Errorf("read block %d: %w", idx, err)
+			}
+			start := time.Now()
+			enc, err := codec.EncodeBlock(codec.DefaultFilter.Apply(buf))
+			if err != nil {
+				return fmt.Errorf("compress block %d: %w", idx, err)
+			}
+			reports[idx] = BlockReport{
+				Index:    idx,
+				Offset:   off,
+				Size:     int(n),
+				CompSize: len(enc),
+				Codec:    codec.CodecName(enc[0]),
+				Time:     time.Since(start),
+			}
+			return nil
+		})
+	})
+	for _, ev := range evs {
+		if !ev.Barrier && ev.Task >= 0 && ev.Task < numBlocks {
+			reports[ev.Task].Worker = ev.Worker
+			reports[ev.Task].Stolen = ev.Stolen
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// WriteBlockCSV writes reports as CSV with a header line, one row per
+// block; times are in microseconds.
+func WriteBlockCSV(w io.Writer, reports []BlockReport) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "block,offset,size,compressed,ratio,codec,worker,stolen,time_us")
+	for _, b := range reports {
+		fmt.Fprintf(bw, "%d,%d,%d,%d,%.3f,%s,%d,%t,%d\n",
+			b.Index, b.Offset, b.Size, b.CompSize, b.Ratio(), b.Codec, b.Worker, b.Stolen, b.Time.Microseconds())
+	}
+	return bw.Flush()
+}
+
+// heatmapShades go from blocks that shrink to almost nothing to blocks
+// that do not shrink at all, by compressed size over size in tenths.
+const heatmapShades = " .:-=+*%#@"
+
+// WriteHeatmap draws reports as rows of width blocks, one character per
+// block shaded by how much of it is left after compression: ' ' for under
+// 10%, '@' for 90% and more, stored blocks included. A legend and the
+// blocks, bytes and encoding time of every worker follow.
+func WriteHeatmap(w io.Writer, reports []BlockReport, width int) error {
+	if width <= 0 {
+		width = 64
+	}
+	bw := bufio.NewWriter(w)
+	var row strings.Builder
+	for i, b := range reports {
+		if i%width == 0 {
+			if i > 0 {
+				fmt.Fprintf(bw, "%s|\n", row.String())
+				row.Reset()
+			}
+			fmt.Fprintf(bw, "%12d |", b.Offset)
+		}
+		shade := 0
+		if b.Size > 0 {
+			shade = 10 * b.CompSize / b.Size
+		}
+		if shade >= len(heatmapShades) {
+			shade = len(heatmapShades) - 1
+		}
+		row.WriteByte(heatmapShades[shade])
+	}
+	if len(reports) > 0 {
+		fmt.Fprintf(bw, "%s|\n", row.String())
+	}
+	fmt.Fprintf(bw, "legend: %q = <10%% of the block left after compression ... %q = 90%% or more\n",
+		heatmapShades[:1], heatmapShades[len(heatmapShades)-1:])
+
+	type load struct {
+		blocks, stolen int
+		bytes          int64
+		busy           time.Duration
+	}
+	workers := map[int]*load{}
+	for _, b := range reports {
+		l := workers[b.Worker]
+		if l == nil {
+			l = &load{}
+			workers[b.Worker] = l
+		}
+		l.blocks++
+		l.bytes += int64(b.Size)
+		l.busy += b.Time
+		if b.Stolen {
+			l.stolen++
+		}
+	}
+	ids := make([]int, 0, len(workers))
+	for id := range workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		l := workers[id]
+		fmt.Fprintf(bw, "worker %3d: %6d blocks (%d stolen), %12d bytes, %v encoding\n",
+			id, l.blocks, l.stolen, l.bytes, l.busy.Round(time.Microsecond))
+	}
+	return bw.Flush()
+}
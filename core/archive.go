@@ -0,0 +1,141 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"proj3/core/codec"
+)
+
+// Archive is an archive opened for programs that work with archives
+// directly rather than through the CLI: its headers, block tables and the
+// files it holds. Every member of a concatenated archive is listed; the
+// files of a member are read through an ArchiveFS over it, so extracting
+// one only decodes the blocks that hold it. An Archive is safe for
+// concurrent use.
+type Archive struct {
+	f      *ioFile
+	header *codec.FileHeader
+	info   *ArchiveInfo
+
+	mu  sync.Mutex
+	fss map[int]*ArchiveFS // member index -> reader, opened on first use
+}
+
+// OpenArchive opens the archive at archivePath and reads all its headers.
+// Nothing is decoded until a member is extracted.
+func OpenArchive(archivePath string) (*Archive, error) {
+	info, err := InspectArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openFile(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	h, err := readMemberHeader(f, 0)
+	if err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	return &Archive{f: f, header: h, info: info, fss: map[int]*ArchiveFS{}}, nil
+}
+
+// Header returns the header of the first member. It must not be modified.
+func (a *Archive) Header() *codec.FileHeader {
+	return a.header
+}
+
+// Members describes every member of the archive, in order, with its block
+// table, as -mode info prints them.
+func (a *Archive) Members() []MemberInfo {
+	return a.info.Members
+}
+
+// BlockInfo returns row i of the first member's block table.
+func (a *Archive) BlockInfo(i int) (BlockInfo, error) {
+	blocks := a.info.Members[0].Blocks
+	if i < 0 || i >= len(blocks) {
+		return BlockInfo{}, fmt.Errorf("block %d out of range: the first member has %d", i, len(blocks))
+	}
+	return blocks[i], nil
+}
+
+// ExtractMember writes the file called name to w: a regular file of a
+// .tar.pcz, or the file a plain member was compressed from, looked up by
+// its stored name or its base name. When several members hold a file of
+// that name the last one wins, as when tar extracts.
+func (a *Archive) ExtractMember(name string, w io.Writer) error {
+	want, err := memberPath(name)
+	if err != nil {
+		return err
+	}
+	for m := len(a.info.Members) - 1; m >= 0; m-- {
+		p, ok := memberHolds(&a.info.Members[m], want)
+		if !ok {
+			continue
+		}
+		afs, err := a.memberFS(m)
+		if err != nil {
+			return fmt.Errorf("member %d: %w", m, err)
+		}
+		f, err := afs.Open(p)
+		if err != nil {
+			return fmt.Errorf("member %d: %w", m, err)
+		}
+		defer f.Close()
+		if _, err := io.Copy(w, f); err != nil {
+			return fmt.Errorf("extract %s: %w", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: no regular file %q", a.info.Path, name)
+}
+
+// Close releases the archive.
+func (a *Archive) Close() error {
+	return closeFile(a.f)
+}
+
+// memberHolds reports whether member m holds the file want, a memberPath,
+// and returns the path under which the member's ArchiveFS serves it.
+func memberHolds(m *MemberInfo, want string) (string, bool) {
+	if len(m.TarEntries) > 0 {
+		for _, e := range m.TarEntries {
+			if p, err := memberPath(e.Name); err == nil && p == want {
+				return "/" + p, true
+			}
+		}
+		return "", false
+	}
+	base := path.Base("/" + m.Filename)
+	if base == "/" {
+		base = "data"
+	}
+	if p, err := memberPath(m.Filename); (err == nil && p == want) || want == base {
+		return "/" + base, true
+	}
+	return "", false
+}
+
+// memberFS returns the reader of member m, opening it the first time.
+func (a *Archive) memberFS(m int) (*ArchiveFS, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if afs, ok := a.fss[m]; ok {
+		return afs, nil
+	}
+	// newArchiveFS reads the header at the file position; the readers it
+	// returns only use ReadAt, so all of them share f.
+	if _, err := a.f.Seek(a.info.Members[m].Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	afs, err := newArchiveFS(a.f)
+	if err != nil {
+		return nil, err
+	}
+	a.fss[m] = afs
+	return afs, nil
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// batchMember is one member of an archive decoded by BatchDecompress.
+type batchMember struct {
+	in   *ioFile
+	h    *codec.FileHeader
+	data int64   // payload offset in in
+	comp []int64 // compressed block offsets
+	offs []int64 // uncompressed block offsets
+	out  *ioFile
+	base int64 // offset of the member's output in out
+	name string
+}
+
+// batchTask is one block of one member.
+type batchTask struct {
+	m     *batchMember
+	block int
+}
+
+// batchOutputName is where BatchDecompress writes archive: its name with
+// ".pcz" removed, like gunzip, or with ".out" added when there is none.
+func batchOutputName(archive string) string {
+	name := filepath.Base(archive)
+	if s := strings.TrimSuffix(name, ".pcz"); s != name && s != "" {
+		return s
+	}
+	return name + ".out"
+}
+
+// BatchDecompress decodes many archives into outputDir in one run. Rather
+// than decoding archive after archive, the blocks of all of them are put on
+// one list and spread over a single pool of threads workers by the scheduler
+// named by impl, so a restore job of hundreds of small archives keeps every
+// worker busy. Each worker reads its block with ReadAt and writes the result
+// at its final offset, so memory stays at a block per worker.
+func BatchDecompress(archives []string, outputDir, impl string, threads int) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	seen := map[string]string{}
+	for _, a := range archives {
+		name := batchOutputName(a)
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", prev, a, name)
+		}
+		seen[name] = a
+	}
+
+	var files []*ioFile
+	defer func() {
+		for _, f := range files {
+			closeFile(f)
+		}
+	}()
+
+	var tasks []batchTask
+	var all []*batchMember
+	var outs []*ioFile
+	for _, a := range archives {
+		in, err := openFile(a)
+		if err != nil {
+			return fmt.Errorf("open input: %w", err)
+		}
+		files = append(files, in)
+		out, err := createAtomic(filepath.Join(outputDir, batchOutputName(a)))
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		files = append(files, out)
+		outs = append(outs, out)
+
+		members, err := batchMembers(in, out, a)
+		if err != nil {
+			return err
+		}
+		all = append(all, members...)
+		total := int64(0)
+		for _, m := range members {
+			total += int64(m.h.OriginalSize)
+			for i := 0; i < int(m.h.NumBlocks); i++ {
+				tasks = append(tasks, batchTask{m: m, block: i})
+			}
+		}
+		if err := reserve(out, uint64(total)); err != nil {
+			return err
+		}
+	}
+
+	err := codec.ForEachBlock(impl, len(tasks), threads, func(idx int) error {
+		t := tasks[idx]
+		m := t.m
+		comp, err := readBlockAt(m.in, m.h, m.data, m.comp, t.block)
+		if err == nil {
+			var dec []byte
+			dec, err = decodeMemberBlock(m.h, t.block, comp, int(m.offs[t.block+1]-m.offs[t.block]))
+			if err == nil {
+				_, err = m.out.WriteAt(dec, m.base+m.offs[t.block])
+			} else {
+				err = fmt.Errorf("decompress block %d: %w", t.block, err)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Long-range references copy from bytes any block may have written.
+	for _, m := range all {
+		if err := resolveLongRangeAt(m.h, m.out, m.base); err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+	}
+	for _, out := range outs {
+		if err := commitFile(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchMembers reads the headers of every member of the archive in, whose
+// output goes to out.
+func batchMembers(in, out *ioFile, name string) ([]*batchMember, error) {
+	var members []*batchMember
+	base := int64(0)
+	for member := 0; ; member++ {
+		h, err := readMemberHeader(in, member)
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if h.Flags&(codec.FlagVolumes|codec.FlagDelta) != 0 {
+			return nil, fmt.Errorf("%s: multi-volume archives and delta patches cannot be batch decompressed", name)
+		}
+		data, err := in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		m := &batchMember{in: in, h: h, data: data, comp: h.CompOffsets(), offs: h.RawOffsets(), out: out, base: base, name: name}
+		members = append(members, m)
+		base += int64(h.OriginalSize)
+		// Skip the payload, unless it was read with the header or is kept
+		// in the block store.
+		if h.Payload == nil && h.Flags&codec.FlagStore == 0 {
+			if _, err := in.Seek(m.comp[h.NumBlocks], io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"proj3/core/codec"
+)
+
+// decodeMemberBlock decodes block idx of the member described by h, undoing
+// the encryption, pre-filter and block transform recorded in the header, if
+// any.
+func decodeMemberBlock(h *codec.FileHeader, idx int, comp []byte, expected int) ([]byte, error) {
+	if h.Flags&codec.FlagChained != 0 {
+		return nil, fmt.Errorf("blocks of a chained member only decode in order")
+	}
+	comp, err := openBlock(h, idx, comp)
+	if err != nil {
+		return nil, err
+	}
+	if h.Flags&codec.FlagTransform == 0 {
+		return decodeFiltered(h, comp, expected)
+	}
+	t, err := memberTransform(h)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := decodeFiltered(h, comp, int(h.TransformSizes[idx]))
+	if err != nil {
+		return nil, err
+	}
+	return untransformBlock(h, t, idx, dec, expected)
+}
+
+// decodeFiltered decodes a block of the member h, undoing its pre-filter.
+func decodeFiltered(h *codec.FileHeader, comp []byte, expected int) ([]byte, error) {
+	if err := execMissing(h, comp); err != nil {
+		return nil, err
+	}
+	if len(comp) > 0 && comp[0] == codec.BlockModeHoles {
+		return decodeHoles(h, comp[1:], expected)
+	}
+	dec, err := codec.DecodeBlock(comp, expected)
+	if err != nil || h.Flags&codec.FlagFilter == 0 {
+		return dec, err
+	}
+	// Raw blocks alias the compressed buffer; revert may work in place.
+	if len(comp) > 0 && comp[0] == codec.BlockModeRaw {
+		dec = append([]byte(nil), dec...)
+	}
+	return h.Filter.Revert(dec), nil
+}
+
+// execMissing fails for an exec block when there is no command to decode it.
+func execMissing(h *codec.FileHeader, comp []byte) error {
+	if len(comp) > 0 && comp[0] == codec.BlockModeExec && DefaultExecCommand == "" {
+		return fmt.Errorf("block was compressed with %q; pass -exec-cmd to decode it", h.ExecCommand)
+	}
+	return nil
+}
+
+// DefaultBlockHashes records the SHA-256 of every block in the header.
+var DefaultBlockHashes bool
+
+func SetBlockHashes(on bool) {
+	DefaultBlockHashes = on
+}
+
+// blockSet collects the encoded blocks of one compression run, indexed by
+// block number. Workers may fill different indices concurrently.
+type blockSet struct {
+	enc    [][]byte
+	sizes  []uint64
+	raw    []uint32   // uncompressed size of every block
+	hashes [][32]byte // nil unless DefaultBlockHashes
+	refs   []codec.LongRangeRef
+	filter codec.BlockFilter
+	codec  string      // DefaultCodec, or "store" once detect finds the input compressed
+	exec   atomic.Bool // some block uses the exec codec
+
+	transform string    // DefaultTransform
+	tsizes    []uint32  // size of every block after the transform
+	sealer    *sealer   // seals encoded blocks (SetEncryption), or nil
+	member    uint64    // number of the member under the sealer's key
+	sealed    bool      // header has sealed the blocks
+	digest    hash.Hash // SHA-256 of the input (DefaultStrongHash), or nil
+
+	// chained sets have their blocks encoded in order, each after dict.
+	chained bool
+	dict    []byte
+}
+
+func newBlockSet(numBlocks int) *blockSet {
+	s := &blockSet{
+		enc:    make([][]byte, numBlocks),
+		sizes:  make([]uint64, numBlocks),
+		raw:    make([]uint32, numBlocks),
+		filter: codec.DefaultFilter,
+		codec:  codec.DefaultCodec,
+		sealer: encryption,
+	}
+	if DefaultBlockHashes {
+		s.hashes = make([][32]byte, numBlocks)
+	}
+	if DefaultStrongHash {
+		s.digest = sha256.New()
+	}
+	if s.sealer != nil {
+		s.member = s.sealer.members.Add(1)
+	}
+	s.setTransform(DefaultTransform)
+	return s
+}
+
+// setTransform makes the set apply the block transform called name.
+func (s *blockSet) setTransform(name string) {
+	s.transform = name
+	s.tsizes = nil
+	if name != "" {
+		s.tsizes = make([]uint32, len(s.sizes))
+	}
+}
+
+// encode transforms, pre-filters and compresses buf and stores it as block
+// idx.
+func (s *blockSet) encode(idx int, buf []byte) error {
+	t, err := s.transformBlock(idx, buf)
+	if err != nil {
+		return err
+	}
+	if s.chained {
+		return s.encodeChained(idx, buf, t)
+	}
+	enc, err := codec.EncodeWith(s.codec, s.filter.Apply(t))
+	if err != nil {
+		return fmt.Errorf("compress block %d: %w", idx, err)
+	}
+	s.store(idx, buf, enc)
+	return nil
+}
+
+// encodeAt is encode for the block at offset off of the file: bytes covered
+// by the set's long-range references are left out. Transformed blocks
+// have no holes; the set's references go unused.
+func (s *blockSet) encodeAt(idx int, off int64, buf []byte) error {
+	if s.transform == "" {
+		enc, err := encodeHoles(buf, off, s.refs, s.filter, s.codec)
+		if err != nil {
+			return fmt.Errorf("compress block %d: %w", idx, err)
+		}
+		if enc != nil {
+			s.store(idx, buf, enc)
+			return nil
+		}
+	}
+	return s.encode(idx, buf)
+}
+
+// store records enc as the encoding of buf at block idx.
+func (s *blockSet) store(idx int, buf, enc []byte) {
+	s.set(idx, len(buf), enc)
+	if s.hashes != nil {
+		s.hashes[idx] = sha256.Sum256(buf)
+	}
+}
+
+// set stores an already encoded block of raw uncompressed bytes. In an
+// encrypted set, its size is that of the sealed block, but the block is
+// only sealed once it is known whether it is the last (see sealBlock).
+func (s *blockSet) set(idx, raw int, enc []byte) {
+	if len(enc) > 0 && enc[0] == codec.BlockModeExec {
+		s.exec.Store(true)
+	}
+	s.enc[idx] = enc
+	s.sizes[idx] = uint64(len(enc))
+	if s.sealer != nil {
+		s.sizes[idx] += codec.SealOverhead
+	}
+	s.raw[idx] = uint32(raw)
+}
+
+// sealBlock seals block idx of an encrypted set, the last of the member if
+// last is set, for a member of originalSize bytes. header seals all blocks
+// still held; sets whose blocks are written as they are encoded seal each
+// one first.
+func (s *blockSet) sealBlock(idx int, last bool, originalSize uint64) {
+	if s.sealer != nil {
+		s.enc[idx] = s.sealer.seal(blockAD(s.member, idx, last, originalSize), s.enc[idx])
+	}
+}
+
+// grow appends room for n more blocks. It must not run concurrently with
+// encode or set.
+func (s *blockSet) grow(n int) {
+	s.enc = append(s.enc, make([][]byte, n)...)
+	s.sizes = append(s.sizes, make([]uint64, n)...)
+	s.raw = append(s.raw, make([]uint32, n)...)
+	if s.hashes != nil {
+		s.hashes = append(s.hashes, make([][32]byte, n)...)
+	}
+	if s.tsizes != nil {
+		s.tsizes = append(s.tsizes, make([]uint32, n)...)
+	}
+}
+
+// header describes the set for a file of originalSize bytes. blockSize is
+// the nominal block size; the table records every block's actual size. The
+// set must be complete: header seals the blocks of an encrypted set.
+func (s *blockSet) header(name string, originalSize uint64, blockSize uint32) *codec.FileHeader {
+	h := &codec.FileHeader{
+		Filename:       name,
+		OriginalSize:   originalSize,
+		BlockSize:      blockSize,
+		NumBlocks:      uint64(len(s.sizes)),
+		BlockCompSizes: s.sizes,
+	}
+	if len(s.raw) > 0 {
+		h.Flags |= codec.FlagBlockSizes
+		h.BlockSizes = s.raw
+	}
+	if s.hashes != nil {
+		h.Flags |= codec.FlagBlockHashes
+		h.BlockHashes = s.hashes
+	}
+	if s.filter.Kind != 0 {
+		h.Flags |= codec.FlagFilter
+		h.Filter = s.filter
+	}
+	if len(s.refs) > 0 && s.transform == "" {
+		h.Flags |= codec.FlagLongRange
+		h.LongRange = s.refs
+	}
+	if s.exec.Load() {
+		h.Flags |= codec.FlagExec
+		h.ExecCommand = DefaultExecCommand
+	}
+	if codec.DefaultRepcodes {
+		h.Flags |= codec.FlagRepcodes
+	}
+	if s.chained {
+		h.Flags |= codec.FlagChained
+	}
+	if s.transform != "" {
+		h.Flags |= codec.FlagTransform
+		h.Transform = s.transform
+		h.TransformSizes = s.tsizes
+	}
+	if s.sealer != nil {
+		h.Flags |= codec.FlagEncrypted
+		h.KMS, h.KeyID, h.WrappedKey = s.sealer.kms, s.sealer.keyID, s.sealer.wrapped
+		h.Member = s.member
+		s.sealAll(originalSize)
+	}
+	if s.digest != nil {
+		h.Flags |= codec.FlagSHA256
+		copy(h.SHA256[:], s.digest.Sum(nil))
+	}
+	return h
+}
+
+// sealAll seals the blocks the set still holds, once.
+func (s *blockSet) sealAll(originalSize uint64) {
+	if s.sealed {
+		return
+	}
+	s.sealed = true
+	var wg sync.WaitGroup
+	for w, n := 0, runtime.GOMAXPROCS(0); w < n; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for idx := w; idx < len(s.enc); idx += n {
+				if s.enc[idx] != nil {
+					s.sealBlock(idx, idx == len(s.enc)-1, originalSize)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// readBlocks reads the whole payload of a member and returns the compressed
+// bytes of each block, sliced out of one buffer.
+func readBlocks(in io.Reader, h *codec.FileHeader) ([][]byte, error) {
+	defer codec.StartPhase("read")()
+	total := uint64(0)
+	for _, s := range h.BlockCompSizes {
+		total += s
+	}
+	compData := make([]byte, total)
+	if _, err := io.ReadFull(in, compData); err != nil {
+		return nil, fmt.Errorf("read compressed payload: %w", err)
+	}
+
+	comps := make([][]byte, len(h.BlockCompSizes))
+	cur := uint64(0)
+	for i, s := range h.BlockCompSizes {
+		comps[i] = compData[cur : cur+s]
+		cur += s
+	}
+	return comps, nil
+}
+
+// readBlockAt returns the compressed bytes of block i of the member described
+// by h, whose payload starts at data in f; comp holds h.CompOffsets().
+// Streamed members serve their block from memory and manifests from the
+// block store. Multi-volume members are not supported.
+func readBlockAt(f io.ReaderAt, h *codec.FileHeader, data int64, comp []int64, i int) ([]byte, error) {
+	if h.Payload != nil {
+		return h.Payload[comp[i] : comp[i]+int64(h.BlockCompSizes[i])], nil
+	}
+	if h.Flags&codec.FlagStore != 0 {
+		if DefaultStore == "" {
+			return nil, fmt.Errorf("archive keeps its blocks in a block store; pass -store to read it")
+		}
+		return readObject(DefaultStore, h.BlockKeys[i], h.BlockCompSizes[i])
+	}
+	if in, ok := f.(*ioFile); ok && in.direct != nil && h.Flags&codec.FlagAlign != 0 && h.Align%directAlign == 0 {
+		// The block with its padding, in one read O_DIRECT can take.
+		buf := alignedBuffer(int(comp[i+1] - comp[i]))
+		if _, err := f.ReadAt(buf, data+comp[i]); err != nil {
+			return nil, fmt.Errorf("read compressed block %d: %w", i, noEOF(err))
+		}
+		return buf[:h.BlockCompSizes[i]], nil
+	}
+	buf := make([]byte, h.BlockCompSizes[i])
+	if _, err := f.ReadAt(buf, data+comp[i]); err != nil {
+		return nil, fmt.Errorf("read compressed block %d: %w", i, noEOF(err))
+	}
+	return buf, nil
+}
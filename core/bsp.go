@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"sync"
+
+	"proj3/core/codec"
 )
 
 // BSPCompressFile:
@@ -15,35 +16,42 @@ func BSPCompressFile(inputPath, outputPath string, threads int) error {
 		threads = 1
 	}
 
+	if inputPath == "-" || isURL(inputPath) {
+		return streamCompressFile(inputPath, outputPath, "bsp", threads)
+	}
 	info, err := os.Stat(inputPath)
 	if err != nil {
 		return fmt.Errorf("stat input: %w", err)
 	}
 	if !info.Mode().IsRegular() {
-		return fmt.Errorf("input is not a regular file")
+		return streamCompressFile(inputPath, outputPath, "bsp", threads)
 	}
 
 	if info.Size() == 0 {
 		// Handle empty file
-		out, err := os.Create(outputPath)
+		out, err := createArchive(outputPath)
 		if err != nil {
 			return fmt.Errorf("create output: %w", err)
 		}
-		defer out.Close()
-		header := &FileHeader{
+		defer closeFile(out)
+		header := &codec.FileHeader{
 			Filename:       info.Name(),
 			OriginalSize:   0,
 			BlockSize:      DefaultBlockSize,
 			NumBlocks:      0,
 			BlockCompSizes: nil,
 		}
-		if err := WriteHeader(out, header); err != nil {
+		emptyDigest(header)
+		if err := codec.WriteEmptyMember(out, header); err != nil {
 			return fmt.Errorf("write header: %w", err)
 		}
-		return nil
+		return commitFile(out)
 	}
 
-	data, err := os.ReadFile(inputPath)
+	if DefaultPrefetch && !DefaultLongRange {
+		return compressPrefetched("bsp", inputPath, outputPath, info, threads)
+	}
+	data, err := readFile(inputPath)
 	if err != nil {
 		return fmt.Errorf("read input: %w", err)
 	}
@@ -62,235 +70,80 @@ func BSPCompressFile(inputPath, outputPath string, threads int) error {
 		blocks[i] = data[s:e]
 	}
 
-	compressedBlocks := make([][]byte, numBlocks)
-	blockCompSizes := make([]uint64, numBlocks)
-
-	if threads > numBlocks {
-		threads = numBlocks
-	}
-	barrier := NewBarrier(threads)
-	var wg sync.WaitGroup
-	wg.Add(threads)
-
-	// Calculate partition size (N / T)
-	chunkSize := numBlocks / threads
-	if numBlocks%threads != 0 {
-		chunkSize++
-	}
-
-	for id := 0; id < threads; id++ {
-		go func(id int) {
-			defer wg.Done()
-
-			start := id * chunkSize
-			end := start + chunkSize
-			if start >= numBlocks {
-				// This thread has no work (can happen if threads > blocks)
-				start = 0
-				end = 0
-			}
-			if end > numBlocks {
-				end = numBlocks
-			}
-
-			for idx := start; idx < end; idx++ {
-				buf := blocks[idx]
-
-				tokens := lzCompressTokens(buf)
-				var enc []byte
-				if len(tokens)+1 >= len(buf)+1 {
-					enc = make([]byte, 1+len(buf))
-					enc[0] = 0xFF
-					copy(enc[1:], buf)
-				} else {
-					enc = make([]byte, 1+len(tokens))
-					enc[0] = 0x00
-					copy(enc[1:], tokens)
-				}
-
-				compressedBlocks[idx] = enc
-				blockCompSizes[idx] = uint64(len(enc))
-			}
-			barrier.Wait()
-		}(id)
+	set := newBlockSet(numBlocks)
+	set.detect(info.Name())
+	if DefaultLongRange {
+		set.refs = findLongRange(data)
 	}
-	wg.Wait()
-
-	out, err := os.Create(outputPath)
+	wait := set.hashInput(data)
+	done := codec.StartPhase("compress")
+	err = codec.BSPForEach(numBlocks, threads, func(idx int) error {
+		return set.encodeAt(idx, int64(idx)*int64(blockSize), blocks[idx])
+	})
+	done()
+	wait()
 	if err != nil {
-		return fmt.Errorf("create output: %w", err)
+		return err
 	}
-	defer out.Close()
 
-	header := &FileHeader{
-		Filename:       info.Name(),
-		OriginalSize:   uint64(originalSize),
-		BlockSize:      DefaultBlockSize,
-		NumBlocks:      uint64(numBlocks),
-		BlockCompSizes: blockCompSizes,
-	}
-	if err := WriteHeader(out, header); err != nil {
-		return fmt.Errorf("write header: %w", err)
-	}
-	for i := 0; i < numBlocks; i++ {
-		if _, err := out.Write(compressedBlocks[i]); err != nil {
-			return fmt.Errorf("write block %d: %w", i, err)
-		}
-	}
-	return nil
+	header := set.header(info.Name(), uint64(originalSize), DefaultBlockSize)
+	return writeArchive(outputPath, header, set.enc)
 }
 
 // BSPDecompressFile :
 // Splits work into contiguous partitions of blocks.
 // Thread 0 takes first N/T blocks, Thread 1 takes next N/T, etc.
+// Concatenated members are decoded one after another into the same output.
 func BSPDecompressFile(compressedPath, outputPath string, threads int) error {
 	if threads <= 0 {
 		threads = 1
 	}
 
-	in, err := os.Open(compressedPath)
+	in, err := openFile(compressedPath)
 	if err != nil {
 		return fmt.Errorf("open input: %w", err)
 	}
-	defer in.Close()
+	defer closeFile(in)
 
-	header, err := ReadHeader(in)
+	header, err := readMemberLead(in, 0)
 	if err != nil {
-		return fmt.Errorf("read header: %w", err)
+		return err
 	}
 
-	if header.OriginalSize == 0 || header.NumBlocks == 0 {
-		out, err := os.Create(outputPath)
-		if err != nil {
-			return fmt.Errorf("create output: %w", err)
-		}
-		defer out.Close()
-		return nil
-	}
-
-	numBlocks := int(header.NumBlocks)
-	blockSize := int(header.BlockSize)
-	originalSize := int(header.OriginalSize)
-
-	total := uint64(0)
-	for _, s := range header.BlockCompSizes {
-		total += s
-	}
-	compData := make([]byte, total)
-	if _, err := io.ReadFull(in, compData); err != nil {
-		return fmt.Errorf("read compressed payload: %w", err)
-	}
-
-	offs := make([]uint64, numBlocks)
-	cur := uint64(0)
-	for i := 0; i < numBlocks; i++ {
-		offs[i] = cur
-		cur += header.BlockCompSizes[i]
-	}
-
-	outBuf := make([]byte, originalSize)
-
-	if threads > numBlocks {
-		threads = numBlocks
-	}
-	barrier := NewBarrier(threads)
-	var wg sync.WaitGroup
-	wg.Add(threads)
-
-	var firstErr error
-	var mu sync.Mutex
-
-	// Calculate partition size (N / T)
-	chunkSize := numBlocks / threads
-	if numBlocks%threads != 0 {
-		chunkSize++
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
 	}
+	defer closeFile(out)
 
-	for id := 0; id < threads; id++ {
-		go func(id int) {
-			defer wg.Done()
-
-			start := id * chunkSize
-			end := start + chunkSize
-			if start >= numBlocks {
-				start = 0
-				end = 0
+	for member := 0; ; member++ {
+		if member > 0 {
+			header, err = readMemberLead(in, member)
+			if err == io.EOF {
+				return commitFile(out)
 			}
-			if end > numBlocks {
-				end = numBlocks
+			if err != nil {
+				return err
 			}
-
-			for idx := start; idx < end; idx++ {
-				mu.Lock()
-				if firstErr != nil {
-					mu.Unlock()
-					return
-				}
-				mu.Unlock()
-
-				comp := compData[offs[idx] : offs[idx]+header.BlockCompSizes[idx]]
-				if len(comp) == 0 {
-					mu.Lock()
-					if firstErr == nil {
-						firstErr = fmt.Errorf("empty compressed block %d", idx)
-					}
-					mu.Unlock()
-					return
-				}
-
-				exp := blockSize
-				if idx == numBlocks-1 {
-					exp = originalSize - blockSize*(numBlocks-1)
-				}
-
-				mode := comp[0]
-				data := comp[1:]
-				switch mode {
-				case 0xFF:
-					if len(data) != exp {
-						mu.Lock()
-						if firstErr == nil {
-							firstErr = fmt.Errorf("raw block %d size mismatch: got %d, expected %d", idx, len(data), exp)
-						}
-						mu.Unlock()
-						return
-					}
-					copy(outBuf[idx*blockSize:idx*blockSize+exp], data)
-				case 0x00:
-					dec, err := lzDecompressTokens(data, exp)
-					if err != nil {
-						mu.Lock()
-						if firstErr == nil {
-							firstErr = fmt.Errorf("decompress block %d: %w", idx, err)
-						}
-						mu.Unlock()
-						return
-					}
-					copy(outBuf[idx*blockSize:idx*blockSize+exp], dec)
-				default:
-					mu.Lock()
-					if firstErr == nil {
-						firstErr = fmt.Errorf("unknown block mode 0x%02x in block %d", mode, idx)
-					}
-					mu.Unlock()
-					return
-				}
+		}
+		if header.Flags&codec.FlagTrailer != 0 {
+			err = decompressStreamed("bsp", in, out, header, threads)
+		} else {
+			err = decompressPayload(in, out, compressedPath, header, func(payload io.Reader, w io.Writer) error {
+				return bspDecompressMember(payload, w, header, threads)
+			})
+		}
+		if err != nil {
+			if member > 0 {
+				return fmt.Errorf("member %d: %w", member, err)
 			}
-			barrier.Wait()
-		}(id)
-	}
-	wg.Wait()
-	if firstErr != nil {
-		return firstErr
+			return err
+		}
 	}
+}
 
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("create output: %w", err)
-	}
-	defer out.Close()
-	if _, err := out.Write(outBuf); err != nil {
-		return fmt.Errorf("write output: %w", err)
-	}
-	return nil
+// bspDecompressMember decodes one member a window of blocks at a time, each
+// window split into contiguous partitions, and writes the result to out.
+func bspDecompressMember(in io.Reader, out io.Writer, header *codec.FileHeader, threads int) error {
+	return decompressWindowed(in, out, header, threads, codec.BSPForEach)
 }
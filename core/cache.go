@@ -0,0 +1,80 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultBlockCacheSize is how many bytes of decoded blocks each random-access
+// reader (ArchiveFS) keeps. The most recent block is always kept, whatever
+// the budget, since readers usually ask for a block in several pieces.
+var DefaultBlockCacheSize uint64 = 64 << 20
+
+func SetBlockCacheSize(n uint64) {
+	DefaultBlockCacheSize = n
+}
+
+// CacheStats counts block cache lookups.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Bytes     uint64 // decoded bytes currently held
+}
+
+// blockCache is an LRU cache of decoded blocks, bounded in bytes. It is
+// safe for concurrent use.
+type blockCache struct {
+	mu      sync.Mutex
+	limit   uint64
+	lru     *list.List // front = most recently used
+	entries map[int]*list.Element
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	idx  int
+	data []byte
+}
+
+func newBlockCache(limit uint64) *blockCache {
+	return &blockCache{limit: limit, lru: list.New(), entries: map[int]*list.Element{}}
+}
+
+// get returns block idx if cached.
+func (c *blockCache) get(idx int) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[idx]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*cacheEntry).data, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// put adds block idx and evicts the least recently used blocks beyond the
+// budget.
+func (c *blockCache) put(idx int, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[idx]; ok {
+		c.lru.MoveToFront(el) // decoded concurrently by another reader
+		return
+	}
+	c.entries[idx] = c.lru.PushFront(&cacheEntry{idx: idx, data: data})
+	c.stats.Bytes += uint64(len(data))
+	for c.stats.Bytes > c.limit && c.lru.Len() > 1 {
+		e := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, e.idx)
+		c.stats.Bytes -= uint64(len(e.data))
+		c.stats.Evictions++
+	}
+}
+
+func (c *blockCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+
+	"proj3/core/codec"
+)
+
+// DefaultChained lets the LZ window of the sequential compressor run on
+// from every block into the next, like a single-stream compressor:
+// matches may reach up to codec.LZWindowSize bytes back into the previous
+// block. Members are flagged FlagChained and their blocks can no longer be
+// decoded on their own, so every decompressor decodes them in order on one
+// thread, and random access (serve, grep, tar extract) refuses them.
+var DefaultChained bool
+
+func SetChained(on bool) {
+	DefaultChained = on
+}
+
+// encodeChained is encode for a chained set, with t the transformed buf.
+// Blocks must come in order. Long-range holes are not supported: they would
+// leave gaps in the window.
+func (s *blockSet) encodeChained(idx int, buf, t []byte) error {
+	f := s.filter.Apply(t)
+	enc, err := codec.EncodeAfter(s.codec, s.dict, f)
+	if err != nil {
+		return fmt.Errorf("compress block %d: %w", idx, err)
+	}
+	s.store(idx, buf, enc)
+	s.dict = codec.ChainDict(s.dict, f)
+	return nil
+}
+
+// decodeChainedBlock decodes block idx of the chained member h, which
+// follows dict, and returns it with the dictionary for the next block.
+func decodeChainedBlock(h *codec.FileHeader, idx int, dict, comp []byte, expected int) ([]byte, []byte, error) {
+	comp, err := openBlock(h, idx, comp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := execMissing(h, comp); err != nil {
+		return nil, nil, err
+	}
+	if len(comp) > 0 && comp[0] == codec.BlockModeHoles {
+		return nil, nil, fmt.Errorf("chained member with long-range references")
+	}
+	size := expected
+	var t BlockTransform
+	if h.Flags&codec.FlagTransform != 0 {
+		if t, err = memberTransform(h); err != nil {
+			return nil, nil, err
+		}
+		size = int(h.TransformSizes[idx])
+	}
+	dec, err := codec.DecodeAfter(dict, comp, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The window holds filtered bytes, as the encoder saw them.
+	next := codec.ChainDict(dict, dec)
+	if h.Flags&codec.FlagFilter != 0 {
+		if comp[0] == codec.BlockModeRaw {
+			dec = append([]byte(nil), dec...)
+		}
+		dec = h.Filter.Revert(dec)
+	}
+	if h.Flags&codec.FlagTransform != 0 {
+		if dec, err = untransformBlock(h, t, idx, dec, expected); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dec, next, nil
+}
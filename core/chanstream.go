@@ -0,0 +1,176 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"proj3/core/codec"
+)
+
+// CompressChan compresses the chunks received from in on threads workers
+// and sends one frame per chunk on the returned channel, in the order the
+// chunks came:
+//
+//	uint32 raw size | uint32 compressed size | compressed block
+//
+// as in the payload of a streamed member. Every frame decodes on its own
+// with DecompressChan, so frames can go out over a network or a queue one
+// at a time. Chunks may have any size up to 4 GiB; empty ones are skipped.
+// Frames carry no header, so the codec is applied but the pre-filter,
+// transform and encryption settings, which need one, are not.
+//
+// The frame channel is closed once in is closed and every frame is sent.
+// The error channel then receives the first error, if there was one, and
+// is closed. After an error no more frames are sent but in is still
+// drained, so its sender never blocks; once the run context (SetContext)
+// is done, both stop. Chunks belong to CompressChan once sent.
+func CompressChan(in <-chan []byte, threads int) (<-chan []byte, <-chan error) {
+	return chanPipeline(in, threads, func(chunk []byte) ([]byte, error) {
+		if uint64(len(chunk)) > math.MaxUint32 {
+			return nil, fmt.Errorf("chunk of %d bytes: frames hold at most 4 GiB", len(chunk))
+		}
+		enc, err := codec.EncodeBlock(chunk)
+		if err != nil {
+			return nil, err
+		}
+		frame := make([]byte, 8, 8+len(enc))
+		binary.LittleEndian.PutUint32(frame[:4], uint32(len(chunk)))
+		binary.LittleEndian.PutUint32(frame[4:], uint32(len(enc)))
+		return append(frame, enc...), nil
+	})
+}
+
+// DecompressChan reverses CompressChan: it decodes every frame received
+// from in, one frame per message, and sends the chunks on the returned
+// channel in order. Frames are checked against DefaultDecodeLimits before
+// they are decoded. Channels, errors and cancellation work as with
+// CompressChan. A chunk may share memory with its frame.
+func DecompressChan(in <-chan []byte, threads int) (<-chan []byte, <-chan error) {
+	return chanPipeline(in, threads, decodeFrame)
+}
+
+// decodeFrame decodes one frame written by CompressChan.
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 8 {
+		return nil, corruptf("frame of %d bytes is too short", len(frame))
+	}
+	raw := binary.LittleEndian.Uint32(frame[:4])
+	comp := binary.LittleEndian.Uint32(frame[4:8])
+	if comp == 0 || uint64(len(frame)-8) != uint64(comp) {
+		return nil, corruptf("frame holds %d compressed bytes, its header says %d", len(frame)-8, comp)
+	}
+	if err := codec.CheckDecodeSize(uint64(raw), 1); err != nil {
+		return nil, err
+	}
+	if err := codec.CheckExpansion(uint64(raw), uint64(comp)); err != nil {
+		return nil, err
+	}
+	return codec.DecodeBlock(frame[8:], int(raw))
+}
+
+// chanPipeline applies fn to every non-empty slice received from in on
+// threads workers and sends the results on the returned channel in order.
+// At most inFlight(threads) slices are between being received and sent, so
+// a slow receiver holds back the sender of in.
+func chanPipeline(in <-chan []byte, threads int, fn func([]byte) ([]byte, error)) (<-chan []byte, <-chan error) {
+	if threads <= 0 {
+		threads = 1
+	}
+	ctx := codec.Context()
+	out := make(chan []byte)
+	errc := make(chan error, 1)
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	type job struct {
+		b   []byte
+		res chan result
+	}
+	jobs := make(chan job)
+	pending := make(chan chan result, inFlight(threads)) // results in input order
+	var failed atomic.Bool
+
+	// Hand every slice to the workers and queue up its result.
+	go func() {
+		defer close(pending)
+		defer close(jobs)
+		for {
+			var b []byte
+			var ok bool
+			select {
+			case b, ok = <-in:
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			if failed.Load() || len(b) == 0 {
+				continue
+			}
+			res := make(chan result, 1)
+			select {
+			case pending <- res:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- job{b, res}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < threads; w++ {
+		go func() {
+			for j := range jobs {
+				if failed.Load() || ctx.Err() != nil {
+					j.res <- result{}
+					continue
+				}
+				b, err := fn(j.b)
+				j.res <- result{b, err}
+			}
+		}()
+	}
+
+	// Send the results in order; after the first error, only drain.
+	go func() {
+		defer close(errc)
+		defer close(out)
+		fail := func(err error) {
+			if !failed.Swap(true) {
+				errc <- err
+				codec.AbortRun()
+			}
+		}
+		for res := range pending {
+			var r result
+			select {
+			case r = <-res:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+			if failed.Load() {
+				continue
+			}
+			if r.err != nil {
+				fail(r.err)
+				continue
+			}
+			select {
+			case out <- r.b:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+		}
+	}()
+	return out, errc
+}
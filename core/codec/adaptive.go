@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// adaptiveInterval is how often the system run queue is sampled.
+const adaptiveInterval = 250 * time.Millisecond
+
+// workerSlots is a semaphore with a capacity that can change at any time.
+// Scheduler workers hold a slot while running a task; when the capacity
+// drops, the surplus workers park at their next task until it grows again.
+// Any worker may take a free slot, so the job always progresses while the
+// capacity is at least one.
+type workerSlots struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newWorkerSlots(limit int) *workerSlots {
+	s := &workerSlots{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *workerSlots) acquire() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+	s.mu.Unlock()
+}
+
+func (s *workerSlots) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+func (s *workerSlots) setLimit(limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// running returns the number of workers currently holding a slot.
+func (s *workerSlots) running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// adaptiveSlots limits the bsp and ws workers when adaptive threads are on;
+// nil means workers never park.
+var adaptiveSlots *workerSlots
+
+// SetAdaptiveThreads makes the parallel schedulers yield to other work on
+// the machine: the run queue is sampled every adaptiveInterval and the
+// number of workers allowed to run is lowered to the CPUs other processes
+// leave idle (at least one), and raised again as they free up. runQueue
+// returns the number of runnable tasks on the machine; once it fails, the
+// workers are simply never parked again.
+func SetAdaptiveThreads(on bool, runQueue func() (int, bool)) {
+	if !on || adaptiveSlots != nil {
+		return
+	}
+	adaptiveSlots = newWorkerSlots(runtime.NumCPU())
+	go adaptiveMonitor(adaptiveSlots, runQueue)
+}
+
+// adaptiveMonitor adjusts s from the run queue length for the life of the
+// process.
+func adaptiveMonitor(s *workerSlots, runQueue func() (int, bool)) {
+	cpus := runtime.NumCPU()
+	others := 0.0
+	for range time.Tick(adaptiveInterval) {
+		runnable, ok := runQueue()
+		if !ok {
+			return
+		}
+		// The run queue counts our own running workers and this sampler.
+		o := float64(runnable - s.running() - 1)
+		if o < 0 {
+			o = 0
+		}
+		others = 0.5*others + 0.5*o
+		s.setLimit(cpus - int(others+0.5))
+	}
+}
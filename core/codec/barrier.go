@@ -1,5 +1,5 @@
 // In this file, we implement a simple barrier synchronization primitive using sync.Cond.
-package core
+package codec
 
 import "sync"
 
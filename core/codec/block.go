@@ -0,0 +1,96 @@
+package codec
+
+import "fmt"
+
+// Block modes stored in the first byte of every compressed block.
+const (
+	BlockModeLZ    = 0x00
+	BlockModeDelta = 0x01 // LZ tokens that may also reference a base file
+	BlockModeRLE   = 0x02
+	BlockModeLZH   = 0x03 // LZ tokens, Huffman-coded
+	BlockModeExec  = 0x04 // output of an external compressor
+	BlockModeHoles = 0x05 // block without its long-range references
+	BlockModeFast  = 0x06 // literal runs and copies for speed (see fast.go)
+	BlockModeRaw   = 0xFF
+)
+
+// DecodeBlock reverses EncodeBlock using the codec named by the mode byte.
+// expected is the uncompressed size of the block.
+func DecodeBlock(comp []byte, expected int) ([]byte, error) {
+	return DecodeAfter(nil, comp, expected)
+}
+
+// DecodeAfter reverses EncodeAfter.
+func DecodeAfter(dict, comp []byte, expected int) ([]byte, error) {
+	if len(comp) == 0 {
+		return nil, corruptf("empty compressed block")
+	}
+
+	mode := comp[0]
+	c := codecsByMode[mode]
+	if c == nil {
+		if mode == BlockModeDelta {
+			return nil, fmt.Errorf("delta block needs its base file (use -mode apply)")
+		}
+		if mode == BlockModeHoles {
+			return nil, fmt.Errorf("block with long-range references needs its member header")
+		}
+		return nil, corruptf("unknown block mode 0x%02x", mode)
+	}
+	dec, err := c.decodeAfter(dict, comp[1:], expected)
+	return dec, corrupt(err)
+}
+
+// DecodeInto decodes comp straight into dst, which is exactly the block's
+// size, and reports true, when its codec can; otherwise it reports false
+// and DecodeBlock has to be used.
+func DecodeInto(dst, comp []byte) (bool, error) {
+	if len(comp) == 0 {
+		return false, nil
+	}
+	c := codecsByMode[comp[0]]
+	if c == nil || c.decodeInto == nil {
+		return false, nil
+	}
+	return true, corrupt(c.decodeInto(dst, comp[1:]))
+}
+
+// EncodeBlock encodes buf with the configured codec (or, under "auto", the
+// one autoEncode picks) and falls back to raw (0xFF) whenever that would not
+// be smaller than the input.
+//
+// The result must depend only on buf and the global settings, never on which
+// worker runs it or in what order: every implementation then writes
+// byte-identical archives for the same input. Adaptive choices (codec, raw fallback) look at
+// the block itself and nothing else.
+func EncodeBlock(buf []byte) ([]byte, error) {
+	return EncodeWith(DefaultCodec, buf)
+}
+
+// EncodeWith is EncodeBlock with the codec named codec.
+func EncodeWith(codec string, buf []byte) ([]byte, error) {
+	return EncodeAfter(codec, nil, buf)
+}
+
+// EncodeAfter is EncodeWith for a block following dict in a chained member.
+func EncodeAfter(codec string, dict, buf []byte) ([]byte, error) {
+	var best *blockCodec
+	var payload []byte
+	if codec == "auto" {
+		best, payload = autoEncode(dict, buf)
+	} else {
+		best, payload = codecsByMode[BlockModeRaw], buf
+		p, err := codecsByName[codec].encodeAfter(dict, buf)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil && len(p) < len(buf) {
+			best, payload = codecsByName[codec], p
+		}
+	}
+
+	enc := make([]byte, 1+len(payload))
+	enc[0] = best.mode
+	copy(enc[1:], payload)
+	return enc, nil
+}
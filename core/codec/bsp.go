@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"sync"
+	"time"
+)
+
+// BSPForEach runs fn for every index in [0, n) as a single superstep.
+// Thread 0 takes the first N/T indices, Thread 1 the next N/T, etc., and all
+// threads meet at a barrier once their partition is done. After the first
+// error, threads stop taking new indices and that error is returned.
+func BSPForEach(n, threads int, fn func(idx int) error) error {
+	if n == 0 {
+		return nil
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	if threads > n {
+		threads = n
+	}
+	barrier := NewBarrier(threads)
+	var wg sync.WaitGroup
+	wg.Add(threads)
+
+	var firstErr error
+	var mu sync.Mutex
+
+	// With -timing or -trace, every thread's time on its partition and at
+	// the barrier is recorded.
+	measure := DefaultTiming || DefaultTrace
+	compute := make([]time.Duration, threads)
+	wait := make([]time.Duration, threads)
+	if DefaultTiming {
+		done := startSuperstep()
+		defer func() { done(compute, wait) }()
+	}
+	call, record := traceCall()
+
+	// Calculate partition size (N / T)
+	chunkSize := n / threads
+	if n%threads != 0 {
+		chunkSize++
+	}
+
+	for id := 0; id < threads; id++ {
+		go func(id int) {
+			defer wg.Done()
+			defer lockWorker()()
+			begin := time.Now()
+
+			start := id * chunkSize
+			end := start + chunkSize
+			if start >= n {
+				// This thread has no work (can happen if threads > blocks)
+				start = 0
+				end = 0
+			}
+			if end > n {
+				end = n
+			}
+
+			var evs []TraceEvent
+			if record != nil {
+				defer func() { record(evs) }()
+			}
+
+			for idx := start; idx < end; idx++ {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = CanceledErr()
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					break
+				}
+
+				adaptiveSlots.acquire()
+				var ev TraceEvent
+				if record != nil {
+					ev = TraceEvent{Sched: "bsp", Call: call, Task: idx, Worker: id, Start: traceNow(), Victim: -1}
+				}
+				p := progressStart(id, idx)
+				err := fn(idx)
+				p.done(false)
+				if record != nil {
+					ev.End = traceNow()
+					evs = append(evs, ev)
+				}
+				adaptiveSlots.release()
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					AbortRun()
+					break
+				}
+			}
+			if !measure {
+				barrier.Wait()
+				return
+			}
+			arrive, ev := time.Now(), TraceEvent{Sched: "bsp", Call: call, Task: -1, Worker: id, Barrier: true, Victim: -1}
+			if record != nil {
+				ev.Start = traceNow()
+			}
+			barrier.Wait()
+			compute[id], wait[id] = arrive.Sub(begin), time.Since(arrive)
+			if record != nil {
+				ev.End = traceNow()
+				evs = append(evs, ev)
+			}
+		}(id)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = CanceledErr()
+	}
+	return firstErr
+}
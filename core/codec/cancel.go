@@ -0,0 +1,53 @@
+package codec
+
+import "context"
+
+// Runs can be cancelled through the context set with SetContext. Once it is
+// done, the schedulers take no further blocks and return its error, and the
+// LZ loops look at it every cancelCheckBytes, so even a very large block
+// stops promptly: an encoder emits the rest of its block as literals (still
+// a valid block, which the run then throws away), a decoder returns the
+// error.
+var runCtx, runCancel = context.WithCancel(context.Background())
+
+// cancelCheckBytes is how much input the LZ loops handle between checks.
+const cancelCheckBytes = 256 << 10
+
+// SetContext makes ctx the context of every later run.
+func SetContext(ctx context.Context) {
+	runCancel()
+	runCtx, runCancel = context.WithCancel(ctx)
+}
+
+// Context returns the context of the current run.
+func Context() context.Context {
+	return runCtx
+}
+
+// DefaultAbortOnError cancels the run context as soon as a worker fails, so
+// the blocks the other workers are in the middle of stop too instead of
+// running to the end. Every later run then fails as well, so it suits a
+// process doing one job, like the CLI, rather than a server or a library.
+var DefaultAbortOnError bool
+
+func SetAbortOnError(on bool) {
+	DefaultAbortOnError = on
+}
+
+// CanceledErr returns the error of the run context once it is done, and
+// nil before. It does not block and is cheap enough for inner loops.
+func CanceledErr() error {
+	select {
+	case <-runCtx.Done():
+		return runCtx.Err()
+	default:
+		return nil
+	}
+}
+
+// AbortRun is called by the schedulers with a worker's error.
+func AbortRun() {
+	if DefaultAbortOnError {
+		runCancel()
+	}
+}
@@ -0,0 +1,216 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+)
+
+// blockCodec is one way of encoding a block, identified by the mode byte
+// stored in front of the block's payload.
+type blockCodec struct {
+	name string
+	mode byte
+	// encode returns the payload for src, or nil when the codec cannot
+	// represent it.
+	encode func(src []byte) []byte
+	// tryEncode, if set, replaces encode for a codec that can fail, such as
+	// an external command that exits with an error. The failure fails the
+	// run rather than storing the block raw.
+	tryEncode func(src []byte) ([]byte, error)
+	decode    func(payload []byte, size int) ([]byte, error)
+	// decodeInto, if set, is decode writing to dst, which is exactly the
+	// block's size (see -mmap).
+	decodeInto func(dst, payload []byte) error
+	// encodeDict and decodeDict, if set, are encode and decode for a block
+	// of a chained member, which may refer back into dict (see FlagChained).
+	encodeDict func(dict, src []byte) []byte
+	decodeDict func(dict, payload []byte, size int) ([]byte, error)
+}
+
+// encodeAfter encodes src, a block following dict.
+func (c *blockCodec) encodeAfter(dict, src []byte) ([]byte, error) {
+	if len(dict) > 0 && c.encodeDict != nil {
+		return c.encodeDict(dict, src), nil
+	}
+	if c.tryEncode != nil {
+		return c.tryEncode(src)
+	}
+	return c.encode(src), nil
+}
+
+// decodeAfter decodes payload, a block following dict.
+func (c *blockCodec) decodeAfter(dict, payload []byte, size int) ([]byte, error) {
+	if len(dict) > 0 && c.decodeDict != nil {
+		return c.decodeDict(dict, payload, size)
+	}
+	return c.decode(payload, size)
+}
+
+var (
+	codecsByMode = map[byte]*blockCodec{}
+	codecsByName = map[string]*blockCodec{}
+)
+
+// RegisterCodec adds the codec name, stored as mode, whose encoder may fail,
+// such as an external command: the failure fails the run rather than
+// storing the block raw.
+func RegisterCodec(name string, mode byte, encode func(src []byte) ([]byte, error), decode func(payload []byte, size int) ([]byte, error)) {
+	registerCodec(&blockCodec{name: name, mode: mode, tryEncode: encode, decode: decode})
+}
+
+func registerCodec(c *blockCodec) {
+	if codecsByMode[c.mode] != nil || codecsByName[c.name] != nil {
+		panic("duplicate codec " + c.name)
+	}
+	codecsByMode[c.mode] = c
+	codecsByName[c.name] = c
+}
+
+func init() {
+	registerCodec(&blockCodec{
+		name:   "raw",
+		mode:   BlockModeRaw,
+		encode: func(src []byte) []byte { return src },
+		decode: func(payload []byte, size int) ([]byte, error) {
+			if len(payload) != size {
+				return nil, fmt.Errorf("raw size mismatch: got %d, expected %d", len(payload), size)
+			}
+			return payload, nil
+		},
+		decodeInto: func(dst, payload []byte) error {
+			if len(payload) != len(dst) {
+				return fmt.Errorf("raw size mismatch: got %d, expected %d", len(payload), len(dst))
+			}
+			copy(dst, payload)
+			return nil
+		},
+	})
+	registerCodec(&blockCodec{
+		name:   "lz",
+		mode:   BlockModeLZ,
+		encode: LZCompressTokens,
+		decode: lzDecompressTokens,
+		decodeInto: func(dst, payload []byte) error {
+			return lzDecodeInto(dst, 0, payload)
+		},
+		encodeDict: lzCompressDict,
+		decodeDict: func(dict, payload []byte, size int) ([]byte, error) {
+			return lzDecompressDict(payload, dict, size)
+		},
+	})
+	// "store" is raw under the name used for already compressed inputs.
+	codecsByName["store"] = codecsByMode[BlockModeRaw]
+}
+
+// CodecName names a block mode byte.
+func CodecName(mode byte) string {
+	if c := codecsByMode[mode]; c != nil {
+		return c.name
+	}
+	if mode == BlockModeDelta {
+		return "delta"
+	}
+	if mode == BlockModeHoles {
+		return "long-range"
+	}
+	return fmt.Sprintf("unknown(0x%02x)", mode)
+}
+
+// DefaultCodec selects the block codec. "auto" probes each block and picks
+// among raw, RLE, LZ and LZ+Huffman, and stores files that look already
+// compressed as they are (see core.DefaultDetect); a codec name forces that codec.
+var DefaultCodec = "auto"
+
+func SetCodec(name string) error {
+	if name != "auto" && codecsByName[name] == nil {
+		return fmt.Errorf("unknown codec %q", name)
+	}
+	DefaultCodec = name
+	return nil
+}
+
+// DefaultLevel trades compression speed for ratio, from 1 to 9. Levels up
+// to 8 use the greedy LZ parser, below 6 skipping ahead ever sooner
+// through data without matches, from 7 on with a second hash table for
+// long matches; 9 uses the optimal parser. The level is not
+// recorded in archives: any level decodes the same way.
+var DefaultLevel = 6
+
+func SetLevel(n int) error {
+	if n < 1 || n > 9 {
+		return fmt.Errorf("level %d out of range 1-9", n)
+	}
+	DefaultLevel = n
+	return nil
+}
+
+// Entropy thresholds for auto selection, in bits per byte.
+const (
+	// Blocks sampling at or above this are stored raw without an LZ pass;
+	// they are almost always already compressed or encrypted.
+	RawEntropyBits = 7.95
+	// LZ token streams sampling below this are worth a Huffman stage.
+	huffmanEntropyBits = 7.5
+
+	probeSpans   = 16
+	probeSpanLen = 4096
+)
+
+// ProbeEntropy estimates the order-0 entropy of buf from up to probeSpans
+// evenly spread spans of probeSpanLen bytes.
+func ProbeEntropy(buf []byte) float64 {
+	var freq [256]int
+	n := 0
+	if len(buf) <= probeSpans*probeSpanLen {
+		for _, b := range buf {
+			freq[b]++
+		}
+		n = len(buf)
+	} else {
+		step := (len(buf) - probeSpanLen) / (probeSpans - 1)
+		for k := 0; k < probeSpans; k++ {
+			for _, b := range buf[k*step : k*step+probeSpanLen] {
+				freq[b]++
+			}
+		}
+		n = probeSpans * probeSpanLen
+	}
+	if n == 0 {
+		return 0
+	}
+	e := 0.0
+	for _, c := range freq {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// autoEncode picks a codec for buf from a cheap probe instead of running
+// every codec: high-entropy blocks go straight to raw, blocks with long runs
+// also try RLE, and the LZ tokens get a Huffman stage when they still look
+// compressible. The LZ pass runs at most once. The smallest result wins.
+// LZ matches may refer back into dict.
+func autoEncode(dict, buf []byte) (*blockCodec, []byte) {
+	best, payload := codecsByMode[BlockModeRaw], buf
+	if ProbeEntropy(buf) >= RawEntropyBits {
+		return best, payload
+	}
+	consider := func(c *blockCodec, p []byte) {
+		if p != nil && len(p) < len(payload) {
+			best, payload = c, p
+		}
+	}
+
+	if hasLongRuns(buf) {
+		consider(codecsByMode[BlockModeRLE], rleCompress(buf))
+	}
+	tokens := lzCompressDict(dict, buf)
+	consider(codecsByMode[BlockModeLZ], tokens)
+	if len(tokens) > 0 && ProbeEntropy(tokens) < huffmanEntropyBits {
+		consider(codecsByMode[BlockModeLZH], huffmanEncode(tokens))
+	}
+	return best, payload
+}
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DecodeLimits guards readers of untrusted archives against decompression
+// bombs: small archives whose headers promise huge outputs or block
+// tables. They are checked as each member's header is read, before
+// anything is allocated for it. Zero fields do not limit.
+type DecodeLimits struct {
+	MaxOutputSize uint64  // bytes one member may decode to
+	MaxBlocks     uint64  // blocks one member may have
+	MaxRatio      float64 // original over compressed size of one member
+}
+
+// DefaultDecodeLimits applies to every archive read from now on.
+var DefaultDecodeLimits DecodeLimits
+
+func SetDecodeLimits(l DecodeLimits) error {
+	if l.MaxRatio < 0 {
+		return &DecodeLimitError{"MaxRatio", fmt.Errorf("expansion ratio must not be negative")}
+	}
+	if l.MaxRatio > 0 && l.MaxRatio < 1 {
+		return &DecodeLimitError{"MaxRatio", fmt.Errorf("expansion ratio %g is below 1, which even stored data exceeds", l.MaxRatio)}
+	}
+	DefaultDecodeLimits = l
+	return nil
+}
+
+// DecodeLimitError is the error of SetDecodeLimits, naming the field of
+// DecodeLimits that was refused so callers can point at its source.
+type DecodeLimitError struct {
+	Field string // MaxOutputSize, MaxBlocks or MaxRatio
+	Err   error
+}
+
+func (e *DecodeLimitError) Error() string { return e.Field + ": " + e.Err.Error() }
+func (e *DecodeLimitError) Unwrap() error { return e.Err }
+
+// ErrLimitExceeded is wrapped by the error of a member that is over one
+// of DefaultDecodeLimits. Such an archive may be perfectly valid; it is
+// refused, not found corrupt.
+var ErrLimitExceeded = errors.New("decode limit exceeded")
+
+// CheckDecodeSize fails if a member of size bytes in n blocks is over the
+// limits.
+func CheckDecodeSize(size, n uint64) error {
+	l := DefaultDecodeLimits
+	if l.MaxBlocks > 0 && n > l.MaxBlocks {
+		return fmt.Errorf("%w: %d blocks, the limit is %d", ErrLimitExceeded, n, l.MaxBlocks)
+	}
+	if l.MaxOutputSize > 0 && size > l.MaxOutputSize {
+		return fmt.Errorf("%w: decodes to %d bytes, the limit is %d", ErrLimitExceeded, size, l.MaxOutputSize)
+	}
+	return nil
+}
+
+// CheckDecodeRatio fails if the blocks of h expand more than the limit
+// allows.
+func CheckDecodeRatio(h *FileHeader) error {
+	comp := uint64(0)
+	for _, s := range h.BlockCompSizes {
+		comp += s
+	}
+	return CheckExpansion(h.OriginalSize, comp)
+}
+
+// CheckExpansion fails if comp bytes that decode to size expand more than
+// the limit allows. No compressed bytes for a nonzero size expand without
+// bound.
+func CheckExpansion(size, comp uint64) error {
+	max := DefaultDecodeLimits.MaxRatio
+	if max == 0 || size == 0 {
+		return nil
+	}
+	if comp == 0 || float64(size)/float64(comp) > max {
+		return fmt.Errorf("%w: %d bytes decode to %d, more than %gx", ErrLimitExceeded, comp, size, max)
+	}
+	return nil
+}
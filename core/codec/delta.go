@@ -0,0 +1,260 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	deltaMaxMatch    = 65535 // base references store a 2-byte length
+	deltaMinHashBits = 16
+	deltaMaxHashBits = 24
+)
+
+// DeltaBaseWindow returns the part of base a block covering [start, end) of
+// the new file could reference in patches written before base references
+// held absolute offsets (token 0x02): the same range widened by one block
+// on each side. It also returns where start falls inside the window.
+func DeltaBaseWindow(base []byte, start, end, blockSize int) ([]byte, int) {
+	ws := start - blockSize
+	if ws < 0 {
+		ws = 0
+	}
+	we := end + blockSize
+	if we > len(base) {
+		we = len(base)
+	}
+	if ws >= we {
+		return nil, 0
+	}
+	return base[ws:we], start - ws
+}
+
+// DeltaIndex is a hash table over the whole base file, built once before
+// the workers start and only read by them, so every block of the new file
+// can find data that moved anywhere in the base.
+type DeltaIndex struct {
+	base  []byte
+	bits  uint
+	table []uint32 // 1 + the last position whose 8 bytes hash here; 0 if none
+}
+
+// NewDeltaIndex indexes every position of base, in a table of about one
+// slot per two bytes of base, within 64 Ki to 16 Mi slots. Positions past
+// 4 GiB are not indexed; blocks there still find the base at their own
+// offset and right after their previous base match.
+func NewDeltaIndex(base []byte) *DeltaIndex {
+	b := uint(bits.Len(uint(len(base) / 2)))
+	if b < deltaMinHashBits {
+		b = deltaMinHashBits
+	}
+	if b > deltaMaxHashBits {
+		b = deltaMaxHashBits
+	}
+	x := &DeltaIndex{base: base, bits: b, table: make([]uint32, 1<<b)}
+	for j := 0; j+8 <= len(base) && j < math.MaxUint32; j++ {
+		x.table[x.hash(base[j:])] = uint32(j + 1)
+	}
+	return x
+}
+
+// hash hashes the 8 bytes at b. The base is large, so a longer key than
+// the in-block matcher keeps repetitive data from always landing on the
+// wrong occurrence.
+func (x *DeltaIndex) hash(b []byte) uint32 {
+	v := binary.LittleEndian.Uint64(b)
+	return uint32((v * 0x9e3779b97f4a7c15) >> (64 - x.bits))
+}
+
+// lookup returns the last base position whose 8 bytes hash like those at
+// b, or -1.
+func (x *DeltaIndex) lookup(b []byte) int {
+	return int(x.table[x.hash(b)]) - 1
+}
+
+// lzDeltaTokens extends the LZ token stream with base references:
+//
+//	0x00 lit                    literal byte
+//	0x01 off16 len8             match into the block's own history
+//	0x02 off32 len16            copy from the base window (DeltaBaseWindow); only read
+//	0x03 uvarint(off) len16     copy from the base at offset off
+//
+// start is the offset of input[0] in the new file.
+func lzDeltaTokens(input []byte, index *DeltaIndex, start int) []byte {
+	if len(input) == 0 {
+		return nil
+	}
+
+	out := make([]byte, 0, len(input)/4)
+	base := index.base
+
+	table := getLZTable(len(input))
+	defer putLZTable(table, len(input))
+
+	// Base position right after the previous base match: in-place edits keep
+	// the rest of the data aligned, so it is the best first guess.
+	next := start
+
+	i := 0
+	for i < len(input) {
+		if i+LZMinMatch > len(input) {
+			out = append(out, 0x00, input[i])
+			i++
+			continue
+		}
+
+		baseLen, baseOff := 0, 0
+		hashed := -1
+		if i+8 <= len(input) {
+			hashed = index.lookup(input[i:])
+		}
+		for _, c := range [3]int{next, start + i, hashed} {
+			if c < 0 || c >= len(base) {
+				continue
+			}
+			n := MatchLength(base[c:], input[i:], deltaMaxMatch)
+			if n > baseLen {
+				baseLen, baseOff = n, c
+			}
+		}
+
+		h := ((uint32(input[i]) << 24) ^ (uint32(input[i+1]) << 16) ^ (uint32(input[i+2]) << 8) ^ uint32(input[i+3]))
+		h = (h * 0x1e35a7bd) >> (32 - HashBits)
+		candidate := table.lookup(h, i)
+
+		localLen := 0
+		if candidate != -1 && (i-candidate) < LZWindowSize && i-candidate > 0 {
+			localLen = MatchLength(input[candidate:], input[i:], LZMaxMatch)
+		}
+
+		switch {
+		case baseLen >= LZMinMatch && baseLen >= localLen:
+			out = append(out, 0x03)
+			out = binary.AppendUvarint(out, uint64(baseOff))
+			out = binary.LittleEndian.AppendUint16(out, uint16(baseLen))
+			i += baseLen
+			next = baseOff + baseLen
+		case localLen >= LZMinMatch:
+			offset := i - candidate
+			out = append(out, 0x01, byte(offset&0xFF), byte(offset>>8), byte(localLen))
+			i += localLen
+			if next >= 0 {
+				next += localLen
+			}
+		default:
+			out = append(out, 0x00, input[i])
+			i++
+			if next >= 0 {
+				next++
+			}
+		}
+	}
+
+	return out
+}
+
+// DeltaDecompress decodes a token stream produced by lzDeltaTokens, with
+// win the block's base window for 0x02 tokens. A token that would take the
+// block past expectedSize is rejected before anything is copied.
+func DeltaDecompress(tokens, base, win []byte, expectedSize int) ([]byte, error) {
+	out := make([]byte, 0, expectedSize)
+	i := 0
+
+	for i < len(tokens) {
+		flag := tokens[i]
+		i++
+
+		switch flag {
+		case 0x00:
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("truncated literal")
+			}
+			if len(out) >= expectedSize {
+				return nil, fmt.Errorf("literal past the block's %d bytes", expectedSize)
+			}
+			out = append(out, tokens[i])
+			i++
+
+		case 0x01:
+			if i+3 > len(tokens) {
+				return nil, fmt.Errorf("truncated match")
+			}
+			offset := int(tokens[i]) | int(tokens[i+1])<<8
+			length := int(tokens[i+2])
+			i += 3
+
+			if offset <= 0 || offset > len(out) {
+				return nil, fmt.Errorf("invalid match offset %d (out len %d)", offset, len(out))
+			}
+			if len(out)+length > expectedSize {
+				return nil, fmt.Errorf("match of %d bytes past the block's %d bytes", length, expectedSize)
+			}
+
+			start := len(out) - offset
+			for j := 0; j < length; j++ {
+				out = append(out, out[start+j])
+			}
+
+		case 0x02:
+			if i+6 > len(tokens) {
+				return nil, fmt.Errorf("truncated base reference")
+			}
+			offset := int(binary.LittleEndian.Uint32(tokens[i:]))
+			length := int(binary.LittleEndian.Uint16(tokens[i+4:]))
+			i += 6
+
+			if offset+length > len(win) {
+				return nil, fmt.Errorf("base reference %d+%d outside window of %d bytes", offset, length, len(win))
+			}
+			if len(out)+length > expectedSize {
+				return nil, fmt.Errorf("base reference of %d bytes past the block's %d bytes", length, expectedSize)
+			}
+			out = append(out, win[offset:offset+length]...)
+
+		case 0x03:
+			offset, n := binary.Uvarint(tokens[i:])
+			if n <= 0 || i+n+2 > len(tokens) {
+				return nil, fmt.Errorf("truncated base reference")
+			}
+			length := int(binary.LittleEndian.Uint16(tokens[i+n:]))
+			i += n + 2
+
+			if offset > uint64(len(base)) || length > len(base)-int(offset) {
+				return nil, fmt.Errorf("base reference %d+%d outside base of %d bytes", offset, length, len(base))
+			}
+			if len(out)+length > expectedSize {
+				return nil, fmt.Errorf("base reference of %d bytes past the block's %d bytes", length, expectedSize)
+			}
+			out = append(out, base[offset:int(offset)+length]...)
+
+		default:
+			return nil, fmt.Errorf("invalid token flag 0x%02x", flag)
+		}
+	}
+
+	if len(out) != expectedSize {
+		return nil, fmt.Errorf("size mismatch: got %d, expected %d", len(out), expectedSize)
+	}
+	return out, nil
+}
+
+// EncodeDeltaBlock stores buf, at offset start of the new file, as delta
+// tokens against the indexed base (0x01) when that is smaller than the raw
+// bytes, and raw (0xFF) otherwise.
+func EncodeDeltaBlock(buf []byte, index *DeltaIndex, start int) []byte {
+	tokens := lzDeltaTokens(buf, index, start)
+
+	var enc []byte
+	if len(tokens) >= len(buf) {
+		enc = make([]byte, 1+len(buf))
+		enc[0] = BlockModeRaw
+		copy(enc[1:], buf)
+	} else {
+		enc = make([]byte, 1+len(tokens))
+		enc[0] = BlockModeDelta
+		copy(enc[1:], tokens)
+	}
+	return enc
+}
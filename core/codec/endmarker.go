@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// DefaultEndMarker ends every member written to a single archive file with
+// an end marker (FlagEndMarker): "PCZE" and the size of the payload before
+// it. A reader of a regular file looks for the marker as soon as it has
+// read the header, so an archive cut short mid-write is reported as
+// truncated before a single block is decoded, rather than as a failure
+// inside whichever block the data ran out in. Members split into volumes
+// or kept in a block store carry no marker; nor do archives written with
+// this off, which readers that predate the marker can still open.
+var DefaultEndMarker = true
+
+func SetEndMarker(on bool) {
+	DefaultEndMarker = on
+}
+
+var endMagic = [4]byte{'P', 'C', 'Z', 'E'}
+
+const EndMarkerSize = 4 + 8
+
+// AppendEndMarker appends the end marker of a member with size bytes of
+// payload.
+func AppendEndMarker(b []byte, size int64) []byte {
+	b = append(b, endMagic[:]...)
+	return binary.LittleEndian.AppendUint64(b, uint64(size))
+}
+
+// WriteEmptyMember writes the header of a member without blocks, and its
+// end marker.
+func WriteEmptyMember(w io.Writer, h *FileHeader) error {
+	if DefaultEndMarker {
+		h.Flags |= FlagEndMarker
+	}
+	b, err := AppendHeader(nil, h)
+	if err != nil {
+		return err
+	}
+	if DefaultEndMarker {
+		b = AppendEndMarker(b, 0)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// CheckEndMarker checks that the member h, whose header has just been read
+// from r, ends with its marker. A streamed member's marker follows its
+// trailer and is read here; otherwise it follows the payload, which is
+// checked without moving r when r can seek (a regular file, or bytes in
+// memory) and left for ReadHeader to skip. Pipes cannot be checked ahead.
+// With -parse lenient, only a payload cut short is an error.
+func CheckEndMarker(r io.Reader, h *FileHeader, streamed bool) error {
+	size := h.CompOffsets()[h.NumBlocks]
+	var m [EndMarkerSize]byte
+	if streamed {
+		if _, err := io.ReadFull(r, m[:]); err != nil {
+			return Lenient(corruptf("archive truncated: no end marker after the trailer"))
+		}
+		return Lenient(endMarkerMatches(m, size))
+	}
+
+	f, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+	if !ok {
+		return nil
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	switch have := end - pos; {
+	case have < size:
+		return corruptf("archive truncated: %d of %d payload bytes present", have, size)
+	case have < size+EndMarkerSize:
+		return Lenient(corruptf("archive truncated: no end marker after the payload"))
+	}
+	if _, err := f.ReadAt(m[:], pos+size); err != nil {
+		return err
+	}
+	return Lenient(endMarkerMatches(m, size))
+}
+
+func endMarkerMatches(m [EndMarkerSize]byte, size int64) error {
+	if [4]byte{m[0], m[1], m[2], m[3]} != endMagic {
+		return corruptf("no end marker after the payload")
+	}
+	if n := binary.LittleEndian.Uint64(m[4:]); n != uint64(size) {
+		return corruptf("end marker records %d payload bytes, the header %d", n, size)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// Errors that are about the data rather than the system wrap one of these,
+// so callers such as the CLI can tell them apart with errors.Is.
+var (
+	// ErrCorrupt: an archive, stream or frame could not be parsed or
+	// decoded; it is damaged, truncated or not an archive at all.
+	ErrCorrupt = errors.New("corrupt archive")
+	// ErrVerify: data decoded but does not match its checksum or hash, or
+	// two results that must agree (implementations, a delta's base) do not.
+	ErrVerify = errors.New("verification failed")
+)
+
+// kindError gives err one of the kinds above without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+func corruptf(format string, args ...interface{}) error {
+	return &kindError{ErrCorrupt, fmt.Errorf(format, args...)}
+}
+
+func verifyf(format string, args ...interface{}) error {
+	return &kindError{ErrVerify, fmt.Errorf(format, args...)}
+}
+
+// corrupt marks err, met while decoding a block, as ErrCorrupt. Failed
+// I/O (of a registered codec such as an external command), cancellation,
+// decode limits and errors that already have a kind are left as they are.
+func corrupt(err error) error {
+	var pathErr *fs.PathError
+	var errno syscall.Errno
+	if err == nil || errors.As(err, &pathErr) || errors.As(err, &errno) ||
+		errors.Is(err, ErrCorrupt) || errors.Is(err, ErrVerify) || errors.Is(err, ErrLimitExceeded) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &kindError{ErrCorrupt, err}
+}
@@ -0,0 +1,207 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The fast codec trades ratio for speed, in the manner of LZ4: a greedy
+// parse that skips ahead faster the longer it finds no match, and output
+// made of whole literal runs and copies instead of per-byte tokens, so the
+// decoder mostly calls copy.
+const (
+	fastMinMatch = 4
+	// fastLastLiterals is how many bytes at the end are always literals, so
+	// the match finder can read 4 bytes anywhere it looks.
+	fastLastLiterals = 5
+	// fastSkipShift sets the acceleration: the step grows by one every
+	// 1<<fastSkipShift positions without a match.
+	fastSkipShift = 5
+)
+
+func init() {
+	registerCodec(&blockCodec{
+		name:       "fast",
+		mode:       BlockModeFast,
+		encode:     fastCompress,
+		decode:     fastDecompress,
+		decodeInto: fastDecodeInto,
+	})
+}
+
+// fastCompress encodes input as a sequence of
+//
+//	token | [literal length ext] | literals | offset (uint16 LE) | [match length ext]
+//
+// where the token's high nibble is the literal run length and the low nibble
+// the match length minus fastMinMatch, and a nibble of 15 continues in bytes
+// of 255 until one below. The last sequence has literals and no match.
+func fastCompress(input []byte) []byte {
+	out := make([]byte, 0, len(input)+len(input)/255+16)
+	if len(input) < fastMinMatch+fastLastLiterals {
+		return fastSequence(out, input, 0, 0)
+	}
+
+	table := getLZTable(len(input))
+	defer putLZTable(table, len(input))
+
+	limit := len(input) - fastLastLiterals
+	lit := 0 // start of the pending literals
+	i := 0
+	misses := 0
+	check := cancelCheckBytes
+	for i+fastMinMatch <= limit {
+		if i >= check {
+			if CanceledErr() != nil {
+				break // the rest goes out as literals
+			}
+			check = i + cancelCheckBytes
+		}
+		h := binary.LittleEndian.Uint32(input[i:]) * 2654435761 >> (32 - HashBits)
+		candidate := table.lookup(h, i)
+		if candidate < 0 || i-candidate >= LZWindowSize ||
+			binary.LittleEndian.Uint32(input[candidate:]) != binary.LittleEndian.Uint32(input[i:]) {
+			misses++
+			i += 1 + misses>>fastSkipShift
+			continue
+		}
+		misses = 0
+
+		// Extend backwards over pending literals, then forwards.
+		for i > lit && candidate > 0 && input[i-1] == input[candidate-1] {
+			i--
+			candidate--
+		}
+		n := fastMinMatch + MatchLength(input[candidate+fastMinMatch:], input[i+fastMinMatch:limit], limit)
+		out = fastSequence(out, input[lit:i], i-candidate, n)
+		i += n
+		lit = i
+	}
+	return fastSequence(out, input[lit:], 0, 0)
+}
+
+// fastSequence appends literals and, unless n is 0, a match of n bytes at
+// offset back.
+func fastSequence(out, literals []byte, offset, n int) []byte {
+	token := len(literals)
+	if token > 15 {
+		token = 15
+	}
+	m := 0
+	if n > 0 {
+		m = n - fastMinMatch
+		if m > 15 {
+			out = append(out, byte(token<<4|15))
+		} else {
+			out = append(out, byte(token<<4|m))
+		}
+	} else {
+		out = append(out, byte(token<<4))
+	}
+	if len(literals) >= 15 {
+		out = fastLength(out, len(literals)-15)
+	}
+	out = append(out, literals...)
+	if n > 0 {
+		out = append(out, byte(offset), byte(offset>>8))
+		if m >= 15 {
+			out = fastLength(out, m-15)
+		}
+	}
+	return out
+}
+
+func fastLength(out []byte, n int) []byte {
+	for n >= 255 {
+		out = append(out, 255)
+		n -= 255
+	}
+	return append(out, byte(n))
+}
+
+// fastDecompress decodes the output of fastCompress into exactly size bytes.
+func fastDecompress(payload []byte, size int) ([]byte, error) {
+	out := make([]byte, size)
+	if err := fastDecodeInto(out, payload); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fastDecodeInto is fastDecompress into out, which payload must fill.
+func fastDecodeInto(out, payload []byte) error {
+	size := len(out)
+	o, i := 0, 0
+	length := func(n int) (int, error) {
+		for {
+			if i >= len(payload) {
+				return 0, fmt.Errorf("truncated length")
+			}
+			b := payload[i]
+			i++
+			n += int(b)
+			if n > size {
+				return 0, fmt.Errorf("length exceeds block size %d", size)
+			}
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+	check := cancelCheckBytes
+	for i < len(payload) {
+		if o >= check {
+			if err := CanceledErr(); err != nil {
+				return err
+			}
+			check = o + cancelCheckBytes
+		}
+		token := payload[i]
+		i++
+
+		lits := int(token >> 4)
+		if lits == 15 {
+			var err error
+			if lits, err = length(lits); err != nil {
+				return err
+			}
+		}
+		if lits > len(payload)-i || lits > size-o {
+			return fmt.Errorf("literal run of %d overruns the block", lits)
+		}
+		o += copy(out[o:], payload[i:i+lits])
+		i += lits
+		if i == len(payload) {
+			break // the last sequence has no match
+		}
+
+		if i+2 > len(payload) {
+			return fmt.Errorf("truncated match")
+		}
+		offset := int(payload[i]) | int(payload[i+1])<<8
+		i += 2
+		n := int(token & 15)
+		if n == 15 {
+			var err error
+			if n, err = length(n); err != nil {
+				return err
+			}
+		}
+		n += fastMinMatch
+		if offset == 0 || offset > o {
+			return fmt.Errorf("invalid match offset %d (out len %d)", offset, o)
+		}
+		if n > size-o {
+			return fmt.Errorf("output exceeds expected size %d", size)
+		}
+		start := o - offset
+		for k := 0; k < n; {
+			k += copy(out[o+k:o+n], out[start:o+k])
+		}
+		o += n
+	}
+	if o != size {
+		return fmt.Errorf("size mismatch: got %d, expected %d", o, size)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pre-filter kinds, combinable. Delta runs before transpose when both are set.
+const (
+	FilterDelta     uint32 = 1 << 0 // byte-wise difference with the byte Stride positions earlier
+	FilterTranspose uint32 = 1 << 1 // regroup bytes into Stride byte planes
+)
+
+// BlockFilter is a reversible per-block transform applied before the codec.
+// It suits fixed-width numeric data (float/int arrays, columnar dumps) where
+// the same byte of neighbouring values is strongly correlated.
+type BlockFilter struct {
+	Kind   uint32
+	Stride uint32
+}
+
+// DefaultFilter is applied to every block compressed from now on.
+var DefaultFilter BlockFilter
+
+// SetFilter configures the pre-filter from a name ("none", "delta",
+// "transpose" or "delta+transpose") and an element stride in bytes.
+func SetFilter(name string, stride int) error {
+	var kind uint32
+	for _, part := range strings.Split(name, "+") {
+		switch part {
+		case "", "none":
+		case "delta":
+			kind |= FilterDelta
+		case "transpose":
+			kind |= FilterTranspose
+		default:
+			return fmt.Errorf("unknown filter %q", part)
+		}
+	}
+	if kind != 0 && (stride < 1 || stride > 1<<16) {
+		return fmt.Errorf("filter stride must be between 1 and 65536")
+	}
+	if kind == 0 {
+		stride = 0
+	}
+	DefaultFilter = BlockFilter{Kind: kind, Stride: uint32(stride)}
+	return nil
+}
+
+// Apply returns the filtered copy of buf.
+func (f BlockFilter) Apply(buf []byte) []byte {
+	if f.Kind == 0 {
+		return buf
+	}
+	out := make([]byte, len(buf))
+	copy(out, buf)
+	s := int(f.Stride)
+	if f.Kind&FilterDelta != 0 {
+		for i := len(out) - 1; i >= s; i-- {
+			out[i] -= out[i-s]
+		}
+	}
+	if f.Kind&FilterTranspose != 0 {
+		out = transpose(out, s)
+	}
+	return out
+}
+
+// Revert undoes Apply in place where possible and returns the result.
+func (f BlockFilter) Revert(buf []byte) []byte {
+	if f.Kind == 0 {
+		return buf
+	}
+	s := int(f.Stride)
+	if f.Kind&FilterTranspose != 0 {
+		buf = untranspose(buf, s)
+	}
+	if f.Kind&FilterDelta != 0 {
+		for i := s; i < len(buf); i++ {
+			buf[i] += buf[i-s]
+		}
+	}
+	return buf
+}
+
+// transpose moves byte k of every stride-sized element into plane k. Bytes
+// after the last whole element are kept at the end unchanged.
+func transpose(buf []byte, stride int) []byte {
+	n := len(buf) / stride
+	out := make([]byte, len(buf))
+	for k := 0; k < stride; k++ {
+		plane := out[k*n : (k+1)*n]
+		for e := 0; e < n; e++ {
+			plane[e] = buf[e*stride+k]
+		}
+	}
+	copy(out[n*stride:], buf[n*stride:])
+	return out
+}
+
+func untranspose(buf []byte, stride int) []byte {
+	n := len(buf) / stride
+	out := make([]byte, len(buf))
+	for k := 0; k < stride; k++ {
+		plane := buf[k*n : (k+1)*n]
+		for e := 0; e < n; e++ {
+			out[e*stride+k] = plane[e]
+		}
+	}
+	copy(out[n*stride:], buf[n*stride:])
+	return out
+}
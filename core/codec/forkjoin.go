@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fjDequeSize bounds the ranges a worker holds at once: one per level of
+// splitting, so at most the bits of an int.
+const fjDequeSize = 64
+
+// Ranges are deque tasks numbered like the nodes of a binary heap: [0, n)
+// is 1, and the halves of node k are 2k and 2k+1. fjBounds finds the range
+// of node k by following its bits down from the root.
+func fjBounds(k, n int) (lo, hi int) {
+	hi = n
+	for bit := bits.Len(uint(k)) - 2; bit >= 0; bit-- {
+		mid := lo + (hi-lo)/2
+		if k>>bit&1 == 0 {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return lo, hi
+}
+
+// FJForEach runs fn for every index in [0, n) by recursive splitting. The
+// whole range starts on worker 0's deque. A worker holding [lo, hi) forks
+// the upper half onto its own deque and goes on with the lower half until
+// one index is left, which it runs, then pops the most recently forked
+// range. Idle workers steal the oldest, and so largest, range from the
+// deques, starting at a random victim; while there is none they back off
+// and then park until a range is forked or every index has run. After the
+// first error, workers stop taking new ranges and that error is returned.
+func FJForEach(n, threads int, fn func(idx int) error) error {
+	if n == 0 {
+		return nil
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	if threads > n {
+		threads = n
+	}
+	deques := newWSDeques(threads, fjDequeSize)
+	deques[0].PushBottom(1)
+
+	remaining := int64(n)
+	idlers := newParking()
+	var wg sync.WaitGroup
+	wg.Add(threads)
+
+	var firstErr error
+	var mu sync.Mutex
+
+	call, record := traceCall()
+	var stolen int64
+	if DefaultTiming {
+		defer func() { addSteals(n, int(atomic.LoadInt64(&stolen))) }()
+	}
+
+	for wid := 0; wid < threads; wid++ {
+		go func(id int) {
+			defer wg.Done()
+			defer lockWorker()()
+			dq := deques[id]
+			rs := uint32(time.Now().UnixNano()) ^ uint32(id) | 1
+
+			var evs []TraceEvent
+			if record != nil {
+				defer func() { record(evs) }()
+			}
+
+			idle := 0
+			for atomic.LoadInt64(&remaining) > 0 {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = CanceledErr()
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					idlers.close()
+					return
+				}
+
+				task, ok := dq.PopBottom()
+				victim := -1
+				if !ok {
+					rs ^= rs << 13
+					rs ^= rs >> 17
+					rs ^= rs << 5
+					start := int(rs % uint32(threads))
+					if task, victim = stealAny(deques, id, start); victim < 0 {
+						// Ranges are still being run, and may be forked.
+						if backoff(idle) {
+							idle++
+							continue
+						}
+						t := idlers.ticket()
+						if task, victim = stealAny(deques, id, start); victim < 0 {
+							idlers.park(t)
+							continue
+						}
+						idlers.cancel()
+					}
+				}
+				idle = 0
+				if victim >= 0 && DefaultTiming {
+					atomic.AddInt64(&stolen, 1)
+				}
+
+				lo, hi := fjBounds(task, n)
+				for hi-lo > 1 {
+					dq.PushBottom(2*task + 1)
+					idlers.wake()
+					task, hi = 2*task, lo+(hi-lo)/2
+				}
+
+				adaptiveSlots.acquire()
+				var ev TraceEvent
+				if record != nil {
+					ev = TraceEvent{Sched: "fj", Call: call, Task: lo, Worker: id, Start: traceNow(),
+						Stolen: victim >= 0, Victim: victim}
+				}
+				p := progressStart(id, lo)
+				err := fn(lo)
+				p.done(victim >= 0)
+				if record != nil {
+					ev.End = traceNow()
+					evs = append(evs, ev)
+				}
+				adaptiveSlots.release()
+				if atomic.AddInt64(&remaining, -1) == 0 {
+					idlers.close()
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					AbortRun()
+					idlers.close()
+					return
+				}
+			}
+		}(wid)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = CanceledErr()
+	}
+	return firstErr
+}
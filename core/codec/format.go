@@ -0,0 +1,737 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Magic starts every archive header.
+var Magic = [4]byte{'P', 'C', 'Z', '2'}
+
+// MagicFlags identifies headers that carry a flags word right after the
+// magic. Archives without any flag set are still written as plain PCZ2.
+var MagicFlags = [4]byte{'P', 'C', 'Z', '3'}
+
+// Header flags. Each flag appends its own section after the block table, in
+// bit order.
+const (
+	// FlagVolumes: uint64 volume size, then one uint32 volume number per block.
+	FlagVolumes uint32 = 1 << 0
+	// FlagBlockHashes: SHA-256 of every block's uncompressed bytes (32 bytes each).
+	FlagBlockHashes uint32 = 1 << 1
+	// FlagDelta: uint64 base file size, then the base file's SHA-256.
+	FlagDelta uint32 = 1 << 2
+	// FlagFilter: uint32 filter kind, then uint32 stride (see BlockFilter).
+	FlagFilter uint32 = 1 << 3
+
+	// FlagExec: uint16 length, then the exec codec command (informational).
+	FlagExec uint32 = 1 << 4
+	// FlagBlockSizes: uint32 uncompressed size per block. Written for every
+	// member with blocks; without it, blocks are BlockSize long except for a
+	// shorter last one.
+	FlagBlockSizes uint32 = 1 << 5
+	// FlagTarIndex: uint32 entry count, then per tar member a uint16 name
+	// length, the name, and uint64 data offset and size in the tar stream.
+	FlagTarIndex uint32 = 1 << 6
+	// FlagTrailer: the member was streamed. This header lists no blocks; the
+	// payload is a sequence of frames (see core/stream.go) followed by
+	// the complete header as a trailer.
+	FlagTrailer uint32 = 1 << 7
+	// FlagStore: the payload lives in a block store (see core/store.go); the
+	// SHA-256 of every compressed block follows, naming its object.
+	FlagStore uint32 = 1 << 8
+	// FlagAlign: uint32 alignment, then the payload offset of every block
+	// (uint64 each). After all other sections, the header ends with a uint32
+	// count of zero bytes padding it to the alignment, and the padding.
+	FlagAlign uint32 = 1 << 9
+	// FlagLongRange: uint32 count, then per long-range reference uint64
+	// destination, source and length (see core/longrange.go).
+	FlagLongRange uint32 = 1 << 10
+	// FlagRepcodes: LZ blocks may use repeat-offset tokens (see lz.go). No
+	// data; readers that predate the tokens refuse the member up front
+	// instead of failing on its first such block.
+	FlagRepcodes uint32 = 1 << 11
+	// FlagChained: no data; the LZ window runs on from every block into
+	// the next (see core/chain.go), so blocks decode in order.
+	FlagChained uint32 = 1 << 12
+	// FlagTransform: uint16 length, then the name of the block transform
+	// (see core/transform.go), then uint32 transformed size per block.
+	FlagTransform uint32 = 1 << 13
+	// FlagEncrypted: uint16 length and name of the KMS, uint16 length and
+	// key id, uint16 length and the wrapped data key, then uint64 member
+	// number; every block is sealed (see core/encrypt.go).
+	FlagEncrypted uint32 = 1 << 14
+	// FlagManifest: uint32 length, then the SHA-256 manifest of the archived
+	// files in the format of sha256sum (see core/manifest.go).
+	FlagManifest uint32 = 1 << 15
+	// FlagSHA256: SHA-256 of the whole uncompressed member (32 bytes),
+	// checked after decompression (-strong-hash).
+	FlagSHA256 uint32 = 1 << 16
+	// FlagEndMarker: no data; the payload (a streamed member's trailer) is
+	// followed by an end marker, "PCZE" and the uint64 payload size (see
+	// endmarker.go).
+	FlagEndMarker uint32 = 1 << 17
+
+	knownFlags = FlagVolumes | FlagBlockHashes | FlagDelta | FlagFilter | FlagExec |
+		FlagBlockSizes | FlagTarIndex | FlagTrailer | FlagStore | FlagAlign | FlagLongRange | FlagRepcodes |
+		FlagChained | FlagTransform | FlagEncrypted | FlagManifest | FlagSHA256 | FlagEndMarker
+)
+
+type FileHeader struct {
+	Filename       string
+	OriginalSize   uint64
+	BlockSize      uint32
+	NumBlocks      uint64
+	BlockCompSizes []uint64
+
+	Flags          uint32
+	VolumeSize     uint64         // FlagVolumes
+	BlockVolumes   []uint32       // FlagVolumes
+	BlockHashes    [][32]byte     // FlagBlockHashes
+	BaseSize       uint64         // FlagDelta
+	BaseHash       [32]byte       // FlagDelta
+	Filter         BlockFilter    // FlagFilter
+	ExecCommand    string         // FlagExec
+	BlockSizes     []uint32       // FlagBlockSizes
+	TarEntries     []TarEntry     // FlagTarIndex
+	BlockKeys      [][32]byte     // FlagStore
+	Align          uint32         // FlagAlign
+	BlockOffsets   []uint64       // FlagAlign: of each block in the payload
+	LongRange      []LongRangeRef // FlagLongRange
+	Transform      string         // FlagTransform
+	TransformSizes []uint32       // FlagTransform: of each block before the codec
+	KMS            string         // FlagEncrypted
+	KeyID          string         // FlagEncrypted
+	WrappedKey     []byte         // FlagEncrypted
+	Member         uint64         // FlagEncrypted: number under the data key
+	Manifest       string         // FlagManifest
+	SHA256         [32]byte       // FlagSHA256
+
+	Payload []byte // streamed members: payload read along with the trailer
+}
+
+// WriteHeader writes the custom header (including block table) to w. The
+// whole header is encoded into one buffer and written with a single call.
+func WriteHeader(w io.Writer, h *FileHeader) error {
+	b, err := AppendHeader(nil, h)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// AppendHeader appends the encoded header to b.
+func AppendHeader(b []byte, h *FileHeader) ([]byte, error) {
+	start := len(b)
+	if h.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unsupported header flags 0x%x", h.Flags)
+	}
+	nameBytes := []byte(h.Filename)
+	if len(nameBytes) > 0xFFFF {
+		return nil, fmt.Errorf("filename too long")
+	}
+	if uint64(len(h.BlockCompSizes)) != h.NumBlocks {
+		return nil, fmt.Errorf("block count mismatch")
+	}
+	n := int(h.NumBlocks)
+
+	le := binary.LittleEndian
+	if h.Flags == 0 {
+		b = append(b, Magic[:]...)
+	} else {
+		b = append(b, MagicFlags[:]...)
+		b = le.AppendUint32(b, h.Flags)
+	}
+	b = le.AppendUint16(b, uint16(len(nameBytes)))
+	b = le.AppendUint64(b, h.OriginalSize)
+	b = append(b, nameBytes...)
+	b = le.AppendUint32(b, h.BlockSize)
+	b = le.AppendUint64(b, h.NumBlocks)
+	for _, s := range h.BlockCompSizes {
+		b = le.AppendUint64(b, s)
+	}
+
+	if h.Flags&FlagVolumes != 0 {
+		if len(h.BlockVolumes) != n {
+			return nil, fmt.Errorf("volume table mismatch")
+		}
+		b = le.AppendUint64(b, h.VolumeSize)
+		for _, v := range h.BlockVolumes {
+			b = le.AppendUint32(b, v)
+		}
+	}
+
+	if h.Flags&FlagBlockHashes != 0 {
+		if len(h.BlockHashes) != n {
+			return nil, fmt.Errorf("block hash table mismatch")
+		}
+		for i := range h.BlockHashes {
+			b = append(b, h.BlockHashes[i][:]...)
+		}
+	}
+
+	if h.Flags&FlagDelta != 0 {
+		b = le.AppendUint64(b, h.BaseSize)
+		b = append(b, h.BaseHash[:]...)
+	}
+
+	if h.Flags&FlagFilter != 0 {
+		b = le.AppendUint32(b, h.Filter.Kind)
+		b = le.AppendUint32(b, h.Filter.Stride)
+	}
+
+	if h.Flags&FlagExec != 0 {
+		if len(h.ExecCommand) > 0xFFFF {
+			return nil, fmt.Errorf("exec command too long")
+		}
+		b = le.AppendUint16(b, uint16(len(h.ExecCommand)))
+		b = append(b, h.ExecCommand...)
+	}
+
+	if h.Flags&FlagBlockSizes != 0 {
+		if len(h.BlockSizes) != n {
+			return nil, fmt.Errorf("block size table mismatch")
+		}
+		for _, s := range h.BlockSizes {
+			b = le.AppendUint32(b, s)
+		}
+	}
+
+	if h.Flags&FlagTarIndex != 0 {
+		b = le.AppendUint32(b, uint32(len(h.TarEntries)))
+		for _, e := range h.TarEntries {
+			if len(e.Name) > 0xFFFF {
+				return nil, fmt.Errorf("tar member name too long")
+			}
+			b = le.AppendUint16(b, uint16(len(e.Name)))
+			b = append(b, e.Name...)
+			b = le.AppendUint64(b, e.Offset)
+			b = le.AppendUint64(b, e.Size)
+		}
+	}
+
+	if h.Flags&FlagStore != 0 {
+		if len(h.BlockKeys) != n {
+			return nil, fmt.Errorf("block key table mismatch")
+		}
+		for i := range h.BlockKeys {
+			b = append(b, h.BlockKeys[i][:]...)
+		}
+	}
+
+	if h.Flags&FlagAlign != 0 {
+		if len(h.BlockOffsets) != n {
+			return nil, fmt.Errorf("block offset table mismatch")
+		}
+		b = le.AppendUint32(b, h.Align)
+		for _, o := range h.BlockOffsets {
+			b = le.AppendUint64(b, o)
+		}
+	}
+
+	if h.Flags&FlagLongRange != 0 {
+		b = le.AppendUint32(b, uint32(len(h.LongRange)))
+		for _, r := range h.LongRange {
+			b = le.AppendUint64(b, r.Dst)
+			b = le.AppendUint64(b, r.Src)
+			b = le.AppendUint64(b, r.Len)
+		}
+	}
+
+	if h.Flags&FlagTransform != 0 {
+		if len(h.Transform) > 0xFFFF {
+			return nil, fmt.Errorf("transform name too long")
+		}
+		if len(h.TransformSizes) != n {
+			return nil, fmt.Errorf("transform size table mismatch")
+		}
+		b = le.AppendUint16(b, uint16(len(h.Transform)))
+		b = append(b, h.Transform...)
+		for _, s := range h.TransformSizes {
+			b = le.AppendUint32(b, s)
+		}
+	}
+
+	if h.Flags&FlagEncrypted != 0 {
+		for _, f := range [][]byte{[]byte(h.KMS), []byte(h.KeyID), h.WrappedKey} {
+			if len(f) > 0xFFFF {
+				return nil, fmt.Errorf("encryption section too long")
+			}
+			b = le.AppendUint16(b, uint16(len(f)))
+			b = append(b, f...)
+		}
+		b = le.AppendUint64(b, h.Member)
+	}
+
+	if h.Flags&FlagManifest != 0 {
+		if len(h.Manifest) > maxManifestSize {
+			return nil, fmt.Errorf("manifest too long")
+		}
+		b = le.AppendUint32(b, uint32(len(h.Manifest)))
+		b = append(b, h.Manifest...)
+	}
+
+	if h.Flags&FlagSHA256 != 0 {
+		b = append(b, h.SHA256[:]...)
+	}
+
+	if h.Flags&FlagAlign != 0 {
+		pad := AlignUp(int64(len(b)-start+4), h.Align) - int64(len(b)-start+4)
+		b = le.AppendUint32(b, uint32(pad))
+		b = append(b, make([]byte, pad)...)
+	}
+
+	return b, nil
+}
+
+// maxHeaderBlocks bounds the block count accepted from a header, so a
+// corrupt count fails cleanly instead of attempting a huge allocation.
+const maxHeaderBlocks = 1 << 28
+
+// maxManifestSize bounds the manifest a header may carry, likewise.
+const maxManifestSize = 1 << 30
+
+// HeaderDecoder consumes little-endian fields from a buffer whose length the
+// caller has already checked.
+type HeaderDecoder struct{ b []byte }
+
+func (d *HeaderDecoder) U16() uint16 {
+	v := binary.LittleEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *HeaderDecoder) U32() uint32 {
+	v := binary.LittleEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *HeaderDecoder) U64() uint64 {
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *HeaderDecoder) Bytes(n int) []byte {
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+// ReadChunk reads exactly n bytes from r into a decoder.
+func ReadChunk(r io.Reader, n int) (*HeaderDecoder, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return &HeaderDecoder{b: b}, nil
+}
+
+// ReadHeader reads and validates the header (including block table). It
+// reads the fixed-size parts of the header in a handful of large reads and
+// never consumes bytes past the header. Headers that do not parse fail
+// with ErrCorrupt; an input ending before the header returns io.EOF.
+func ReadHeader(r io.Reader) (*FileHeader, error) {
+	h, err := readHeader(r)
+	if err != nil && err != io.EOF {
+		return nil, corrupt(err)
+	}
+	return h, err
+}
+
+func readHeader(r io.Reader) (*FileHeader, error) {
+	var m [4]byte
+	if _, err := io.ReadFull(r, m[:]); err != nil {
+		return nil, err
+	}
+
+	prefix := 2 + 8 // name length, original size
+	switch m {
+	case Magic:
+	case MagicFlags:
+		prefix += 4
+	case endMagic:
+		// The end of the member before; checked when its header was read.
+		if _, err := ReadChunk(r, EndMarkerSize-4); err != nil {
+			return nil, err
+		}
+		return readHeader(r)
+	default:
+		return nil, fmt.Errorf("invalid magic")
+	}
+	d, err := ReadChunk(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var flags uint32
+	if m == MagicFlags {
+		flags = d.U32()
+		if flags&^knownFlags != 0 {
+			return nil, fmt.Errorf("unsupported header flags 0x%x", flags)
+		}
+	}
+	nameLen := int(d.U16())
+	originalSize := d.U64()
+
+	d, err = ReadChunk(r, nameLen+4+8)
+	if err != nil {
+		return nil, err
+	}
+	h := &FileHeader{
+		Filename:     string(d.Bytes(nameLen)),
+		OriginalSize: originalSize,
+		BlockSize:    d.U32(),
+		NumBlocks:    d.U64(),
+		Flags:        flags,
+	}
+	if h.NumBlocks > maxHeaderBlocks {
+		return nil, fmt.Errorf("implausible block count %d", h.NumBlocks)
+	}
+	if err := CheckDecodeSize(h.OriginalSize, h.NumBlocks); err != nil {
+		return nil, err
+	}
+	n := int(h.NumBlocks)
+
+	// Everything up to the exec command length has a size fixed by the
+	// flags and the block count.
+	size := 8 * n
+	if flags&FlagVolumes != 0 {
+		size += 8 + 4*n
+	}
+	if flags&FlagBlockHashes != 0 {
+		size += 32 * n
+	}
+	if flags&FlagDelta != 0 {
+		size += 8 + 32
+	}
+	if flags&FlagFilter != 0 {
+		size += 4 + 4
+	}
+	if flags&FlagExec != 0 {
+		size += 2
+	}
+	d, err = ReadChunk(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	h.BlockCompSizes = make([]uint64, n)
+	for i := range h.BlockCompSizes {
+		h.BlockCompSizes[i] = d.U64()
+	}
+	if err := CheckDecodeRatio(h); err != nil {
+		return nil, err
+	}
+
+	if flags&FlagVolumes != 0 {
+		h.VolumeSize = d.U64()
+		h.BlockVolumes = make([]uint32, n)
+		for i := range h.BlockVolumes {
+			h.BlockVolumes[i] = d.U32()
+		}
+	}
+
+	if flags&FlagBlockHashes != 0 {
+		h.BlockHashes = make([][32]byte, n)
+		for i := range h.BlockHashes {
+			copy(h.BlockHashes[i][:], d.Bytes(32))
+		}
+	}
+
+	if flags&FlagDelta != 0 {
+		h.BaseSize = d.U64()
+		copy(h.BaseHash[:], d.Bytes(32))
+	}
+
+	if flags&FlagFilter != 0 {
+		h.Filter.Kind = d.U32()
+		h.Filter.Stride = d.U32()
+		if h.Filter.Stride == 0 {
+			return nil, fmt.Errorf("invalid filter stride 0")
+		}
+	}
+
+	// Variable-size sections: exec command, block sizes, tar index.
+	size = 0
+	cmdLen := 0
+	if flags&FlagExec != 0 {
+		cmdLen = int(d.U16())
+		size += cmdLen
+	}
+	if flags&FlagBlockSizes != 0 {
+		size += 4 * n
+	}
+	if flags&FlagTarIndex != 0 {
+		size += 4
+	}
+	d, err = ReadChunk(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&FlagExec != 0 {
+		h.ExecCommand = string(d.Bytes(cmdLen))
+	}
+
+	if flags&FlagBlockSizes != 0 {
+		h.BlockSizes = make([]uint32, n)
+		total := uint64(0)
+		for i := range h.BlockSizes {
+			h.BlockSizes[i] = d.U32()
+			total += uint64(h.BlockSizes[i])
+		}
+		if total != originalSize {
+			if err := Lenient(fmt.Errorf("block sizes add up to %d, expected %d", total, originalSize)); err != nil {
+				return nil, err
+			}
+			originalSize, h.OriginalSize = total, total
+			if err := CheckDecodeSize(h.OriginalSize, h.NumBlocks); err != nil {
+				return nil, err
+			}
+			if err := CheckDecodeRatio(h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if flags&FlagTarIndex != 0 {
+		count := d.U32()
+		for i := uint32(0); i < count; i++ {
+			e, err := ReadChunk(r, 2)
+			if err != nil {
+				return nil, err
+			}
+			nameLen := int(e.U16())
+			if e, err = ReadChunk(r, nameLen+16); err != nil {
+				return nil, err
+			}
+			entry := TarEntry{Name: string(e.Bytes(nameLen)), Offset: e.U64(), Size: e.U64()}
+			if entry.Offset+entry.Size < entry.Offset || entry.Offset+entry.Size > originalSize {
+				return nil, fmt.Errorf("tar entry %q outside the archive", entry.Name)
+			}
+			h.TarEntries = append(h.TarEntries, entry)
+		}
+	}
+
+	if flags&FlagStore != 0 {
+		if flags&(FlagVolumes|FlagTrailer) != 0 {
+			return nil, fmt.Errorf("block store manifest cannot have volumes or a trailer")
+		}
+		d, err := ReadChunk(r, 32*n)
+		if err != nil {
+			return nil, err
+		}
+		h.BlockKeys = make([][32]byte, n)
+		for i := range h.BlockKeys {
+			copy(h.BlockKeys[i][:], d.Bytes(32))
+		}
+	}
+
+	if flags&FlagAlign != 0 {
+		if flags&(FlagVolumes|FlagTrailer|FlagStore) != 0 {
+			return nil, fmt.Errorf("aligned archive cannot have volumes, a trailer or a block store")
+		}
+		d, err := ReadChunk(r, 4+8*n)
+		if err != nil {
+			return nil, err
+		}
+		h.Align = d.U32()
+		if h.Align == 0 || h.Align&(h.Align-1) != 0 || h.Align > MaxAlign {
+			return nil, fmt.Errorf("invalid alignment %d", h.Align)
+		}
+		h.BlockOffsets = make([]uint64, n)
+		end := uint64(0)
+		for i := range h.BlockOffsets {
+			h.BlockOffsets[i] = d.U64()
+			if h.BlockOffsets[i] < end || h.BlockOffsets[i]%uint64(h.Align) != 0 {
+				return nil, fmt.Errorf("invalid offset of block %d", i)
+			}
+			end = h.BlockOffsets[i] + h.BlockCompSizes[i]
+		}
+	}
+
+	if flags&FlagLongRange != 0 {
+		d, err := ReadChunk(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		count := int(d.U32())
+		if count > maxHeaderBlocks {
+			return nil, fmt.Errorf("implausible long-range reference count %d", count)
+		}
+		if d, err = ReadChunk(r, 24*count); err != nil {
+			return nil, err
+		}
+		h.LongRange = make([]LongRangeRef, count)
+		end := uint64(0)
+		for i := range h.LongRange {
+			ref := LongRangeRef{Dst: d.U64(), Src: d.U64(), Len: d.U64()}
+			// In destination order, each copying from bytes before it.
+			if ref.Len == 0 || ref.Len > originalSize || ref.Len > ref.Dst || ref.Src > ref.Dst-ref.Len ||
+				ref.Dst < end || ref.Dst > originalSize-ref.Len {
+				return nil, fmt.Errorf("invalid long-range reference %d", i)
+			}
+			end = ref.Dst + ref.Len
+			h.LongRange[i] = ref
+		}
+	}
+
+	if flags&FlagTransform != 0 {
+		d, err := ReadChunk(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		nameLen := int(d.U16())
+		if d, err = ReadChunk(r, nameLen+4*n); err != nil {
+			return nil, err
+		}
+		h.Transform = string(d.Bytes(nameLen))
+		h.TransformSizes = make([]uint32, n)
+		for i := range h.TransformSizes {
+			h.TransformSizes[i] = d.U32()
+		}
+	}
+
+	if flags&FlagEncrypted != 0 {
+		var fields [3][]byte
+		for i := range fields {
+			d, err := ReadChunk(r, 2)
+			if err != nil {
+				return nil, err
+			}
+			if d, err = ReadChunk(r, int(d.U16())); err != nil {
+				return nil, err
+			}
+			fields[i] = d.b
+		}
+		h.KMS, h.KeyID, h.WrappedKey = string(fields[0]), string(fields[1]), fields[2]
+		d, err := ReadChunk(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		h.Member = d.U64()
+	}
+
+	if flags&FlagManifest != 0 {
+		d, err := ReadChunk(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		size := d.U32()
+		if size > maxManifestSize {
+			return nil, fmt.Errorf("implausible manifest size %d", size)
+		}
+		if d, err = ReadChunk(r, int(size)); err != nil {
+			return nil, err
+		}
+		h.Manifest = string(d.b)
+	}
+
+	if flags&FlagSHA256 != 0 {
+		d, err := ReadChunk(r, 32)
+		if err != nil {
+			return nil, err
+		}
+		copy(h.SHA256[:], d.b)
+	}
+
+	if flags&FlagAlign != 0 {
+		d, err := ReadChunk(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		pad := d.U32()
+		if pad >= h.Align {
+			return nil, fmt.Errorf("invalid header padding %d", pad)
+		}
+		d, err = ReadChunk(r, int(pad))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range d.b {
+			if c != 0 && DefaultParse == ParseStrict {
+				return nil, fmt.Errorf("nonzero header padding")
+			}
+		}
+	}
+
+	return h, nil
+}
+
+// RawOffsets returns the uncompressed offset of every block within the
+// member, followed by the member's size: multiples of BlockSize, or the
+// running sum of BlockSizes when FlagBlockSizes is set.
+func (h *FileHeader) RawOffsets() []int64 {
+	n := int(h.NumBlocks)
+	offs := make([]int64, n+1)
+	for i := 1; i <= n; i++ {
+		if h.Flags&FlagBlockSizes != 0 {
+			offs[i] = offs[i-1] + int64(h.BlockSizes[i-1])
+		} else {
+			offs[i] = int64(i) * int64(h.BlockSize)
+		}
+	}
+	if n > 0 && offs[n] > int64(h.OriginalSize) {
+		offs[n] = int64(h.OriginalSize)
+	}
+	return offs
+}
+
+// FixedBlocks reports whether the member's blocks are cut at multiples of
+// BlockSize, so they line up with blocks of a fresh compression run.
+func (h *FileHeader) FixedBlocks() bool {
+	if h.Flags&FlagBlockSizes == 0 {
+		return true
+	}
+	for i := 0; i+1 < len(h.BlockSizes); i++ {
+		if h.BlockSizes[i] != h.BlockSize {
+			return false
+		}
+	}
+	return len(h.BlockSizes) == 0 || h.BlockSizes[len(h.BlockSizes)-1] <= h.BlockSize
+}
+
+// CompOffsets returns the offset of every compressed block from the start
+// of the member's payload, followed by the payload size. Blocks of aligned
+// members are where the header says, with padding in between.
+func (h *FileHeader) CompOffsets() []int64 {
+	offs := make([]int64, h.NumBlocks+1)
+	for i, s := range h.BlockCompSizes {
+		if h.Flags&FlagAlign != 0 {
+			offs[i] = int64(h.BlockOffsets[i])
+			offs[i+1] = AlignUp(offs[i]+int64(s), h.Align)
+		} else {
+			offs[i+1] = offs[i] + int64(s)
+		}
+	}
+	return offs
+}
+
+// MaxAlign bounds the alignment accepted from flags and headers.
+const MaxAlign = 1 << 30
+
+// AlignUp rounds n up to a multiple of align, a power of two.
+func AlignUp(n int64, align uint32) int64 {
+	a := int64(align)
+	return (n + a - 1) &^ (a - 1)
+}
+
+// LongRangeRef says that Len bytes of a member at Dst repeat the bytes at
+// Src, which lie entirely before Dst. Blocks leave the bytes at Dst out, and
+// decoders copy them from Src once the blocks are decoded.
+type LongRangeRef struct {
+	Dst, Src, Len uint64
+}
+
+// TarEntry locates the data of one regular file inside a tar stream.
+type TarEntry struct {
+	Name   string
+	Offset uint64 // start of the file data in the tar stream
+	Size   uint64
+}
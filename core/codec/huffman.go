@@ -0,0 +1,262 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const huffMaxBits = 15 // longest code length; keeps the decode table at 32K entries
+
+func init() {
+	registerCodec(&blockCodec{
+		name: "lzh",
+		mode: BlockModeLZH,
+		encode: func(src []byte) []byte {
+			return huffmanEncode(LZCompressTokens(src))
+		},
+		decode: func(payload []byte, size int) ([]byte, error) {
+			tokens, err := huffmanDecode(payload)
+			if err != nil {
+				return nil, err
+			}
+			return lzDecompressTokens(tokens, size)
+		},
+		decodeInto: func(dst, payload []byte) error {
+			tokens, err := huffmanDecode(payload)
+			if err != nil {
+				return err
+			}
+			return lzDecodeInto(dst, 0, tokens)
+		},
+		encodeDict: func(dict, src []byte) []byte {
+			return huffmanEncode(lzCompressDict(dict, src))
+		},
+		decodeDict: func(dict, payload []byte, size int) ([]byte, error) {
+			tokens, err := huffmanDecode(payload)
+			if err != nil {
+				return nil, err
+			}
+			return lzDecompressDict(tokens, dict, size)
+		},
+	})
+}
+
+// huffmanEncode entropy-codes src with a canonical Huffman code:
+//
+//	uvarint len(src) | 256 code lengths as nibbles (128 bytes) | bitstream
+//
+// The bitstream is LSB-first with bit-reversed codes, so the decoder can
+// index a lookup table with the next huffMaxBits bits directly.
+func huffmanEncode(src []byte) []byte {
+	var freq [256]int
+	for _, b := range src {
+		freq[b]++
+	}
+	lengths := huffmanLengths(&freq)
+	codes := canonicalCodes(&lengths)
+
+	out := make([]byte, 0, binary.MaxVarintLen64+128+len(src)/2)
+	out = binary.AppendUvarint(out, uint64(len(src)))
+	for i := 0; i < 256; i += 2 {
+		out = append(out, lengths[i]|lengths[i+1]<<4)
+	}
+
+	var acc uint64
+	nbits := uint(0)
+	for _, b := range src {
+		acc |= uint64(codes[b]) << nbits
+		nbits += uint(lengths[b])
+		for nbits >= 8 {
+			out = append(out, byte(acc))
+			acc >>= 8
+			nbits -= 8
+		}
+	}
+	if nbits > 0 {
+		out = append(out, byte(acc))
+	}
+	return out
+}
+
+// huffmanDecode reverses huffmanEncode.
+func huffmanDecode(payload []byte) ([]byte, error) {
+	n, w := binary.Uvarint(payload)
+	if w <= 0 {
+		return nil, fmt.Errorf("huffman: invalid length")
+	}
+	payload = payload[w:]
+	if len(payload) < 128 {
+		return nil, fmt.Errorf("huffman: truncated code lengths")
+	}
+	// Every symbol takes at least one bit.
+	if n > uint64(len(payload)-128)*8 {
+		return nil, fmt.Errorf("huffman: length %d exceeds bitstream", n)
+	}
+
+	var lengths [256]uint8
+	maxLen := uint8(0)
+	for i := 0; i < 128; i++ {
+		lengths[2*i] = payload[i] & 0x0F
+		lengths[2*i+1] = payload[i] >> 4
+	}
+	kraft := 0
+	for _, l := range lengths {
+		if l > maxLen {
+			maxLen = l
+		}
+		if l > 0 {
+			kraft += 1 << (huffMaxBits - l)
+		}
+	}
+	if kraft > 1<<huffMaxBits {
+		return nil, fmt.Errorf("huffman: oversubscribed code")
+	}
+	bits := payload[128:]
+	out := make([]byte, n)
+	if n == 0 {
+		return out, nil
+	}
+	if maxLen == 0 {
+		return nil, fmt.Errorf("huffman: empty code")
+	}
+
+	// table[reversed code padded to maxLen bits] = symbol | length<<8
+	codes := canonicalCodes(&lengths)
+	table := make([]uint16, 1<<maxLen)
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		for j := int(codes[sym]); j < len(table); j += 1 << l {
+			table[j] = uint16(sym) | uint16(l)<<8
+		}
+	}
+
+	mask := uint64(1)<<maxLen - 1
+	var acc uint64
+	nbits := uint(0)
+	pos := 0
+	for i := range out {
+		for nbits < uint(maxLen) && pos < len(bits) {
+			acc |= uint64(bits[pos]) << nbits
+			pos++
+			nbits += 8
+		}
+		e := table[acc&mask]
+		l := uint(e >> 8)
+		if l == 0 || l > nbits {
+			return nil, fmt.Errorf("huffman: corrupt bitstream at symbol %d", i)
+		}
+		out[i] = byte(e)
+		acc >>= l
+		nbits -= l
+	}
+	return out, nil
+}
+
+// huffmanLengths computes code lengths (at most huffMaxBits) for freq.
+func huffmanLengths(freq *[256]int) [256]uint8 {
+	var lengths [256]uint8
+	f := *freq
+	for {
+		var syms []int
+		for s, c := range f {
+			if c > 0 {
+				syms = append(syms, s)
+			}
+		}
+		switch len(syms) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[syms[0]] = 1
+			return lengths
+		}
+
+		// Two-queue Huffman construction over leaves sorted by weight.
+		sort.Slice(syms, func(i, j int) bool { return f[syms[i]] < f[syms[j]] })
+		type node struct {
+			weight      int
+			left, right int // child node indices, -1 for leaves
+			sym         int
+		}
+		nodes := make([]node, 0, 2*len(syms))
+		for _, s := range syms {
+			nodes = append(nodes, node{weight: f[s], left: -1, right: -1, sym: s})
+		}
+		leaf, inner := 0, len(nodes)
+		pick := func() int {
+			if leaf < len(syms) && (inner >= len(nodes) || nodes[leaf].weight <= nodes[inner].weight) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for k := 1; k < len(syms); k++ {
+			a := pick()
+			b := pick()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+		}
+
+		depth := make([]int, len(nodes))
+		tooLong := false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			nd := nodes[i]
+			if nd.left < 0 {
+				if depth[i] > huffMaxBits {
+					tooLong = true
+				}
+				lengths[nd.sym] = uint8(depth[i])
+				continue
+			}
+			depth[nd.left] = depth[i] + 1
+			depth[nd.right] = depth[i] + 1
+		}
+		if !tooLong {
+			return lengths
+		}
+		// Flatten the distribution and rebuild until the code fits.
+		lengths = [256]uint8{}
+		for s := range f {
+			if f[s] > 0 {
+				f[s] = (f[s] + 1) / 2
+			}
+		}
+	}
+}
+
+// canonicalCodes assigns canonical codes for lengths, returned bit-reversed
+// for LSB-first output.
+func canonicalCodes(lengths *[256]uint8) [256]uint16 {
+	var codes [256]uint16
+	syms := make([]int, 0, 256)
+	for s, l := range lengths {
+		if l > 0 {
+			syms = append(syms, s)
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		li, lj := lengths[syms[i]], lengths[syms[j]]
+		if li != lj {
+			return li < lj
+		}
+		return syms[i] < syms[j]
+	})
+
+	code := 0
+	prev := uint8(0)
+	for _, s := range syms {
+		l := lengths[s]
+		code <<= l - prev
+		prev = l
+		r := 0
+		for b := uint8(0); b < l; b++ {
+			r |= (code >> b & 1) << (l - 1 - b)
+		}
+		codes[s] = uint16(r)
+		code++
+	}
+	return codes
+}
@@ -0,0 +1,23 @@
+package codec
+
+import "runtime"
+
+// DefaultLockThreads wires every bsp/ws worker to an OS thread of its own
+// (runtime.LockOSThread) while it runs, so the Go scheduler cannot move
+// workers between threads or run two on one. For benchmarks that separate
+// the block schedulers from the runtime's; it costs a thread per worker.
+var DefaultLockThreads bool
+
+func SetLockThreads(on bool) {
+	DefaultLockThreads = on
+}
+
+// lockWorker is called by a scheduler worker as it starts; the returned
+// function undoes it.
+func lockWorker() func() {
+	if !DefaultLockThreads {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	return runtime.UnlockOSThread
+}
@@ -0,0 +1,336 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+const (
+	LZWindowSize = 65535 // 64KB sliding window
+	LZMinMatch   = 4     // Minimum match length
+	LZMaxMatch   = 255   // Maximum match length (1 byte to store length)
+	HashBits     = 14    // 16K entries
+	hashSize     = 1 << HashBits
+
+	// lzLongMatch is the sequence length of the dual match finder's second
+	// table.
+	lzLongMatch = 8
+)
+
+// lzTable is the match finder's hash table, reused across blocks. Entries
+// hold position+base; anything below base belongs to an earlier block and
+// counts as empty, so reuse only moves base past the previous block instead
+// of clearing all entries.
+type lzTable struct {
+	pos  [hashSize]int32
+	base int32
+}
+
+var lzTables = sync.Pool{New: func() interface{} { return &lzTable{base: 1} }}
+
+// getLZTable returns a table ready for an input of n bytes.
+func getLZTable(n int) *lzTable {
+	t := lzTables.Get().(*lzTable)
+	if int64(t.base)+int64(n) >= math.MaxInt32 {
+		t.pos = [hashSize]int32{}
+		t.base = 1
+	}
+	return t
+}
+
+// putLZTable retires the positions of an n-byte input and pools t.
+func putLZTable(t *lzTable, n int) {
+	t.base += int32(n)
+	lzTables.Put(t)
+}
+
+// lookup returns the last position stored for hash h, or -1, and stores i.
+func (t *lzTable) lookup(h uint32, i int) int {
+	c := int(t.pos[h]) - int(t.base)
+	t.pos[h] = int32(i) + t.base
+	if c < 0 {
+		return -1
+	}
+	return c
+}
+
+// DefaultRepcodes lets LZ blocks use repeat-offset tokens, which archives
+// then flag with FlagRepcodes.
+var DefaultRepcodes bool
+
+func SetRepcodes(on bool) {
+	DefaultRepcodes = on
+}
+
+// repOffsets are the offsets of the last two matches, most recent first.
+// Besides the plain match token, the token stream may then reuse them in
+//
+//	0x02 len   match at the last offset
+//	0x03 len   match at the one before, which becomes the last
+//
+// Structured data (CSV, JSON, logs, tables) repeats its record length over
+// and over, so these two-byte tokens replace many four-byte ones. Both
+// encoder and decoder start from repOffsets{1, 4}.
+type repOffsets [2]int
+
+// appendMatch appends a token for a match of length bytes at offset: a
+// repeat token if the offset is one of r's and repcodes are on, a plain one
+// otherwise. It keeps r up to date either way.
+func (r *repOffsets) appendMatch(out []byte, offset, length int) []byte {
+	switch {
+	case DefaultRepcodes && offset == r[0]:
+		return append(out, 0x02, byte(length))
+	case DefaultRepcodes && offset == r[1]:
+		r[0], r[1] = r[1], r[0]
+		return append(out, 0x03, byte(length))
+	}
+	r[0], r[1] = offset, r[0]
+	return append(out, 0x01, byte(offset), byte(offset>>8), byte(length))
+}
+
+// repMatch returns the longer match at i of the two repeat offsets, as
+// offset and length, or a length of 0.
+func (r *repOffsets) repMatch(input []byte, i int) (int, int) {
+	best, bestLen := 0, 0
+	for _, off := range r {
+		if off > i || i+LZMinMatch > len(input) ||
+			binary.LittleEndian.Uint32(input[i-off:]) != binary.LittleEndian.Uint32(input[i:]) {
+			continue
+		}
+		if l := 4 + MatchLength(input[i-off+4:], input[i+4:], LZMaxMatch-4); l > bestLen {
+			best, bestLen = off, l
+		}
+	}
+	return best, bestLen
+}
+
+// levelSkip makes the greedy parser of -level 1 to 5 cheaper: after n
+// positions in a row without a match it moves on 1 + n>>levelSkip[level]
+// bytes at a time, passing the bytes in between as literals without
+// looking for matches there, as LZ4 and Snappy do. The lower the level,
+// the sooner it speeds up through data that does not compress; 0 searches
+// every position.
+var levelSkip = [10]uint{1: 2, 2: 3, 3: 4, 4: 5, 5: 6}
+
+// LZCompressTokens uses a Hash-based LZ77 implementation: a greedy parse
+// that takes the match the level's MatchFinder finds at every position, if
+// any, skipping ahead through unmatched data below -level 6 (levelSkip).
+// At -level 9 the tokens come from the optimal parser instead (see
+// optimal.go).
+func LZCompressTokens(input []byte) []byte {
+	return lzCompressDict(nil, input)
+}
+
+// lzCompressDict is LZCompressTokens for input following dict, the end of
+// the previous block of a chained member: matches may reach back into dict,
+// which is not encoded itself.
+func lzCompressDict(dict, input []byte) []byte {
+	if len(input) == 0 {
+		return nil
+	}
+	start := len(dict)
+	if start > 0 {
+		input = append(append(make([]byte, 0, start+len(input)), dict...), input...)
+	}
+	if DefaultLevel >= lzOptimalLevel {
+		return lzOptimalTokens(input, start)
+	}
+
+	out := make([]byte, 0, len(input)-start)
+
+	mf, release := newMatchFinder(input)
+	defer release()
+
+	reps := repOffsets{1, 4}
+	skip := levelSkip[DefaultLevel]
+	misses := 0
+	i := 0
+	check := cancelCheckBytes
+	for i < len(input) {
+		if i >= check {
+			if CanceledErr() != nil {
+				// The run is over: finish the block cheaply, still valid.
+				for ; i < len(input); i++ {
+					if i >= start {
+						out = append(out, 0x00, input[i])
+					}
+				}
+				break
+			}
+			check = i + cancelCheckBytes
+		}
+		offset, matchLen := mf.FindMatch(i)
+		if i < start {
+			// Parse dict without emitting anything, so the finder ends up
+			// holding what it would have if dict had just been encoded.
+			if matchLen > start-i {
+				matchLen = start - i
+			}
+			if matchLen < LZMinMatch {
+				matchLen = 1
+			}
+			mf.Insert(i+1, i+matchLen)
+			i += matchLen
+			continue
+		}
+		// A repeat offset wins ties: its token is half the size.
+		if DefaultRepcodes {
+			if off, l := reps.repMatch(input, i); l >= matchLen && l > 0 {
+				offset, matchLen = off, l
+			}
+		}
+		if matchLen > 0 {
+			// Emit Match Token
+			out = reps.appendMatch(out, offset, matchLen)
+			mf.Insert(i+1, i+matchLen)
+			i += matchLen
+			misses = 0
+			continue
+		}
+
+		// No match found, emit literal (and, at low levels, the ones skipped)
+		step := 1
+		if skip > 0 {
+			misses++
+			step += misses >> skip
+			if step > len(input)-i {
+				step = len(input) - i
+			}
+			mf.Insert(i+1, i+step)
+		}
+		for end := i + step; i < end; i++ {
+			out = append(out, 0x00, input[i])
+		}
+	}
+
+	return out
+}
+
+// MatchLength returns how many leading bytes a and b have in common, up to
+// limit, comparing 8 bytes at a time.
+func MatchLength(a, b []byte, limit int) int {
+	if len(a) < limit {
+		limit = len(a)
+	}
+	if len(b) < limit {
+		limit = len(b)
+	}
+	n := 0
+	for n+8 <= limit {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < limit && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// lzDecompressTokens decompresses LZ77 tokens back to original data. The
+// output is allocated once at expectedSize; tokens that would write past it
+// are rejected right away.
+func lzDecompressTokens(tokens []byte, expectedSize int) ([]byte, error) {
+	return lzDecompressDict(tokens, nil, expectedSize)
+}
+
+// lzDecompressDict decodes the output of lzCompressDict, which may copy
+// from dict.
+func lzDecompressDict(tokens, dict []byte, expectedSize int) ([]byte, error) {
+	if len(tokens) == 0 && expectedSize == 0 {
+		return nil, nil
+	}
+
+	// dict goes in front, so matches into it are ordinary back references.
+	out := make([]byte, len(dict)+expectedSize)
+	copy(out, dict)
+	if err := lzDecodeInto(out, len(dict), tokens); err != nil {
+		return nil, err
+	}
+	return out[len(dict):], nil
+}
+
+// lzDecodeInto decodes tokens into out[start:], which they must fill
+// exactly; matches may copy from out[:start] too.
+func lzDecodeInto(out []byte, start int, tokens []byte) error {
+	o := start // bytes written to out
+	end := len(out)
+	expectedSize := end - start
+	i := 0
+	reps := repOffsets{1, 4}
+	check := o + cancelCheckBytes
+
+	for i < len(tokens) {
+		if o >= check {
+			if err := CanceledErr(); err != nil {
+				return err
+			}
+			check = o + cancelCheckBytes
+		}
+		flag := tokens[i]
+		i++
+
+		switch flag {
+		case 0x00:
+			if i >= len(tokens) {
+				return fmt.Errorf("truncated literal")
+			}
+			if o >= end {
+				return fmt.Errorf("output exceeds expected size %d", expectedSize)
+			}
+			out[o] = tokens[i]
+			o++
+			i++
+
+		case 0x01, 0x02, 0x03:
+			var offset, length int
+			if flag == 0x01 {
+				if i+3 > len(tokens) {
+					return fmt.Errorf("truncated match")
+				}
+				offset = int(tokens[i]) | int(tokens[i+1])<<8
+				length = int(tokens[i+2])
+				i += 3
+				reps[0], reps[1] = offset, reps[0]
+			} else {
+				if i >= len(tokens) {
+					return fmt.Errorf("truncated repeat match")
+				}
+				if flag == 0x03 {
+					reps[0], reps[1] = reps[1], reps[0]
+				}
+				offset = reps[0]
+				length = int(tokens[i])
+				i++
+			}
+
+			if offset <= 0 || offset > o {
+				return fmt.Errorf("invalid match offset %d (out len %d)", offset, o)
+			}
+			if length > end-o {
+				return fmt.Errorf("output exceeds expected size %d", expectedSize)
+			}
+
+			// A match may overlap its own output (offset < length). Copying
+			// from start up to the bytes written so far stays correct and
+			// doubles the span each round.
+			start := o - offset
+			for n := 0; n < length; {
+				n += copy(out[o+n:o+length], out[start:o+n])
+			}
+			o += length
+
+		default:
+			return fmt.Errorf("invalid token flag 0x%02x", flag)
+		}
+	}
+
+	if o != end {
+		return fmt.Errorf("size mismatch: got %d, expected %d", o-start, expectedSize)
+	}
+	return nil
+}
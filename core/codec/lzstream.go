@@ -0,0 +1,154 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// lzStreamChunk is how much input an LZWriter collects before it encodes.
+const lzStreamChunk = 128 << 10
+
+// LZWriter is an incremental LZ encoder for unbounded streams: it takes
+// input as it arrives and writes it to the underlying writer as chunks of
+//
+//	uvarint raw size | uvarint token size | LZ tokens
+//
+// in the token format of LZ blocks, whose matches may reach back 64 KiB
+// into earlier chunks, as in a -chained member. A chunk goes out whenever
+// 128 KiB have come in, and on Flush. Memory stays at the window plus one
+// chunk however long the stream. NewLZReader decodes the result.
+type LZWriter struct {
+	w       io.Writer
+	window  []byte // the last LZWindowSize bytes encoded
+	pending []byte // input not encoded yet
+	err     error
+}
+
+func NewLZWriter(w io.Writer) *LZWriter {
+	return &LZWriter{w: w, pending: make([]byte, 0, lzStreamChunk)}
+}
+
+// Write buffers p and encodes every full chunk. After an error of the
+// underlying writer, it and every later call return that error.
+func (z *LZWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if z.err != nil {
+			return written, z.err
+		}
+		k := copy(z.pending[len(z.pending):lzStreamChunk], p[written:])
+		z.pending = z.pending[:len(z.pending)+k]
+		written += k
+		if len(z.pending) == lzStreamChunk {
+			z.emit()
+		}
+	}
+	return written, z.err
+}
+
+// Flush encodes and writes whatever input is buffered, so a reader can
+// decode everything written so far. It ends the chunk early, and matches
+// cannot run past the end of a chunk, so frequent flushes cost ratio.
+func (z *LZWriter) Flush() error {
+	if z.err != nil {
+		return z.err
+	}
+	if len(z.pending) == 0 {
+		return nil
+	}
+	return z.emit()
+}
+
+// Close flushes. It does not close the underlying writer.
+func (z *LZWriter) Close() error {
+	return z.Flush()
+}
+
+func (z *LZWriter) emit() error {
+	tokens := lzCompressDict(z.window, z.pending)
+	buf := binary.AppendUvarint(nil, uint64(len(z.pending)))
+	buf = binary.AppendUvarint(buf, uint64(len(tokens)))
+	if _, err := z.w.Write(append(buf, tokens...)); err != nil {
+		z.err = err
+		return err
+	}
+	z.window = ChainDict(z.window, z.pending)
+	z.pending = z.pending[:0]
+	return nil
+}
+
+// LZReader decodes the output of an LZWriter.
+type LZReader struct {
+	r      *bufio.Reader
+	window []byte
+	out    []byte // decoded, not read yet
+	err    error
+}
+
+func NewLZReader(r io.Reader) *LZReader {
+	return &LZReader{r: bufio.NewReader(r)}
+}
+
+func (z *LZReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// next decodes one chunk. A clean end of the stream comes before a chunk.
+func (z *LZReader) next() error {
+	raw, err := binary.ReadUvarint(z.r)
+	if err != nil {
+		return err // io.EOF between chunks
+	}
+	size, err := binary.ReadUvarint(z.r)
+	if err != nil {
+		return noEOF(err)
+	}
+	// Every token byte pair yields at least one byte.
+	if raw == 0 || raw > lzStreamChunk || size > 2*raw {
+		return corruptf("invalid LZ stream chunk (%d bytes from %d)", raw, size)
+	}
+	tokens := make([]byte, size)
+	if _, err := io.ReadFull(z.r, tokens); err != nil {
+		return noEOF(err)
+	}
+	dec, err := lzDecompressDict(tokens, z.window, int(raw))
+	if err != nil {
+		return fmt.Errorf("LZ stream: %w", err)
+	}
+	z.window = ChainDict(z.window, dec)
+	z.out = dec
+	return nil
+}
+
+// ChainDict returns the dictionary for the block after block: the last
+// LZWindowSize bytes of dict followed by block.
+func ChainDict(dict, block []byte) []byte {
+	next := make([]byte, 0, LZWindowSize)
+	if keep := LZWindowSize - len(block); keep > 0 {
+		if len(dict) > keep {
+			dict = dict[len(dict)-keep:]
+		}
+		next = append(next, dict...)
+	} else {
+		block = block[len(block)-LZWindowSize:]
+	}
+	return append(next, block...)
+}
+
+// noEOF reports a clean EOF in the middle of a stream as truncation.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,342 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MatchFinder finds earlier occurrences of the bytes at a position of one
+// block, for the LZ parsers. Positions are fed in increasing order, each
+// exactly once, through either FindMatch or Insert. Matches are at least
+// LZMinMatch and at most LZMaxMatch bytes long and start less than
+// LZWindowSize bytes back.
+type MatchFinder interface {
+	// Insert records the positions [from, to) without looking for matches
+	// there. The greedy parser calls it for the positions a match covers;
+	// a finder may ignore them.
+	Insert(from, to int)
+	// FindMatch returns the offset and length of the best match it finds
+	// at i, or a length of 0, and records i.
+	FindMatch(i int) (offset, length int)
+}
+
+// matchFinders holds the constructors of the match finders by name. A new
+// finder is made for every block and only sees that block's input.
+var matchFinders = map[string]func(input []byte) MatchFinder{
+	"hash":  newHashFinder,
+	"dual":  newDualFinder,
+	"chain": newChainFinder,
+	"bt":    newBTFinder,
+}
+
+// RegisterMatchFinder makes a match finder selectable with SetMatchFinder.
+func RegisterMatchFinder(name string, newFinder func(input []byte) MatchFinder) {
+	matchFinders[name] = newFinder
+}
+
+// levelFinders is the match finder of every -level: the single-slot hash
+// up to 6, then the dual hash, a hash chain, and at 9 (where the optimal
+// parser needs the longest match at every position) the binary tree.
+var levelFinders = [10]string{1: "hash", 2: "hash", 3: "hash", 4: "hash", 5: "hash", 6: "hash",
+	7: "dual", 8: "chain", 9: "bt"}
+
+// DefaultMatchFinder overrides the match finder of the level; "" keeps it.
+var DefaultMatchFinder string
+
+func SetMatchFinder(name string) error {
+	if name != "" && matchFinders[name] == nil {
+		names := make([]string, 0, len(matchFinders))
+		for n := range matchFinders {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown match finder %q (have %v)", name, names)
+	}
+	DefaultMatchFinder = name
+	return nil
+}
+
+// MatchFinderName names the match finder in use.
+func MatchFinderName() string {
+	if DefaultMatchFinder != "" {
+		return DefaultMatchFinder
+	}
+	return levelFinders[DefaultLevel]
+}
+
+// LevelParse describes the LZ parse of level under the match finder in
+// force. Levels with the same description write the same tokens.
+func LevelParse(level int) string {
+	finder := DefaultMatchFinder
+	if finder == "" {
+		finder = levelFinders[level]
+	}
+	if level >= lzOptimalLevel {
+		return "optimal " + finder
+	}
+	return fmt.Sprintf("greedy %s skip %d", finder, levelSkip[level])
+}
+
+// newMatchFinder returns the configured match finder for input, and the
+// function that retires it once the block is parsed.
+func newMatchFinder(input []byte) (MatchFinder, func()) {
+	f := matchFinders[MatchFinderName()](input)
+	if r, ok := f.(interface{ release() }); ok {
+		return f, r.release
+	}
+	return f, func() {}
+}
+
+// hashFinder is the single-slot hash: the last position of every 4-byte
+// sequence. One probe per position makes it the fastest and the weakest.
+type hashFinder struct {
+	input []byte
+	table *lzTable
+}
+
+func newHashFinder(input []byte) MatchFinder {
+	return &hashFinder{input: input, table: getLZTable(len(input))}
+}
+
+func (f *hashFinder) release() { putLZTable(f.table, len(f.input)) }
+
+func (f *hashFinder) lookup(i int) int {
+	in := f.input
+	h := (uint32(in[i]) << 24) ^ (uint32(in[i+1]) << 16) ^ (uint32(in[i+2]) << 8) ^ uint32(in[i+3])
+	return f.table.lookup(h*0x1e35a7bd>>(32-HashBits), i)
+}
+
+// Insert does nothing: in a single slot, a position inside a match would
+// replace an older and often longer match with a nearer, shorter one, and
+// skipping them saves a probe per byte.
+func (f *hashFinder) Insert(from, to int) {}
+
+func (f *hashFinder) FindMatch(i int) (int, int) {
+	if i+LZMinMatch > len(f.input) {
+		return 0, 0
+	}
+	c := f.lookup(i)
+	in := f.input
+	if c < 0 || i-c >= LZWindowSize || binary.LittleEndian.Uint32(in[c:]) != binary.LittleEndian.Uint32(in[i:]) {
+		return 0, 0
+	}
+	return i - c, 4 + MatchLength(in[c+4:], in[i+4:], LZMaxMatch-4)
+}
+
+// dualFinder adds a table of 8-byte sequences to the single-slot hash. The
+// 4-byte table only remembers the last position of every short sequence,
+// which is often a short match while an older one would run much longer; a
+// hit in the 8-byte table is such a long match found directly. The longer
+// of the two is taken.
+type dualFinder struct {
+	hashFinder
+	long *lzTable
+}
+
+func newDualFinder(input []byte) MatchFinder {
+	return &dualFinder{
+		hashFinder: hashFinder{input: input, table: getLZTable(len(input))},
+		long:       getLZTable(len(input)),
+	}
+}
+
+func (f *dualFinder) release() {
+	f.hashFinder.release()
+	putLZTable(f.long, len(f.input))
+}
+
+func (f *dualFinder) lookupLong(i int) int {
+	h := binary.LittleEndian.Uint64(f.input[i:]) * 0xcf1bbcdcb7a56463 >> (64 - HashBits)
+	return f.long.lookup(uint32(h), i)
+}
+
+func (f *dualFinder) FindMatch(i int) (int, int) {
+	offset, length := f.hashFinder.FindMatch(i)
+	if i+lzLongMatch > len(f.input) {
+		return offset, length
+	}
+	c := f.lookupLong(i)
+	in := f.input
+	if c < 0 || i-c >= LZWindowSize || i-c == offset ||
+		binary.LittleEndian.Uint64(in[c:]) != binary.LittleEndian.Uint64(in[i:]) {
+		return offset, length
+	}
+	if l := lzLongMatch + MatchLength(in[c+lzLongMatch:], in[i+lzLongMatch:], LZMaxMatch-lzLongMatch); l > length {
+		return i - c, l
+	}
+	return offset, length
+}
+
+const (
+	chainHashBits = 16
+	// chainDepth bounds how many earlier positions with the same hash the
+	// chain and tree finders try per position.
+	chainDepth = 64
+)
+
+// chainBuffers is the working memory of the chain and tree finders: the
+// newest position of every hash, and per position one or two links.
+type chainBuffers struct {
+	head        [1 << chainHashBits]int32
+	prev, right []int32
+}
+
+var chainPool = sync.Pool{New: func() interface{} { return new(chainBuffers) }}
+
+func getChainBuffers(n int, tree bool) *chainBuffers {
+	b := chainPool.Get().(*chainBuffers)
+	for i := range b.head {
+		b.head[i] = -1
+	}
+	if cap(b.prev) < n {
+		b.prev = make([]int32, n)
+	}
+	b.prev = b.prev[:n]
+	if tree {
+		if cap(b.right) < n {
+			b.right = make([]int32, n)
+		}
+		b.right = b.right[:n]
+	}
+	return b
+}
+
+func chainHash(in []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(in[i:]) * 0x1e35a7bd >> (32 - chainHashBits)
+}
+
+// chainFinder links every position to the previous one with the same hash
+// and walks up to chainDepth links for the longest match.
+type chainFinder struct {
+	input []byte
+	b     *chainBuffers
+}
+
+func newChainFinder(input []byte) MatchFinder {
+	return &chainFinder{input: input, b: getChainBuffers(len(input), false)}
+}
+
+func (f *chainFinder) release() { chainPool.Put(f.b) }
+
+func (f *chainFinder) Insert(from, to int) {
+	if end := len(f.input) - LZMinMatch + 1; to > end {
+		to = end
+	}
+	for i := from; i < to; i++ {
+		h := chainHash(f.input, i)
+		f.b.prev[i] = f.b.head[h]
+		f.b.head[h] = int32(i)
+	}
+}
+
+func (f *chainFinder) FindMatch(i int) (int, int) {
+	in := f.input
+	if i+LZMinMatch > len(in) {
+		return 0, 0
+	}
+	f.Insert(i, i+1)
+	limit := LZMaxMatch
+	if len(in)-i < limit {
+		limit = len(in) - i
+	}
+	offset, best := 0, 0
+	for c, depth := int(f.b.prev[i]), 0; c >= 0 && depth < chainDepth; c, depth = int(f.b.prev[c]), depth+1 {
+		if i-c >= LZWindowSize {
+			break
+		}
+		// Only a candidate that also matches at best can be longer.
+		if in[c+best] != in[i+best] || binary.LittleEndian.Uint32(in[c:]) != binary.LittleEndian.Uint32(in[i:]) {
+			continue
+		}
+		if l := 4 + MatchLength(in[c+4:], in[i+4:], limit-4); l > best {
+			offset, best = i-c, l
+			if l == limit {
+				break
+			}
+		}
+	}
+	return offset, best
+}
+
+// btFinder keeps, per hash, a binary search tree of the earlier positions
+// ordered by the bytes that follow them, as LZMA's bt4 does. Inserting a
+// position walks down from the root, which is the newest position, and
+// passes the candidates closest to it in sort order: those that share the
+// longest prefix with it. The new position becomes the root, the walked
+// nodes are split into its two subtrees, and nodes out of the window fall
+// off. It finds longer matches than the chain for the same depth.
+type btFinder struct {
+	input []byte
+	b     *chainBuffers // prev holds the left (smaller) child, right the right one
+}
+
+func newBTFinder(input []byte) MatchFinder {
+	return &btFinder{input: input, b: getChainBuffers(len(input), true)}
+}
+
+func (f *btFinder) release() { chainPool.Put(f.b) }
+
+func (f *btFinder) Insert(from, to int) {
+	for i := from; i < to; i++ {
+		f.FindMatch(i)
+	}
+}
+
+func (f *btFinder) FindMatch(i int) (int, int) {
+	in := f.input
+	if i+LZMinMatch > len(in) {
+		return 0, 0
+	}
+	limit := LZMaxMatch
+	if len(in)-i < limit {
+		limit = len(in) - i
+	}
+	left, right := f.b.prev, f.b.right
+	h := chainHash(in, i)
+	c := int(f.b.head[h])
+	f.b.head[h] = int32(i)
+
+	// Smaller nodes go to i's left subtree, at *lt; larger ones to the
+	// right, at *rt. Everything below a smaller node that was already
+	// compared shares at least lenLt bytes with i; likewise lenRt.
+	lt, rt := &left[i], &right[i]
+	lenLt, lenRt := 0, 0
+	offset, best := 0, 0
+	for depth := 0; c >= 0 && i-c < LZWindowSize && depth < chainDepth; depth++ {
+		l := lenLt
+		if lenRt < l {
+			l = lenRt
+		}
+		l += MatchLength(in[c+l:], in[i+l:], limit-l)
+		if l > best {
+			offset, best = i-c, l
+		}
+		if l == limit {
+			// c equals i as far as we look: i takes its place.
+			*lt, *rt = left[c], right[c]
+			return btResult(offset, best)
+		}
+		if in[c+l] < in[i+l] {
+			*lt = int32(c)
+			lt = &right[c]
+			c = int(right[c])
+			lenLt = l
+		} else {
+			*rt = int32(c)
+			rt = &left[c]
+			c = int(left[c])
+			lenRt = l
+		}
+	}
+	*lt, *rt = -1, -1
+	return btResult(offset, best)
+}
+
+func btResult(offset, length int) (int, int) {
+	if length < LZMinMatch {
+		return 0, 0
+	}
+	return offset, length
+}
@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// memoryFlags are the member features DecompressBytes decodes. The others
+// need a file, a key or a registered transform, and package core.
+const memoryFlags = FlagBlockHashes | FlagFilter | FlagExec | FlagBlockSizes | FlagTarIndex |
+	FlagAlign | FlagRepcodes | FlagChained | FlagManifest | FlagSHA256 | FlagEndMarker
+
+// CompressBytes compresses data into an in-memory .pcz archive of blocks of
+// blockSize bytes, using the scheduler named by impl ("seq", "bsp", "ws", "fj"
+// or "pool"). It honours the codec, level, filter and end marker settings of
+// this package; what package core adds on top (block hashes, encryption,
+// transforms, detection of compressed inputs, ...) needs core.CompressBytes.
+func CompressBytes(data []byte, blockSize int, impl string, threads int) ([]byte, error) {
+	numBlocks := (len(data) + blockSize - 1) / blockSize
+	enc := make([][]byte, numBlocks)
+	sizes := make([]uint64, numBlocks)
+	err := ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		s := idx * blockSize
+		e := s + blockSize
+		if e > len(data) {
+			e = len(data)
+		}
+		b, err := EncodeBlock(DefaultFilter.Apply(data[s:e]))
+		if err != nil {
+			return fmt.Errorf("compress block %d: %w", idx, err)
+		}
+		enc[idx], sizes[idx] = b, uint64(len(b))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h := &FileHeader{
+		OriginalSize:   uint64(len(data)),
+		BlockSize:      uint32(blockSize),
+		NumBlocks:      uint64(numBlocks),
+		BlockCompSizes: sizes,
+	}
+	if DefaultFilter.Kind != 0 {
+		h.Flags |= FlagFilter
+		h.Filter = DefaultFilter
+	}
+	if DefaultRepcodes {
+		h.Flags |= FlagRepcodes
+	}
+	if DefaultEndMarker {
+		h.Flags |= FlagEndMarker
+	}
+	out, err := AppendHeader(nil, h)
+	if err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	for _, b := range enc {
+		out = append(out, b...)
+	}
+	if DefaultEndMarker {
+		out = AppendEndMarker(out, h.CompOffsets()[h.NumBlocks])
+	}
+	return out, nil
+}
+
+// DecompressBytes decodes an in-memory .pcz archive, including concatenated
+// members, with the scheduler named by impl. Streamed, multi-volume,
+// delta, long-range, encrypted, transformed and block store members need
+// core.DecompressBytes or the file API.
+func DecompressBytes(archive []byte, impl string, threads int) ([]byte, error) {
+	in := bytes.NewReader(archive)
+	var out []byte
+	for member := 0; ; member++ {
+		h, err := ReadHeader(in)
+		if err == io.EOF && member > 0 {
+			return out, nil
+		}
+		if err != nil {
+			err = corrupt(fmt.Errorf("read header: %w", noEOF(err)))
+		} else {
+			out, err = decodeMemory(in, h, out, impl, threads)
+		}
+		if err != nil {
+			if member > 0 {
+				return nil, fmt.Errorf("member %d: %w", member, err)
+			}
+			return nil, err
+		}
+	}
+}
+
+// decodeMemory appends the member h, whose payload follows in in, to out.
+func decodeMemory(in *bytes.Reader, h *FileHeader, out []byte, impl string, threads int) ([]byte, error) {
+	if f := h.Flags &^ memoryFlags; f != 0 {
+		return nil, fmt.Errorf("member flags 0x%x cannot be decoded by this package", f)
+	}
+	if h.Flags&FlagEndMarker != 0 {
+		if err := CheckEndMarker(in, h, false); err != nil {
+			return nil, err
+		}
+	}
+	if err := CheckStrict(h); err != nil {
+		return nil, err
+	}
+	comp := h.CompOffsets()
+	payload := make([]byte, comp[h.NumBlocks])
+	if _, err := io.ReadFull(in, payload); err != nil {
+		return nil, corrupt(fmt.Errorf("read payload: %w", noEOF(err)))
+	}
+
+	raw := h.RawOffsets()
+	base := len(out)
+	out = append(out, make([]byte, h.OriginalSize)...)
+	decode := func(idx int, dict []byte) ([]byte, error) {
+		b := payload[comp[idx] : comp[idx]+int64(h.BlockCompSizes[idx])]
+		dec, err := DecodeAfter(dict, b, int(raw[idx+1]-raw[idx]))
+		if err != nil {
+			return nil, fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		next := dict
+		if h.Flags&FlagChained != 0 {
+			// The window holds filtered bytes, as the encoder saw them.
+			next = ChainDict(dict, dec)
+		}
+		if h.Flags&FlagFilter != 0 {
+			// Raw blocks alias the payload; Revert may work in place.
+			if b[0] == BlockModeRaw {
+				dec = append([]byte(nil), dec...)
+			}
+			dec = h.Filter.Revert(dec)
+		}
+		copy(out[base+int(raw[idx]):], dec)
+		return next, nil
+	}
+	var err error
+	if h.Flags&FlagChained != 0 {
+		var dict []byte
+		for idx := 0; idx < int(h.NumBlocks) && err == nil; idx++ {
+			dict, err = decode(idx, dict)
+		}
+	} else {
+		err = ForEachBlock(impl, int(h.NumBlocks), threads, func(idx int) error {
+			_, err := decode(idx, nil)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.Flags&FlagSHA256 != 0 && sha256.Sum256(out[base:]) != h.SHA256 {
+		return nil, verifyf("SHA-256 of the output does not match the original's")
+	}
+	return out, nil
+}
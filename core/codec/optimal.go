@@ -0,0 +1,101 @@
+package codec
+
+import "sync"
+
+const (
+	// lzOptimalLevel is the -level at which LZ tokens come from the optimal
+	// parser instead of the greedy one.
+	lzOptimalLevel = 9
+
+	lzLiteralCost = 2 // bytes per literal token
+	lzMatchCost   = 4 // bytes per match token
+)
+
+// optBuffers holds the per-block working memory of the optimal parser.
+type optBuffers struct {
+	length []uint8  // longest match at each position
+	offset []uint16 // its offset
+	cost   []uint32 // token bytes needed from each position to the end
+	choice []uint8  // length of the match to take there, 0 for a literal
+}
+
+var optPool = sync.Pool{New: func() interface{} { return new(optBuffers) }}
+
+func (b *optBuffers) reset(n int) {
+	if cap(b.length) < n {
+		b.length = make([]uint8, n)
+		b.offset = make([]uint16, n)
+		b.cost = make([]uint32, n+1)
+		b.choice = make([]uint8, n)
+	}
+	b.length, b.offset = b.length[:n], b.offset[:n]
+	b.cost, b.choice = b.cost[:n+1], b.choice[:n]
+}
+
+// lzOptimalTokens produces the same token format as LZCompressTokens, but
+// picks the token sequence of least total size instead of taking the first
+// match found. The match finder (the binary tree, unless overridden) looks
+// for the longest match at every position (any prefix of it is a match too,
+// and every match token costs the same), then a backward pass computes the
+// cheapest way to encode each suffix of the block.
+// It is tens of times slower than the greedy parser and is used at -level 9.
+// With repcodes, matches that happen to reuse an offset get the short token,
+// but the parse itself does not look for them.
+//
+// Tokens start at input[start:]; the bytes before are only matched against.
+func lzOptimalTokens(input []byte, start int) []byte {
+	n := len(input)
+	if n == start {
+		return nil
+	}
+	b := optPool.Get().(*optBuffers)
+	defer optPool.Put(b)
+	b.reset(n)
+
+	// Longest match at every position; too close to the end, none.
+	mf, release := newMatchFinder(input)
+	defer release()
+	check := cancelCheckBytes
+	for i := 0; i < n; i++ {
+		if i >= check {
+			if CanceledErr() != nil {
+				// The run is over: no matches from here, so the rest is
+				// literals.
+				for ; i < n; i++ {
+					b.length[i] = 0
+				}
+				break
+			}
+			check = i + cancelCheckBytes
+		}
+		off, l := mf.FindMatch(i)
+		b.length[i], b.offset[i] = uint8(l), uint16(off)
+	}
+
+	// Cheapest encoding of every suffix.
+	b.cost[n] = 0
+	for i := n - 1; i >= start; i-- {
+		b.cost[i] = lzLiteralCost + b.cost[i+1]
+		b.choice[i] = 0
+		for l := LZMinMatch; l <= int(b.length[i]); l++ {
+			if c := lzMatchCost + b.cost[i+l]; c < b.cost[i] {
+				b.cost[i] = c
+				b.choice[i] = uint8(l)
+			}
+		}
+	}
+
+	out := make([]byte, 0, b.cost[start])
+	reps := repOffsets{1, 4}
+	for i := start; i < n; {
+		l := int(b.choice[i])
+		if l == 0 {
+			out = append(out, 0x00, input[i])
+			i++
+			continue
+		}
+		out = reps.appendMatch(out, int(b.offset[i]), l)
+		i += l
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package codec
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// stealAny sweeps the deques other than self's, starting at start, and
+// steals the oldest task of the first one holding any. A failed Steal only
+// means another worker took that task first, so a deque is retried until it
+// is empty. The victim is -1 if every deque was empty.
+func stealAny(deques []*WSDeque, self, start int) (task, victim int) {
+	for k := 0; k < len(deques); k++ {
+		v := (start + k) % len(deques)
+		if v == self {
+			continue
+		}
+		for deques[v].Len() > 0 {
+			if task, ok := deques[v].Steal(); ok {
+				return task, v
+			}
+		}
+	}
+	return 0, -1
+}
+
+// parkAfter is how many rounds of backoff an idle worker goes through
+// before it parks: round r yields the processor 1<<r times.
+const parkAfter = 5
+
+// backoff yields the processor for an idle worker that has been idle for
+// round rounds, and reports false once it is time to park instead.
+func backoff(round int) bool {
+	if round >= parkAfter {
+		return false
+	}
+	for k := 0; k < 1<<round; k++ {
+		runtime.Gosched()
+	}
+	return true
+}
+
+// parking puts idle workers to sleep until a task is pushed or the run is
+// over. A worker takes a ticket, looks for work once more and parks on the
+// ticket if it found none: a push after the ticket wakes it, and a push
+// before it was seen by that last look, so no wakeup is lost.
+type parking struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting atomic.Int32
+	gen     uint64 // counts wakes
+	closed  bool
+}
+
+func newParking() *parking {
+	p := &parking{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *parking) ticket() uint64 {
+	p.waiting.Add(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gen
+}
+
+// cancel returns a ticket that is not parked on.
+func (p *parking) cancel() {
+	p.waiting.Add(-1)
+}
+
+// park sleeps until a wake after the ticket was taken, or close.
+func (p *parking) park(ticket uint64) {
+	p.mu.Lock()
+	for p.gen == ticket && !p.closed {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+	p.waiting.Add(-1)
+}
+
+// wake wakes one parked worker after a push. With none parked it costs an
+// atomic load.
+func (p *parking) wake() {
+	if p.waiting.Load() == 0 {
+		return
+	}
+	p.mu.Lock()
+	p.gen++
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// close wakes every parked worker for good, when the run is over.
+func (p *parking) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
@@ -0,0 +1,96 @@
+package codec
+
+import "fmt"
+
+// How readers treat archives that are odd but not plainly broken.
+const (
+	ParseNormal  = "normal"  // reject what cannot be decoded, accept the rest
+	ParseStrict  = "strict"  // also reject anything no writer of the format produces
+	ParseLenient = "lenient" // warn about oddities that can be worked around, and go on
+)
+
+// DefaultParse selects how archive headers are checked. Strict parsing
+// suits forensics, where an archive that is not exactly as written is
+// suspect: zero-sized or oversized blocks, block sizes or an end marker
+// that do not add up to the header's totals, and nonzero padding all fail
+// with ErrCorrupt. Lenient parsing suits bulk restores: bytes after the
+// last member that are not a member, block sizes that disagree with the
+// original size, and a missing or mismatched end marker after a complete
+// payload are reported on the warnings writer and decoding goes on.
+var DefaultParse = ParseNormal
+
+func SetParse(name string) error {
+	if name != ParseNormal && name != ParseStrict && name != ParseLenient {
+		return fmt.Errorf("unknown parse mode %q", name)
+	}
+	DefaultParse = name
+	return nil
+}
+
+// TransformMaxGrowth bounds how much a block transform may grow a block,
+// so readers can still bound the size of a compressed block.
+const TransformMaxGrowth = 64 << 10
+
+// SealOverhead is what sealing adds to an encrypted block: a 12-byte
+// nonce and a 16-byte tag.
+const SealOverhead = 12 + 16
+
+// MaxCompSize bounds the compressed size of a block of h: a raw block of
+// BlockSize bytes and its mode byte, plus what a transform or encryption
+// may add.
+func (h *FileHeader) MaxCompSize() uint64 {
+	n := uint64(h.BlockSize) + 1
+	if h.Flags&FlagTransform != 0 {
+		n += TransformMaxGrowth
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		n += SealOverhead
+	}
+	return n
+}
+
+// CheckStrict rejects headers that parse and decode but that no writer
+// produces. It does nothing unless DefaultParse is ParseStrict.
+func CheckStrict(h *FileHeader) error {
+	if DefaultParse != ParseStrict {
+		return nil
+	}
+	for i, s := range h.BlockCompSizes {
+		if s == 0 {
+			return corruptf("block %d has no compressed bytes", i)
+		}
+		if s > h.MaxCompSize() {
+			return corruptf("block %d: %d compressed bytes, more than a block of %d can take", i, s, h.BlockSize)
+		}
+	}
+	for i, s := range h.BlockSizes {
+		if s == 0 {
+			return corruptf("block %d is empty", i)
+		}
+		if s > h.BlockSize {
+			return corruptf("block %d holds %d bytes, more than the block size %d", i, s, h.BlockSize)
+		}
+	}
+	if h.NumBlocks > 0 && h.BlockSize == 0 {
+		return corruptf("block size 0")
+	}
+	if h.Flags&FlagBlockSizes == 0 && h.BlockSize > 0 && h.NumBlocks != (h.OriginalSize+uint64(h.BlockSize)-1)/uint64(h.BlockSize) {
+		return corruptf("%d blocks of %d bytes do not hold the original size %d", h.NumBlocks, h.BlockSize, h.OriginalSize)
+	}
+	for i, e := range h.TarEntries {
+		if i > 0 && e.Offset < h.TarEntries[i-1].Offset+h.TarEntries[i-1].Size {
+			return corruptf("tar entry %q overlaps the one before", e.Name)
+		}
+	}
+	return nil
+}
+
+// Lenient reports err as a warning and returns nil when DefaultParse is
+// ParseLenient, and returns err otherwise.
+func Lenient(err error) error {
+	if DefaultParse != ParseLenient || err == nil {
+		return err
+	}
+	Warnf("warning: %v; going on (-parse lenient)", err)
+	return nil
+}
@@ -0,0 +1,85 @@
+package codec
+
+import "sync"
+
+// PoolForEach runs fn for every index in [0, n) on threads workers that
+// take the indices, in order, from a buffered channel. It is the baseline
+// for the deque-based schedulers: no partitioning and no stealing, just the
+// channel's lock. After the first error, workers stop taking new indices and
+// that error is returned.
+func PoolForEach(n, threads int, fn func(idx int) error) error {
+	if n == 0 {
+		return nil
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	if threads > n {
+		threads = n
+	}
+	tasks := make(chan int, n)
+	for idx := 0; idx < n; idx++ {
+		tasks <- idx
+	}
+	close(tasks)
+
+	var wg sync.WaitGroup
+	wg.Add(threads)
+
+	var firstErr error
+	var mu sync.Mutex
+
+	call, record := traceCall()
+
+	for wid := 0; wid < threads; wid++ {
+		go func(id int) {
+			defer wg.Done()
+			defer lockWorker()()
+
+			var evs []TraceEvent
+			if record != nil {
+				defer func() { record(evs) }()
+			}
+
+			for idx := range tasks {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = CanceledErr()
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					return
+				}
+
+				adaptiveSlots.acquire()
+				var ev TraceEvent
+				if record != nil {
+					ev = TraceEvent{Sched: "pool", Call: call, Task: idx, Worker: id, Start: traceNow(), Victim: -1}
+				}
+				p := progressStart(id, idx)
+				err := fn(idx)
+				p.done(false)
+				if record != nil {
+					ev.End = traceNow()
+					evs = append(evs, ev)
+				}
+				adaptiveSlots.release()
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					AbortRun()
+					return
+				}
+			}
+		}(wid)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = CanceledErr()
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// workerProgress holds the live counters of one scheduler worker. Workers
+// are numbered per scheduler call, so worker i of every call adds to the
+// same counters.
+type workerProgress struct {
+	block  atomic.Int64 // block being worked on, plus one; 0 when idle
+	tasks  atomic.Int64
+	stolen atomic.Int64
+	busy   atomic.Int64 // nanoseconds spent in tasks
+	since  atomic.Int64 // start of the current task, in Unix nanoseconds
+}
+
+// progressWorkers is set by SetProgress; nil keeps no counters.
+var progressWorkers []workerProgress
+
+// SetProgress keeps live counters for the first threads workers of every
+// scheduler, for core.StartProgressView; 0 turns them off. It must not be called
+// while a run is going.
+func SetProgress(threads int) {
+	progressWorkers = nil
+	if threads > 0 {
+		progressWorkers = make([]workerProgress, threads)
+	}
+}
+
+// progressStart is called by worker id before it runs task. It returns nil,
+// on which done does nothing, when no counters are kept.
+func progressStart(id, task int) *workerProgress {
+	if id >= len(progressWorkers) {
+		return nil
+	}
+	w := &progressWorkers[id]
+	w.since.Store(time.Now().UnixNano())
+	w.block.Store(int64(task) + 1)
+	return w
+}
+
+// done is called when the task from progressStart is finished.
+func (w *workerProgress) done(stolen bool) {
+	if w == nil {
+		return
+	}
+	w.busy.Add(time.Now().UnixNano() - w.since.Load())
+	w.tasks.Add(1)
+	if stolen {
+		w.stolen.Add(1)
+	}
+	w.block.Store(0)
+}
+
+// WorkerProgress is a snapshot of one worker's counters.
+type WorkerProgress struct {
+	Worker int
+	Block  int // being worked on, or -1 when idle
+	Tasks  int64
+	Stolen int64 // ws, fj: tasks taken from another worker's deque
+	Busy   time.Duration
+}
+
+// Workers returns a snapshot of every worker's counters.
+func Workers() []WorkerProgress {
+	ws := make([]WorkerProgress, len(progressWorkers))
+	for i := range progressWorkers {
+		w := &progressWorkers[i]
+		ws[i] = WorkerProgress{Worker: i, Block: int(w.block.Load()) - 1, Tasks: w.tasks.Load(),
+			Stolen: w.stolen.Load(), Busy: time.Duration(w.busy.Load())}
+	}
+	return ws
+}
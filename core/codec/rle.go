@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	rleMinRun     = 3   // shorter repeats are cheaper as literals
+	rleMaxLiteral = 128 // literal runs are stored with a 7-bit count
+)
+
+func init() {
+	registerCodec(&blockCodec{
+		name:   "rle",
+		mode:   BlockModeRLE,
+		encode: rleCompress,
+		decode: rleDecompress,
+	})
+}
+
+// rleCompress encodes input as a sequence of control bytes:
+//
+//	0x00-0x7F  c+1 literal bytes follow
+//	0x80-0xFE  the next byte repeats (c&0x7F)+3 times
+//	0xFF       the next byte repeats 130+uvarint times (uvarint precedes it)
+func rleCompress(input []byte) []byte {
+	out := make([]byte, 0, len(input)/2)
+	var tmp [binary.MaxVarintLen64]byte
+
+	lit := 0 // start of the pending literal run
+	flush := func(end int) {
+		for lit < end {
+			n := end - lit
+			if n > rleMaxLiteral {
+				n = rleMaxLiteral
+			}
+			out = append(out, byte(n-1))
+			out = append(out, input[lit:lit+n]...)
+			lit += n
+		}
+	}
+
+	i := 0
+	for i < len(input) {
+		j := i + 1
+		for j < len(input) && input[j] == input[i] {
+			j++
+		}
+		run := j - i
+		if run < rleMinRun {
+			i = j
+			continue
+		}
+
+		flush(i)
+		if n := run - rleMinRun; n < 0x7F {
+			out = append(out, 0x80|byte(n))
+		} else {
+			out = append(out, 0xFF)
+			out = append(out, tmp[:binary.PutUvarint(tmp[:], uint64(n-0x7F))]...)
+		}
+		out = append(out, input[i])
+		i = j
+		lit = i
+	}
+	flush(len(input))
+	return out
+}
+
+// rleDecompress reverses rleCompress.
+func rleDecompress(payload []byte, expectedSize int) ([]byte, error) {
+	out := make([]byte, 0, expectedSize)
+	i := 0
+	for i < len(payload) {
+		c := payload[i]
+		i++
+		if c < 0x80 {
+			n := int(c) + 1
+			if i+n > len(payload) {
+				return nil, fmt.Errorf("truncated literal run")
+			}
+			if len(out)+n > expectedSize {
+				return nil, fmt.Errorf("literal run overflows block: %d > %d", len(out)+n, expectedSize)
+			}
+			out = append(out, payload[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := int(c&0x7F) + rleMinRun
+		if c == 0xFF {
+			extra, w := binary.Uvarint(payload[i:])
+			if w <= 0 || extra > uint64(expectedSize) {
+				return nil, fmt.Errorf("invalid run length")
+			}
+			n += int(extra)
+			i += w
+		}
+		if i >= len(payload) {
+			return nil, fmt.Errorf("truncated run")
+		}
+		if len(out)+n > expectedSize {
+			return nil, fmt.Errorf("run overflows block: %d > %d", len(out)+n, expectedSize)
+		}
+		b := payload[i]
+		i++
+		for k := 0; k < n; k++ {
+			out = append(out, b)
+		}
+	}
+
+	if len(out) != expectedSize {
+		return nil, fmt.Errorf("size mismatch: got %d, expected %d", len(out), expectedSize)
+	}
+	return out, nil
+}
+
+// hasLongRuns reports whether runs of at least 16 equal bytes cover an
+// eighth or more of buf. It stops as soon as the answer is known.
+func hasLongRuns(buf []byte) bool {
+	const minRun = 16
+	need := len(buf) / 8
+	if need == 0 {
+		return false
+	}
+	covered := 0
+	i := 0
+	for i < len(buf) {
+		j := i + 1
+		for j < len(buf) && buf[j] == buf[i] {
+			j++
+		}
+		if j-i >= minRun {
+			covered += j - i
+			if covered >= need {
+				return true
+			}
+		}
+		i = j
+	}
+	return false
+}
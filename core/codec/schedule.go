@@ -0,0 +1,30 @@
+package codec
+
+import "fmt"
+
+// ForEachBlock runs fn for every block index in [0, n) using the named
+// implementation's scheduling strategy: "seq", "bsp", "ws", "fj" or "pool".
+func ForEachBlock(impl string, n, threads int, fn func(idx int) error) error {
+	switch impl {
+	case "seq":
+		for idx := 0; idx < n; idx++ {
+			p := progressStart(0, idx)
+			err := fn(idx)
+			p.done(false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "bsp":
+		return BSPForEach(n, threads, fn)
+	case "ws":
+		return WSForEach(n, threads, fn)
+	case "fj":
+		return FJForEach(n, threads, fn)
+	case "pool":
+		return PoolForEach(n, threads, fn)
+	default:
+		return fmt.Errorf("unknown implementation %q", impl)
+	}
+}
@@ -0,0 +1,156 @@
+package codec
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTiming records how long every phase of a run takes (see Timings).
+var DefaultTiming bool
+
+func SetTiming(on bool) {
+	DefaultTiming = on
+}
+
+// PhaseTiming is the time spent in one phase of a run: reading input,
+// compressing or decompressing blocks, writing output, ... A phase entered
+// several times (once per block, member or superstep) adds up.
+type PhaseTiming struct {
+	Name  string
+	Count int           // times the phase was entered
+	Wall  time.Duration // elapsed
+	CPU   time.Duration // user+system time of the whole process, all threads
+
+	// BSP supersteps only: the time every thread spent on its partition
+	// and then waiting at the barrier for the others, summed over threads,
+	// and the partition times of the fastest and slowest thread.
+	Threads                int
+	Compute, Wait          time.Duration
+	MinCompute, MaxCompute time.Duration
+
+	// Work stealing only: the tasks run, and how many of them were
+	// stolen from another worker's deque.
+	Tasks, Stolen int
+}
+
+var timings struct {
+	sync.Mutex
+	phases []PhaseTiming
+	steps  int
+}
+
+// StartPhase starts timing the phase name and returns the function that
+// stops it. Without -timing it does nothing.
+func StartPhase(name string) func() {
+	if !DefaultTiming {
+		return func() {}
+	}
+	addPhase(PhaseTiming{Name: name})
+	wall, cpu := time.Now(), processCPU()
+	return func() {
+		addPhase(PhaseTiming{Name: name, Count: 1, Wall: time.Since(wall), CPU: processCPU() - cpu})
+	}
+}
+
+// StartPhaseAround is StartPhase for a phase that runs the phase inner,
+// timed on its own, along the way (writes of core's OrderedWriter during
+// decompression, say): time spent in inner meanwhile is not counted twice.
+func StartPhaseAround(name, inner string) func() {
+	if !DefaultTiming {
+		return func() {}
+	}
+	addPhase(PhaseTiming{Name: name})
+	before := phaseTotal(inner)
+	wall, cpu := time.Now(), processCPU()
+	return func() {
+		in := phaseTotal(inner)
+		addPhase(PhaseTiming{Name: name, Count: 1,
+			Wall: time.Since(wall) - (in.Wall - before.Wall),
+			CPU:  processCPU() - cpu - (in.CPU - before.CPU)})
+	}
+}
+
+func phaseTotal(name string) PhaseTiming {
+	timings.Lock()
+	defer timings.Unlock()
+	for _, p := range timings.phases {
+		if p.Name == name {
+			return p
+		}
+	}
+	return PhaseTiming{}
+}
+
+// maxSupersteps is how many supersteps are timed on their own; the rest
+// add up in a single phase.
+const maxSupersteps = 16
+
+// startSuperstep is StartPhase for one BSP superstep; the returned function
+// takes the time each thread computed and waited at the barrier.
+func startSuperstep() func(compute, wait []time.Duration) {
+	timings.Lock()
+	timings.steps++
+	name := "superstep " + strconv.Itoa(timings.steps)
+	if timings.steps > maxSupersteps {
+		name = "supersteps " + strconv.Itoa(maxSupersteps+1) + "+"
+	}
+	timings.Unlock()
+	addPhase(PhaseTiming{Name: name})
+	wall, cpu := time.Now(), processCPU()
+	return func(compute, wait []time.Duration) {
+		p := PhaseTiming{Name: name, Count: 1, Wall: time.Since(wall), CPU: processCPU() - cpu, Threads: len(compute)}
+		for i := range compute {
+			p.Compute += compute[i]
+			p.Wait += wait[i]
+			if i == 0 || compute[i] < p.MinCompute {
+				p.MinCompute = compute[i]
+			}
+			if compute[i] > p.MaxCompute {
+				p.MaxCompute = compute[i]
+			}
+		}
+		addPhase(p)
+	}
+}
+
+// addSteals records a work-stealing call that ran tasks tasks, stolen of
+// them stolen.
+func addSteals(tasks, stolen int) {
+	addPhase(PhaseTiming{Name: "work stealing", Count: 1, Tasks: tasks, Stolen: stolen})
+}
+
+func addPhase(p PhaseTiming) {
+	timings.Lock()
+	defer timings.Unlock()
+	for i := range timings.phases {
+		if q := &timings.phases[i]; q.Name == p.Name {
+			if p.Threads > 0 && (q.Threads == 0 || p.MinCompute < q.MinCompute) {
+				q.MinCompute = p.MinCompute
+			}
+			if p.MaxCompute > q.MaxCompute {
+				q.MaxCompute = p.MaxCompute
+			}
+			if p.Threads > q.Threads {
+				q.Threads = p.Threads
+			}
+			q.Count += p.Count
+			q.Wall += p.Wall
+			q.CPU += p.CPU
+			q.Compute += p.Compute
+			q.Wait += p.Wait
+			q.Tasks += p.Tasks
+			q.Stolen += p.Stolen
+			return
+		}
+	}
+	timings.phases = append(timings.phases, p)
+}
+
+// Timings returns the phases timed so far, in the order they were first
+// entered. CPU times are zero where the platform does not report them.
+func Timings() []PhaseTiming {
+	timings.Lock()
+	defer timings.Unlock()
+	return append([]PhaseTiming(nil), timings.phases...)
+}
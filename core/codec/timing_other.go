@@ -0,0 +1,9 @@
+//go:build !unix
+
+package codec
+
+import "time"
+
+func processCPU() time.Duration {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package codec
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPU returns the user and system time used by the process so far.
+func processCPU() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
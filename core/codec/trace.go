@@ -0,0 +1,135 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultTrace records every task the bsp and ws schedulers run (see
+// TraceEvents and WriteTrace).
+var DefaultTrace bool
+
+func SetTrace(on bool) {
+	DefaultTrace = on
+	traces.Lock()
+	traces.start = time.Now()
+	traces.Unlock()
+}
+
+// TraceEvent is one task run by a scheduler worker.
+type TraceEvent struct {
+	Sched      string        // "bsp", "ws", "fj" or "pool"
+	Call       int           // scheduler call (BSP superstep) within the run, from 1
+	Task       int           // index within the call
+	Worker     int           // worker that ran it
+	Start, End time.Duration // since SetTrace
+	Stolen     bool          // ws, fj: taken from another worker's deque
+	Victim     int           // ws, fj: the worker it was stolen from, or -1
+	Barrier    bool          // bsp: the worker waiting at the barrier; Task is -1
+}
+
+var traces struct {
+	sync.Mutex
+	start  time.Time
+	calls  int
+	events []TraceEvent
+}
+
+// traceCall returns the number of a new scheduler call and the recorder its
+// workers add their tasks with, or nil without -trace. Every worker should
+// keep its tasks in a slice of its own and add them once it is done.
+func traceCall() (int, func([]TraceEvent)) {
+	if !DefaultTrace {
+		return 0, nil
+	}
+	traces.Lock()
+	traces.calls++
+	call := traces.calls
+	traces.Unlock()
+	return call, func(evs []TraceEvent) {
+		traces.Lock()
+		traces.events = append(traces.events, evs...)
+		traces.Unlock()
+	}
+}
+
+// traceNow returns the time since SetTrace.
+func traceNow() time.Duration {
+	return time.Since(traces.start)
+}
+
+// TraceEvents returns the tasks recorded so far, grouped by worker.
+func TraceEvents() []TraceEvent {
+	traces.Lock()
+	defer traces.Unlock()
+	return append([]TraceEvent(nil), traces.events...)
+}
+
+// TraceRun runs fn with the trace on and returns the tasks it recorded.
+// Unless DefaultTrace was already on, they are not kept for TraceEvents.
+func TraceRun(fn func() error) ([]TraceEvent, error) {
+	traced := DefaultTrace
+	DefaultTrace = true
+	traces.Lock()
+	before := len(traces.events)
+	traces.Unlock()
+	err := fn()
+	DefaultTrace = traced
+	traces.Lock()
+	defer traces.Unlock()
+	evs := append([]TraceEvent(nil), traces.events[before:]...)
+	if !traced {
+		traces.events = traces.events[:before]
+	}
+	return evs, err
+}
+
+// WriteTrace writes the recorded tasks in the Chrome trace event format,
+// for chrome://tracing or Perfetto: one row per worker, one slice per task.
+func WriteTrace(w io.Writer) error {
+	type event struct {
+		Name string                 `json:"name"`
+		Cat  string                 `json:"cat,omitempty"`
+		Ph   string                 `json:"ph"`
+		Ts   float64                `json:"ts"`
+		Dur  float64                `json:"dur,omitempty"`
+		Pid  int                    `json:"pid"`
+		Tid  int                    `json:"tid"`
+		Args map[string]interface{} `json:"args,omitempty"`
+	}
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+
+	out := []event{}
+	workers := map[int]bool{}
+	for _, e := range TraceEvents() {
+		if !workers[e.Worker] {
+			workers[e.Worker] = true
+			out = append(out, event{Name: "thread_name", Ph: "M", Pid: 1, Tid: e.Worker,
+				Args: map[string]interface{}{"name": fmt.Sprintf("worker %d", e.Worker)}})
+		}
+		if e.Barrier {
+			out = append(out, event{Name: "barrier wait", Cat: e.Sched, Ph: "X", Ts: us(e.Start), Dur: us(e.End - e.Start),
+				Pid: 1, Tid: e.Worker, Args: map[string]interface{}{"call": e.Call}})
+			continue
+		}
+		args := map[string]interface{}{"call": e.Call, "task": e.Task}
+		name := fmt.Sprintf("task %d", e.Task)
+		if e.Stolen {
+			args["stolen_from"] = e.Victim
+			name += " (stolen)"
+		}
+		out = append(out, event{Name: name, Cat: e.Sched, Ph: "X", Ts: us(e.Start), Dur: us(e.End - e.Start),
+			Pid: 1, Tid: e.Worker, Args: args})
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(map[string]interface{}{"traceEvents": out, "displayTimeUnit": "ms"}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+)
+
+// warnings receives one line for everything that was skipped rather than
+// failing a run: metadata that could not be recorded or restored, files
+// whose names cannot be stored portably, ...
+var warnings io.Writer = io.Discard
+
+// SetWarnings sends warnings to w; nil drops them.
+func SetWarnings(w io.Writer) {
+	if w == nil {
+		w = io.Discard
+	}
+	warnings = w
+}
+
+func Warnf(format string, args ...interface{}) {
+	fmt.Fprintf(warnings, format+"\n", args...)
+}
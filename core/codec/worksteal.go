@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Initial distributions of indices over the work-stealing deques.
+const (
+	WSSeedStripe = "stripe" // round-robin: worker i gets i, i+T, i+2T, ...
+	WSSeedRange  = "range"  // contiguous: worker i gets the i-th run of N/T indices
+)
+
+// DefaultWSSeed selects how WSForEach deals indices into the deques. With
+// "range", owners work through their run front to back, reading input and
+// output sequentially, and thieves take blocks from its far end.
+var DefaultWSSeed = WSSeedStripe
+
+func SetWSSeed(name string) error {
+	if name != WSSeedStripe && name != WSSeedRange {
+		return fmt.Errorf("unknown work-stealing seed %q", name)
+	}
+	DefaultWSSeed = name
+	return nil
+}
+
+// WSForEach runs fn for every index in [0, n) on work-stealing workers.
+// Indices are dealt into per-worker deques as DefaultWSSeed says; owners pop
+// bottom, thieves steal top. No index is pushed after the deal, so a thief
+// that finds every deque empty has nothing left to wait for and quits. After
+// the first error, workers stop taking new indices and that error is returned.
+func WSForEach(n, threads int, fn func(idx int) error) error {
+	if n == 0 {
+		return nil
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	if threads > n {
+		threads = n
+	}
+	deques := newWSDeques(threads, (n+threads-1)/threads)
+	if DefaultWSSeed == WSSeedRange {
+		// Pushed last to first, so that owners pop them in order.
+		chunk := (n + threads - 1) / threads
+		for idx := n - 1; idx >= 0; idx-- {
+			deques[idx/chunk].PushBottom(idx)
+		}
+	} else {
+		for idx := 0; idx < n; idx++ {
+			deques[idx%threads].PushBottom(idx)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(threads)
+
+	var firstErr error
+	var mu sync.Mutex
+
+	type rngState uint32
+	xorshift := func(r *rngState) int {
+		x := uint32(*r)
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		*r = rngState(x)
+		return int(x >> 1)
+	}
+
+	call, record := traceCall()
+	var stolen int64
+	if DefaultTiming {
+		defer func() { addSteals(n, int(atomic.LoadInt64(&stolen))) }()
+	}
+
+	for wid := 0; wid < threads; wid++ {
+		go func(id int) {
+			defer wg.Done()
+			defer lockWorker()()
+			dq := deques[id]
+
+			rs := rngState(uint32(time.Now().UnixNano()) ^ uint32(id))
+
+			var evs []TraceEvent
+			if record != nil {
+				defer func() { record(evs) }()
+			}
+
+			for {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = CanceledErr()
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					return
+				}
+
+				adaptiveSlots.acquire()
+				task, ok := dq.PopBottom()
+				victim := -1
+				if !ok {
+					if task, victim = stealAny(deques, id, xorshift(&rs)%threads); victim < 0 {
+						adaptiveSlots.release()
+						return
+					}
+				}
+
+				if victim >= 0 && DefaultTiming {
+					atomic.AddInt64(&stolen, 1)
+				}
+				var ev TraceEvent
+				if record != nil {
+					ev = TraceEvent{Sched: "ws", Call: call, Task: task, Worker: id, Start: traceNow(),
+						Stolen: victim >= 0, Victim: victim}
+				}
+				p := progressStart(id, task)
+				err := fn(task)
+				p.done(victim >= 0)
+				if record != nil {
+					ev.End = traceNow()
+					evs = append(evs, ev)
+				}
+				adaptiveSlots.release()
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					AbortRun()
+					return
+				}
+			}
+		}(wid)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = CanceledErr()
+	}
+	return firstErr
+}
@@ -0,0 +1,172 @@
+package codec
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const cacheLineSize = 64
+
+// WSDeque is a lock-free Chase–Lev work-stealing deque of fixed capacity.
+// Tasks pushed while it is full go to its spill queue instead, which may be
+// shared by several deques; they come out again once the deque is empty.
+type WSDeque struct {
+	tasks []int
+	mask  uint64
+	spill *SpillQueue
+
+	// Padding ensures 'top' is on its own cache line, separate from 'tasks'
+	_ [cacheLineSize]byte
+
+	top atomic.Uint64
+
+	// Padding ensures 'bottom' is on its own cache line, separate from 'top'
+	_ [cacheLineSize]byte
+
+	bottom atomic.Uint64
+}
+
+func nextPow2(n int) int {
+	x := uint64(n - 1)
+	x |= x >> 1
+	x |= x >> 2
+	x |= x >> 4
+	x |= x >> 8
+	x |= x >> 16
+	x |= x >> 32
+	return int(x + 1)
+}
+
+// NewWSDeque allocates a deque with capacity >= requested and a spill queue
+// of its own.
+func NewWSDeque(capacity int) *WSDeque {
+	return NewWSDequeSpill(capacity, new(SpillQueue))
+}
+
+// NewWSDequeSpill allocates a deque with capacity >= requested that
+// overflows into spill.
+func NewWSDequeSpill(capacity int, spill *SpillQueue) *WSDeque {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	size := nextPow2(capacity)
+	return &WSDeque{
+		tasks: make([]int, size),
+		mask:  uint64(size - 1),
+		spill: spill,
+	}
+}
+
+// newWSDeques allocates n deques that share one spill queue.
+func newWSDeques(n, capacity int) []*WSDeque {
+	spill := new(SpillQueue)
+	deques := make([]*WSDeque, n)
+	for i := range deques {
+		deques[i] = NewWSDequeSpill(capacity, spill)
+	}
+	return deques
+}
+
+// PushBottom: owner-only; append at bottom, or to the spill queue when full.
+func (d *WSDeque) PushBottom(task int) {
+	b := d.bottom.Load()
+	if b-d.top.Load() > d.mask {
+		// Writing slot b would overwrite the oldest task, which a thief
+		// may not have taken yet.
+		d.spill.push(task)
+		return
+	}
+	d.tasks[b&d.mask] = task
+	d.bottom.Store(b + 1)
+}
+
+// PopBottom: owner-only pop, falling back to the spill queue when empty.
+func (d *WSDeque) PopBottom() (int, bool) {
+	if task, ok := d.popBottom(); ok {
+		return task, true
+	}
+	return d.spill.pop()
+}
+
+// popBottom resolves the last-item race with thieves via CAS on top.
+func (d *WSDeque) popBottom() (int, bool) {
+	b := d.bottom.Load()
+	if b == 0 {
+		return 0, false
+	}
+	b = b - 1
+	d.bottom.Store(b)
+
+	t := d.top.Load()
+	if t <= b {
+		task := d.tasks[b&d.mask]
+		if t == b {
+			if !d.top.CompareAndSwap(t, t+1) {
+				d.bottom.Store(b + 1)
+				return 0, false
+			}
+			d.bottom.Store(b + 1)
+		}
+		return task, true
+	}
+
+	d.bottom.Store(b + 1)
+	return 0, false
+}
+
+// Steal: thieves take from top using CAS; owner unaffected. An empty deque
+// hands out a task of its spill queue.
+func (d *WSDeque) Steal() (int, bool) {
+	t := d.top.Load()
+	b := d.bottom.Load()
+	if t >= b {
+		return d.spill.pop()
+	}
+	task := d.tasks[t&d.mask]
+	if !d.top.CompareAndSwap(t, t+1) {
+		return 0, false
+	}
+	return task, true
+}
+
+// Len reports how many tasks the deque and its spill queue held at some
+// moment during the call.
+func (d *WSDeque) Len() int {
+	n := int(d.spill.n.Load())
+	b := d.bottom.Load()
+	t := d.top.Load()
+	if t >= b {
+		return n
+	}
+	return n + int(b-t)
+}
+
+// SpillQueue holds the tasks pushed onto full deques, behind a mutex. It is
+// the slow path: deques sized for their load never touch it.
+type SpillQueue struct {
+	mu    sync.Mutex
+	tasks []int
+	n     atomic.Int64 // len(tasks), read without the lock
+}
+
+func (q *SpillQueue) push(task int) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, task)
+	q.n.Store(int64(len(q.tasks)))
+	q.mu.Unlock()
+}
+
+func (q *SpillQueue) pop() (int, bool) {
+	if q.n.Load() == 0 {
+		return 0, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.tasks) == 0 {
+		return 0, false
+	}
+	task := q.tasks[len(q.tasks)-1]
+	q.tasks = q.tasks[:len(q.tasks)-1]
+	q.n.Store(int64(len(q.tasks)))
+	return task, true
+}
@@ -0,0 +1,480 @@
+package codec
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// A zstd frame encoder (RFC 8878) for -mode zstd. Matches come from the LZ
+// parser of the level in force, as for the native codecs; they are coded as
+// zstd sequences with the predefined FSE tables, so no table descriptions
+// are written, and literals are stored as they are. A block that does not
+// shrink is stored raw (or as a run of one byte).
+const (
+	zstdMagic     = 0xFD2FB528
+	zstdBlockMax  = 128 << 10 // raw bytes per block
+	zstdMinMatch  = 3
+	zstdRepeatOff = 3 // offset values 1-3 are repeat codes
+
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+)
+
+// zstdSeq is a run of lit literals followed by a match of match bytes at
+// off back.
+type zstdSeq struct {
+	lit, off, match int
+}
+
+// AppendZstdFrame appends src as one single-segment zstd frame with its
+// content size and checksum, the low 32 bits of its XXH64, which is sum.
+func AppendZstdFrame(out, src []byte, sum uint32) []byte {
+	out = binary.LittleEndian.AppendUint32(out, zstdMagic)
+	// Frame header descriptor: content size field size, single segment,
+	// content checksum.
+	n := len(src)
+	switch {
+	case n < 256:
+		out = append(out, 0<<6|1<<5|1<<2, byte(n))
+	case n < 65536+256:
+		out = append(out, 1<<6|1<<5|1<<2)
+		out = binary.LittleEndian.AppendUint16(out, uint16(n-256))
+	case uint64(n) < 1<<32:
+		out = append(out, 2<<6|1<<5|1<<2)
+		out = binary.LittleEndian.AppendUint32(out, uint32(n))
+	default:
+		out = append(out, 3<<6|1<<5|1<<2)
+		out = binary.LittleEndian.AppendUint64(out, uint64(n))
+	}
+
+	if n == 0 {
+		out = appendZstdBlockHeader(out, true, zstdBlockRaw, 0)
+		return binary.LittleEndian.AppendUint32(out, sum)
+	}
+	z := zstdBlockWriter{src: src, out: out}
+	z.split(LZCompressTokens(src))
+	return binary.LittleEndian.AppendUint32(z.out, sum)
+}
+
+func appendZstdBlockHeader(out []byte, last bool, kind, size int) []byte {
+	h := uint32(kind)<<1 | uint32(size)<<3
+	if last {
+		h |= 1
+	}
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// zstdBlockWriter cuts the sequences of a frame into blocks of at most
+// zstdBlockMax bytes and appends them to out.
+type zstdBlockWriter struct {
+	src   []byte
+	out   []byte
+	start int // of the current block in src
+	pos   int // bytes of src covered by the sequences so far
+	lit   int // literals since the last match
+	seqs  []zstdSeq
+}
+
+// split turns LZ tokens over src into sequences, block by block. Matches of
+// the same offset that follow each other are joined, since zstd matches are
+// not limited to LZMaxMatch bytes; matches crossing a block boundary are
+// cut in two.
+func (z *zstdBlockWriter) split(tokens []byte) {
+	reps := repOffsets{1, 4}
+	off, length := 0, 0 // pending match
+	for i := 0; i < len(tokens); {
+		var o, n int
+		switch tokens[i] {
+		case 0x00:
+			if length > 0 {
+				z.match(off, length)
+				length = 0
+			}
+			z.literals(1)
+			i += 2
+			continue
+		case 0x01:
+			o, n = int(tokens[i+1])|int(tokens[i+2])<<8, int(tokens[i+3])
+			reps[0], reps[1] = o, reps[0]
+			i += 4
+		default:
+			if tokens[i] == 0x03 {
+				reps[0], reps[1] = reps[1], reps[0]
+			}
+			o, n = reps[0], int(tokens[i+1])
+			i += 2
+		}
+		if length > 0 && o == off {
+			length += n
+			continue
+		}
+		if length > 0 {
+			z.match(off, length)
+		}
+		off, length = o, n
+	}
+	if length > 0 {
+		z.match(off, length)
+	}
+	z.literals(len(z.src) - z.pos)
+	z.flush(len(z.src), true)
+}
+
+func (z *zstdBlockWriter) literals(n int) {
+	z.pos += n
+	z.lit += n
+	for z.pos-z.start > zstdBlockMax {
+		z.flush(z.start+zstdBlockMax, false)
+		z.lit = z.pos - z.start
+	}
+}
+
+func (z *zstdBlockWriter) match(off, n int) {
+	for n > 0 {
+		room := z.start + zstdBlockMax - z.pos
+		if room == 0 {
+			z.flush(z.pos, false)
+			continue
+		}
+		take := n
+		if take > room {
+			take = room
+		}
+		if take < zstdMinMatch {
+			z.literals(take) // the source bytes, copied as they are
+		} else {
+			z.seqs = append(z.seqs, zstdSeq{z.lit, off, take})
+			z.lit = 0
+			z.pos += take
+		}
+		n -= take
+	}
+}
+
+// flush appends the block src[z.start:end] made of the pending sequences
+// and the literals after them.
+func (z *zstdBlockWriter) flush(end int, last bool) {
+	src := z.src[z.start:end]
+	mark := len(z.out)
+	z.out = appendZstdBlockHeader(z.out, last, zstdBlockCompressed, 0)
+
+	lits := make([]byte, 0, len(src))
+	p := z.start
+	for _, s := range z.seqs {
+		lits = append(lits, z.src[p:p+s.lit]...)
+		p += s.lit + s.match
+	}
+	lits = append(lits, z.src[p:end]...)
+	z.out = appendZstdLiterals(z.out, lits)
+	z.out = appendZstdSequences(z.out, z.seqs)
+
+	if size := len(z.out) - mark - 3; size < len(src) {
+		appendZstdBlockHeader(z.out[:mark], last, zstdBlockCompressed, size) // in place
+	} else {
+		z.out = z.out[:mark]
+		if isRun(src) {
+			z.out = append(appendZstdBlockHeader(z.out, last, zstdBlockRLE, len(src)), src[0])
+		} else {
+			z.out = append(appendZstdBlockHeader(z.out, last, zstdBlockRaw, len(src)), src...)
+		}
+	}
+	z.start = end
+	z.seqs = z.seqs[:0]
+	z.lit = 0
+}
+
+// isRun reports whether b is one byte repeated.
+func isRun(b []byte) bool {
+	for _, c := range b {
+		if c != b[0] {
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+// appendZstdLiterals appends a literals section storing lits raw, or as a
+// run when they are all the same byte.
+func appendZstdLiterals(out, lits []byte) []byte {
+	kind := 0 // raw
+	body := lits
+	if len(lits) > 1 && isRun(lits) {
+		kind, body = 1, lits[:1]
+	}
+	n := len(lits)
+	switch {
+	case n < 32:
+		out = append(out, byte(kind|n<<3))
+	case n < 4096:
+		h := kind | 1<<2 | n<<4
+		out = append(out, byte(h), byte(h>>8))
+	default:
+		h := kind | 3<<2 | n<<4
+		out = append(out, byte(h), byte(h>>8), byte(h>>16))
+	}
+	return append(out, body...)
+}
+
+// Baselines and extra bits of the literal length, match length (less
+// zstdMinMatch) and offset codes.
+var (
+	zstdLLBase = [36]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdLLBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMLBase = [53]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+		32, 34, 36, 38, 40, 44, 48, 56, 64, 80, 96, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+	zstdMLBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+// The predefined distributions of the three codes, and their encoders.
+var (
+	zstdLLEnc = newFSEEncoder([]int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}, 6)
+	zstdMLEnc = newFSEEncoder([]int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}, 6)
+	zstdOFEnc = newFSEEncoder([]int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+)
+
+// zstdCode returns the code of v in base, the last whose baseline is not
+// above v.
+func zstdCode(base []uint32, v uint32) uint8 {
+	lo, hi := 0, len(base)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if base[mid] <= v {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return uint8(lo)
+}
+
+// appendZstdSequences appends the sequences section for seqs, coded with
+// the predefined tables.
+func appendZstdSequences(out []byte, seqs []zstdSeq) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+	out = append(out, 0) // predefined modes for all three codes
+
+	ll := make([]uint8, n)
+	ml := make([]uint8, n)
+	of := make([]uint8, n)
+	for i, s := range seqs {
+		ll[i] = zstdCode(zstdLLBase[:], uint32(s.lit))
+		ml[i] = zstdCode(zstdMLBase[:], uint32(s.match-zstdMinMatch))
+		of[i] = uint8(bits.Len32(uint32(s.off+zstdRepeatOff)) - 1)
+	}
+	extra := func(w *bitWriter, i int) {
+		s := seqs[i]
+		w.add(uint64(uint32(s.lit)-zstdLLBase[ll[i]]), uint(zstdLLBits[ll[i]]))
+		w.add(uint64(uint32(s.match-zstdMinMatch)-zstdMLBase[ml[i]]), uint(zstdMLBits[ml[i]]))
+		w.add(uint64(s.off+zstdRepeatOff), uint(of[i]))
+	}
+
+	// The decoder reads backwards, so the last sequence goes first.
+	w := bitWriter{out: out}
+	mlState := zstdMLEnc.init(ml[n-1])
+	ofState := zstdOFEnc.init(of[n-1])
+	llState := zstdLLEnc.init(ll[n-1])
+	extra(&w, n-1)
+	for i := n - 2; i >= 0; i-- {
+		zstdOFEnc.encode(&w, &ofState, of[i])
+		zstdMLEnc.encode(&w, &mlState, ml[i])
+		zstdLLEnc.encode(&w, &llState, ll[i])
+		extra(&w, i)
+	}
+	zstdMLEnc.flush(&w, mlState)
+	zstdOFEnc.flush(&w, ofState)
+	zstdLLEnc.flush(&w, llState)
+	return w.close()
+}
+
+// bitWriter appends bits LSB first, as the zstd bitstreams hold them.
+type bitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+// add appends the low nb bits of v; nb is at most 32.
+func (w *bitWriter) add(v uint64, nb uint) {
+	w.acc |= (v & (1<<nb - 1)) << w.n
+	w.n += nb
+	if w.n >= 32 {
+		w.out = binary.LittleEndian.AppendUint32(w.out, uint32(w.acc))
+		w.acc >>= 32
+		w.n -= 32
+	}
+}
+
+// close ends the stream with a 1 bit, from which the decoder finds its
+// end, and returns the bytes.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	for w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		if w.n < 8 {
+			break
+		}
+		w.n -= 8
+	}
+	return w.out
+}
+
+// fseEncoder encodes symbols with the FSE table of a normalized
+// distribution, built as the zstd reference encoder builds it so that the
+// decoder's table of the same distribution reads the states back.
+type fseEncoder struct {
+	tableLog uint
+	states   []uint16
+	symbols  []fseSymbol
+}
+
+type fseSymbol struct {
+	deltaBits  int // (bits out << 16) less the lowest state taking them
+	deltaState int // where the symbol's states start in states
+}
+
+// newFSEEncoder builds the encoder of norm, where -1 marks a probability
+// below 1 that still takes one state.
+func newFSEEncoder(norm []int16, tableLog uint) *fseEncoder {
+	size := 1 << tableLog
+	cumul := make([]int, len(norm)+1)
+	spread := make([]uint8, size)
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			cumul[s+1] = cumul[s] + 1
+			spread[high] = uint8(s)
+			high--
+		} else {
+			cumul[s+1] = cumul[s] + int(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			spread[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	e := &fseEncoder{tableLog: tableLog, states: make([]uint16, size), symbols: make([]fseSymbol, len(norm))}
+	for u, s := range spread {
+		e.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, c := range norm {
+		switch c {
+		case 0:
+			e.symbols[s].deltaBits = int(tableLog+1)<<16 - size
+		case -1, 1:
+			e.symbols[s] = fseSymbol{int(tableLog)<<16 - size, total - 1}
+			total++
+		default:
+			maxBits := int(tableLog) - (bits.Len16(uint16(c-1)) - 1)
+			e.symbols[s] = fseSymbol{maxBits<<16 - int(c)<<maxBits, total - int(c)}
+			total += int(c)
+		}
+	}
+	return e
+}
+
+// init returns the state that starts the stream with symbol s.
+func (e *fseEncoder) init(s uint8) int {
+	sym := e.symbols[s]
+	nb := (sym.deltaBits + 1<<15) >> 16
+	v := nb<<16 - sym.deltaBits
+	return int(e.states[v>>nb+sym.deltaState])
+}
+
+// encode moves state on to symbol s, writing the bits it sheds.
+func (e *fseEncoder) encode(w *bitWriter, state *int, s uint8) {
+	sym := e.symbols[s]
+	nb := (*state + sym.deltaBits) >> 16
+	w.add(uint64(*state), uint(nb))
+	*state = int(e.states[*state>>nb+sym.deltaState])
+}
+
+// flush writes the final state, which the decoder starts from.
+func (e *fseEncoder) flush(w *bitWriter, state int) {
+	w.add(uint64(state), e.tableLog)
+}
+
+// XXH64 returns the XXH64 hash of b with seed 0, the checksum zstd uses.
+func XXH64(b []byte) uint64 {
+	p1, p2 := uint64(xxPrime1), uint64(xxPrime2)
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := p1+p2, p2, uint64(0), -p1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		for _, v := range [4]uint64{v1, v2, v3, v4} {
+			h = (h^xxRound(0, v))*p1 + xxPrime4
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*p1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * p1
+		h = bits.RotateLeft64(h, 23)*p2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * p1
+	}
+	h ^= h >> 33
+	h *= p2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+const (
+	xxPrime1 = 11400714785074694791
+	xxPrime2 = 14029467366897019727
+	xxPrime3 = 1609587929392839161
+	xxPrime4 = 9650029242287828579
+	xxPrime5 = 2870177450012600261
+)
+
+func xxRound(acc, v uint64) uint64 {
+	return bits.RotateLeft64(acc+v*xxPrime2, 31) * xxPrime1
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"proj3/core/codec"
+)
+
+// CompareResult describes how an archive's contents relate to an original file.
+type CompareResult struct {
+	Equal bool
+
+	// When !Equal: offset of the first differing byte of the original, and
+	// the member and block holding it. Block is -1 when the contents match
+	// but one side is longer than the other.
+	Offset int64
+	Member int
+	Block  int
+
+	ArchiveSize  int64 // total uncompressed size of all members
+	OriginalSize int64
+}
+
+// CompareFile decompresses archivePath in memory with the given
+// implementation and compares it against originalPath, without writing the
+// extracted data anywhere.
+func CompareFile(archivePath, originalPath, impl string, threads int) (*CompareResult, error) {
+	in, err := openFile(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer closeFile(in)
+
+	orig, err := openFile(originalPath)
+	if err != nil {
+		return nil, fmt.Errorf("open original: %w", err)
+	}
+	defer closeFile(orig)
+
+	info, err := orig.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat original: %w", err)
+	}
+	res := &CompareResult{OriginalSize: info.Size(), Block: -1}
+
+	base := int64(0)
+	for member := 0; ; member++ {
+		h, err := readMemberHeader(in, member)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		payload, closeVolumes, err := openPayload(in, archivePath, h)
+		if err != nil {
+			return nil, err
+		}
+		block, off, err := compareMember(payload, orig, base, h, impl, threads)
+		closeVolumes()
+		if err != nil {
+			if member > 0 {
+				return nil, fmt.Errorf("member %d: %w", member, err)
+			}
+			return nil, err
+		}
+		if block >= 0 {
+			res.Offset = off
+			res.Member = member
+			res.Block = block
+			return res, nil
+		}
+		base += int64(h.OriginalSize)
+	}
+
+	res.ArchiveSize = base
+	if base != res.OriginalSize {
+		res.Offset = base
+		if res.OriginalSize < base {
+			res.Offset = res.OriginalSize
+		}
+		return res, nil
+	}
+	res.Equal = true
+	return res, nil
+}
+
+// compareMember decodes one member and compares it with orig starting at
+// base. It returns the first mismatching block and absolute offset, or -1.
+func compareMember(in io.Reader, orig io.ReaderAt, base int64, h *codec.FileHeader, impl string, threads int) (int, int64, error) {
+	if h.OriginalSize == 0 || h.NumBlocks == 0 {
+		return -1, 0, nil
+	}
+
+	numBlocks := int(h.NumBlocks)
+	offs := h.RawOffsets()
+
+	comps, err := readBlocks(in, h)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	decode, err := blockDecoder(h, comps, impl, threads)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	var mu sync.Mutex
+	firstBlock := numBlocks
+	firstOff := int64(0)
+
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		// A lower block already differs; nothing here can come first.
+		mu.Lock()
+		skip := idx > firstBlock
+		mu.Unlock()
+		if skip {
+			return nil
+		}
+
+		exp := int(offs[idx+1] - offs[idx])
+		dec, err := decode(idx)
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+
+		start := base + offs[idx]
+		want := make([]byte, exp)
+		n, err := orig.ReadAt(want, start)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read original at %d: %w", start, err)
+		}
+
+		if n == exp && bytes.Equal(dec, want) {
+			return nil
+		}
+		diff := n
+		for i := 0; i < n; i++ {
+			if dec[i] != want[i] {
+				diff = i
+				break
+			}
+		}
+
+		mu.Lock()
+		if idx < firstBlock {
+			firstBlock = idx
+			firstOff = start + int64(diff)
+		}
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return -1, 0, err
+	}
+	if firstBlock == numBlocks {
+		return -1, 0, nil
+	}
+	return firstBlock, firstOff, nil
+}
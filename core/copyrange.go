@@ -0,0 +1,41 @@
+package core
+
+import "proj3/core/codec"
+
+// canCopyRange reports whether copyRange may move bytes from src to dst:
+// both are local regular files, dst has no copies to write to and no
+// -limit-rate limit applies, since the kernel would bypass all of them.
+func canCopyRange(dst, src *ioFile) bool {
+	return src.src == nil && dst.tee == nil && readLimiter == nil && writeLimiter == nil &&
+		isRegular(src) && isRegular(dst)
+}
+
+// copyRange copies n bytes of src at srcOff to dst at dstOff inside the
+// kernel (copy_file_range), without passing them through user space, and
+// counts them for Stats. It reports false when the kernel or filesystem
+// cannot do it; the caller then copies the range the usual way, which
+// also overwrites anything copied before the failure.
+func copyRange(dst *ioFile, dstOff int64, src *ioFile, srcOff, n int64) bool {
+	if !copyFileRange(dst.File, dstOff, src.File, srcOff, n) {
+		return false
+	}
+	if !src.output {
+		statsIn.Add(uint64(n))
+	}
+	statsOut.Add(uint64(n))
+	return true
+}
+
+// rawBlockAt reports whether block idx of member h, whose payload starts
+// at data in in, is stored raw and can be copied out of in as it is: the
+// member is neither encrypted, filtered nor transformed, its payload is in
+// in, and the block is its uncompressed bytes behind a 0xFF mode byte.
+func rawBlockAt(in *ioFile, h *codec.FileHeader, data int64, comp []int64, idx int, expected int64) bool {
+	if h.Payload != nil || h.Flags&(codec.FlagStore|codec.FlagVolumes|codec.FlagChained|codec.FlagEncrypted|codec.FlagFilter|codec.FlagTransform) != 0 ||
+		int64(h.BlockCompSizes[idx]) != expected+1 {
+		return false
+	}
+	var mode [1]byte
+	_, err := in.File.ReadAt(mode[:], data+comp[idx])
+	return err == nil && mode[0] == codec.BlockModeRaw
+}
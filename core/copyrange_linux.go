@@ -0,0 +1,37 @@
+//go:build linux && (amd64 || arm64 || riscv64 || ppc64le)
+
+package core
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// copy_file_range is not in package syscall; its number depends on the
+// architecture.
+var sysCopyFileRange uintptr = map[string]uintptr{"amd64": 326, "arm64": 285, "riscv64": 285, "ppc64le": 379}[runtime.GOARCH]
+
+func copyFileRange(dst *os.File, dstOff int64, src *os.File, srcOff, n int64) bool {
+	for n > 0 {
+		chunk := n
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		// The kernel advances both offsets past what it copied.
+		r, _, errno := syscall.Syscall6(sysCopyFileRange, src.Fd(), uintptr(unsafe.Pointer(&srcOff)),
+			dst.Fd(), uintptr(unsafe.Pointer(&dstOff)), uintptr(chunk), 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		// ENOSYS before Linux 4.5, EXDEV across filesystems before 5.3,
+		// EOPNOTSUPP or EINVAL where the filesystem does not support it,
+		// and 0 at the end of src: all fall back to copying.
+		if errno != 0 || r == 0 {
+			return false
+		}
+		n -= int64(r)
+	}
+	return true
+}
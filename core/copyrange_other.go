@@ -0,0 +1,7 @@
+//go:build !(linux && (amd64 || arm64 || riscv64 || ppc64le))
+
+package core
+
+import "os"
+
+func copyFileRange(dst *os.File, dstOff int64, src *os.File, srcOff, n int64) bool { return false }
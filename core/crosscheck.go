@@ -0,0 +1,124 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Implementations lists the implementations, in the order -impl all runs them.
+var Implementations = []string{"seq", "bsp", "ws", "fj", "pool"}
+
+// ImplRun is the result of one implementation in CrossCheckFile.
+type ImplRun struct {
+	Impl    string
+	Elapsed time.Duration
+	Size    int64 // of the output
+	SHA256  [32]byte
+}
+
+// runFile compresses or decompresses inputPath to outputPath with impl.
+func runFile(mode, impl, inputPath, outputPath string, threads int) error {
+	switch mode + "/" + impl {
+	case "compress/seq":
+		return SequentialCompressFile(inputPath, outputPath)
+	case "compress/bsp":
+		return BSPCompressFile(inputPath, outputPath, threads)
+	case "compress/ws":
+		return WorkStealingCompressFile(inputPath, outputPath, threads)
+	case "compress/fj":
+		return ForkJoinCompressFile(inputPath, outputPath, threads)
+	case "compress/pool":
+		return PoolCompressFile(inputPath, outputPath, threads)
+	case "decompress/seq":
+		return SequentialDecompressFile(inputPath, outputPath)
+	case "decompress/bsp":
+		return BSPDecompressFile(inputPath, outputPath, threads)
+	case "decompress/ws":
+		return WorkStealingDecompressFile(inputPath, outputPath, threads)
+	case "decompress/fj":
+		return ForkJoinDecompressFile(inputPath, outputPath, threads)
+	case "decompress/pool":
+		return PoolDecompressFile(inputPath, outputPath, threads)
+	}
+	return fmt.Errorf("cannot %s with implementation %q", mode, impl)
+}
+
+// CrossCheckFile runs mode ("compress" or "decompress") on inputPath once
+// with every implementation, timing each, and checks they all produce the
+// same bytes. Every run writes to its own temporary file next to outputPath;
+// when they agree, one is kept as outputPath and the rest are removed. When
+// they do not, all are kept for inspection and an error names the
+// implementations that disagree. The runs are returned either way.
+func CrossCheckFile(mode, inputPath, outputPath string, threads int) ([]ImplRun, error) {
+	if inputPath == "-" {
+		return nil, fmt.Errorf("-impl all reads its input once per implementation and cannot read standard input")
+	}
+	if mode == "compress" && DefaultVolumeSize != 0 {
+		return nil, fmt.Errorf("-impl all cannot be combined with volumes")
+	}
+
+	var runs []ImplRun
+	var paths []string
+	for _, impl := range Implementations {
+		p := fmt.Sprintf("%s.%s.tmp", outputPath, impl)
+		start := time.Now()
+		if err := runFile(mode, impl, inputPath, p, threads); err != nil {
+			removeAll(paths)
+			os.Remove(p)
+			return runs, fmt.Errorf("%s: %w", impl, err)
+		}
+		run := ImplRun{Impl: impl, Elapsed: time.Since(start)}
+		paths = append(paths, p)
+		var err error
+		if run.Size, run.SHA256, err = hashFile(p); err != nil {
+			removeAll(paths)
+			return runs, fmt.Errorf("%s: %w", impl, err)
+		}
+		runs = append(runs, run)
+	}
+
+	var differ []string
+	for _, r := range runs[1:] {
+		if r.Size != runs[0].Size || r.SHA256 != runs[0].SHA256 {
+			differ = append(differ, r.Impl)
+		}
+	}
+	if len(differ) > 0 {
+		return runs, verifyf("output of %s differs from %s; outputs kept as %s.<impl>.tmp",
+			strings.Join(differ, ", "), runs[0].Impl, outputPath)
+	}
+
+	if err := os.Rename(paths[0], outputPath); err != nil {
+		removeAll(paths)
+		return runs, fmt.Errorf("rename output: %w", err)
+	}
+	removeAll(paths[1:])
+	return runs, nil
+}
+
+// hashFile returns the size and SHA-256 of the file at path.
+func hashFile(path string) (int64, [32]byte, error) {
+	var sum [32]byte
+	f, err := openFile(path)
+	if err != nil {
+		return 0, sum, err
+	}
+	defer closeFile(f)
+	d := sha256.New()
+	n, err := io.Copy(d, f)
+	if err != nil {
+		return 0, sum, err
+	}
+	copy(sum[:], d.Sum(nil))
+	return n, sum, nil
+}
+
+func removeAll(paths []string) {
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
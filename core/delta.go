@@ -0,0 +1,147 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// DeltaCompressFile writes a patch to outputPath that rebuilds inputPath from
+// basePath. Blocks are encoded like regular archives, except that LZ matches
+// may also point anywhere into the base file, found through one index of
+// the whole base shared by the workers.
+func DeltaCompressFile(basePath, inputPath, outputPath, impl string, threads int) error {
+	base, err := readFile(basePath)
+	if err != nil {
+		return fmt.Errorf("read base: %w", err)
+	}
+
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("input is not a regular file")
+	}
+	data, err := readFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("read input: %w", err)
+	}
+	originalSize := len(data)
+
+	blockSize := int(DefaultBlockSize)
+	numBlocks := (originalSize + blockSize - 1) / blockSize
+
+	set := newBlockSet(numBlocks)
+	set.filter = codec.BlockFilter{} // base references work on the original bytes
+	set.setTransform("")
+	done := codec.StartPhase("index")
+	index := codec.NewDeltaIndex(base)
+	done()
+	wait := set.hashInput(data)
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		s := idx * blockSize
+		e := s + blockSize
+		if e > originalSize {
+			e = originalSize
+		}
+		set.store(idx, data[s:e], codec.EncodeDeltaBlock(data[s:e], index, s))
+		return nil
+	})
+	wait()
+	if err != nil {
+		return err
+	}
+
+	header := set.header(info.Name(), uint64(originalSize), uint32(blockSize))
+	header.Flags |= codec.FlagDelta
+	header.BaseSize = uint64(len(base))
+	header.BaseHash = sha256.Sum256(base)
+	return writeArchive(outputPath, header, set.enc)
+}
+
+// ApplyDeltaFile rebuilds the file described by the patch at patchPath from
+// basePath and writes it to outputPath. The base must be byte-identical to
+// the one the patch was made against.
+func ApplyDeltaFile(basePath, patchPath, outputPath, impl string, threads int) error {
+	in, err := openFile(patchPath)
+	if err != nil {
+		return fmt.Errorf("open patch: %w", err)
+	}
+	defer closeFile(in)
+
+	h, err := codec.ReadHeader(in)
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	if h.Flags&codec.FlagDelta == 0 {
+		return fmt.Errorf("%s is not a delta patch", patchPath)
+	}
+
+	base, err := readFile(basePath)
+	if err != nil {
+		return fmt.Errorf("read base: %w", err)
+	}
+	if uint64(len(base)) != h.BaseSize || sha256.Sum256(base) != h.BaseHash {
+		return verifyf("base file does not match the one the patch was made against")
+	}
+
+	payload, closeVolumes, err := openPayload(in, patchPath, h)
+	if err != nil {
+		return err
+	}
+	defer closeVolumes()
+	comps, err := readBlocks(payload, h)
+	if err != nil {
+		return err
+	}
+
+	numBlocks := int(h.NumBlocks)
+	blockSize := int(h.BlockSize)
+	offs := h.RawOffsets()
+	outBuf := make([]byte, h.OriginalSize)
+
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		s, e := int(offs[idx]), int(offs[idx+1])
+
+		comp, err := openBlock(h, idx, comps[idx])
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		var dec []byte
+		if len(comp) > 0 && comp[0] == codec.BlockModeDelta {
+			win, _ := codec.DeltaBaseWindow(base, s, e, blockSize)
+			dec, err = codec.DeltaDecompress(comp[1:], base, win, e-s)
+			err = corrupt(err)
+		} else {
+			dec, err = codec.DecodeBlock(comp, e-s)
+		}
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		copy(outBuf[s:e], dec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if h.Flags&codec.FlagSHA256 != 0 && sha256.Sum256(outBuf) != h.SHA256 {
+		return verifyf("SHA-256 of the output does not match the original's")
+	}
+
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+	if err := reserve(out, uint64(len(outBuf))); err != nil {
+		return err
+	}
+	if _, err := out.Write(outBuf); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	return commitFile(out)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// DefaultDetect stores inputs that look already compressed (see
+// alreadyCompressed) without an LZ pass when the codec is "auto".
+var DefaultDetect = true
+
+func SetDetect(on bool) {
+	DefaultDetect = on
+}
+
+// compressedExts are extensions of formats that are compressed already:
+// archives, images, audio and video. LZ finds next to nothing in them.
+var compressedExts = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".txz": true,
+	".zst": true, ".lz4": true, ".7z": true, ".rar": true, ".pcz": true,
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".m4a": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true,
+}
+
+// alreadyCompressed reports why the file name is not worth compressing, or
+// "" if it is. Only the extension counts: a file whose contents merely
+// start out random may go on compressibly, and auto stores each block that
+// probes at raw entropy on its own (see codec.RawEntropyBits).
+func alreadyCompressed(name string) string {
+	if ext := strings.ToLower(filepath.Ext(name)); compressedExts[ext] {
+		return ext + " file"
+	}
+	return ""
+}
+
+// detect switches the set to the store codec when it holds a file that is
+// already compressed.
+func (s *blockSet) detect(name string) {
+	if !DefaultDetect || s.codec != "auto" {
+		return
+	}
+	if why := alreadyCompressed(name); why != "" {
+		s.codec = "store"
+		codec.Warnf("%s: already compressed (%s), storing as-is", name, why)
+	}
+}
@@ -0,0 +1,314 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"proj3/core/codec"
+)
+
+// Encrypted members seal every encoded block, mode byte included, with
+// AES-256-GCM under a data key of the run:
+//
+//	nonce (12 bytes) | ciphertext | tag (16 bytes)
+//
+// with the member's number and the block index as additional data (see
+// blockAD), so blocks cannot be swapped or dropped. The header records the
+// data key wrapped by a KMS (FlagEncrypted); the key itself is never
+// stored. The nonce and tag add codec.SealOverhead bytes to a block.
+
+// KMS wraps and unwraps data keys with a key encryption key it holds,
+// named by keyID, such as a key in a cloud KMS or an HSM. Wrapped keys are
+// stored in archive headers as they are.
+type KMS interface {
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// kmsByName holds the registered key management services: "keyfile" wraps
+// with the key of SetKeyfile, "exec" runs DefaultKMSCommand.
+var kmsByName = map[string]KMS{
+	"keyfile": keyfileKMS{},
+	"exec":    execKMS{},
+}
+
+// RegisterKMS makes a key management service selectable with
+// SetEncryption. Encrypted members name the KMS that wrapped their data key
+// and only decrypt in programs that register one of that name.
+func RegisterKMS(name string, k KMS) {
+	kmsByName[name] = k
+}
+
+// sealer encrypts blocks with one data key.
+type sealer struct {
+	kms     string
+	keyID   string
+	wrapped []byte
+	aead    cipher.AEAD
+	prefix  [4]byte       // random, for the nonces of this key
+	count   atomic.Uint64 // nonces used
+	members atomic.Uint64 // members numbered, for blockAD
+}
+
+// encryption is the sealer of SetEncryption, or nil.
+var encryption *sealer
+
+// SetEncryption encrypts the archives of later runs with a new data key,
+// wrapped by the KMS called kms under keyID; "" turns encryption off. The
+// "keyfile" KMS takes the key of SetKeyfile and ignores keyID.
+func SetEncryption(kms, keyID string) error {
+	if kms == "" {
+		encryption = nil
+		return nil
+	}
+	k, ok := kmsByName[kms]
+	if !ok {
+		return fmt.Errorf("unknown KMS %q (have %v)", kms, kmsNames())
+	}
+	if kms == "keyfile" {
+		if keyfileKey == nil {
+			return fmt.Errorf("keyfile encryption needs a key file")
+		}
+		keyID = keyfileID(keyfileKey)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return fmt.Errorf("generate data key: %w", err)
+	}
+	wrapped, err := k.WrapKey(keyID, dataKey)
+	if err != nil {
+		return fmt.Errorf("wrap data key with %s: %w", kms, err)
+	}
+	if len(kms) > 0xFFFF || len(keyID) > 0xFFFF || len(wrapped) > 0xFFFF {
+		return fmt.Errorf("KMS name, key id or wrapped key too long")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	s := &sealer{kms: kms, keyID: keyID, wrapped: wrapped, aead: aead}
+	if _, err := io.ReadFull(rand.Reader, s.prefix[:]); err != nil {
+		return fmt.Errorf("generate nonce prefix: %w", err)
+	}
+	encryption = s
+	return nil
+}
+
+func kmsNames() []string {
+	names := make([]string, 0, len(kmsByName))
+	for n := range kmsByName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key is %d bytes, expected 32", len(key))
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+// blockAD is the additional data of block idx of the member numbered
+// member under its data key, which all members of a run share. The last
+// block is marked final and also binds the block count and the original
+// size, so a member cannot be cut short, extended or given another size:
+// its header would name a last block that does not open.
+func blockAD(member uint64, idx int, last bool, size uint64) []byte {
+	ad := binary.LittleEndian.AppendUint64(nil, member)
+	ad = binary.LittleEndian.AppendUint64(ad, uint64(idx))
+	if last {
+		ad = append(ad, 1)
+		ad = binary.LittleEndian.AppendUint64(ad, uint64(idx)+1)
+		ad = binary.LittleEndian.AppendUint64(ad, size)
+	}
+	return ad
+}
+
+// seal encrypts enc, the encoding of a block with additional data ad.
+// Nonces are the random prefix and a counter, so they never repeat under
+// one data key.
+func (s *sealer) seal(ad, enc []byte) []byte {
+	nonce := make([]byte, 12, codec.SealOverhead+len(enc))
+	copy(nonce, s.prefix[:])
+	binary.LittleEndian.PutUint64(nonce[4:], s.count.Add(1))
+	return s.aead.Seal(nonce, nonce, enc, ad)
+}
+
+// openBlock decrypts comp, block idx of the member h, if the member is
+// encrypted, and returns it unchanged otherwise.
+func openBlock(h *codec.FileHeader, idx int, comp []byte) ([]byte, error) {
+	if h.Flags&codec.FlagEncrypted == 0 {
+		return comp, nil
+	}
+	aead, err := memberKey(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(comp) < codec.SealOverhead {
+		return nil, corruptf("encrypted block too short")
+	}
+	ad := blockAD(h.Member, idx, uint64(idx)+1 == h.NumBlocks, h.OriginalSize)
+	enc, err := aead.Open(nil, comp[:12], comp[12:], ad)
+	if err != nil {
+		return nil, verifyf("block does not decrypt: wrong key or damaged data")
+	}
+	return enc, nil
+}
+
+// unwrappedKeys caches the data keys unwrapped so far, by KMS, key id and
+// wrapped key, so a KMS sees one request per run rather than per block.
+// Failures are not kept: a later SetKeyfile may fix them.
+var (
+	unwrappedMu   sync.Mutex
+	unwrappedKeys = map[string]cipher.AEAD{}
+)
+
+// memberKey returns the cipher of the data key of the member h.
+func memberKey(h *codec.FileHeader) (cipher.AEAD, error) {
+	id := h.KMS + "\x00" + h.KeyID + "\x00" + string(h.WrappedKey)
+	unwrappedMu.Lock()
+	defer unwrappedMu.Unlock()
+	if aead, ok := unwrappedKeys[id]; ok {
+		return aead, nil
+	}
+	var u struct {
+		aead cipher.AEAD
+		err  error
+	}
+	k, ok := kmsByName[h.KMS]
+	if !ok {
+		u.err = fmt.Errorf("member's data key is wrapped by KMS %q, which is not registered", h.KMS)
+	} else if key, err := k.UnwrapKey(h.KeyID, h.WrappedKey); err != nil {
+		u.err = fmt.Errorf("unwrap data key with %s: %w", h.KMS, err)
+	} else {
+		u.aead, u.err = newGCM(key)
+	}
+	if u.err == nil {
+		unwrappedKeys[id] = u.aead
+	}
+	return u.aead, u.err
+}
+
+// keyfileKey is the key loaded by SetKeyfile.
+var keyfileKey []byte
+
+// SetKeyfile loads the 32-byte key in the file at path, stored raw or as
+// 64 hex digits, for the "keyfile" KMS; "" forgets it.
+func SetKeyfile(path string) error {
+	if path == "" {
+		keyfileKey = nil
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(b) != 32 {
+		if b, err = hex.DecodeString(strings.TrimSpace(string(b))); err != nil || len(b) != 32 {
+			return fmt.Errorf("%s: not a 32-byte key (raw or 64 hex digits)", path)
+		}
+	}
+	keyfileKey = b
+	return nil
+}
+
+// keyfileID names a key file's key by the start of its SHA-256, so a wrong
+// key file is told apart from damaged data.
+func keyfileID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyfileKMS wraps data keys with AES-256-GCM under the key file's key.
+type keyfileKMS struct{}
+
+func (keyfileKMS) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(keyfileKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12, codec.SealOverhead+len(dataKey))
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (keyfileKMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyfileKey == nil {
+		return nil, fmt.Errorf("archive is encrypted with key file %s; pass -keyfile", keyID)
+	}
+	if id := keyfileID(keyfileKey); id != keyID {
+		return nil, verifyf("archive is encrypted with key file %s, not %s", keyID, id)
+	}
+	aead, err := newGCM(keyfileKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < codec.SealOverhead {
+		return nil, corruptf("wrapped key too short")
+	}
+	key, err := aead.Open(nil, wrapped[:12], wrapped[12:], []byte(keyID))
+	if err != nil {
+		return nil, corruptf("wrapped key does not decrypt")
+	}
+	return key, nil
+}
+
+// DefaultKMSCommand is the external command of the "exec" KMS, e.g. a
+// script around a cloud KMS client. It is run as "command wrap KEYID" with
+// the data key on standard input and must print the wrapped key, and as
+// "command unwrap KEYID" the other way round. Like DefaultExecCommand, it
+// is never taken from an archive.
+var DefaultKMSCommand string
+
+// SetKMSCommand sets the command of the "exec" KMS, checking that the
+// program exists.
+func SetKMSCommand(cmd string) error {
+	args := strings.Fields(cmd)
+	if len(args) > 0 {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("kms command: %w", err)
+		}
+	}
+	DefaultKMSCommand = strings.Join(args, " ")
+	return nil
+}
+
+type execKMS struct{}
+
+func (execKMS) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	return runKMS("wrap", keyID, dataKey)
+}
+
+func (execKMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	return runKMS("unwrap", keyID, wrapped)
+}
+
+func runKMS(op, keyID string, stdin []byte) ([]byte, error) {
+	if DefaultKMSCommand == "" {
+		return nil, fmt.Errorf("no KMS command set (use -kms-cmd)")
+	}
+	if keyID == "" || strings.ContainsAny(keyID, " \t\n") {
+		return nil, fmt.Errorf("invalid key id %q", keyID)
+	}
+	return runExec(DefaultKMSCommand+" "+op+" "+keyID, stdin)
+}
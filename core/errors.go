@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"syscall"
+
+	"proj3/core/codec"
+)
+
+// Errors that are about the data rather than the system wrap one of these,
+// so callers such as the CLI can tell them apart with errors.Is. They are
+// the errors of the codec package, which decodes the blocks.
+var (
+	// ErrCorrupt: an archive, stream or frame could not be parsed or
+	// decoded; it is damaged, truncated or not an archive at all.
+	ErrCorrupt = codec.ErrCorrupt
+	// ErrVerify: data decoded but does not match its checksum or hash, or
+	// two results that must agree (implementations, a delta's base) do not.
+	ErrVerify = codec.ErrVerify
+	// ErrLimitExceeded: a member is over one of codec.DefaultDecodeLimits.
+	ErrLimitExceeded = codec.ErrLimitExceeded
+)
+
+// errIO marks failures to read or write that are not system errors, such as
+// an HTTP error status; see IsIOError.
+var errIO = errors.New("i/o error")
+
+// kindError gives err one of the kinds above without changing its message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+func corruptf(format string, args ...interface{}) error {
+	return &kindError{ErrCorrupt, fmt.Errorf(format, args...)}
+}
+
+func verifyf(format string, args ...interface{}) error {
+	return &kindError{ErrVerify, fmt.Errorf(format, args...)}
+}
+
+func ioErrorf(format string, args ...interface{}) error {
+	return &kindError{errIO, fmt.Errorf(format, args...)}
+}
+
+// corrupt marks err, met while parsing or decoding an archive, as
+// ErrCorrupt. Failed I/O, cancellation, decode limits and errors that
+// already have a kind are left as they are.
+func corrupt(err error) error {
+	if err == nil || IsIOError(err) || errors.Is(err, ErrCorrupt) || errors.Is(err, ErrVerify) || errors.Is(err, ErrLimitExceeded) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &kindError{ErrCorrupt, err}
+}
+
+// IsIOError reports whether err is a failure of the system to read or write
+// a file, device or connection, rather than a problem with the data.
+func IsIOError(err error) bool {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var sysErr *os.SyscallError
+	var netErr net.Error
+	var errno syscall.Errno
+	return errors.Is(err, errIO) || errors.As(err, &pathErr) || errors.As(err, &linkErr) ||
+		errors.As(err, &sysErr) || errors.As(err, &netErr) || errors.As(err, &errno)
+}
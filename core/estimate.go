@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// Estimate is the projected outcome of compressing a file, extrapolated from
+// a sample of its blocks.
+type Estimate struct {
+	OriginalSize  int64
+	NumBlocks     int
+	SampledBlocks int
+	SampledBytes  int64
+	SampledComp   int64
+
+	CompressedSize int64         // projected payload size
+	SeqTime        time.Duration // projected single-threaded compression time
+}
+
+// Ratio returns original size / compressed size.
+func (e *Estimate) Ratio() float64 {
+	if e.CompressedSize == 0 {
+		return 0
+	}
+	return float64(e.OriginalSize) / float64(e.CompressedSize)
+}
+
+// EstimateFile compresses a random sample of about 1% of the blocks of
+// inputPath (at least 16) and extrapolates the compressed size and the time a
+// full run would take. No output is produced.
+func EstimateFile(inputPath string, threads int) (*Estimate, error) {
+	in, err := openFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("input is not a regular file")
+	}
+
+	originalSize := info.Size()
+	blockSize := int64(DefaultBlockSize)
+	numBlocks := int((originalSize + blockSize - 1) / blockSize)
+	est := &Estimate{OriginalSize: originalSize, NumBlocks: numBlocks}
+	if numBlocks == 0 {
+		return est, nil
+	}
+
+	sampled := numBlocks / 100
+	if sampled < 16 {
+		sampled = 16
+	}
+	if sampled > numBlocks {
+		sampled = numBlocks
+	}
+	// A fixed seed keeps repeated estimates of the same file comparable.
+	picks := rand.New(rand.NewSource(originalSize)).Perm(numBlocks)[:sampled]
+
+	var mu sync.Mutex
+	var busy time.Duration
+	err = codec.WSForEach(sampled, threads, func(i int) error {
+		idx := int64(picks[i])
+		n := blockSize
+		if idx == int64(numBlocks-1) {
+			n = originalSize - blockSize*idx
+		}
+		buf := make([]byte, n)
+		if _, err := in.ReadAt(buf, idx*blockSize); err != nil && err != io.EOF {
+			return fmt.Errorf("read block %d: %w", idx, err)
+		}
+
+		start := time.Now()
+		enc, err := codec.EncodeBlock(buf)
+		if err != nil {
+			return fmt.Errorf("compress block %d: %w", idx, err)
+		}
+		elapsed := time.Since(start)
+
+		mu.Lock()
+		est.SampledBytes += n
+		est.SampledComp += int64(len(enc))
+		busy += elapsed
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	est.SampledBlocks = sampled
+	scale := float64(originalSize) / float64(est.SampledBytes)
+	est.CompressedSize = int64(float64(est.SampledComp) * scale)
+	est.SeqTime = time.Duration(float64(busy) * scale)
+	return est, nil
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// DefaultExecCommand is the external compressor used by the exec codec, e.g.
+// "zstd -q -c" or "xz -c". Each block is piped through it on stdin and the
+// result read from stdout; decoding runs the same command with "-d"
+// appended, the convention shared by gzip, bzip2, xz and zstd.
+//
+// The command is recorded in the archive header for reference only: it is
+// never run unless the user passes it again, so opening an untrusted archive
+// cannot execute anything.
+var DefaultExecCommand string
+
+// SetExecCommand sets the external compressor command, checking that the
+// program exists.
+func SetExecCommand(cmd string) error {
+	args := strings.Fields(cmd)
+	if len(args) > 0 {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return fmt.Errorf("exec codec: %w", err)
+		}
+	}
+	DefaultExecCommand = strings.Join(args, " ")
+	return nil
+}
+
+func init() {
+	codec.RegisterCodec("exec", codec.BlockModeExec,
+		func(src []byte) ([]byte, error) {
+			return runExec(DefaultExecCommand, src)
+		},
+		func(payload []byte, size int) ([]byte, error) {
+			if DefaultExecCommand == "" {
+				return nil, fmt.Errorf("exec codec block: no command set (use -exec-cmd)")
+			}
+			out, err := runExec(DefaultExecCommand+" -d", payload)
+			if err != nil {
+				return nil, err
+			}
+			if len(out) != size {
+				return nil, fmt.Errorf("exec size mismatch: got %d, expected %d", len(out), size)
+			}
+			return out, nil
+		})
+}
+
+// runExec runs cmd with stdin as its standard input and returns its
+// standard output.
+func runExec(cmd string, stdin []byte) ([]byte, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("exec codec: empty command")
+	}
+	return runArgs(args, stdin)
+}
+
+// runArgs is runExec for a command already split into its arguments.
+func runArgs(args []string, stdin []byte) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("exec %q: %w: %s", cmd, err, msg)
+		}
+		return nil, fmt.Errorf("exec %q: %w", cmd, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,14 @@
+package core
+
+// ForkJoinCompressFile: the block range is split recursively; every half is
+// a task on the forking worker's deque, open to thieves.
+func ForkJoinCompressFile(inputPath, outputPath string, threads int) error {
+	return compressFile("fj", inputPath, outputPath, threads)
+}
+
+// ForkJoinDecompressFile decodes with recursive splitting of each window of
+// blocks. Concatenated members are decoded one after another into the same
+// output.
+func ForkJoinDecompressFile(compressedPath, outputPath string, threads int) error {
+	return decompressFile("fj", compressedPath, outputPath, threads)
+}
@@ -1,110 +1,96 @@
 package core
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-)
-
-var magic = [4]byte{'P', 'C', 'Z', '2'}
-
-type FileHeader struct {
-	Filename       string
-	OriginalSize   uint64
-	BlockSize      uint32
-	NumBlocks      uint64
-	BlockCompSizes []uint64
-}
-
-// WriteHeader writes the custom header (including block table) to w.
-func WriteHeader(w io.Writer, h *FileHeader) error {
-	if _, err := w.Write(magic[:]); err != nil {
-		return err
-	}
-
-	nameBytes := []byte(h.Filename)
-	if len(nameBytes) > 0xFFFF {
-		return fmt.Errorf("filename too long")
-	}
-	if err := binary.Write(w, binary.LittleEndian, uint16(len(nameBytes))); err != nil {
-		return err
-	}
-
-	if err := binary.Write(w, binary.LittleEndian, h.OriginalSize); err != nil {
-		return err
-	}
 
-	if _, err := w.Write(nameBytes); err != nil {
-		return err
-	}
+	"proj3/core/codec"
+)
 
-	if err := binary.Write(w, binary.LittleEndian, h.BlockSize); err != nil {
-		return err
+// IsArchive reports whether the file (or http(s) URL) at path starts with
+// the magic of an archive header. Shorter files are not archives.
+func IsArchive(path string) (bool, error) {
+	f, err := openFile(path)
+	if err != nil {
+		return false, err
 	}
-
-	if err := binary.Write(w, binary.LittleEndian, h.NumBlocks); err != nil {
-		return err
+	defer closeFile(f)
+	var m [4]byte
+	if _, err := io.ReadFull(f, m[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
 	}
+	return m == codec.Magic || m == codec.MagicFlags, nil
+}
 
-	if uint64(len(h.BlockCompSizes)) != h.NumBlocks {
-		return fmt.Errorf("block count mismatch")
+// readMemberHeader reads the header of the next member of a (possibly
+// concatenated) archive. Once at least one member has been read, a clean
+// end of input is reported as io.EOF. For streamed members it also reads
+// the payload and returns the trailer header. Members with an end marker
+// are checked for truncation up front (see codec.CheckEndMarker).
+func readMemberHeader(r io.Reader, member int) (*codec.FileHeader, error) {
+	h, err := readMemberLead(r, member)
+	if err != nil || h.Flags&codec.FlagTrailer == 0 {
+		return h, err
 	}
-	for i := uint64(0); i < h.NumBlocks; i++ {
-		if err := binary.Write(w, binary.LittleEndian, h.BlockCompSizes[i]); err != nil {
-			return err
-		}
+	if h, err = readStreamedMember(r, h); err != nil {
+		return nil, memberHeaderError(member, err)
 	}
-
-	return nil
+	return h, checkMemberEnd(r, member, h, true)
 }
 
-// ReadHeader reads and validates the header (including block table).
-func ReadHeader(r io.Reader) (*FileHeader, error) {
-	var m [4]byte
-	if _, err := io.ReadFull(r, m[:]); err != nil {
-		return nil, err
+// readMemberLead is readMemberHeader, except that a streamed member is
+// left unread: its leading header is returned, with r at its first frame
+// (see decompressStreamed).
+func readMemberLead(r io.Reader, member int) (*codec.FileHeader, error) {
+	h, err := codec.ReadHeader(r)
+	if err != nil && member > 0 {
+		if err = trailingData(member, err); err == io.EOF {
+			return nil, io.EOF
+		}
 	}
-	if m != magic {
-		return nil, fmt.Errorf("invalid magic")
+	if err != nil {
+		return nil, memberHeaderError(member, err)
 	}
-
-	var nameLen uint16
-	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
-		return nil, err
+	if h.Flags&codec.FlagTrailer != 0 {
+		return h, nil
 	}
+	return h, checkMemberEnd(r, member, h, false)
+}
 
-	var originalSize uint64
-	if err := binary.Read(r, binary.LittleEndian, &originalSize); err != nil {
-		return nil, err
+func memberHeaderError(member int, err error) error {
+	if member > 0 {
+		return corrupt(fmt.Errorf("member %d: read header: %w", member, err))
 	}
+	return corrupt(fmt.Errorf("read header: %w", err))
+}
 
-	nameBytes := make([]byte, nameLen)
-	if _, err := io.ReadFull(r, nameBytes); err != nil {
-		return nil, err
+// checkMemberEnd checks the end marker of member h, whose header has just
+// been read from r (the trailer, if streamed), and runs codec.CheckStrict on it.
+func checkMemberEnd(r io.Reader, member int, h *codec.FileHeader, streamed bool) error {
+	var err error
+	if h.Flags&codec.FlagEndMarker != 0 {
+		err = codec.CheckEndMarker(r, h, streamed)
 	}
-
-	var blockSize uint32
-	if err := binary.Read(r, binary.LittleEndian, &blockSize); err != nil {
-		return nil, err
+	if err == nil {
+		err = codec.CheckStrict(h)
 	}
-
-	var numBlocks uint64
-	if err := binary.Read(r, binary.LittleEndian, &numBlocks); err != nil {
-		return nil, err
+	if err != nil && member > 0 {
+		return fmt.Errorf("member %d: %w", member, err)
 	}
+	return err
+}
 
-	blockSizes := make([]uint64, numBlocks)
-	for i := uint64(0); i < numBlocks; i++ {
-		if err := binary.Read(r, binary.LittleEndian, &blockSizes[i]); err != nil {
-			return nil, err
-		}
+// trailingData is what readMemberHeader returns when the bytes after the
+// last member are not a member, err being why the header did not parse:
+// the error itself, or io.EOF once lenient has warned about it.
+func trailingData(member int, err error) error {
+	if codec.DefaultParse != codec.ParseLenient || !errors.Is(err, ErrCorrupt) {
+		return err
 	}
-
-	return &FileHeader{
-		Filename:       string(nameBytes),
-		OriginalSize:   originalSize,
-		BlockSize:      blockSize,
-		NumBlocks:      numBlocks,
-		BlockCompSizes: blockSizes,
-	}, nil
+	codec.Warnf("warning: ignoring trailing data after member %d: %v (-parse lenient)", member-1, err)
+	return io.EOF
 }
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"proj3/core/codec"
+)
+
+// GrepHit is a line of an archive's contents matching a pattern.
+type GrepHit struct {
+	Member int    // member of the archive
+	Name   string // tar entry holding the line, or the member's file name
+	Line   int64  // 1-based line number within Name
+	Offset int64  // of the line's first byte, within Name
+	Text   []byte // the line, without its newline
+}
+
+// grepMaxLine bounds a line assembled from pieces without a newline; longer
+// lines (binary data, mostly) are skipped with a warning.
+const grepMaxLine = 64 << 20
+
+// grepPiece is the part of a block that lies in one searched unit: a tar
+// entry, or the whole member. A worker keeps the lines wholly inside it that
+// match, and the partial lines at its ends for the sequential pass to join
+// with its neighbours.
+type grepPiece struct {
+	unit   int   // index in the member's units
+	lo, hi int64 // member offsets
+
+	newlines int64
+	head     []byte // up to and including the first newline; all of a piece without one
+	tail     []byte // after the last newline
+	hits     []grepLocal
+}
+
+// grepLocal is a match in a line wholly inside a piece.
+type grepLocal struct {
+	off  int64 // in the piece
+	nl   int64 // newlines in the piece before it
+	text []byte
+}
+
+// grepUnit is a range of a member whose lines are numbered from 1: a tar
+// entry, or the whole member.
+type grepUnit struct {
+	name  string
+	start int64
+}
+
+// GrepFile searches the contents of the archive at archivePath line by line
+// for re, without writing them anywhere, and calls fn for every matching
+// line in order. Blocks are decoded and searched in parallel by the
+// scheduler named by impl; lines crossing block boundaries are put back
+// together afterwards. In archives made with -mode tar, every tar entry is
+// searched on its own and lines and offsets count from its start; otherwise
+// they count from the start of each member.
+func GrepFile(archivePath string, re *regexp.Regexp, impl string, threads int, fn func(GrepHit)) error {
+	// Searching a whole piece needs ^ and $ to match at line boundaries;
+	// candidates are then checked against their line with re itself.
+	search, err := regexp.Compile("(?m:" + re.String() + ")")
+	if err != nil {
+		return err
+	}
+
+	in, err := openFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("open archive: %w", err)
+	}
+	defer closeFile(in)
+
+	for member := 0; ; member++ {
+		h, err := readMemberHeader(in, member)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		payload, closeVolumes, err := openPayload(in, archivePath, h)
+		if err != nil {
+			return err
+		}
+		err = grepMember(payload, member, h, re, search, impl, threads, fn)
+		closeVolumes()
+		if err != nil {
+			if member > 0 {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+			return err
+		}
+	}
+}
+
+// grepMember searches one member.
+func grepMember(in io.Reader, member int, h *codec.FileHeader, re, search *regexp.Regexp, impl string, threads int, fn func(GrepHit)) error {
+	if h.OriginalSize == 0 || h.NumBlocks == 0 {
+		return nil
+	}
+	numBlocks := int(h.NumBlocks)
+	offs := h.RawOffsets()
+	comps, err := readBlocks(in, h)
+	if err != nil {
+		return err
+	}
+	decode, err := blockDecoder(h, comps, impl, threads)
+	if err != nil {
+		return err
+	}
+
+	units, pieces := grepPieces(h, offs)
+	byBlock := make([][]int, numBlocks)
+	for i := range pieces {
+		b := sort.Search(numBlocks, func(b int) bool { return offs[b+1] > pieces[i].lo })
+		byBlock[b] = append(byBlock[b], i)
+	}
+
+	// The partial lines are joined and everything numbered in order, by
+	// the closures below.
+	unit := -1
+	var carry []byte // the line so far
+	carryOff, nl := int64(0), int64(0)
+	tooLong := false
+	line := func(text []byte) {
+		if tooLong {
+			codec.Warnf("%s: line at offset %d is longer than %d bytes; not searched", units[unit].name, carryOff, grepMaxLine)
+		} else if re.Match(text) {
+			fn(GrepHit{Member: member, Name: units[unit].name, Line: nl + 1, Offset: carryOff, Text: text})
+		}
+	}
+	join := func(p *grepPiece) {
+		if p.unit != unit {
+			if unit >= 0 && (len(carry) > 0 || tooLong) {
+				line(carry) // last line, without a newline
+			}
+			unit, carry, carryOff, nl, tooLong = p.unit, nil, 0, 0, false
+		}
+		if len(carry)+len(p.head) > grepMaxLine {
+			tooLong = true
+		}
+		if !tooLong {
+			carry = append(carry, p.head...)
+		}
+		if p.newlines == 0 {
+			return // the line goes on into the next piece
+		}
+		line(bytes.TrimSuffix(carry, []byte{'\n'}))
+
+		base := p.lo - units[unit].start
+		for _, l := range p.hits {
+			// Newlines before the hit: those before the piece, the one
+			// ending its head, and those between.
+			before := nl + 1 + l.nl
+			fn(GrepHit{Member: member, Name: units[unit].name, Line: before + 1, Offset: base + l.off, Text: l.text})
+		}
+		nl += p.newlines
+		carry, tooLong = append([]byte(nil), p.tail...), false
+		carryOff = p.hi - units[unit].start - int64(len(p.tail))
+	}
+
+	// Blocks are searched a window at a time, so memory stays at a few
+	// blocks per worker however long the member and its lines are.
+	window := inFlight(threads)
+	for w := 0; w < numBlocks; w += window {
+		n := numBlocks - w
+		if n > window {
+			n = window
+		}
+		err = codec.ForEachBlock(impl, n, threads, func(k int) error {
+			idx := w + k
+			if len(byBlock[idx]) == 0 {
+				return nil
+			}
+			dec, err := decode(idx)
+			if err != nil {
+				return fmt.Errorf("decompress block %d: %w", idx, err)
+			}
+			for _, i := range byBlock[idx] {
+				p := &pieces[i]
+				p.scan(dec[p.lo-offs[idx]:p.hi-offs[idx]], re, search)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for idx := w; idx < w+n; idx++ {
+			for _, i := range byBlock[idx] {
+				join(&pieces[i])
+				pieces[i].head, pieces[i].tail, pieces[i].hits = nil, nil, nil
+			}
+		}
+	}
+	if unit >= 0 && (len(carry) > 0 || tooLong) {
+		line(carry)
+	}
+	return nil
+}
+
+// grepPieces splits the member h into the units searched on their own and
+// cuts those at block boundaries.
+func grepPieces(h *codec.FileHeader, offs []int64) ([]grepUnit, []grepPiece) {
+	var units []grepUnit
+	var pieces []grepPiece
+	add := func(name string, start, end int64) {
+		u := len(units)
+		units = append(units, grepUnit{name: name, start: start})
+		b := sort.Search(int(h.NumBlocks), func(b int) bool { return offs[b+1] > start })
+		for ; start < end; b++ {
+			hi := offs[b+1]
+			if hi > end {
+				hi = end
+			}
+			pieces = append(pieces, grepPiece{unit: u, lo: start, hi: hi})
+			start = hi
+		}
+	}
+	if h.Flags&codec.FlagTarIndex == 0 {
+		add(h.Filename, 0, int64(h.OriginalSize))
+		return units, pieces
+	}
+	entries := append([]codec.TarEntry(nil), h.TarEntries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	next := int64(0)
+	for _, e := range entries {
+		start, end := int64(e.Offset), int64(e.Offset+e.Size)
+		if start < next || end > int64(h.OriginalSize) {
+			continue // overlapping or out of range: not from scanTar
+		}
+		add(e.Name, start, end)
+		next = end
+	}
+	return units, pieces
+}
+
+// scan searches dec, the bytes of p, for lines wholly inside it that match.
+func (p *grepPiece) scan(dec []byte, re, search *regexp.Regexp) {
+	first := bytes.IndexByte(dec, '\n') + 1
+	if first == 0 {
+		p.head = append([]byte(nil), dec...)
+		return
+	}
+	last := bytes.LastIndexByte(dec, '\n') + 1
+	p.newlines = int64(bytes.Count(dec, []byte{'\n'}))
+	p.head = append([]byte(nil), dec[:first]...)
+	p.tail = append([]byte(nil), dec[last:]...)
+
+	nl, counted := int64(0), first
+	for pos := first; pos < last; {
+		loc := search.FindIndex(dec[pos:last])
+		if loc == nil || pos+loc[0] == last {
+			return
+		}
+		s := bytes.LastIndexByte(dec[:pos+loc[0]], '\n') + 1
+		if s < pos {
+			s = pos
+		}
+		e := s + bytes.IndexByte(dec[s:], '\n')
+		if re.Match(dec[s:e]) {
+			nl += int64(bytes.Count(dec[counted:s], []byte{'\n'}))
+			counted = s
+			p.hits = append(p.hits, grepLocal{off: int64(s), nl: nl, text: append([]byte(nil), dec[s:e]...)})
+		}
+		pos = e + 1
+	}
+}
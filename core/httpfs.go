@@ -0,0 +1,300 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// ArchiveFS serves the contents of a .pcz archive as an http.FileSystem:
+// every regular file of a .tar.pcz, or the single file of a plain archive.
+// Files are io.ReadSeekers over the archive's block index, so range
+// requests only decode the blocks they touch. Only the first member of a
+// concatenated archive is served.
+type ArchiveFS struct {
+	f       *ioFile
+	h       *codec.FileHeader
+	data    int64   // offset of the first block in f
+	offs    []int64 // uncompressed block offsets
+	comp    []int64 // compressed block offsets, relative to data
+	modTime time.Time
+	files   map[string]codec.TarEntry // cleaned, rooted path -> span of the member
+	dirs    map[string][]string       // cleaned, rooted path -> child names
+	cache   *blockCache
+}
+
+// OpenArchiveFS opens the archive at archivePath for serving.
+func OpenArchiveFS(archivePath string) (*ArchiveFS, error) {
+	f, err := openFile(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	a, err := newArchiveFS(f)
+	if err != nil {
+		closeFile(f)
+		return nil, err
+	}
+	return a, nil
+}
+
+func newArchiveFS(f *ioFile) (*ArchiveFS, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat input: %w", err)
+	}
+	h, err := readMemberHeader(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := blockReadable(h); err != nil {
+		return nil, err
+	}
+	data, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ArchiveFS{
+		f:       f,
+		h:       h,
+		data:    data,
+		offs:    h.RawOffsets(),
+		comp:    h.CompOffsets(),
+		modTime: info.ModTime(),
+		files:   map[string]codec.TarEntry{},
+		dirs:    map[string][]string{"/": nil},
+		cache:   newBlockCache(DefaultBlockCacheSize),
+	}
+	if h.Flags&codec.FlagTarIndex != 0 {
+		// Later entries replace earlier ones, as when tar extracts.
+		for _, e := range h.TarEntries {
+			if p, err := memberPath(e.Name); err == nil {
+				a.files["/"+p] = e
+			}
+		}
+	} else {
+		name := path.Base("/" + h.Filename)
+		if name == "/" {
+			name = "data"
+		}
+		a.files["/"+name] = codec.TarEntry{Name: name, Size: h.OriginalSize}
+	}
+	// Every ancestor of a file is a directory listing the next path element.
+	seen := map[string]bool{}
+	for p := range a.files {
+		for p != "/" && !seen[p] {
+			seen[p] = true
+			dir := path.Dir(p)
+			a.dirs[dir] = append(a.dirs[dir], path.Base(p))
+			p = dir
+		}
+	}
+	for _, names := range a.dirs {
+		sort.Strings(names)
+	}
+	return a, nil
+}
+
+// blockReadable fails for a member whose blocks cannot be read one at a
+// time, up front, rather than on the first read of a block: readers of an
+// ArchiveFS such as http.FileServer may have sent their headers by then.
+func blockReadable(h *codec.FileHeader) error {
+	switch {
+	case h.Flags&(codec.FlagVolumes|codec.FlagDelta) != 0:
+		return fmt.Errorf("multi-volume archives and delta patches cannot be served")
+	case h.Flags&codec.FlagChained != 0:
+		return fmt.Errorf("blocks of a chained member only decode in order; it cannot be served")
+	case h.Flags&codec.FlagStore != 0 && DefaultStore == "":
+		return fmt.Errorf("archive keeps its blocks in a block store; pass -store to read it")
+	case h.Flags&codec.FlagExec != 0 && DefaultExecCommand == "":
+		return fmt.Errorf("archive was compressed with %q; pass -exec-cmd to decode it", h.ExecCommand)
+	}
+	if h.Flags&codec.FlagTransform != 0 {
+		if _, err := memberTransform(h); err != nil {
+			return err
+		}
+	}
+	if h.Flags&codec.FlagEncrypted != 0 {
+		if _, err := memberKey(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CacheStats reports how well the decoded block cache has served reads.
+func (a *ArchiveFS) CacheStats() CacheStats {
+	return a.cache.snapshot()
+}
+
+// Close releases the archive.
+func (a *ArchiveFS) Close() error {
+	return closeFile(a.f)
+}
+
+// block returns the decoded block i, from the cache when possible.
+func (a *ArchiveFS) block(i int) ([]byte, error) {
+	if dec, ok := a.cache.get(i); ok {
+		return dec, nil
+	}
+
+	comp, err := readBlockAt(a.f, a.h, a.data, a.comp, i)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := decodeMemberBlock(a.h, i, comp, int(a.offs[i+1]-a.offs[i]))
+	if err != nil {
+		return nil, fmt.Errorf("decompress block %d: %w", i, err)
+	}
+	// Fill in long-range references from their sources, which all lie
+	// before the block and so never lead back to it.
+	start, end := uint64(a.offs[i]), uint64(a.offs[i+1])
+	for _, r := range a.h.LongRange {
+		s, e := r.Dst, r.Dst+r.Len
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		if s >= e {
+			continue
+		}
+		if _, err := a.ReadAt(dec[s-start:e-start], int64(r.Src+s-r.Dst)); err != nil {
+			return nil, fmt.Errorf("block %d: long-range source: %w", i, err)
+		}
+	}
+	a.cache.put(i, dec)
+	return dec, nil
+}
+
+// ReadAt reads the uncompressed bytes of the archive's member at off.
+func (a *ArchiveFS) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(a.h.OriginalSize)
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	n := 0
+	// First block holding off.
+	i := sort.Search(int(a.h.NumBlocks), func(i int) bool { return a.offs[i+1] > off })
+	for n < len(p) && off < size {
+		dec, err := a.block(i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], dec[off-a.offs[i]:])
+		n += c
+		off += int64(c)
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Open implements http.FileSystem.
+func (a *ArchiveFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if e, ok := a.files[name]; ok {
+		return &archiveFile{
+			SectionReader: io.NewSectionReader(a, int64(e.Offset), int64(e.Size)),
+			info:          archiveFileInfo{name: path.Base(name), size: int64(e.Size), modTime: a.modTime},
+		}, nil
+	}
+	if names, ok := a.dirs[name]; ok {
+		d := &archiveDir{info: archiveFileInfo{name: path.Base(name), modTime: a.modTime, dir: true}}
+		for _, n := range names {
+			child := path.Join(name, n)
+			if e, ok := a.files[child]; ok {
+				d.entries = append(d.entries, archiveFileInfo{name: n, size: int64(e.Size), modTime: a.modTime})
+			} else {
+				d.entries = append(d.entries, archiveFileInfo{name: n, modTime: a.modTime, dir: true})
+			}
+		}
+		return d, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// archiveFileInfo describes a file or directory of an ArchiveFS.
+type archiveFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i archiveFileInfo) Name() string       { return i.name }
+func (i archiveFileInfo) Size() int64        { return i.size }
+func (i archiveFileInfo) ModTime() time.Time { return i.modTime }
+func (i archiveFileInfo) IsDir() bool        { return i.dir }
+func (i archiveFileInfo) Sys() interface{}   { return nil }
+
+func (i archiveFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+// archiveFile is an open file of an ArchiveFS.
+type archiveFile struct {
+	*io.SectionReader
+	info archiveFileInfo
+}
+
+func (f *archiveFile) Close() error               { return nil }
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *archiveFile) Readdir(int) ([]fs.FileInfo, error) {
+	return nil, fmt.Errorf("%s: not a directory", f.info.name)
+}
+
+// archiveDir is an open directory of an ArchiveFS.
+type archiveDir struct {
+	info    archiveFileInfo
+	entries []archiveFileInfo
+	pos     int
+}
+
+func (d *archiveDir) Close() error               { return nil }
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("%s: is a directory", d.info.name)
+}
+
+func (d *archiveDir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		d.pos = 0
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%s: is a directory", d.info.name)
+}
+
+// Readdir follows os.File.Readdir: count > 0 returns at most count entries
+// and io.EOF at the end, otherwise all remaining entries.
+func (d *archiveDir) Readdir(count int) ([]fs.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if len(rest) > count {
+			rest = rest[:count]
+		}
+	}
+	d.pos += len(rest)
+	infos := make([]fs.FileInfo, len(rest))
+	for i := range rest {
+		infos[i] = rest[i]
+	}
+	return infos, nil
+}
@@ -0,0 +1,282 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// DefaultHTTPParallel is how many ranged requests fetch an http(s) input at
+// once, a block each. With 1, or when the server does not announce byte
+// ranges and a length, the input is one plain GET.
+var DefaultHTTPParallel = 1
+
+func SetHTTPParallel(n int) error {
+	if n < 1 {
+		return fmt.Errorf("parallel fetches must be at least 1")
+	}
+	DefaultHTTPParallel = n
+	return nil
+}
+
+// isURL reports whether an input path is an http(s) URL. Such inputs are
+// streamed: compressed like standard input, or decompressed from the
+// download as it comes in, with no local copy.
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// urlName is the file name recorded for a URL input: the last element of
+// its path.
+func urlName(u string) string {
+	if parsed, err := url.Parse(u); err == nil && parsed.Path != "" && parsed.Path != "/" {
+		return path.Base(parsed.Path)
+	}
+	return "download"
+}
+
+// Downloads survive dropped connections: a broken body or a failed range
+// is requested again from the first byte not yet received, with the same
+// attempts and growing pauses as SendFile. Every such request carries
+// If-Range with the resource's validator (its ETag, or else Last-Modified),
+// so a resource changed in the meantime fails the download instead of
+// splicing two versions together. Without a validator there is no resuming.
+
+// errChanged is returned when a resumed download finds a different resource.
+var errChanged = errors.New("resource changed during download")
+
+// openURL starts downloading u and returns a file reading the body in order
+// as it arrives.
+func openURL(u string) (*ioFile, error) {
+	if DefaultHTTPParallel > 1 {
+		if size, validator, ok := rangeSize(u); ok {
+			return &ioFile{src: fetchRanges(u, size, validator)}, nil
+		}
+	}
+	resp, err := getWhole(u)
+	err = retryTransient("GET "+u, err, func() error {
+		resp, err = getWhole(u)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ioFile{src: &httpBody{url: u, body: resp.Body, validator: validatorOf(resp)}}, nil
+}
+
+// getWhole GETs all of u.
+func getWhole(u string) (*http.Response, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, statusError("GET "+u, resp)
+	}
+	return resp, nil
+}
+
+// validatorOf returns the validator of a response for If-Range, or "".
+// Weak ETags cannot be used there.
+func validatorOf(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// rangeSize returns the length and validator of u if the server serves byte
+// ranges of it.
+func rangeSize(u string) (int64, string, bool) {
+	resp, err := http.Head(u)
+	if err != nil {
+		return 0, "", false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return 0, "", false
+	}
+	return resp.ContentLength, validatorOf(resp), true
+}
+
+// httpBody is the body of a plain GET that resumes where it broke off.
+type httpBody struct {
+	url       string
+	body      io.ReadCloser
+	off       int64
+	validator string
+	err       error // sticky, once resuming failed
+}
+
+func (b *httpBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	b.off += int64(n)
+	if err == nil || err == io.EOF || b.validator == "" {
+		return n, err
+	}
+	b.body.Close()
+	delay := DefaultRetry.Delay
+	for attempt := 1; attempt < DefaultRetry.Attempts; attempt++ {
+		if err = retryWait(&delay); err != nil {
+			break
+		}
+		resp, rerr := getRange(b.url, b.off, -1, b.validator)
+		if rerr == nil {
+			b.body = resp.Body
+			return n, nil
+		}
+		if err = rerr; err == errChanged || isPermanent(err) {
+			break
+		}
+	}
+	b.body = nil
+	b.err = fmt.Errorf("GET %s at byte %d: %w", b.url, b.off, err)
+	return n, b.err
+}
+
+func (b *httpBody) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+// retryWait sleeps for delay, or until the run is cancelled, and doubles
+// delay for the next time.
+func retryWait(delay *time.Duration) error {
+	t := time.NewTimer(*delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-codec.Context().Done():
+		return codec.Context().Err()
+	}
+	if *delay *= 2; *delay > DefaultRetry.MaxDelay {
+		*delay = DefaultRetry.MaxDelay
+	}
+	return nil
+}
+
+// getRange requests the bytes of u from start up to end, or to the end of
+// the resource if end is negative, and checks they are what was asked for.
+func getRange(u string, start, end int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	}
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && validator != "" {
+			return nil, errChanged
+		}
+		return nil, statusError("", resp)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+		resp.Body.Close()
+		return nil, ioErrorf("server sent the wrong range")
+	}
+	return resp, nil
+}
+
+// fetchRanges downloads the size bytes of u in blocks of DefaultBlockSize
+// with DefaultHTTPParallel ranged requests at a time, and returns a reader
+// of them in order. Blocks are handed out in order and at most twice as
+// many as there are fetchers wait to be read, so memory stays bounded
+// however large the download.
+func fetchRanges(u string, size int64, validator string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	chunk := int64(DefaultBlockSize)
+	n := int((size + chunk - 1) / chunk)
+	ow := NewOrderedWriter(pw, 2*DefaultHTTPParallel)
+	var next int64
+	var wg sync.WaitGroup
+	for w := 0; w < DefaultHTTPParallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1) - 1)
+				if i >= n {
+					return
+				}
+				start := int64(i) * chunk
+				end := start + chunk
+				if end > size {
+					end = size
+				}
+				data, err := fetchRange(u, start, end, validator)
+				if err == nil {
+					err = ow.WriteIndex(i, data)
+				}
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		pw.CloseWithError(ow.Close(n))
+	}()
+	return pr
+}
+
+// fetchRange GETs the bytes [start, end) of u, resuming after a partial
+// read and retrying failed requests, unless the server's answer says
+// asking again will not help.
+func fetchRange(u string, start, end int64, validator string) ([]byte, error) {
+	data := make([]byte, end-start)
+	got := int64(0)
+	delay := DefaultRetry.Delay
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = getRange(u, start+got, end, validator)
+		if err == nil {
+			var n int
+			n, err = io.ReadFull(resp.Body, data[got:])
+			resp.Body.Close()
+			got += int64(n)
+			if err == nil {
+				return data, nil
+			}
+			err = noEOF(err)
+		}
+		if err == errChanged || isPermanent(err) || attempt >= DefaultRetry.Attempts {
+			break
+		}
+		if validator == "" {
+			got = 0 // nothing says the rest would match
+		}
+		if werr := retryWait(&delay); werr != nil {
+			return nil, werr
+		}
+	}
+	return nil, fmt.Errorf("GET %s bytes %d-%d: %w", u, start, end-1, err)
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// IncrementalCompressFile recompresses inputPath into outputPath, reusing the
+// compressed blocks of the archive already at outputPath. Each block of the
+// input is hashed and compared with the SHA-256 stored for the same block of
+// the previous archive: matching blocks are copied over as-is, and only
+// changed, grown or new blocks are compressed again. Appending to a log thus
+// costs one block plus the tail, and a small in-place edit costs the blocks
+// it touches. The new archive always records block hashes so the next run can
+// do the same. The new archive is written under a temporary name and only
+// replaces the previous one once complete (see createAtomic), so a failed
+// or interrupted update keeps the old archive. It returns the number of
+// blocks that were reused.
+func IncrementalCompressFile(inputPath, outputPath, impl string, threads int) (int, error) {
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return 0, fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("input is not a regular file")
+	}
+
+	prev, prevBlocks, err := loadPreviousArchive(outputPath)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := readFile(inputPath)
+	if err != nil {
+		return 0, fmt.Errorf("read input: %w", err)
+	}
+	originalSize := len(data)
+
+	blockSize := int(DefaultBlockSize)
+	candidates := 0
+	if prev != nil {
+		// Keep the previous block size so old block boundaries line up.
+		blockSize = int(prev.BlockSize)
+		candidates = reusableBlocks(prev)
+	}
+
+	numBlocks := (originalSize + blockSize - 1) / blockSize
+	blocks := make([][]byte, numBlocks)
+	for i := 0; i < numBlocks; i++ {
+		s := i * blockSize
+		e := s + blockSize
+		if e > originalSize {
+			e = originalSize
+		}
+		blocks[i] = data[s:e]
+	}
+
+	set := newBlockSet(numBlocks)
+	set.detect(info.Name())
+	if set.hashes == nil {
+		set.hashes = make([][32]byte, numBlocks)
+	}
+	reused := make([]bool, numBlocks)
+	wait := set.hashInput(data)
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		if idx < candidates {
+			// The hash covers the block length too, so a grown or
+			// truncated last block never matches.
+			sum := sha256.Sum256(blocks[idx])
+			if sum == prev.BlockHashes[idx] {
+				set.set(idx, len(blocks[idx]), prevBlocks[idx])
+				if set.tsizes != nil {
+					set.tsizes[idx] = prev.TransformSizes[idx]
+				}
+				set.hashes[idx] = sum
+				reused[idx] = true
+				return nil
+			}
+		}
+		return set.encode(idx, blocks[idx])
+	})
+	wait()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, r := range reused {
+		if r {
+			count++
+		}
+	}
+
+	header := set.header(info.Name(), uint64(originalSize), uint32(blockSize))
+	if err := writeArchive(outputPath, header, set.enc); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// reusableBlocks returns how many leading blocks of the member described by
+// prev may be reused under the current settings: all of them, or none.
+func reusableBlocks(prev *codec.FileHeader) int {
+	// Old blocks were encoded with the old pre-filter; they are only
+	// reusable when it is still the one in effect.
+	if prev.Filter != codec.DefaultFilter {
+		return 0
+	}
+	// Variable-size blocks (tar archives) do not line up with fixed ones.
+	if !prev.FixedBlocks() {
+		return 0
+	}
+	// Blocks with long-range references depend on the rest of the file.
+	if prev.Flags&codec.FlagLongRange != 0 {
+		return 0
+	}
+	// Transformed blocks need the same transform to decode.
+	if prev.Transform != DefaultTransform {
+		return 0
+	}
+	// Encrypted blocks are sealed under the data key of their run.
+	if prev.Flags&codec.FlagEncrypted != 0 || encryption != nil {
+		return 0
+	}
+	// Likewise, exec codec blocks need the same command to decode.
+	if prev.Flags&codec.FlagExec != 0 && prev.ExecCommand != DefaultExecCommand {
+		return 0
+	}
+	return int(prev.NumBlocks)
+}
+
+// loadPreviousArchive reads the header and compressed blocks of the archive
+// at path. It returns a nil header when there is nothing to reuse: the file
+// does not exist, or it was written without block hashes.
+func loadPreviousArchive(path string) (*codec.FileHeader, [][]byte, error) {
+	in, err := openFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("open previous archive: %w", err)
+	}
+	defer closeFile(in)
+
+	h, err := readMemberHeader(in, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("previous archive: %w", err)
+	}
+	if h.Flags&codec.FlagBlockHashes == 0 {
+		return nil, nil, nil
+	}
+
+	payload, closeVolumes, err := openPayload(in, path, h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("previous archive: %w", err)
+	}
+	defer closeVolumes()
+	blocks, err := readBlocks(payload, h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("previous archive: %w", err)
+	}
+
+	if _, err := codec.ReadHeader(in); err != io.EOF {
+		return nil, nil, fmt.Errorf("previous archive has several members; incremental update needs a single one")
+	}
+	return h, blocks, nil
+}
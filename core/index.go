@@ -0,0 +1,388 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// indexVersion is the Version of the sidecars ExportIndex writes.
+const indexVersion = 1
+
+// ArchiveIndex is the JSON sidecar written by ExportIndex: every header of
+// an archive, field for field, where each member's payload starts and its
+// block table. External indexers can find any block from it without
+// parsing the format, and RebuildArchive puts the archive back together
+// from it when the headers themselves are damaged.
+type ArchiveIndex struct {
+	Version int
+	Archive string // path the index was exported from
+	Size    int64  // of the archive file
+	Members []IndexMember
+}
+
+// IndexMember is one member of an ArchiveIndex. Blocks are informational;
+// RebuildArchive only needs Data, Streamed and Header.
+type IndexMember struct {
+	Offset   int64 // of the header in the archive
+	Data     int64 // of the payload, or of the first frame of a streamed member
+	Streamed bool  `json:",omitempty"`
+	Header   IndexHeader
+	Blocks   []BlockInfo
+}
+
+// IndexHeader holds the fields of a FileHeader, with hashes, keys and the
+// wrapped data key in hex. The block count is len(BlockCompSizes).
+type IndexHeader struct {
+	Filename       string
+	OriginalSize   uint64
+	BlockSize      uint32
+	BlockCompSizes []uint64
+	Flags          uint32
+	VolumeSize     uint64               `json:",omitempty"`
+	BlockVolumes   []uint32             `json:",omitempty"`
+	BlockHashes    []string             `json:",omitempty"`
+	BaseSize       uint64               `json:",omitempty"`
+	BaseHash       string               `json:",omitempty"`
+	Filter         *codec.BlockFilter   `json:",omitempty"`
+	ExecCommand    string               `json:",omitempty"`
+	BlockSizes     []uint32             `json:",omitempty"`
+	TarEntries     []codec.TarEntry     `json:",omitempty"`
+	BlockKeys      []string             `json:",omitempty"`
+	Align          uint32               `json:",omitempty"`
+	BlockOffsets   []uint64             `json:",omitempty"`
+	LongRange      []codec.LongRangeRef `json:",omitempty"`
+	Transform      string               `json:",omitempty"`
+	TransformSizes []uint32             `json:",omitempty"`
+	KMS            string               `json:",omitempty"`
+	KeyID          string               `json:",omitempty"`
+	WrappedKey     string               `json:",omitempty"`
+	Member         uint64               `json:",omitempty"`
+	Manifest       string               `json:",omitempty"`
+	SHA256         string               `json:",omitempty"`
+}
+
+func newIndexHeader(h *codec.FileHeader) IndexHeader {
+	x := IndexHeader{
+		Filename:       h.Filename,
+		OriginalSize:   h.OriginalSize,
+		BlockSize:      h.BlockSize,
+		BlockCompSizes: h.BlockCompSizes,
+		Flags:          h.Flags,
+		VolumeSize:     h.VolumeSize,
+		BlockVolumes:   h.BlockVolumes,
+		BaseSize:       h.BaseSize,
+		ExecCommand:    h.ExecCommand,
+		BlockSizes:     h.BlockSizes,
+		TarEntries:     h.TarEntries,
+		Align:          h.Align,
+		BlockOffsets:   h.BlockOffsets,
+		LongRange:      h.LongRange,
+		Transform:      h.Transform,
+		TransformSizes: h.TransformSizes,
+		KMS:            h.KMS,
+		KeyID:          h.KeyID,
+		WrappedKey:     hex.EncodeToString(h.WrappedKey),
+		Member:         h.Member,
+		Manifest:       h.Manifest,
+		BlockHashes:    hexHashes(h.BlockHashes),
+		BlockKeys:      hexHashes(h.BlockKeys),
+	}
+	if h.Flags&codec.FlagDelta != 0 {
+		x.BaseHash = hex.EncodeToString(h.BaseHash[:])
+	}
+	if h.Flags&codec.FlagFilter != 0 {
+		f := h.Filter
+		x.Filter = &f
+	}
+	if h.Flags&codec.FlagSHA256 != 0 {
+		x.SHA256 = hex.EncodeToString(h.SHA256[:])
+	}
+	return x
+}
+
+// fileHeader turns x back into a header, checking it the way ReadHeader
+// checks one read from an archive.
+func (x *IndexHeader) fileHeader() (*codec.FileHeader, error) {
+	h := &codec.FileHeader{
+		Filename:       x.Filename,
+		OriginalSize:   x.OriginalSize,
+		BlockSize:      x.BlockSize,
+		NumBlocks:      uint64(len(x.BlockCompSizes)),
+		BlockCompSizes: x.BlockCompSizes,
+		Flags:          x.Flags,
+		VolumeSize:     x.VolumeSize,
+		BlockVolumes:   x.BlockVolumes,
+		BaseSize:       x.BaseSize,
+		ExecCommand:    x.ExecCommand,
+		BlockSizes:     x.BlockSizes,
+		TarEntries:     x.TarEntries,
+		Align:          x.Align,
+		BlockOffsets:   x.BlockOffsets,
+		LongRange:      x.LongRange,
+		Transform:      x.Transform,
+		TransformSizes: x.TransformSizes,
+		KMS:            x.KMS,
+		KeyID:          x.KeyID,
+		Member:         x.Member,
+		Manifest:       x.Manifest,
+	}
+	if h.BlockCompSizes == nil {
+		h.BlockCompSizes = []uint64{}
+	}
+	if x.Filter != nil {
+		h.Filter = *x.Filter
+	}
+	var err error
+	if h.WrappedKey, err = hex.DecodeString(x.WrappedKey); err != nil {
+		return nil, fmt.Errorf("WrappedKey: %w", err)
+	}
+	if h.BlockHashes, err = parseHashes(x.BlockHashes); err != nil {
+		return nil, fmt.Errorf("BlockHashes: %w", err)
+	}
+	if h.BlockKeys, err = parseHashes(x.BlockKeys); err != nil {
+		return nil, fmt.Errorf("BlockKeys: %w", err)
+	}
+	if x.BaseHash != "" {
+		if h.BaseHash, err = parseHash(x.BaseHash); err != nil {
+			return nil, fmt.Errorf("BaseHash: %w", err)
+		}
+	}
+	if x.SHA256 != "" {
+		if h.SHA256, err = parseHash(x.SHA256); err != nil {
+			return nil, fmt.Errorf("SHA256: %w", err)
+		}
+	}
+
+	b, err := codec.AppendHeader(nil, h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := codec.ReadHeader(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func hexHashes(hs [][32]byte) []string {
+	var s []string
+	for _, h := range hs {
+		s = append(s, hex.EncodeToString(h[:]))
+	}
+	return s
+}
+
+func parseHashes(s []string) ([][32]byte, error) {
+	var hs [][32]byte
+	for _, x := range s {
+		h, err := parseHash(x)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, h)
+	}
+	return hs, nil
+}
+
+func parseHash(s string) ([32]byte, error) {
+	var h [32]byte
+	b, err := hex.DecodeString(s)
+	if err == nil && len(b) != len(h) {
+		err = fmt.Errorf("%q is not a SHA-256", s)
+	}
+	copy(h[:], b)
+	return h, err
+}
+
+// ExportIndex writes the index of the archive at archivePath to
+// outputPath as JSON (see ArchiveIndex). The archive is read like
+// InspectArchive reads it, so a damaged one fails the same way.
+func ExportIndex(archivePath, outputPath string) error {
+	in, err := openFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+	size, err := in.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	index := &ArchiveIndex{Version: indexVersion, Archive: archivePath, Size: size}
+	for member := 0; ; member++ {
+		start, err := in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		h, err := codec.ReadHeader(in)
+		if err != nil && member > 0 {
+			err = trailingData(member, err)
+		}
+		if err == io.EOF && member > 0 {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("member %d: read header: %w", member, err)
+		}
+		data, err := in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		streamed := h.Flags&codec.FlagTrailer != 0
+		if streamed {
+			if h, err = readStreamedMember(in, h); err != nil {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+		}
+		marker := int64(0)
+		if h.Flags&codec.FlagEndMarker != 0 {
+			if err := codec.CheckEndMarker(in, h, streamed); err != nil {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+			marker = codec.EndMarkerSize
+		}
+		if err := codec.CheckStrict(h); err != nil {
+			return fmt.Errorf("member %d: %w", member, err)
+		}
+		m, err := inspectMember(in, archivePath, h, start, data, streamed)
+		if err != nil {
+			return fmt.Errorf("member %d: %w", member, err)
+		}
+		index.Members = append(index.Members, IndexMember{
+			Offset:   start,
+			Data:     data,
+			Streamed: streamed,
+			Header:   newIndexHeader(h),
+			Blocks:   m.Blocks,
+		})
+
+		if !streamed {
+			if _, err := in.Seek(data+payloadBytes(h)+marker, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(index); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return commitFile(out)
+}
+
+// payloadBytes is how many payload bytes follow the header of a member
+// that is not streamed: none for a block store, only the first volume's
+// for volumes.
+func payloadBytes(h *codec.FileHeader) int64 {
+	switch {
+	case h.Flags&codec.FlagStore != 0:
+		return 0
+	case h.Flags&codec.FlagVolumes != 0:
+		return int64(volumeBytes(h, 0))
+	}
+	return h.CompOffsets()[h.NumBlocks]
+}
+
+// LoadIndex reads an index written by ExportIndex.
+func LoadIndex(path string) (*ArchiveIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var index ArchiveIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, corruptf("%s: %v", path, err)
+	}
+	if index.Version != indexVersion {
+		return nil, corruptf("%s: unsupported index version %d", path, index.Version)
+	}
+	if len(index.Members) == 0 {
+		return nil, corruptf("%s: no members", path)
+	}
+	return &index, nil
+}
+
+// RebuildArchive writes the archive described by the index at indexPath
+// to outputPath, with headers made from the index and payloads copied from
+// archivePath at the offsets it records. Only the headers of archivePath
+// may be damaged: a payload that has moved or changed still fails to
+// decode, or its block hashes to match. Streamed members come out as plain
+// ones; volume files and block store objects are left where they are.
+// Payloads are copied by the kernel where it can (see copyRange).
+func RebuildArchive(archivePath, indexPath, outputPath string) error {
+	index, err := LoadIndex(indexPath)
+	if err != nil {
+		return fmt.Errorf("read index: %w", err)
+	}
+	in, err := openFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+
+	for i, m := range index.Members {
+		h, err := m.Header.fileHeader()
+		if err != nil {
+			return corruptf("index member %d: %v", i, err)
+		}
+		h.Flags &^= codec.FlagTrailer
+		if err := codec.WriteHeader(out, h); err != nil {
+			return fmt.Errorf("member %d: write header: %w", i, err)
+		}
+
+		// A streamed member's blocks follow 8-byte frame headers, which are
+		// left out; the others' payload is copied as it is, padding and all.
+		spans := [][2]int64{{m.Data, payloadBytes(h)}}
+		if m.Streamed {
+			spans = spans[:0]
+			pos := m.Data
+			for _, s := range h.BlockCompSizes {
+				spans = append(spans, [2]int64{pos + 8, int64(s)})
+				pos += 8 + int64(s)
+			}
+		}
+		kernelCopy := canCopyRange(out, in)
+		for _, s := range spans {
+			if kernelCopy {
+				if pos, err := out.Seek(0, io.SeekCurrent); err == nil && copyRange(out, pos, in, s[0], s[1]) {
+					if _, err := out.Seek(pos+s[1], io.SeekStart); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			n, err := io.Copy(out, io.NewSectionReader(in, s[0], s[1]))
+			if err != nil {
+				return fmt.Errorf("member %d: copy payload: %w", i, err)
+			}
+			if n < s[1] {
+				return corruptf("member %d: payload truncated: %d of %d bytes at offset %d", i, n, s[1], s[0])
+			}
+		}
+		if h.Flags&codec.FlagEndMarker != 0 {
+			if _, err := out.Write(codec.AppendEndMarker(nil, h.CompOffsets()[h.NumBlocks])); err != nil {
+				return fmt.Errorf("member %d: write end marker: %w", i, err)
+			}
+		}
+	}
+	return commitFile(out)
+}
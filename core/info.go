@@ -0,0 +1,254 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// ArchiveInfo describes every member of an archive, as read by
+// InspectArchive. Field names double as the JSON keys of -mode info -json.
+type ArchiveInfo struct {
+	Path    string
+	Members []MemberInfo
+}
+
+// MemberInfo holds the header fields of one member and its block table.
+type MemberInfo struct {
+	Offset         int64  // of the member's header in the archive
+	Format         string // magic: PCZ2, or PCZ3 with a flags word
+	Flags          uint32
+	FlagNames      []string
+	Filename       string
+	OriginalSize   uint64
+	BlockSize      uint32
+	NumBlocks      uint64
+	CompressedSize uint64
+	VolumeSize     uint64               `json:",omitempty"`
+	Align          uint32               `json:",omitempty"`
+	BaseSize       uint64               `json:",omitempty"`
+	BaseSHA256     string               `json:",omitempty"`
+	Filter         string               `json:",omitempty"`
+	FilterStride   uint32               `json:",omitempty"`
+	ExecCommand    string               `json:",omitempty"`
+	Transform      string               `json:",omitempty"`
+	KMS            string               `json:",omitempty"`
+	KeyID          string               `json:",omitempty"`
+	Manifest       string               `json:",omitempty"`
+	SHA256         string               `json:",omitempty"`
+	TarEntries     []codec.TarEntry     `json:",omitempty"`
+	LongRange      []codec.LongRangeRef `json:",omitempty"`
+	Blocks         []BlockInfo
+}
+
+// BlockInfo is one row of a member's block table.
+type BlockInfo struct {
+	Offset     int64  // uncompressed offset within the member
+	Size       int64  // uncompressed size
+	Volume     int    `json:",omitempty"` // 0 for the first volume
+	CompOffset int64  // in the archive (or volume) file; 0 for store objects
+	CompSize   uint64 // including the mode byte
+	Codec      string // from the block's mode byte
+	SHA256     string `json:",omitempty"` // of the uncompressed block, if recorded
+	Object     string `json:",omitempty"` // block store key
+}
+
+var flagNames = []string{"volumes", "block-hashes", "delta", "filter", "exec", "block-sizes", "tar-index", "trailer", "store", "align", "long-range", "repcodes", "chained", "transform", "encrypted", "manifest", "sha256", "end-marker"}
+
+// InspectArchive reads every header of the archive at archivePath and the
+// mode byte of every block, without decoding anything. Blocks in a block
+// store are only read when DefaultStore is set.
+func InspectArchive(archivePath string) (*ArchiveInfo, error) {
+	in, err := openFile(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	info := &ArchiveInfo{Path: archivePath}
+	for member := 0; ; member++ {
+		start, err := in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		h, err := codec.ReadHeader(in)
+		if err != nil && member > 0 {
+			err = trailingData(member, err)
+		}
+		if err == io.EOF && member > 0 {
+			return info, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("member %d: read header: %w", member, err)
+		}
+		data, err := in.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		streamed := h.Flags&codec.FlagTrailer != 0
+		if streamed {
+			if h, err = readStreamedMember(in, h); err != nil {
+				return nil, fmt.Errorf("member %d: %w", member, err)
+			}
+		}
+		marker := int64(0)
+		if h.Flags&codec.FlagEndMarker != 0 {
+			if err := codec.CheckEndMarker(in, h, streamed); err != nil {
+				return nil, fmt.Errorf("member %d: %w", member, err)
+			}
+			marker = codec.EndMarkerSize
+		}
+		if err := codec.CheckStrict(h); err != nil {
+			return nil, fmt.Errorf("member %d: %w", member, err)
+		}
+
+		m, err := inspectMember(in, archivePath, h, start, data, streamed)
+		if err != nil {
+			return nil, fmt.Errorf("member %d: %w", member, err)
+		}
+		info.Members = append(info.Members, *m)
+
+		if !streamed && h.Flags&(codec.FlagStore|codec.FlagVolumes) == 0 {
+			if _, err := in.Seek(data+int64(m.CompressedSize)+marker, io.SeekStart); err != nil {
+				return nil, err
+			}
+		} else if h.Flags&codec.FlagVolumes != 0 {
+			if _, err := in.Seek(data+int64(volumeBytes(h, 0)), io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// volumeBytes is how many payload bytes of h live in volume v.
+func volumeBytes(h *codec.FileHeader, v uint32) uint64 {
+	n := uint64(0)
+	for i, s := range h.BlockCompSizes {
+		if h.BlockVolumes[i] == v {
+			n += s
+		}
+	}
+	return n
+}
+
+func inspectMember(in *ioFile, archivePath string, h *codec.FileHeader, start, data int64, streamed bool) (*MemberInfo, error) {
+	m := &MemberInfo{
+		Offset:       start,
+		Format:       string(codec.Magic[:]),
+		Flags:        h.Flags,
+		Filename:     h.Filename,
+		OriginalSize: h.OriginalSize,
+		BlockSize:    h.BlockSize,
+		NumBlocks:    h.NumBlocks,
+		VolumeSize:   h.VolumeSize,
+		Align:        h.Align,
+		BaseSize:     h.BaseSize,
+		ExecCommand:  h.ExecCommand,
+		Transform:    h.Transform,
+		KMS:          h.KMS,
+		KeyID:        h.KeyID,
+		Manifest:     h.Manifest,
+		TarEntries:   h.TarEntries,
+		LongRange:    h.LongRange,
+	}
+	if streamed {
+		m.Flags |= codec.FlagTrailer
+	}
+	if m.Flags != 0 {
+		m.Format = string(codec.MagicFlags[:])
+	}
+	for bit, name := range flagNames {
+		if m.Flags&(1<<bit) != 0 {
+			m.FlagNames = append(m.FlagNames, name)
+		}
+	}
+	if h.Flags&codec.FlagDelta != 0 {
+		m.BaseSHA256 = hex.EncodeToString(h.BaseHash[:])
+	}
+	if h.Flags&codec.FlagSHA256 != 0 {
+		m.SHA256 = hex.EncodeToString(h.SHA256[:])
+	}
+	if h.Flags&codec.FlagFilter != 0 {
+		var parts []string
+		if h.Filter.Kind&codec.FilterDelta != 0 {
+			parts = append(parts, "delta")
+		}
+		if h.Filter.Kind&codec.FilterTranspose != 0 {
+			parts = append(parts, "transpose")
+		}
+		m.Filter = strings.Join(parts, "+")
+		m.FilterStride = h.Filter.Stride
+	}
+
+	offs := h.RawOffsets()
+	comp := h.CompOffsets()
+	m.CompressedSize = uint64(comp[h.NumBlocks])
+
+	// Volume files, opened as blocks reach them.
+	volumes := map[uint32]*ioFile{0: in}
+	defer func() {
+		for v, f := range volumes {
+			if v != 0 {
+				closeFile(f)
+			}
+		}
+	}()
+	volPos := map[uint32]int64{0: data}
+
+	frames := data // streamed members: start of the next frame
+	for i := 0; i < int(h.NumBlocks); i++ {
+		b := BlockInfo{Offset: offs[i], Size: offs[i+1] - offs[i], CompSize: h.BlockCompSizes[i]}
+		if h.Flags&codec.FlagBlockHashes != 0 {
+			b.SHA256 = hex.EncodeToString(h.BlockHashes[i][:])
+		}
+
+		var mode [1]byte
+		var err error
+		switch {
+		case streamed:
+			b.CompOffset = frames + 8
+			frames = b.CompOffset + int64(b.CompSize)
+			mode[0] = h.Payload[comp[i]]
+		case h.Flags&codec.FlagStore != 0:
+			b.Object = hex.EncodeToString(h.BlockKeys[i][:])
+			b.Codec = "?"
+			if DefaultStore != "" {
+				var obj []byte
+				if obj, err = readObject(DefaultStore, h.BlockKeys[i], h.BlockCompSizes[i]); err == nil {
+					mode[0] = obj[0]
+					b.Codec = ""
+				}
+			}
+		case h.Flags&codec.FlagVolumes != 0:
+			v := h.BlockVolumes[i]
+			b.Volume = int(v)
+			if volumes[v] == nil {
+				f, err := openFile(volumePath(archivePath, int(v)))
+				if err != nil {
+					return nil, fmt.Errorf("open volume %d: %w", v+1, err)
+				}
+				volumes[v] = f
+			}
+			b.CompOffset = volPos[v]
+			volPos[v] += int64(b.CompSize)
+			_, err = volumes[v].ReadAt(mode[:], b.CompOffset)
+		default:
+			b.CompOffset = data + comp[i]
+			_, err = in.ReadAt(mode[:], b.CompOffset)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, noEOF(err))
+		}
+		if b.Codec == "" {
+			b.Codec = codec.CodecName(mode[0])
+			if h.Flags&codec.FlagEncrypted != 0 {
+				b.Codec = "encrypted" // the mode byte is sealed too
+			}
+		}
+		m.Blocks = append(m.Blocks, b)
+	}
+	return m, nil
+}
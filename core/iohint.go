@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"proj3/core/codec"
+)
+
+// I/O hints, set with SetIOHint.
+const (
+	IOHintNone       = "none"
+	IOHintSequential = "sequential" // tell the kernel files are read/written front to back
+	IOHintDontNeed   = "dontneed"   // sequential, plus drop the file's pages from the cache when done
+	IOHintDirect     = "direct"     // dontneed, plus O_DIRECT for aligned reads and writes (see SetIOHint)
+)
+
+// directAlign is the alignment O_DIRECT asks of buffers, offsets and
+// lengths: the logical block size of common disks and filesystems.
+const directAlign = 4096
+
+// DefaultIOHint controls how input, archive and output files are advised to
+// the kernel. Large backup jobs can use "dontneed" so they do not evict the
+// page cache of other workloads on the host.
+var DefaultIOHint = IOHintNone
+
+// SetIOHint selects the I/O hint. On platforms without posix_fadvise the
+// hints are accepted and ignored. Under "direct", files get a second
+// descriptor opened with O_DIRECT, which takes the reads and writes whose
+// buffer, offset and length are all multiples of directAlign: the blocks
+// of an archive written or read with DefaultAlign, say. Other I/O goes
+// through the page cache as under "dontneed", with a warning for each file
+// it happens on. Where O_DIRECT is not available, "direct" is "dontneed"
+// with a warning.
+func SetIOHint(name string) error {
+	switch name {
+	case IOHintNone, IOHintSequential, IOHintDontNeed:
+		DefaultIOHint = name
+		return nil
+	case IOHintDirect:
+		if !directSupported {
+			codec.Warnf("io hint %q: O_DIRECT is not available here; using %q", name, IOHintDontNeed)
+			name = IOHintDontNeed
+		}
+		DefaultIOHint = name
+		return nil
+	}
+	return fmt.Errorf("unknown io hint %q", name)
+}
+
+// ioFile is a file opened through openFile or createFile. Its reads and
+// writes go through the -limit-rate limiter. An archive from createArchive
+// writes the same bytes to its copies in tee. A URL input has no File and
+// is read from src; it cannot seek or stat. The bytes read and written are
+// counted for Stats.
+type ioFile struct {
+	*os.File
+	tee       []*os.File
+	src       io.ReadCloser
+	output    bool       // from createFile: reading it back is not input
+	temps     []tempFile // from createAtomic: renamed by commitFile
+	direct    *os.File   // under IOHintDirect, File opened again with O_DIRECT
+	unaligned sync.Once  // warns of the first I/O direct cannot take
+}
+
+// tempFile is the temporary name of an output and the name it gets once
+// complete.
+type tempFile struct {
+	tmp, path string
+}
+
+func (f *ioFile) Read(p []byte) (int, error) {
+	if f.src != nil {
+		n, err := f.src.Read(p)
+		f.didRead(n)
+		return n, err
+	}
+	if pos, ok := f.directPos(p); ok {
+		n, err := f.ReadAt(p, pos)
+		f.File.Seek(pos+int64(n), io.SeekStart)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	n, err := f.File.Read(p)
+	if n > 0 && err != nil && isTransient(err) {
+		err = nil // the next Read meets it again if it persists
+	} else if err != nil && isTransient(err) {
+		err = retryTransient("read "+f.Name(), err, func() error {
+			n, err = f.File.Read(p)
+			return err
+		})
+	}
+	f.didRead(n)
+	return n, err
+}
+
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	file := f.File
+	if f.isDirect(p, off) {
+		file = f.direct
+	}
+	n, err := file.ReadAt(p, off)
+	if err != nil && isTransient(err) {
+		err = retryTransient("read "+f.Name(), err, func() error {
+			m, err := file.ReadAt(p[n:], off+int64(n))
+			n += m
+			return err
+		})
+	}
+	f.didRead(n)
+	return n, err
+}
+
+func (f *ioFile) didRead(n int) {
+	throttleRead(n)
+	if !f.output {
+		statsIn.Add(uint64(n))
+	}
+}
+
+func (f *ioFile) Write(p []byte) (int, error) {
+	throttleWrite(len(p))
+	statsOut.Add(uint64(len(p)))
+	if f.tee != nil {
+		return f.teeWrite(p, -1)
+	}
+	if pos, ok := f.directPos(p); ok {
+		n, err := writeRetry(f.direct, p, pos)
+		f.File.Seek(pos+int64(n), io.SeekStart)
+		return n, err
+	}
+	return writeRetry(f.File, p, -1)
+}
+
+func (f *ioFile) WriteAt(p []byte, off int64) (int, error) {
+	throttleWrite(len(p))
+	statsOut.Add(uint64(len(p)))
+	if f.tee != nil {
+		return f.teeWrite(p, off)
+	}
+	if f.isDirect(p, off) {
+		return writeRetry(f.direct, p, off)
+	}
+	return writeRetry(f.File, p, off)
+}
+
+// isDirect reports whether I/O of p at off goes through the O_DIRECT
+// descriptor of f. The first bulk I/O of f that cannot is reported.
+func (f *ioFile) isDirect(p []byte, off int64) bool {
+	if f.direct == nil {
+		return false
+	}
+	if len(p) > 0 && len(p)%directAlign == 0 && off%directAlign == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%directAlign == 0 {
+		return true
+	}
+	// Headers, end markers and the tail of a file are expected to miss;
+	// bulk I/O at unaligned offsets or from unaligned buffers is not.
+	if len(p) >= directAlign && (off%directAlign != 0 || uintptr(unsafe.Pointer(&p[0]))%directAlign != 0) {
+		if fi, err := f.Stat(); err == nil && !f.output && off >= fi.Size() {
+			return false // a read at the end of the file
+		}
+		f.unaligned.Do(func() {
+			codec.Warnf("%s: unaligned I/O goes through the page cache (-io-hint direct)", f.Name())
+		})
+	}
+	return false
+}
+
+// directPos returns the current offset of f if I/O of p there goes through
+// the O_DIRECT descriptor.
+func (f *ioFile) directPos(p []byte) (int64, bool) {
+	if f.direct == nil {
+		return 0, false
+	}
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	return pos, err == nil && f.isDirect(p, pos)
+}
+
+// alignedBuffer returns a zeroed buffer of n bytes whose start is aligned
+// for O_DIRECT.
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directAlign)
+	skip := 0
+	if r := int(uintptr(unsafe.Pointer(&b[0])) % directAlign); r != 0 {
+		skip = directAlign - r
+	}
+	return b[skip : skip+n : skip+n]
+}
+
+// adviseFile applies the I/O hint to f, a regular file just opened for
+// reading or created for writing.
+func adviseFile(f *ioFile, write bool) {
+	if DefaultIOHint == IOHintNone {
+		return
+	}
+	fadviseSequential(f.File)
+	if DefaultIOHint != IOHintDirect {
+		return
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	d, err := openDirect(f.Name(), write)
+	if err != nil {
+		codec.Warnf("%s: cannot open with O_DIRECT (%v); using the page cache", f.Name(), err)
+		return
+	}
+	f.direct = d
+}
+
+// writeRetry writes p to f at off, or at its offset when off is negative,
+// and writes the rest again after a transient failure.
+func writeRetry(f *os.File, p []byte, off int64) (int, error) {
+	write := func(p []byte, off int64) (int, error) {
+		if off < 0 {
+			return f.Write(p)
+		}
+		return f.WriteAt(p, off)
+	}
+	n, err := write(p, off)
+	if err != nil && isTransient(err) {
+		err = retryTransient("write "+f.Name(), err, func() error {
+			at := off
+			if off >= 0 {
+				at += int64(n)
+			}
+			m, err := write(p[n:], at)
+			n += m
+			return err
+		})
+	}
+	return n, err
+}
+
+// openFile opens path for reading and applies the I/O hint. An http(s)
+// URL is downloaded instead.
+func openFile(path string) (*ioFile, error) {
+	if isURL(path) {
+		return openURL(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	in := &ioFile{File: f}
+	adviseFile(in, false)
+	return in, nil
+}
+
+// createFile creates path for writing with the output mode and applies the
+// I/O hint.
+func createFile(path string) (*ioFile, error) {
+	f, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	out := &ioFile{File: f, output: true}
+	adviseFile(out, true)
+	return out, nil
+}
+
+// createAtomic is createFile for an output that must never be seen half
+// written: archives and decompressed files. It is written under a
+// temporary name next to path (see tempPath) and only replaces path when
+// commitFile renames it there, so a run that fails or is killed leaves the
+// previous file, or none, rather than a truncated one. Closing it without
+// commitFile removes it.
+func createAtomic(path string) (*ioFile, error) {
+	tmp := tempPath(path)
+	if tmp == "" {
+		return createFile(path)
+	}
+	f, err := createTemp(path, tmp)
+	if err != nil {
+		return nil, err
+	}
+	out := &ioFile{File: f, output: true, temps: []tempFile{{tmp, path}}}
+	adviseFile(out, true)
+	return out, nil
+}
+
+// commitFile closes f, an output of createAtomic or createArchive once all
+// of it is written, and renames it and its copies into place. It returns
+// the first error; outputs not renamed yet are removed. A later closeFile
+// of f does nothing more.
+func commitFile(f *ioFile) error {
+	temps := f.temps
+	f.temps = nil
+	err := closeFile(f)
+	for _, t := range temps {
+		if err == nil {
+			err = os.Rename(t.tmp, t.path)
+		}
+		if err != nil {
+			os.Remove(t.tmp)
+		}
+	}
+	return err
+}
+
+// closeFile closes a file from openFile or createFile. Under "dontneed" and
+// "direct" its pages are dropped from the page cache first; written data is
+// synced so the pages are clean and can actually be dropped. The temporary
+// files of an output that was not committed are removed.
+func closeFile(f *ioFile) error {
+	if f.src != nil {
+		return f.src.Close()
+	}
+	if f.direct != nil {
+		f.direct.Close()
+		f.direct = nil
+	}
+	if DefaultIOHint == IOHintDontNeed || DefaultIOHint == IOHintDirect {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			f.Sync()
+			fadviseDontNeed(f.File)
+		}
+	}
+	err := f.Close()
+	for _, c := range f.tee {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, t := range f.temps {
+		os.Remove(t.tmp)
+	}
+	f.temps = nil
+	return err
+}
+
+// readFile is os.ReadFile with the I/O hint and rate limit applied, and
+// counted for Stats.
+func readFile(path string) ([]byte, error) {
+	defer codec.StartPhase("read")()
+	if DefaultIOHint == IOHintNone && readLimiter == nil && !isURL(path) {
+		data, err := os.ReadFile(path)
+		statsIn.Add(uint64(len(data)))
+		return data, err
+	}
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(f)
+	var buf bytes.Buffer
+	if fi, err := f.Stat(); err == nil {
+		buf.Grow(int(fi.Size()) + 1)
+	}
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,33 @@
+//go:build linux && (amd64 || arm64 || riscv64 || ppc64le)
+
+package core
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvDontNeed   = 4 // POSIX_FADV_DONTNEED
+)
+
+func fadvise(f *os.File, advice int) {
+	// Advice is best effort; errors (e.g. on pipes) are ignored.
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, uintptr(advice), 0, 0)
+}
+
+func fadviseSequential(f *os.File) { fadvise(f, fadvSequential) }
+
+func fadviseDontNeed(f *os.File) { fadvise(f, fadvDontNeed) }
+
+const directSupported = true
+
+// openDirect opens path again with O_DIRECT, for reading or for writing.
+func openDirect(path string, write bool) (*os.File, error) {
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_WRONLY
+	}
+	return os.OpenFile(path, flag|syscall.O_DIRECT, 0)
+}
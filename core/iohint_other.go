@@ -0,0 +1,18 @@
+//go:build !(linux && (amd64 || arm64 || riscv64 || ppc64le))
+
+package core
+
+import (
+	"fmt"
+	"os"
+)
+
+func fadviseSequential(f *os.File) {}
+
+func fadviseDontNeed(f *os.File) {}
+
+const directSupported = false
+
+func openDirect(path string, write bool) (*os.File, error) {
+	return nil, fmt.Errorf("O_DIRECT is not supported on this platform")
+}
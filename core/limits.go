@@ -0,0 +1,170 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ServerLimits caps what the clients of the server modes may use. A job is
+// one HTTP request of serve or one connection of recv or tunnel; a client
+// is the remote host. Zero fields do not limit.
+type ServerLimits struct {
+	MaxRequestSize   int64 // bytes one request may read (serve) or send (recv)
+	MaxJobs          int   // jobs running at once, across all clients
+	MaxJobsPerClient int   // jobs one client may have running or queued
+	MaxThreads       int   // worker threads across running jobs; also caps each job's
+	QueueLength      int   // jobs that wait for a slot before more are turned away
+}
+
+// DefaultServerLimits applies to the servers started from now on.
+var DefaultServerLimits ServerLimits
+
+func SetServerLimits(l ServerLimits) error {
+	if l.MaxRequestSize < 0 || l.MaxJobs < 0 || l.MaxJobsPerClient < 0 || l.MaxThreads < 0 || l.QueueLength < 0 {
+		return fmt.Errorf("server limits must not be negative")
+	}
+	DefaultServerLimits = l
+	return nil
+}
+
+// Jobs turned away by a Limiter fail with one of these, so servers can
+// answer with the matching backpressure: retry later, slow down, or ask
+// for less.
+var (
+	ErrBusy       = errors.New("server busy")
+	ErrClientBusy = errors.New("too many jobs from this client")
+	ErrTooLarge   = errors.New("request too large")
+)
+
+// Limiter admits jobs within a set of ServerLimits. Jobs that do not fit
+// wait in a queue, in arrival order, while it has room.
+type Limiter struct {
+	lim     ServerLimits
+	mu      sync.Mutex
+	jobs    int
+	threads int
+	clients map[string]int // running and queued jobs of each client
+	queue   []*limitWaiter
+}
+
+type limitWaiter struct {
+	threads int
+	ready   chan struct{}
+}
+
+func NewLimiter(l ServerLimits) *Limiter {
+	return &Limiter{lim: l, clients: map[string]int{}}
+}
+
+// CheckSize fails with ErrTooLarge if a request of n bytes is over the
+// limit.
+func (l *Limiter) CheckSize(n int64) error {
+	if l.lim.MaxRequestSize > 0 && n > l.lim.MaxRequestSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, n, l.lim.MaxRequestSize)
+	}
+	return nil
+}
+
+// Acquire admits a job of client that wants threads workers, waiting in
+// the queue until it fits or ctx is done. It returns how many workers the
+// job may use and a func to call once it is over.
+func (l *Limiter) Acquire(ctx context.Context, client string, threads int) (int, func(), error) {
+	if threads <= 0 {
+		threads = 1
+	}
+	if l.lim.MaxThreads > 0 && threads > l.lim.MaxThreads {
+		threads = l.lim.MaxThreads
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.jobs--
+			l.threads -= threads
+			l.leave(client)
+			l.admit()
+			l.mu.Unlock()
+		})
+	}
+
+	l.mu.Lock()
+	if max := l.lim.MaxJobsPerClient; max > 0 && l.clients[client] >= max {
+		l.mu.Unlock()
+		return 0, nil, fmt.Errorf("%w: the limit is %d", ErrClientBusy, max)
+	}
+	if len(l.queue) == 0 && l.fits(threads) {
+		l.jobs++
+		l.threads += threads
+		l.clients[client]++
+		l.mu.Unlock()
+		return threads, release, nil
+	}
+	if len(l.queue) >= l.lim.QueueLength {
+		err := fmt.Errorf("%w: %d jobs running, %d queued", ErrBusy, l.jobs, len(l.queue))
+		l.mu.Unlock()
+		return 0, nil, err
+	}
+	w := &limitWaiter{threads: threads, ready: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.clients[client]++
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return threads, release, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Admitted just as ctx was done.
+		l.jobs--
+		l.threads -= threads
+	default:
+		for i, q := range l.queue {
+			if q == w {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	l.leave(client)
+	l.admit()
+	return 0, nil, ctx.Err()
+}
+
+// fits reports whether a job of threads workers may start now.
+func (l *Limiter) fits(threads int) bool {
+	return (l.lim.MaxJobs == 0 || l.jobs < l.lim.MaxJobs) &&
+		(l.lim.MaxThreads == 0 || l.threads+threads <= l.lim.MaxThreads)
+}
+
+// admit starts the queued jobs that fit, in order.
+func (l *Limiter) admit() {
+	for len(l.queue) > 0 && l.fits(l.queue[0].threads) {
+		w := l.queue[0]
+		l.queue = l.queue[1:]
+		l.jobs++
+		l.threads += w.threads
+		close(w.ready)
+	}
+}
+
+// remoteHost names the client at the other end of conn.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (l *Limiter) leave(client string) {
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
@@ -0,0 +1,22 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// ErrLocked is returned when another process, typically a second pcz run,
+// holds the lock on an output file. Outputs are locked from creation until
+// closed, so two jobs never interleave their writes into one archive.
+var ErrLocked = errors.New("in use by another process")
+
+// lockOutput takes the exclusive advisory lock on f, or fails at once with
+// ErrLocked if someone else has it. The lock goes with the file descriptor:
+// closing f, or the process exiting, releases it.
+func lockOutput(f *os.File) error {
+	if err := flockExclusive(f); err != nil {
+		return &fs.PathError{Op: "lock", Path: f.Name(), Err: err}
+	}
+	return nil
+}
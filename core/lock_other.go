@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package core
+
+import "os"
+
+func flockExclusive(f *os.File) error { return nil }
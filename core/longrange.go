@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"proj3/core/codec"
+)
+
+// DefaultLongRange runs the long-range pre-pass when compressing a file.
+var DefaultLongRange bool
+
+func SetLongRange(on bool) {
+	DefaultLongRange = on
+}
+
+const (
+	// lrmChunk is the window of the pre-pass's coarse hash, and so the
+	// shortest region it finds. Repeats closer than the LZ window are
+	// already in reach of the per-block matcher.
+	lrmChunk = 64 << 10
+
+	lrmBase       = 0x100000001b3 // polynomial base of the rolling hash
+	lrmFilterBits = 22            // bits of the bitmap screening hash lookups
+)
+
+// lrmHash hashes a window of lrmChunk bytes; the hash can be rolled forward
+// a byte at a time.
+func lrmHash(w []byte) uint64 {
+	h := uint64(0)
+	for _, c := range w {
+		h = h*lrmBase + uint64(c)
+	}
+	return h
+}
+
+// findLongRange finds regions of data that repeat earlier ones at any
+// distance. Every lrmChunk-aligned window is indexed by a hash; then a
+// rolling hash of the window at every position looks for an earlier
+// indexed window with the same bytes, and each hit is extended both ways.
+// The result is in destination order and references never overlap.
+func findLongRange(data []byte) []codec.LongRangeRef {
+	defer codec.StartPhase("long-range")()
+	n := len(data)
+	if n < 2*lrmChunk {
+		return nil
+	}
+
+	index := map[uint64]int{}
+	filter := make([]uint64, 1<<lrmFilterBits/64)
+	for p := 0; p+lrmChunk <= n; p += lrmChunk {
+		h := lrmHash(data[p : p+lrmChunk])
+		if _, ok := index[h]; !ok {
+			index[h] = p
+			f := h >> (64 - lrmFilterBits)
+			filter[f/64] |= 1 << (f % 64)
+		}
+	}
+
+	pow := uint64(1) // lrmBase^(lrmChunk-1), to roll the oldest byte out
+	for j := 1; j < lrmChunk; j++ {
+		pow *= lrmBase
+	}
+
+	var refs []codec.LongRangeRef
+	last := 0 // end of the previous reference
+	i := lrmChunk
+	h := lrmHash(data[i : i+lrmChunk])
+	for {
+		f := h >> (64 - lrmFilterBits)
+		if filter[f/64]&(1<<(f%64)) != 0 {
+			if p, ok := index[h]; ok && p+lrmChunk <= i && bytes.Equal(data[p:p+lrmChunk], data[i:i+lrmChunk]) {
+				dst, src, l := i, p, lrmChunk
+				for dst > last && src > 0 && src+l < dst && data[dst-1] == data[src-1] {
+					dst, src, l = dst-1, src-1, l+1
+				}
+				l += codec.MatchLength(data[src+l:dst], data[dst+l:], n)
+				refs = append(refs, codec.LongRangeRef{Dst: uint64(dst), Src: uint64(src), Len: uint64(l)})
+				last = dst + l
+				i = last
+				if i+lrmChunk > n {
+					break
+				}
+				h = lrmHash(data[i : i+lrmChunk])
+				continue
+			}
+		}
+		if i+lrmChunk == n {
+			break
+		}
+		h = (h-uint64(data[i])*pow)*lrmBase + uint64(data[i+lrmChunk])
+		i++
+	}
+	return refs
+}
+
+// longRangeHoles returns the parts of [start, end) covered by refs, as
+// start/end pairs relative to start.
+func longRangeHoles(refs []codec.LongRangeRef, start, end int64) [][2]int64 {
+	var holes [][2]int64
+	i := sort.Search(len(refs), func(i int) bool { return int64(refs[i].Dst+refs[i].Len) > start })
+	for ; i < len(refs) && int64(refs[i].Dst) < end; i++ {
+		s, e := int64(refs[i].Dst), int64(refs[i].Dst+refs[i].Len)
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		holes = append(holes, [2]int64{s - start, e - start})
+	}
+	return holes
+}
+
+// encodeHoles encodes buf, the block at offset off of the file, without the
+// bytes covered by refs:
+//
+//	codec.BlockModeHoles | uvarint count | count × (uvarint start, uvarint length) | block
+//
+// where block is the encoding of the remaining bytes with the codec name. It returns
+// nil when no reference touches the block.
+func encodeHoles(buf []byte, off int64, refs []codec.LongRangeRef, filter codec.BlockFilter, name string) ([]byte, error) {
+	holes := longRangeHoles(refs, off, off+int64(len(buf)))
+	if len(holes) == 0 {
+		return nil, nil
+	}
+	enc := binary.AppendUvarint([]byte{codec.BlockModeHoles}, uint64(len(holes)))
+	rest := make([]byte, 0, len(buf))
+	at := int64(0)
+	for _, hole := range holes {
+		rest = append(rest, buf[at:hole[0]]...)
+		enc = binary.AppendUvarint(enc, uint64(hole[0]))
+		enc = binary.AppendUvarint(enc, uint64(hole[1]-hole[0]))
+		at = hole[1]
+	}
+	rest = append(rest, buf[at:]...)
+	block, err := codec.EncodeWith(name, filter.Apply(rest))
+	if err != nil {
+		return nil, err
+	}
+	return append(enc, block...), nil
+}
+
+// decodeHoles reverses encodeHoles, leaving zeros where the holes are.
+func decodeHoles(h *codec.FileHeader, payload []byte, expected int) ([]byte, error) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(expected) {
+		return nil, corruptf("invalid hole count")
+	}
+	payload = payload[n:]
+	holes := make([][2]int, count)
+	at, total := 0, 0
+	for i := range holes {
+		s, n1 := binary.Uvarint(payload)
+		if n1 <= 0 {
+			return nil, corruptf("truncated hole %d", i)
+		}
+		l, n2 := binary.Uvarint(payload[n1:])
+		if n2 <= 0 {
+			return nil, corruptf("truncated hole %d", i)
+		}
+		payload = payload[n1+n2:]
+		if s < uint64(at) || l == 0 || s > uint64(expected) || l > uint64(expected)-s {
+			return nil, corruptf("invalid hole %d", i)
+		}
+		holes[i] = [2]int{int(s), int(s + l)}
+		at = int(s + l)
+		total += int(l)
+	}
+
+	rest, err := decodeFiltered(h, payload, expected-total)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, expected)
+	at = 0
+	for _, hole := range holes {
+		rest = rest[copy(out[at:hole[0]], rest):]
+		at = hole[1]
+	}
+	copy(out[at:], rest)
+	return out, nil
+}
+
+// resolveLongRange copies the long-range references of h into buf, the
+// member's decoded bytes. Sources always precede their destination, so
+// copying in destination order sees every source complete.
+func resolveLongRange(h *codec.FileHeader, buf []byte) {
+	for _, r := range h.LongRange {
+		copy(buf[r.Dst:r.Dst+r.Len], buf[r.Src:r.Src+r.Len])
+	}
+}
+
+// resolveLongRangeAt is resolveLongRange for a member already written to f
+// at base. The copies overwrite bytes counted for Stats when first written,
+// so they bypass the count.
+func resolveLongRangeAt(h *codec.FileHeader, f *ioFile, base int64) error {
+	buf := make([]byte, 1<<20)
+	for _, r := range h.LongRange {
+		for done := uint64(0); done < r.Len; {
+			chunk := buf
+			if r.Len-done < uint64(len(chunk)) {
+				chunk = chunk[:r.Len-done]
+			}
+			if _, err := f.ReadAt(chunk, base+int64(r.Src+done)); err != nil {
+				return fmt.Errorf("read long-range source: %w", noEOF(err))
+			}
+			throttleWrite(len(chunk))
+			if _, err := f.File.WriteAt(chunk, base+int64(r.Dst+done)); err != nil {
+				return fmt.Errorf("write long-range copy: %w", err)
+			}
+			done += uint64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// blockDecoder returns a function decoding block idx of the member h, whose
+// compressed blocks are comps. Blocks of a member with long-range references
+// are only complete once the whole member is decoded, so for those it
+// decodes the member up front on threads workers and serves slices of it.
+func blockDecoder(h *codec.FileHeader, comps [][]byte, impl string, threads int) (func(idx int) ([]byte, error), error) {
+	offs := h.RawOffsets()
+	decode := func(idx int) ([]byte, error) {
+		return decodeMemberBlock(h, idx, comps[idx], int(offs[idx+1]-offs[idx]))
+	}
+	if h.Flags&codec.FlagLongRange == 0 {
+		return decode, nil
+	}
+	full := make([]byte, h.OriginalSize)
+	err := codec.ForEachBlock(impl, len(comps), threads, func(idx int) error {
+		dec, err := decode(idx)
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		copy(full[offs[idx]:], dec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resolveLongRange(h, full)
+	return func(idx int) ([]byte, error) { return full[offs[idx]:offs[idx+1]], nil }, nil
+}
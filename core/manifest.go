@@ -0,0 +1,191 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"proj3/core/codec"
+)
+
+// ManifestEntry is one file of a manifest: its path, slash-separated and
+// relative to the archived tree's root, and the SHA-256 of its contents.
+type ManifestEntry struct {
+	Path   string
+	SHA256 [32]byte
+}
+
+// DefaultManifest is the file to which tar, zip and snapshot write a
+// manifest of the files they archive, in the format of sha256sum; "" writes
+// none. With one set, the manifest is also embedded in the archive: in the
+// header of a .tar.pcz (FlagManifest), in the comment of a .zip, and as the
+// SHA-256 of every file of a snapshot (SnapshotSHA256).
+var DefaultManifest string
+
+func SetManifest(path string) {
+	DefaultManifest = path
+}
+
+// appendManifest appends m to b as sha256sum lines, sorted by path. Member
+// paths never contain control characters or backslashes (see memberPath),
+// so they need no escaping.
+func appendManifest(b []byte, m []ManifestEntry) []byte {
+	sorted := append([]ManifestEntry(nil), m...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	for _, e := range sorted {
+		b = append(b, hex.EncodeToString(e.SHA256[:])...)
+		b = append(b, "  "...)
+		b = append(b, e.Path...)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// parseManifest reads sha256sum lines, in text ("  ") or binary (" *") form.
+func parseManifest(b []byte) ([]ManifestEntry, error) {
+	var m []ManifestEntry
+	for i, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if len(line) < 67 || line[64] != ' ' || (line[65] != ' ' && line[65] != '*') {
+			return nil, corruptf("manifest line %d is not a SHA-256 line", i+1)
+		}
+		var e ManifestEntry
+		if _, err := hex.Decode(e.SHA256[:], []byte(line[:64])); err != nil {
+			return nil, corruptf("manifest line %d is not a SHA-256 line", i+1)
+		}
+		var err error
+		if e.Path, err = memberPath(line[66:]); err != nil {
+			return nil, corruptf("manifest line %d: %v", i+1, err)
+		}
+		m = append(m, e)
+	}
+	return m, nil
+}
+
+// writeManifest writes m to DefaultManifest, if set.
+func writeManifest(m []ManifestEntry) error {
+	if DefaultManifest == "" {
+		return nil
+	}
+	out, err := createAtomic(DefaultManifest)
+	if err != nil {
+		return fmt.Errorf("create manifest: %w", err)
+	}
+	if _, err := out.Write(appendManifest(nil, m)); err != nil {
+		closeFile(out)
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return commitFile(out)
+}
+
+// LoadManifest reads the manifest at path: a sha256sum file, or the one
+// embedded in a .tar.pcz, .zip or snapshot.
+func LoadManifest(path string) ([]ManifestEntry, error) {
+	in, err := openFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	defer closeFile(in)
+	var m [4]byte
+	n, err := io.ReadFull(in, m[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	switch {
+	case n == 4 && (m == codec.Magic || m == codec.MagicFlags):
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		h, err := codec.ReadHeader(in)
+		if err != nil {
+			return nil, fmt.Errorf("read header: %w", noEOF(err))
+		}
+		if h.Flags&codec.FlagManifest == 0 {
+			return nil, fmt.Errorf("%s has no embedded manifest", path)
+		}
+		return parseManifest([]byte(h.Manifest))
+	case n == 4 && (m == snapshotMagic || m == snapshotMagicFlags):
+		snap, err := ReadSnapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		if snap.Flags&SnapshotSHA256 == 0 {
+			return nil, fmt.Errorf("%s has no file hashes", path)
+		}
+		var entries []ManifestEntry
+		for _, e := range snap.Entries {
+			if e.Mode.IsRegular() {
+				entries = append(entries, ManifestEntry{Path: e.Path, SHA256: e.SHA256})
+			}
+		}
+		return entries, nil
+	case n == 4 && string(m[:2]) == "PK":
+		z, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		defer z.Close()
+		if z.Comment == "" {
+			return nil, fmt.Errorf("%s has no embedded manifest", path)
+		}
+		return parseManifest([]byte(z.Comment))
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, in); err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	return parseManifest(b.Bytes())
+}
+
+// ManifestCheck is the result for one file of VerifyManifest: Err is nil
+// when the file's SHA-256 matches, wraps ErrVerify when it differs, and is
+// the error met reading it otherwise.
+type ManifestCheck struct {
+	Path string
+	Err  error
+}
+
+// VerifyManifest hashes the files of m under dir in parallel, with the
+// scheduler named by impl, and calls fn for each in manifest order. It
+// returns how many failed; files under dir that m does not list are not
+// looked at.
+func VerifyManifest(m []ManifestEntry, dir, impl string, threads int, fn func(ManifestCheck)) (int, error) {
+	checks := make([]ManifestCheck, len(m))
+	err := codec.ForEachBlock(impl, len(m), threads, func(idx int) error {
+		if err := codec.CanceledErr(); err != nil {
+			return err
+		}
+		e := m[idx]
+		checks[idx].Path = e.Path
+		_, sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		switch {
+		case err != nil:
+			checks[idx].Err = err
+		case sum != e.SHA256:
+			checks[idx].Err = verifyf("SHA-256 mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, c := range checks {
+		if c.Err != nil {
+			failed++
+		}
+		fn(c)
+	}
+	return failed, nil
+}
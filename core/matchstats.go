@@ -0,0 +1,222 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+
+	"proj3/core/codec"
+)
+
+// MatchStats describes the LZ token streams of a file, for tuning the match
+// finder (codec.HashBits, LZMinMatch, LZWindowSize) against real data.
+// Field names double as the JSON keys of -mode matchstats.
+type MatchStats struct {
+	Input        string
+	OriginalSize int64
+	BlockSize    uint32
+	NumBlocks    int
+
+	// The match finder's compiled-in parameters.
+	WindowSize int
+	MinMatch   int
+	MaxMatch   int
+	HashBits   int
+	Finder     string // the MatchFinder of -level or -match-finder
+
+	// Blocks per codec picked by codec.EncodeBlock under the current -codec and
+	// -filter; RawFallback is the share of blocks stored raw.
+	Codecs      map[string]int
+	RawFallback float64
+
+	Literals     uint64 // literal tokens
+	Matches      uint64 // match tokens
+	MatchedBytes uint64 // bytes covered by matches
+	CappedAtMax  uint64 // matches cut short at MaxMatch
+	RepeatTokens uint64 // matches at a repeat offset (-repcodes)
+
+	MatchLengths []HistogramBucket
+	MatchOffsets []HistogramBucket
+	LiteralRuns  []HistogramBucket // consecutive literals between matches
+}
+
+// HistogramBucket counts the values in [Min, Max]. Values below 16 get a
+// bucket each, larger ones one per power of two.
+type HistogramBucket struct {
+	Min, Max uint64
+	Count    uint64
+}
+
+type histogram [76]uint64
+
+func (h *histogram) add(v uint64) {
+	i := v
+	if v >= 16 {
+		i = uint64(11 + bits.Len64(v))
+	}
+	h[i]++
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o {
+		h[i] += c
+	}
+}
+
+// buckets lists the non-empty buckets in increasing order.
+func (h *histogram) buckets() []HistogramBucket {
+	out := []HistogramBucket{}
+	for i, c := range h {
+		if c == 0 {
+			continue
+		}
+		lo, hi := uint64(i), uint64(i)
+		if i >= 16 {
+			lo = 1 << (i - 12)
+			hi = 2*lo - 1
+		}
+		out = append(out, HistogramBucket{Min: lo, Max: hi, Count: c})
+	}
+	return out
+}
+
+// tokenStats accumulates the token stream of one or more blocks.
+type tokenStats struct {
+	literals, matches, matched, capped, repeats uint64
+	lengths, offsets, runs                      histogram
+}
+
+// addTokens walks a codec.LZCompressTokens stream.
+func (s *tokenStats) addTokens(tokens []byte) {
+	run := uint64(0)
+	reps := [2]int{1, 4}
+	for i := 0; i < len(tokens); {
+		var offset, length uint64
+		switch tokens[i] {
+		case 0x00:
+			s.literals++
+			run++
+			i += 2
+			continue
+		case 0x01:
+			offset = uint64(tokens[i+1]) | uint64(tokens[i+2])<<8
+			length = uint64(tokens[i+3])
+			i += 4
+			reps[0], reps[1] = int(offset), reps[0]
+		default: // repeat offsets
+			if tokens[i] == 0x03 {
+				reps[0], reps[1] = reps[1], reps[0]
+			}
+			offset = uint64(reps[0])
+			length = uint64(tokens[i+1])
+			i += 2
+			s.repeats++
+		}
+		if run > 0 {
+			s.runs.add(run)
+			run = 0
+		}
+		s.matches++
+		s.matched += length
+		if length == codec.LZMaxMatch {
+			s.capped++
+		}
+		s.lengths.add(length)
+		s.offsets.add(offset)
+	}
+	if run > 0 {
+		s.runs.add(run)
+	}
+}
+
+func (s *tokenStats) merge(o *tokenStats) {
+	s.literals += o.literals
+	s.matches += o.matches
+	s.matched += o.matched
+	s.capped += o.capped
+	s.repeats += o.repeats
+	s.lengths.merge(&o.lengths)
+	s.offsets.merge(&o.offsets)
+	s.runs.merge(&o.runs)
+}
+
+// MatchStatsFile runs the LZ match finder over every block of inputPath, as
+// compression would (after the -filter pre-filter), and collects histograms
+// of its matches and literal runs. It also encodes every block to count
+// which codec auto selection picks. Nothing is written.
+func MatchStatsFile(inputPath string, threads int) (*MatchStats, error) {
+	in, err := openFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	info, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("input is not a regular file")
+	}
+
+	originalSize := info.Size()
+	blockSize := int64(DefaultBlockSize)
+	numBlocks := int((originalSize + blockSize - 1) / blockSize)
+	ms := &MatchStats{
+		Input:        inputPath,
+		OriginalSize: originalSize,
+		BlockSize:    DefaultBlockSize,
+		NumBlocks:    numBlocks,
+		WindowSize:   codec.LZWindowSize,
+		MinMatch:     codec.LZMinMatch,
+		MaxMatch:     codec.LZMaxMatch,
+		HashBits:     codec.HashBits,
+		Finder:       codec.MatchFinderName(),
+		Codecs:       map[string]int{},
+	}
+
+	var mu sync.Mutex
+	var total tokenStats
+	err = codec.WSForEach(numBlocks, threads, func(idx int) error {
+		n := blockSize
+		if idx == numBlocks-1 {
+			n = originalSize - blockSize*int64(idx)
+		}
+		buf := make([]byte, n)
+		if _, err := in.ReadAt(buf, int64(idx)*blockSize); err != nil && err != io.EOF {
+			return fmt.Errorf("read block %d: %w", idx, err)
+		}
+		buf = codec.DefaultFilter.Apply(buf)
+
+		var s tokenStats
+		s.addTokens(codec.LZCompressTokens(buf))
+		enc, err := codec.EncodeBlock(buf)
+		if err != nil {
+			return fmt.Errorf("compress block %d: %w", idx, err)
+		}
+		name := codec.CodecName(enc[0])
+
+		mu.Lock()
+		total.merge(&s)
+		ms.Codecs[name]++
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if numBlocks > 0 {
+		ms.RawFallback = float64(ms.Codecs["raw"]) / float64(numBlocks)
+	}
+	ms.Literals = total.literals
+	ms.Matches = total.matches
+	ms.MatchedBytes = total.matched
+	ms.CappedAtMax = total.capped
+	ms.RepeatTokens = total.repeats
+	ms.MatchLengths = total.lengths.buckets()
+	ms.MatchOffsets = total.offsets.buckets()
+	ms.LiteralRuns = total.runs.buckets()
+	return ms, nil
+}
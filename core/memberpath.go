@@ -0,0 +1,31 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// memberPath returns the portable form of p, the path of a member relative
+// to the archive root, in which paths are stored in archives and looked up
+// on extraction: separated by forward slashes (backslashes, as written by
+// Windows tools, count as separators), cleaned, relative, and never leaving
+// the root. Paths that are not valid UTF-8 or contain control characters
+// are rejected, since they cannot be listed or recreated the same way on
+// every system.
+func memberPath(p string) (string, error) {
+	if !utf8.ValidString(p) {
+		return "", fmt.Errorf("path %q is not valid UTF-8", p)
+	}
+	if i := strings.IndexFunc(p, unicode.IsControl); i >= 0 {
+		return "", fmt.Errorf("path %q contains control character %U", p, []rune(p[i:])[0])
+	}
+	p = strings.ReplaceAll(p, "\\", "/")
+	p = path.Clean(strings.TrimLeft(p, "/"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("path %q is outside the archive root", p)
+	}
+	return p, nil
+}
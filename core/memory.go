@@ -0,0 +1,85 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"proj3/core/codec"
+)
+
+// CompressBytes compresses data into an in-memory .pcz archive, using the
+// scheduler named by impl ("seq", "bsp", "ws", "fj" or "pool"). It honours the codec,
+// filter and block hash settings like the file-based compressors, but never
+// touches the filesystem, so it also works in GOOS=js and wasip1 builds.
+// Volumes, alignment and the block store are file-level features and are
+// not applied.
+func CompressBytes(data []byte, impl string, threads int) ([]byte, error) {
+	blockSize := int(DefaultBlockSize)
+	numBlocks := (len(data) + blockSize - 1) / blockSize
+
+	set := newBlockSet(numBlocks)
+	wait := set.hashInput(data)
+	err := codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		s := idx * blockSize
+		e := s + blockSize
+		if e > len(data) {
+			e = len(data)
+		}
+		return set.encode(idx, data[s:e])
+	})
+	wait()
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	header := set.header("", uint64(len(data)), uint32(blockSize))
+	if codec.DefaultEndMarker {
+		header.Flags |= codec.FlagEndMarker
+	}
+	if err := codec.WriteHeader(&out, header); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	for _, b := range set.enc {
+		out.Write(b)
+	}
+	if codec.DefaultEndMarker {
+		out.Write(codec.AppendEndMarker(nil, header.CompOffsets()[header.NumBlocks]))
+	}
+	return out.Bytes(), nil
+}
+
+// DecompressBytes decodes an in-memory .pcz archive, including concatenated
+// members, with the scheduler named by impl. Multi-volume archives and block
+// store manifests need the file API.
+func DecompressBytes(archive []byte, impl string, threads int) ([]byte, error) {
+	in := bytes.NewReader(archive)
+	var out bytes.Buffer
+	for member := 0; ; member++ {
+		h, err := readMemberHeader(in, member)
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Flags&codec.FlagVolumes != 0 {
+			err = fmt.Errorf("multi-volume archives cannot be decoded from memory")
+		} else if h.Flags&codec.FlagStore != 0 {
+			err = fmt.Errorf("block store manifests cannot be decoded from memory")
+		} else {
+			payload, _, _ := openPayload(in, "", h)
+			out.Grow(int(h.OriginalSize))
+			err = checkMember(&out, h, func(w io.Writer) error {
+				return decompressMember(impl, payload, w, h, threads)
+			})
+		}
+		if err != nil {
+			if member > 0 {
+				return nil, fmt.Errorf("member %d: %w", member, err)
+			}
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// DefaultMmap has the parallel decompressors write each member to a
+// regular output file through a shared mapping of it: the file is extended
+// to the member's end and mapped, and every worker decodes its blocks
+// straight into their place in the mapping, leaving the kernel to write
+// the pages back when it likes. There is no output buffer to copy from and
+// no write call. Output that cannot be mapped (pipes, devices, copies from
+// a repeated -out, platforms without mmap, members too large for the
+// address space) is written as usual.
+var DefaultMmap bool
+
+func SetMmap(on bool) {
+	DefaultMmap = on
+}
+
+// decompressMapped is decompressWindowed into a mapping of out, from its
+// current offset on, which it leaves after the member. It reports false,
+// having read and written nothing, when out cannot be mapped.
+func decompressMapped(in io.Reader, out *ioFile, h *codec.FileHeader, threads int, forEach func(n, threads int, fn func(idx int) error) error) (bool, error) {
+	if out.tee != nil || !isRegular(out) {
+		return false, nil
+	}
+	base, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, nil
+	}
+	end := base + int64(h.OriginalSize)
+	page := int64(os.Getpagesize())
+	at := base - base%page // mappings start on a page
+	if end < base || end-at != int64(int(end-at)) {
+		return false, nil
+	}
+	fi, err := out.Stat()
+	if err != nil {
+		return false, nil
+	}
+	if fi.Size() < end {
+		if err := out.Truncate(end); err != nil {
+			return true, fmt.Errorf("extend output: %w", err)
+		}
+	}
+	m, err := mapFile(out.File, at, int(end-at))
+	if err != nil {
+		codec.Warnf("-mmap: %v; writing the output instead", err)
+		return false, nil
+	}
+
+	buf := m[base-at:]
+	offs := h.RawOffsets()
+	phase := func() func() { return codec.StartPhase("decompress") }
+	err = decodeWindows(in, h, threads, forEach, phase, func(idx int, comp []byte) error {
+		dst := buf[offs[idx]:offs[idx+1]]
+		if err := decodeMemberBlockInto(h, idx, comp, dst); err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		throttleWrite(len(dst))
+		statsOut.Add(uint64(len(dst)))
+		return nil
+	})
+	if err == nil {
+		// Long-range references copy from bytes any block may have written.
+		resolveLongRange(h, buf)
+	}
+	if uerr := unmapFile(m); err == nil && uerr != nil {
+		err = fmt.Errorf("unmap output: %w", uerr)
+	}
+	if err != nil {
+		return true, err
+	}
+	if _, err := out.Seek(end, io.SeekStart); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// decodeMemberBlockInto is decodeMemberBlock writing the block to dst,
+// which is exactly its size. Blocks whose codec has a decodeInto and that
+// need no undoing after it (filters, transforms) are decoded in place;
+// the rest are decoded as usual and copied.
+func decodeMemberBlockInto(h *codec.FileHeader, idx int, comp, dst []byte) error {
+	if h.Flags&codec.FlagTransform != 0 {
+		dec, err := decodeMemberBlock(h, idx, comp, len(dst))
+		if err != nil {
+			return err
+		}
+		copy(dst, dec)
+		return nil
+	}
+	comp, err := openBlock(h, idx, comp)
+	if err != nil {
+		return err
+	}
+	if h.Flags&codec.FlagFilter == 0 {
+		if ok, err := codec.DecodeInto(dst, comp); ok {
+			return err
+		}
+	}
+	dec, err := decodeFiltered(h, comp, len(dst))
+	if err != nil {
+		return err
+	}
+	copy(dst, dec)
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package core
+
+import (
+	"errors"
+	"os"
+)
+
+func mapFile(f *os.File, off int64, n int) ([]byte, error) {
+	return nil, errors.New("memory-mapped output is not supported on this platform")
+}
+
+func unmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"proj3/core/codec"
+)
+
+// OrderedWriter writes pieces of output produced concurrently and out of
+// order (the decoded blocks of a member, say) to an io.Writer in index
+// order, starting at index 0. Pieces that arrive early wait in a reorder
+// buffer of at most window pieces; a producer further ahead than that blocks
+// in WriteIndex until the pieces before it are written. Whichever producer
+// completes the next run of pieces writes it out, so there is no extra
+// goroutine.
+//
+// A producer blocked in WriteIndex does no other work, so the pieces before
+// it must be produced by others: hand out indices in order, or keep fewer
+// than window pieces in flight.
+type OrderedWriter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       io.Writer
+	window  int
+	next    int // index of the next piece to write
+	pending map[int][]byte
+	writing bool // a producer is writing pieces out
+	err     error
+}
+
+func NewOrderedWriter(w io.Writer, window int) *OrderedWriter {
+	if window <= 0 {
+		panic("ordered writer window must be > 0")
+	}
+	o := &OrderedWriter{w: w, window: window, pending: make(map[int][]byte)}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// WriteIndex hands piece i to the writer. data is kept, not copied, until it
+// is written, and must not be changed before. The first write error is
+// returned from then on, to every producer.
+func (o *OrderedWriter) WriteIndex(i int, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for o.err == nil && i >= o.next+o.window {
+		o.cond.Wait()
+	}
+	if o.err != nil {
+		return o.err
+	}
+	if _, dup := o.pending[i]; dup || i < o.next {
+		return fmt.Errorf("piece %d written twice", i)
+	}
+	o.pending[i] = data
+	if o.writing {
+		return nil // picked up by the producer writing now
+	}
+
+	o.writing = true
+	for o.err == nil {
+		d, ok := o.pending[o.next]
+		if !ok {
+			break
+		}
+		delete(o.pending, o.next)
+		o.mu.Unlock()
+		done := codec.StartPhase("write")
+		_, err := o.w.Write(d)
+		done()
+		o.mu.Lock()
+		if err != nil {
+			o.err = err
+		} else {
+			o.next++
+		}
+		o.cond.Broadcast()
+	}
+	o.writing = false
+	return o.err
+}
+
+// Next returns the index of the next piece to be written: all before it are.
+func (o *OrderedWriter) Next() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.next
+}
+
+// Close checks that the n pieces [0, n) were all written and returns the
+// first write error, if any. It does not close the underlying writer.
+func (o *OrderedWriter) Close(n int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return o.err
+	}
+	if o.next < n {
+		return fmt.Errorf("piece %d never written", o.next)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+
+	"proj3/core/codec"
+)
+
+// DefaultOwner records the owner and group of every file and directory in
+// snapshots and restores them, which needs root (or CAP_CHOWN) on restore.
+var DefaultOwner bool
+
+func SetOwner(on bool) {
+	DefaultOwner = on
+}
+
+// Owner is the owner and group of a snapshot entry, by number and, when the
+// system that took the snapshot knew them, by name.
+type Owner struct {
+	UID, GID    uint32
+	User, Group string
+}
+
+// ownerNames caches uid and gid lookups, in both directions, over a
+// snapshot or restore run.
+type ownerNames struct {
+	users, groups     map[uint32]string
+	userIDs, groupIDs map[string]int
+
+	denied bool // a chown was refused; the rest are skipped
+}
+
+func newOwnerNames() *ownerNames {
+	return &ownerNames{
+		users: map[uint32]string{}, groups: map[uint32]string{},
+		userIDs: map[string]int{}, groupIDs: map[string]int{},
+	}
+}
+
+// capture returns the owner of the file described by info.
+func (o *ownerNames) capture(info fs.FileInfo) Owner {
+	uid, gid, _ := fileOwner(info)
+	id := strconv.FormatUint(uint64(uid), 10)
+	name, seen := o.users[uid]
+	if !seen {
+		if u, err := user.LookupId(id); err == nil {
+			name = u.Username
+		}
+		o.users[uid] = name
+	}
+	id = strconv.FormatUint(uint64(gid), 10)
+	group, seen := o.groups[gid]
+	if !seen {
+		if g, err := user.LookupGroupId(id); err == nil {
+			group = g.Name
+		}
+		o.groups[gid] = group
+	}
+	return Owner{UID: uid, GID: gid, User: name, Group: group}
+}
+
+// ids returns the uid and gid to give a restored entry owned by ow: those
+// of its user and group names on this system when they exist there, like
+// tar does, and the recorded numbers otherwise.
+func (o *ownerNames) ids(ow Owner) (int, int) {
+	uid, gid := int(ow.UID), int(ow.GID)
+	if ow.User != "" {
+		id, seen := o.userIDs[ow.User]
+		if !seen {
+			id = -1
+			if u, err := user.Lookup(ow.User); err == nil {
+				if n, err := strconv.Atoi(u.Uid); err == nil {
+					id = n
+				}
+			}
+			o.userIDs[ow.User] = id
+		}
+		if id >= 0 {
+			uid = id
+		}
+	}
+	if ow.Group != "" {
+		id, seen := o.groupIDs[ow.Group]
+		if !seen {
+			id = -1
+			if g, err := user.LookupGroup(ow.Group); err == nil {
+				if n, err := strconv.Atoi(g.Gid); err == nil {
+					id = n
+				}
+			}
+			o.groupIDs[ow.Group] = id
+		}
+		if id >= 0 {
+			gid = id
+		}
+	}
+	return uid, gid
+}
+
+// restore gives path the owner ow. Without the privilege to do so it warns
+// once and leaves this and every later entry owned by the current user.
+func (o *ownerNames) restore(path string, ow Owner) error {
+	if o.denied {
+		return nil
+	}
+	if !ownersSupported {
+		o.denied = true
+		codec.Warnf("ownership not restored: not supported on this platform")
+		return nil
+	}
+	uid, gid := o.ids(ow)
+	err := os.Lchown(path, uid, gid)
+	if errors.Is(err, fs.ErrPermission) {
+		o.denied = true
+		codec.Warnf("%s: ownership not restored (%v); run as root to restore owners", path, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("set owner: %w", err)
+	}
+	return nil
+}
+
+// appendOwner encodes ow as uint32 uid and gid, then the user and group
+// names, each a uint16 length and the name.
+func appendOwner(b []byte, ow Owner) ([]byte, error) {
+	if len(ow.User) > 0xFFFF || len(ow.Group) > 0xFFFF {
+		return nil, fmt.Errorf("owner name too long")
+	}
+	le := binary.LittleEndian
+	b = le.AppendUint32(b, ow.UID)
+	b = le.AppendUint32(b, ow.GID)
+	b = le.AppendUint16(b, uint16(len(ow.User)))
+	b = append(b, ow.User...)
+	b = le.AppendUint16(b, uint16(len(ow.Group)))
+	return append(b, ow.Group...), nil
+}
+
+// readOwner reads an owner written by appendOwner.
+func readOwner(r io.Reader) (Owner, error) {
+	var ow Owner
+	d, err := codec.ReadChunk(r, 4+4+2)
+	if err != nil {
+		return ow, err
+	}
+	ow.UID, ow.GID = d.U32(), d.U32()
+	n := int(d.U16())
+	if d, err = codec.ReadChunk(r, n+2); err != nil {
+		return ow, err
+	}
+	ow.User = string(d.Bytes(n))
+	n = int(d.U16())
+	if d, err = codec.ReadChunk(r, n); err != nil {
+		return ow, err
+	}
+	ow.Group = string(d.Bytes(n))
+	return ow, nil
+}
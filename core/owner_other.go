@@ -0,0 +1,9 @@
+//go:build !unix
+
+package core
+
+import "io/fs"
+
+const ownersSupported = false
+
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) { return 0, 0, false }
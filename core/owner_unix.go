@@ -0,0 +1,19 @@
+//go:build unix
+
+package core
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// ownersSupported reports whether files have a numeric owner and group.
+const ownersSupported = true
+
+func fileOwner(info fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// DefaultOutputMode is the permission mode of every output file, applied
+// regardless of the umask. 0 leaves it to os.Create: 0666 less the umask,
+// or the existing mode of a file being overwritten.
+var DefaultOutputMode fs.FileMode
+
+func SetOutputMode(m uint64) error {
+	if m > 0o777 {
+		return fmt.Errorf("output mode %#o is not a permission mode", m)
+	}
+	DefaultOutputMode = fs.FileMode(m)
+	return nil
+}
+
+// createOutput creates or truncates path for writing with the output mode.
+// The mode is set before anything is written, so data never sits in a file
+// with wider permissions; outputs written to a temporary name and renamed
+// into place (see createTemp) carry it from the start. The file is locked
+// before it is truncated, so a run that finds path in use leaves it alone.
+func createOutput(path string) (*os.File, error) {
+	perm := DefaultOutputMode
+	if perm == 0 {
+		perm = 0o666
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockOutput(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := applyOutputMode(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// applyOutputMode gives f the output mode: a new file only got it narrowed
+// by the umask, and an existing one keeps its own.
+func applyOutputMode(f *os.File) error {
+	if DefaultOutputMode == 0 {
+		return nil
+	}
+	if err := f.Chmod(DefaultOutputMode); err != nil {
+		return fmt.Errorf("set mode of %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// tempPath returns the temporary name under which the output path is
+// written and then renamed into place, or "" when path must be written in
+// place: it exists and is not a regular file, such as a device, a pipe or a
+// symlink.
+func tempPath(path string) string {
+	fi, err := os.Lstat(path)
+	if err == nil && !fi.Mode().IsRegular() {
+		return ""
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "" // createOutput reports it
+	}
+	return path + ".tmp"
+}
+
+// createTemp creates tmp, the temporary name of path, like createOutput.
+// Without an output mode it takes the mode of the file at path, which it
+// replaces, as os.Create would have kept it. A temporary file left by a
+// killed run is reused; one another run is writing is locked.
+func createTemp(path, tmp string) (*os.File, error) {
+	f, err := createOutput(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if DefaultOutputMode == 0 {
+		if fi, err := os.Stat(path); err == nil {
+			if err := f.Chmod(fi.Mode().Perm()); err != nil {
+				f.Close()
+				os.Remove(tmp)
+				return nil, fmt.Errorf("set mode of %s: %w", tmp, err)
+			}
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+package core
+
+// PoolCompressFile: block indices go through one buffered channel to the
+// workers, the plain Go worker pool.
+func PoolCompressFile(inputPath, outputPath string, threads int) error {
+	return compressFile("pool", inputPath, outputPath, threads)
+}
+
+// PoolDecompressFile decodes each window of blocks on a channel-fed worker
+// pool. Concatenated members are decoded one after another into the same
+// output.
+func PoolDecompressFile(compressedPath, outputPath string, threads int) error {
+	return decompressFile("pool", compressedPath, outputPath, threads)
+}
@@ -0,0 +1,28 @@
+package core
+
+import (
+	"fmt"
+	"io"
+)
+
+// reserve preallocates n bytes of f from its current offset, so large
+// outputs are laid out contiguously and a full disk is reported before any
+// work is written rather than halfway through. Non-regular files (pipes,
+// /dev/null) are left alone, as are file systems without preallocation.
+func reserve(f *ioFile, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	if err := preallocate(f.File, off, int64(n)); err != nil {
+		return fmt.Errorf("preallocate %d bytes: %w", n, err)
+	}
+	return nil
+}
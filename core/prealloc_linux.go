@@ -0,0 +1,17 @@
+//go:build linux
+
+package core
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func preallocate(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, off, n)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
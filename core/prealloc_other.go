@@ -0,0 +1,18 @@
+//go:build !linux
+
+package core
+
+import "os"
+
+// preallocate extends f to off+n bytes. Without fallocate this does not
+// reserve blocks, but it still sets the final size up front.
+func preallocate(f *os.File, off, n int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= off+n {
+		return nil
+	}
+	return f.Truncate(off + n)
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// DefaultPrefetch reads the input of the parallel compressors on a
+// goroutine of its own, one window of blocks ahead of the workers, so the
+// disk and the CPUs are busy at the same time. Without it, regular files
+// are read whole before the first block is compressed, and streams a
+// window at a time between windows of compression.
+var DefaultPrefetch = true
+
+func SetPrefetch(on bool) {
+	DefaultPrefetch = on
+}
+
+// prefetchWindow is a window of blocks read by a prefetcher.
+type prefetchWindow struct {
+	bufs [][]byte
+	err  error
+}
+
+// prefetcher reads blocks of blockSize from in, window blocks at a time.
+// With DefaultPrefetch, a goroutine reads the next window while the caller
+// works on the current one; otherwise next reads it on the spot. Blocks
+// come from the slab of their size; release gives a window back.
+type prefetcher struct {
+	in        io.Reader
+	blockSize int
+	window    int
+	slab      *slab
+	windows   chan prefetchWindow // nil without a goroutine
+	stop      chan struct{}
+	eof       bool
+}
+
+func newPrefetcher(in io.Reader, blockSize, window int) *prefetcher {
+	p := &prefetcher{in: in, blockSize: blockSize, window: window, slab: slabFor(blockSize)}
+	if DefaultPrefetch {
+		p.windows = make(chan prefetchWindow)
+		p.stop = make(chan struct{})
+		go p.run()
+	}
+	return p
+}
+
+// run is the prefetch goroutine. The channel is unbuffered, so it holds at
+// most one window the caller has not taken yet.
+func (p *prefetcher) run() {
+	defer close(p.windows)
+	for !p.eof {
+		bufs, err := p.read()
+		if len(bufs) == 0 && err == nil {
+			return
+		}
+		select {
+		case p.windows <- prefetchWindow{bufs, err}:
+		case <-p.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read reads the next window; it is short, or empty, at the end of input.
+func (p *prefetcher) read() ([][]byte, error) {
+	var bufs [][]byte
+	for len(bufs) < p.window && !p.eof {
+		buf := p.slab.get(p.blockSize)
+		n, err := io.ReadFull(p.in, buf)
+		if n > 0 {
+			bufs = append(bufs, buf[:n])
+		} else {
+			p.slab.put(buf)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			p.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bufs, nil
+}
+
+// next returns the next window of blocks, or none at the end of input.
+func (p *prefetcher) next() ([][]byte, error) {
+	if p.windows == nil {
+		return p.read()
+	}
+	w := <-p.windows
+	return w.bufs, w.err
+}
+
+// release gives the blocks of a window back to the slab, once nothing
+// reads them any more.
+func (p *prefetcher) release(bufs [][]byte) {
+	p.slab.put(bufs...)
+}
+
+// close stops the goroutine. The input is left open.
+func (p *prefetcher) close() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+}
+
+// compressPrefetched compresses the regular file at inputPath, described by
+// info, like compressFile, but a window of blocks at a time as a prefetcher
+// reads them, instead of reading the whole file first. Memory for the input
+// drops from its size to two windows. Long-range matching needs the whole
+// file and is not done here.
+func compressPrefetched(impl, inputPath, outputPath string, info os.FileInfo, threads int) error {
+	in, err := openFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	blockSize := int(DefaultBlockSize)
+	p := newPrefetcher(in, blockSize, inFlight(threads))
+	defer p.close()
+
+	set := newBlockSet(0)
+	total := uint64(0)
+	for {
+		done := codec.StartPhase("read")
+		bufs, err := p.next()
+		done()
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
+		}
+		if len(bufs) == 0 {
+			break
+		}
+		base := len(set.sizes)
+		if base == 0 {
+			set.detect(info.Name())
+		}
+		set.grow(len(bufs))
+		wait := set.hashInput(bufs...)
+		done = codec.StartPhase("compress")
+		err = codec.ForEachBlock(impl, len(bufs), threads, func(i int) error {
+			return set.encodeAt(base+i, int64(base+i)*int64(blockSize), bufs[i])
+		})
+		done()
+		wait()
+		for _, b := range bufs {
+			total += uint64(len(b))
+		}
+		p.release(bufs)
+		if err != nil {
+			return err
+		}
+	}
+
+	header := set.header(info.Name(), total, DefaultBlockSize)
+	return writeArchive(outputPath, header, set.enc)
+}
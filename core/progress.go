@@ -0,0 +1,98 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// Progress returns a snapshot of every worker (see codec.SetProgress), and
+// the bytes read from the run's inputs and written to its outputs so far.
+func Progress() ([]codec.WorkerProgress, uint64, uint64) {
+	return codec.Workers(), statsIn.Load(), statsOut.Load()
+}
+
+// StartProgressView draws a full-screen view of the run on the terminal w,
+// refreshed every interval until the returned function is called: how much
+// of the input of total bytes has been read (total 0 if unknown) and
+// written, and a bar per worker with its current block, blocks done, rate,
+// steals and busy share. Bars are relative to the busiest worker, so load
+// imbalance shows as ragged bars. The view uses the alternate screen, so
+// the terminal is left as it was.
+func StartProgressView(w io.Writer, title string, total uint64, interval time.Duration) func() {
+	start := time.Now()
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	io.WriteString(w, "\x1b[?1049h\x1b[?25l")
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			io.WriteString(w, "\x1b[H\x1b[2J"+progressFrame(title, total, time.Since(start)))
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+		io.WriteString(w, "\x1b[?25h\x1b[?1049l")
+	}
+}
+
+// progressFrame renders one frame of the progress view, in 80 columns.
+func progressFrame(title string, total uint64, elapsed time.Duration) string {
+	workers, in, out := Progress()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-60s %18s\n\n", title, "elapsed "+elapsed.Round(100*time.Millisecond).String())
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+	if total > 0 {
+		done := float64(in) / float64(total)
+		if done > 1 {
+			done = 1
+		}
+		fmt.Fprintf(&b, "input   %s %5.1f%%  %s of %s\n", progressBar(done, 30), 100*done, HumanBytes(in), HumanBytes(total))
+	} else {
+		fmt.Fprintf(&b, "input   %s read\n", HumanBytes(in))
+	}
+	fmt.Fprintf(&b, "output  %s written   read %s/s, written %s/s\n\n",
+		HumanBytes(out), HumanBytes(uint64(float64(in)/secs)), HumanBytes(uint64(float64(out)/secs)))
+
+	most := int64(1)
+	for _, wp := range workers {
+		if wp.Tasks > most {
+			most = wp.Tasks
+		}
+	}
+	fmt.Fprintf(&b, "%6s  %-20s %7s %6s %8s %10s %6s %5s\n", "worker", "blocks done", "block", "done", "blocks/s", "~MiB/s", "stolen", "busy")
+	for _, wp := range workers {
+		block := "idle"
+		if wp.Block >= 0 {
+			block = fmt.Sprint(wp.Block)
+		}
+		rate := float64(wp.Tasks) / secs
+		fmt.Fprintf(&b, "%6d  %s %7s %6d %8.1f %10.1f %6d %4.0f%%\n", wp.Worker,
+			progressBar(float64(wp.Tasks)/float64(most), 20), block, wp.Tasks, rate,
+			rate*float64(DefaultBlockSize)/(1<<20), wp.Stolen, 100*wp.Busy.Seconds()/secs)
+	}
+	return b.String()
+}
+
+// progressBar draws a bar width characters wide, filled to frac.
+func progressBar(frac float64, width int) string {
+	n := int(frac*float64(width) + 0.5)
+	if n > width {
+		n = width
+	}
+	return strings.Repeat("#", n) + strings.Repeat(".", width-n)
+}
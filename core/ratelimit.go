@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits throughput to rate bytes per second, shared by every
+// goroutine that calls take. Callers may overdraw the bucket; the debt is
+// paid by sleeping, so concurrent callers queue up behind each other and
+// the aggregate rate holds.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64) *tokenBucket {
+	r := float64(rate)
+	burst := r / 4 // a quarter second of traffic
+	if burst < 64<<10 {
+		burst = 64 << 10
+	}
+	return &tokenBucket{rate: r, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take accounts for n bytes, sleeping until the bucket allows them.
+func (b *tokenBucket) take(n int) {
+	if n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Limiters for file reads and writes; nil means unlimited.
+var readLimiter, writeLimiter *tokenBucket
+
+// SetRateLimit caps file I/O at bytesPerSec, applied to reads, writes or
+// both ("read", "write", "both"). Each direction has one limiter shared by
+// all workers. 0 removes the limit.
+func SetRateLimit(bytesPerSec uint64, dir string) error {
+	if dir != "read" && dir != "write" && dir != "both" {
+		return fmt.Errorf("unknown rate limit direction %q", dir)
+	}
+	readLimiter, writeLimiter = nil, nil
+	if bytesPerSec == 0 {
+		return nil
+	}
+	if dir != "write" {
+		readLimiter = newTokenBucket(bytesPerSec)
+	}
+	if dir != "read" {
+		writeLimiter = newTokenBucket(bytesPerSec)
+	}
+	return nil
+}
+
+func throttleRead(n int) {
+	if readLimiter != nil {
+		readLimiter.take(n)
+	}
+}
+
+func throttleWrite(n int) {
+	if writeLimiter != nil {
+		writeLimiter.take(n)
+	}
+}
@@ -0,0 +1,529 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"proj3/core/codec"
+)
+
+var remoteMagic = [4]byte{'P', 'C', 'Z', 'R'}
+
+const remoteRefused = ^uint64(0) // first block wanted: none, a message follows
+
+// Transfer protocol, one file per connection:
+//
+//	sender:   "PCZR" | int64 mtime | header (no blocks)
+//	receiver: uint64 first block wanted (all ones: refused, and the
+//	          message follows at once)
+//	sender:   per block from there on: uint32 compressed size,
+//	          uint32 CRC-32 of the uncompressed block, block bytes
+//	receiver: uint16 message length, message ("" on success)
+//
+// The hello identifies the transfer. The receiver keeps it next to the
+// partial output, along with the checksum of every block it has written, so
+// a sender that reconnects with the same hello resumes after the last block
+// that is on disk intact instead of starting over.
+
+// remoteError is a failure reported by the receiver; retrying will not help.
+type remoteError struct{ msg string }
+
+func (e *remoteError) Error() string { return "receiver: " + e.msg }
+
+// SendFile compresses the regular file inputPath block by block and sends it
+// to a ReceiveFile listening at addr. Blocks are encoded in batches with the
+// scheduler named by impl and written to the connection in order. If the
+// connection drops, SendFile reconnects with growing pauses and resumes
+// where the receiver left off. Block transforms and encryption are not
+// supported.
+func SendFile(inputPath, addr, impl string, threads int) error {
+	if DefaultTransform != "" || encryption != nil {
+		return fmt.Errorf("send does not support block transforms or encryption")
+	}
+	in, err := openFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("send needs a regular input file")
+	}
+
+	lead := newBlockSet(0).header(info.Name(), uint64(info.Size()), DefaultBlockSize)
+	lead.Flags &^= codec.FlagBlockHashes | codec.FlagSHA256
+	hello := append([]byte(nil), remoteMagic[:]...)
+	hello = binary.LittleEndian.AppendUint64(hello, uint64(info.ModTime().UnixNano()))
+	if hello, err = codec.AppendHeader(hello, lead); err != nil {
+		return err
+	}
+
+	delay := DefaultRetry.Delay
+	for attempt := 1; ; attempt++ {
+		err = sendOnce(in, addr, hello, lead, impl, threads)
+		var re *remoteError
+		if err == nil || errors.As(err, &re) || attempt >= DefaultRetry.Attempts {
+			return err
+		}
+		if werr := retryWait(&delay); werr != nil {
+			return werr
+		}
+	}
+}
+
+// sendOnce runs one connection of a transfer.
+func sendOnce(in *ioFile, addr string, hello []byte, lead *codec.FileHeader, impl string, threads int) error {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	w := bufio.NewWriterSize(conn, 1<<20)
+	r := bufio.NewReader(conn)
+
+	if _, err := w.Write(hello); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var word [8]byte
+	if _, err := io.ReadFull(r, word[:]); err != nil {
+		return fmt.Errorf("read resume point: %w", err)
+	}
+	offs := leadOffsets(lead)
+	numBlocks := uint64(len(offs) - 1)
+	start := binary.LittleEndian.Uint64(word[:])
+	if start == remoteRefused {
+		msg, err := readRemoteStatus(r)
+		if err != nil {
+			return fmt.Errorf("read status: %w", err)
+		}
+		return &remoteError{msg}
+	}
+	if start > numBlocks {
+		return &remoteError{fmt.Sprintf("asked for block %d of %d", start, numBlocks)}
+	}
+
+	if threads <= 0 {
+		threads = 1
+	}
+	batch := uint64(inFlight(threads))
+	bufs := slabFor(int(lead.BlockSize))
+	for base := start; base < numBlocks; base += batch {
+		n := numBlocks - base
+		if n > batch {
+			n = batch
+		}
+		enc := make([][]byte, n)
+		sums := make([]uint32, n)
+		err := codec.ForEachBlock(impl, int(n), threads, func(i int) error {
+			idx := base + uint64(i)
+			buf := bufs.get(int(offs[idx+1] - offs[idx]))
+			defer bufs.put(buf)
+			if _, err := in.ReadAt(buf, offs[idx]); err != nil {
+				return fmt.Errorf("read block %d: %w", idx, err)
+			}
+			sums[i] = crc32.ChecksumIEEE(buf)
+			e, err := codec.EncodeBlock(lead.Filter.Apply(buf))
+			if err != nil {
+				return fmt.Errorf("compress block %d: %w", idx, err)
+			}
+			enc[i] = e
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, e := range enc {
+			binary.LittleEndian.PutUint32(word[:4], uint32(len(e)))
+			binary.LittleEndian.PutUint32(word[4:], sums[i])
+			if _, err := w.Write(word[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	msg, err := readRemoteStatus(r)
+	if err != nil {
+		return fmt.Errorf("read status: %w", err)
+	}
+	if msg != "" {
+		return &remoteError{msg}
+	}
+	return nil
+}
+
+// leadOffsets returns the block offsets of the file described by a lead
+// header, which lists no blocks itself.
+func leadOffsets(h *codec.FileHeader) []int64 {
+	full := *h
+	full.NumBlocks = (h.OriginalSize + uint64(h.BlockSize) - 1) / uint64(h.BlockSize)
+	return full.RawOffsets()
+}
+
+// Deadlines of a receiver connection: a sender has remoteHelloTimeout to
+// send its hello, and may then be silent for remoteIdleTimeout at a time
+// (while it encodes a batch, say) before the connection is dropped.
+const (
+	remoteHelloTimeout = 10 * time.Second
+	remoteIdleTimeout  = time.Minute
+)
+
+// ReceiveFile listens on addr for a SendFile and writes the file it sends
+// to outputPath. Blocks are decoded in parallel with the scheduler named by
+// impl, checked against the sender's checksums and appended to
+// outputPath.part, which is renamed to outputPath when complete. Until then,
+// a dropped connection just waits for the sender to reconnect; a later
+// ReceiveFile for the same output also resumes. Every connection is served
+// on a goroutine of its own, within deadlines, so a client that connects
+// and sends nothing cannot hold up the others; only one at a time writes
+// the output. Files over the request size of DefaultServerLimits are
+// refused and the receiver waits for another sender.
+func ReceiveFile(addr, outputPath, impl string, threads int) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	rv := &receiver{ln: ln, outputPath: outputPath, impl: impl, lim: NewLimiter(DefaultServerLimits)}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			rv.mu.Lock()
+			defer rv.mu.Unlock()
+			if rv.finished {
+				return rv.err
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			n, release, err := rv.lim.Acquire(context.Background(), remoteHost(conn), threads)
+			if err != nil {
+				codec.Warnf("recv %s: rejected: %v", conn.RemoteAddr(), err)
+				return
+			}
+			defer release()
+			rv.serve(&deadlineConn{Conn: conn, hello: time.Now().Add(remoteHelloTimeout)}, n)
+		}()
+	}
+}
+
+// receiver is what the connections of a ReceiveFile share.
+type receiver struct {
+	ln         net.Listener
+	outputPath string
+	impl       string
+	lim        *Limiter
+
+	mu       sync.Mutex // held by the connection writing the output
+	finished bool       // the transfer is over; err is its result
+	err      error
+}
+
+// serve runs one connection. Once the transfer is over, successfully or
+// not, it closes the listener, which ends ReceiveFile.
+func (rv *receiver) serve(conn *deadlineConn, threads int) {
+	lead, hello, ok := readRemoteHello(conn, rv.lim)
+	if !ok {
+		return
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	if rv.finished {
+		return
+	}
+	if final, err := receiveOnce(conn, lead, hello, rv.outputPath, rv.impl, threads); final {
+		rv.finished, rv.err = true, err
+		rv.ln.Close()
+	}
+}
+
+// deadlineConn is a net.Conn whose reads fail after hello until the hello
+// is read, and then once the peer has been silent for remoteIdleTimeout;
+// writes fail once the peer has not taken data for as long.
+type deadlineConn struct {
+	net.Conn
+	hello time.Time // zero once the hello is read
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	deadline := c.hello
+	if deadline.IsZero() {
+		deadline = time.Now().Add(remoteIdleTimeout)
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(remoteIdleTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// readRemoteHello reads the hello of a sender on conn and returns the lead
+// header it describes and the hello itself. It reports !ok for anything
+// that is not a sender, and for files the limits refuse, after telling the
+// sender why.
+func readRemoteHello(conn *deadlineConn, lim *Limiter) (lead *codec.FileHeader, hello []byte, ok bool) {
+	r := bufio.NewReader(conn)
+	var word [8]byte
+	var m [4]byte
+	if _, err := io.ReadFull(r, m[:]); err != nil || m != remoteMagic {
+		return nil, nil, false // not a sender
+	}
+	if _, err := io.ReadFull(r, word[:]); err != nil {
+		return nil, nil, false
+	}
+	lead, err := codec.ReadHeader(r)
+	if err != nil {
+		return nil, nil, false
+	}
+	conn.hello = time.Time{}
+	// Block sizes never exceed 4 MiB (see SetBlockSizeBytes).
+	if lead.NumBlocks != 0 || lead.Flags&^(codec.FlagFilter|codec.FlagExec) != 0 || lead.BlockSize == 0 || lead.BlockSize > 4<<20 {
+		return nil, nil, false
+	}
+	if r.Buffered() != 0 {
+		return nil, nil, false // the sender waits for the resume point
+	}
+	if err := lim.CheckSize(int64(lead.OriginalSize)); err != nil {
+		conn.Write(binary.LittleEndian.AppendUint64(nil, remoteRefused))
+		writeRemoteStatus(conn, err.Error())
+		codec.Warnf("recv %s: refused %q: %v", conn.RemoteAddr(), lead.Filename, err)
+		return nil, nil, false
+	}
+	hello = append(append([]byte(nil), m[:]...), word[:]...)
+	if hello, err = codec.AppendHeader(hello, lead); err != nil {
+		return nil, nil, false
+	}
+	return lead, hello, true
+}
+
+// receiveOnce runs the transfer of a connection whose hello has been read.
+// It reports final when the transfer is over, successfully or not;
+// otherwise the receiver waits for a reconnect.
+func receiveOnce(conn net.Conn, lead *codec.FileHeader, hello []byte, outputPath, impl string, threads int) (bool, error) {
+	r := bufio.NewReaderSize(conn, 1<<20)
+	var word [8]byte
+	fail := func(err error) (bool, error) {
+		writeRemoteStatus(conn, err.Error())
+		return true, err
+	}
+
+	part := outputPath + ".part"
+	idPath := part + ".id"
+	sumsPath := part + ".sums"
+	offs := leadOffsets(lead)
+	numBlocks := uint64(len(offs) - 1)
+	start := uint64(0)
+	var out *ioFile
+	var sums *os.File
+	if id, err := os.ReadFile(idPath); err == nil && bytes.Equal(id, hello) {
+		f, err := os.OpenFile(part, os.O_RDWR, 0)
+		if err == nil {
+			out = &ioFile{File: f}
+			if err := lockOutput(f); err != nil {
+				closeFile(out)
+				return fail(err)
+			}
+			if err := applyOutputMode(f); err != nil {
+				closeFile(out)
+				return fail(err)
+			}
+			if sums, err = os.OpenFile(sumsPath, os.O_RDWR|os.O_CREATE, 0o644); err == nil {
+				start, err = resumePart(f, sums, offs)
+			}
+			if err != nil {
+				closeFile(out)
+				if sums != nil {
+					sums.Close()
+				}
+				return fail(err)
+			}
+		}
+	}
+	if out == nil {
+		var err error
+		if out, err = createFile(part); err != nil {
+			return fail(fmt.Errorf("create output: %w", err))
+		}
+		if err := os.WriteFile(idPath, hello, 0o644); err != nil {
+			closeFile(out)
+			return fail(err)
+		}
+		if sums, err = os.Create(sumsPath); err != nil {
+			closeFile(out)
+			return fail(err)
+		}
+	}
+	defer sums.Close()
+	// No preallocation: the size of the partial file is the resume point.
+
+	binary.LittleEndian.PutUint64(word[:], start)
+	if _, err := conn.Write(word[:]); err != nil {
+		closeFile(out)
+		return false, nil
+	}
+
+	if threads <= 0 {
+		threads = 1
+	}
+	batch := uint64(inFlight(threads))
+	for base := start; base < numBlocks; base += batch {
+		n := numBlocks - base
+		if n > batch {
+			n = batch
+		}
+		comps := make([][]byte, n)
+		crcs := make([]byte, 4*n)
+		for i := range comps {
+			if _, err := io.ReadFull(r, word[:]); err != nil {
+				closeFile(out)
+				return false, nil
+			}
+			size := binary.LittleEndian.Uint32(word[:4])
+			copy(crcs[4*i:], word[4:])
+			if size == 0 || size > lead.BlockSize+1 {
+				closeFile(out)
+				return fail(corruptf("invalid size for block %d", base+uint64(i)))
+			}
+			comps[i] = make([]byte, size)
+			if _, err := io.ReadFull(r, comps[i]); err != nil {
+				closeFile(out)
+				return false, nil
+			}
+		}
+		decs := make([][]byte, n)
+		err := codec.ForEachBlock(impl, int(n), threads, func(i int) error {
+			idx := base + uint64(i)
+			dec, err := decodeMemberBlock(lead, int(idx), comps[i], int(offs[idx+1]-offs[idx]))
+			if err != nil {
+				return fmt.Errorf("decompress block %d: %w", idx, err)
+			}
+			if crc32.ChecksumIEEE(dec) != binary.LittleEndian.Uint32(crcs[4*i:]) {
+				return verifyf("block %d: checksum mismatch", idx)
+			}
+			decs[i] = dec
+			return nil
+		})
+		if err == nil {
+			for _, d := range decs {
+				if _, err = out.Write(d); err != nil {
+					break
+				}
+			}
+		}
+		// The checksums follow the blocks, so every one acknowledges a
+		// block already written.
+		if err == nil {
+			_, err = sums.Write(crcs)
+		}
+		if err != nil {
+			closeFile(out)
+			return fail(err)
+		}
+	}
+
+	if err := closeFile(out); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(part, outputPath); err != nil {
+		return fail(err)
+	}
+	os.Remove(idPath)
+	os.Remove(sumsPath)
+	writeRemoteStatus(conn, "")
+	return true, nil
+}
+
+// resumePart finds where an interrupted transfer into part resumes: after
+// the last block whose checksum is in sums and whose data in part still
+// matches it. Blocks written when the receiver died may be missing or torn,
+// so the tail is checked back to the first intact block. Both files are cut
+// to the resume point and positioned at their ends.
+func resumePart(part, sums *os.File, offs []int64) (uint64, error) {
+	journal, err := io.ReadAll(sums)
+	if err != nil {
+		return 0, err
+	}
+	info, err := part.Stat()
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(len(journal) / 4)
+	if n > uint64(len(offs)-1) {
+		n = uint64(len(offs) - 1)
+	}
+	for n > 0 && offs[n] > info.Size() {
+		n--
+	}
+	for ; n > 0; n-- {
+		buf := make([]byte, offs[n]-offs[n-1])
+		if _, err := part.ReadAt(buf, offs[n-1]); err != nil {
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(buf) == binary.LittleEndian.Uint32(journal[4*(n-1):]) {
+			break
+		}
+	}
+	if err := part.Truncate(offs[n]); err != nil {
+		return 0, err
+	}
+	if _, err := part.Seek(offs[n], io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := sums.Truncate(int64(4 * n)); err != nil {
+		return 0, err
+	}
+	if _, err := sums.Seek(int64(4*n), io.SeekStart); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// writeRemoteStatus sends the receiver's final message.
+func writeRemoteStatus(w io.Writer, msg string) {
+	if len(msg) > 0xFFFF {
+		msg = msg[:0xFFFF]
+	}
+	b := binary.LittleEndian.AppendUint16(nil, uint16(len(msg)))
+	w.Write(append(b, msg...))
+}
+
+// readRemoteStatus reads the receiver's final message.
+func readRemoteStatus(r io.Reader) (string, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	msg := make([]byte, binary.LittleEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
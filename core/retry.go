@@ -0,0 +1,102 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// RetryPolicy says how I/O that fails with a transient error is tried
+// again: Attempts tries in all, the first included, with a pause of Delay
+// before the first retry that doubles after each one up to MaxDelay.
+type RetryPolicy struct {
+	Attempts int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetry applies to file reads and writes, HTTP inputs and send's
+// connections. A read or write is retried from where it stopped, so one
+// block is redone at most, never the job.
+var DefaultRetry = RetryPolicy{Attempts: 8, Delay: time.Second, MaxDelay: 30 * time.Second}
+
+// SetRetry retries transient failures up to retries times, pausing delay
+// before the first retry. Pauses double up to 30 seconds, or up to delay if
+// that is longer.
+func SetRetry(retries int, delay time.Duration) error {
+	if retries < 0 || delay < 0 {
+		return fmt.Errorf("retries and retry delay must not be negative")
+	}
+	p := RetryPolicy{Attempts: retries + 1, Delay: delay, MaxDelay: 30 * time.Second}
+	if delay > p.MaxDelay {
+		p.MaxDelay = delay
+	}
+	DefaultRetry = p
+	return nil
+}
+
+// httpStatus is an HTTP response that was not the one asked for.
+type httpStatus struct {
+	code int
+	msg  string
+}
+
+func (e *httpStatus) Error() string { return e.msg }
+
+// statusError reports resp's status as an I/O error, prefixed by what.
+func statusError(what string, resp *http.Response) error {
+	msg := resp.Status
+	if what != "" {
+		msg = what + ": " + msg
+	}
+	return &kindError{errIO, &httpStatus{resp.StatusCode, msg}}
+}
+
+// isTransient reports whether err may go away by itself: an interrupted or
+// would-block call, a timeout (NFS soft mounts fail with ETIMEDOUT), a
+// dropped connection, or an HTTP status that asks to come back later, as
+// object stores answer when they are overloaded.
+func isTransient(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EINTR, syscall.EAGAIN, syscall.ETIMEDOUT, syscall.ECONNRESET, syscall.ECONNREFUSED:
+			return true
+		}
+		return false
+	}
+	var st *httpStatus
+	if errors.As(err, &st) {
+		return st.code >= 500 || st.code == http.StatusTooManyRequests || st.code == http.StatusRequestTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isPermanent reports whether err is an HTTP status that asking again will
+// not change, such as 404. Other failures of an HTTP transfer, a body cut
+// short included, are worth a retry.
+func isPermanent(err error) bool {
+	var st *httpStatus
+	return errors.As(err, &st) && !isTransient(err)
+}
+
+// retryTransient calls op again while err, what op last failed with, is
+// transient and DefaultRetry allows, warning about each retry. op must
+// carry on from where the failed call stopped.
+func retryTransient(what string, err error, op func() error) error {
+	delay := DefaultRetry.Delay
+	for attempt := 2; err != nil && isTransient(err) && attempt <= DefaultRetry.Attempts; attempt++ {
+		codec.Warnf("warning: %s: %v; retrying in %v (attempt %d of %d)", what, err, delay, attempt, DefaultRetry.Attempts)
+		if werr := retryWait(&delay); werr != nil {
+			return werr
+		}
+		err = op()
+	}
+	return err
+}
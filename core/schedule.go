@@ -0,0 +1,295 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"proj3/core/codec"
+)
+
+// decompressMember decodes the member described by h from in to out with the
+// named implementation.
+func decompressMember(impl string, in io.Reader, out io.Writer, h *codec.FileHeader, threads int) error {
+	switch impl {
+	case "seq":
+		return sequentialDecompressMember(in, out, h)
+	case "bsp":
+		return bspDecompressMember(in, out, h, threads)
+	case "ws":
+		return wsDecompressMember(in, out, h, threads)
+	case "fj":
+		return decompressWindowed(in, out, h, threads, codec.FJForEach)
+	case "pool":
+		return decompressWindowed(in, out, h, threads, codec.PoolForEach)
+	default:
+		return fmt.Errorf("unknown implementation %q", impl)
+	}
+}
+
+// compressFile compresses the file at inputPath to outputPath, encoding its
+// blocks with the scheduler named by impl. Inputs that cannot be sized up
+// front are streamed.
+func compressFile(impl, inputPath, outputPath string, threads int) error {
+	if threads <= 0 {
+		threads = 1
+	}
+	if inputPath == "-" || isURL(inputPath) {
+		return streamCompressFile(inputPath, outputPath, impl, threads)
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return streamCompressFile(inputPath, outputPath, impl, threads)
+	}
+	if info.Size() == 0 {
+		out, err := createArchive(outputPath)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		defer closeFile(out)
+		header := &codec.FileHeader{Filename: info.Name(), BlockSize: DefaultBlockSize}
+		emptyDigest(header)
+		if err := codec.WriteEmptyMember(out, header); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+		return commitFile(out)
+	}
+
+	if DefaultPrefetch && !DefaultLongRange {
+		return compressPrefetched(impl, inputPath, outputPath, info, threads)
+	}
+	data, err := readFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("read input: %w", err)
+	}
+	blockSize := int(DefaultBlockSize)
+	numBlocks := (len(data) + blockSize - 1) / blockSize
+
+	set := newBlockSet(numBlocks)
+	set.detect(info.Name())
+	if DefaultLongRange {
+		set.refs = findLongRange(data)
+	}
+	wait := set.hashInput(data)
+	done := codec.StartPhase("compress")
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		s := idx * blockSize
+		e := s + blockSize
+		if e > len(data) {
+			e = len(data)
+		}
+		return set.encodeAt(idx, int64(s), data[s:e])
+	})
+	done()
+	wait()
+	if err != nil {
+		return err
+	}
+
+	header := set.header(info.Name(), uint64(len(data)), DefaultBlockSize)
+	return writeArchive(outputPath, header, set.enc)
+}
+
+// decompressFile decodes every member of the archive at compressedPath, one
+// after another, into outputPath with the scheduler named by impl.
+func decompressFile(impl, compressedPath, outputPath string, threads int) error {
+	if threads <= 0 {
+		threads = 1
+	}
+	in, err := openFile(compressedPath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	h, err := readMemberLead(in, 0)
+	if err != nil {
+		return err
+	}
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+
+	for member := 0; ; member++ {
+		if member > 0 {
+			h, err = readMemberLead(in, member)
+			if err == io.EOF {
+				return commitFile(out)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if h.Flags&codec.FlagTrailer != 0 {
+			err = decompressStreamed(impl, in, out, h, threads)
+		} else {
+			err = decompressPayload(in, out, compressedPath, h, func(payload io.Reader, w io.Writer) error {
+				return decompressMember(impl, payload, w, h, threads)
+			})
+		}
+		if err != nil {
+			if member > 0 {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+			return err
+		}
+	}
+}
+
+// decompressPayload decodes member h, which is not streamed, from in or
+// its volumes to out with decode, and checks it against its digest.
+func decompressPayload(in io.Reader, out *ioFile, path string, h *codec.FileHeader, decode func(payload io.Reader, w io.Writer) error) error {
+	payload, closeVolumes, err := openPayload(in, path, h)
+	if err != nil {
+		return err
+	}
+	defer closeVolumes()
+	if err := reserve(out, h.OriginalSize); err != nil {
+		return err
+	}
+	return checkMember(out, h, func(w io.Writer) error {
+		return decode(payload, w)
+	})
+}
+
+// decompressWindowed decodes the member described by h from in to out with
+// forEach, one window of blocks at a time: the window's compressed blocks
+// are read, then decoded in parallel and handed to an OrderedWriter, which
+// writes every run of blocks as soon as it is complete. Memory stays at a
+// few blocks per worker (see DefaultInFlight) however large the member. Long-range references are resolved in place once the member is
+// written, when out is a file; otherwise the member is decoded in memory.
+// Chained members decode in order, as with -impl seq. Under DefaultMmap,
+// blocks are decoded into a mapping of out instead (see decompressMapped).
+func decompressWindowed(in io.Reader, out io.Writer, h *codec.FileHeader, threads int, forEach func(n, threads int, fn func(idx int) error) error) error {
+	if h.OriginalSize == 0 || h.NumBlocks == 0 {
+		return nil
+	}
+	if h.Flags&codec.FlagChained != 0 {
+		return sequentialDecompressMember(in, out, h)
+	}
+	if f, ok := out.(*ioFile); ok && DefaultMmap {
+		if mapped, err := decompressMapped(in, f, h, threads, forEach); mapped {
+			return err
+		}
+	}
+	var base int64
+	if h.Flags&codec.FlagLongRange != 0 {
+		f, ok := out.(*ioFile)
+		if ok {
+			var err error
+			base, err = f.Seek(0, io.SeekCurrent)
+			ok = err == nil
+		}
+		if !ok {
+			return decompressWhole(in, out, h, threads, forEach)
+		}
+	}
+
+	numBlocks := int(h.NumBlocks)
+	offs := h.RawOffsets()
+	ow := NewOrderedWriter(out, inFlight(threads))
+	phase := func() func() { return codec.StartPhaseAround("decompress", "write") }
+	err := decodeWindows(in, h, threads, forEach, phase, func(idx int, comp []byte) error {
+		dec, err := decodeMemberBlock(h, idx, comp, int(offs[idx+1]-offs[idx]))
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		if err := ow.WriteIndex(idx, dec); err != nil {
+			return fmt.Errorf("write block %d: %w", idx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := ow.Close(numBlocks); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	if h.Flags&codec.FlagLongRange != 0 {
+		return resolveLongRangeAt(h, out.(*ioFile), base)
+	}
+	return nil
+}
+
+// decodeWindows reads the compressed blocks of member h from in, a window
+// of blocks at a time, and runs fn on every block of a window with forEach
+// before reading the next. phase times each window's fn calls.
+func decodeWindows(in io.Reader, h *codec.FileHeader, threads int, forEach func(n, threads int, fn func(idx int) error) error, phase func() func(), fn func(idx int, comp []byte) error) error {
+	numBlocks := int(h.NumBlocks)
+	window := inFlight(threads)
+	var compData []byte
+	comps := make([][]byte, window)
+	for w := 0; w < numBlocks; w += window {
+		n := numBlocks - w
+		if n > window {
+			n = window
+		}
+		total := uint64(0)
+		for _, s := range h.BlockCompSizes[w : w+n] {
+			total += s
+		}
+		if uint64(cap(compData)) < total {
+			compData = make([]byte, total)
+		}
+		compData = compData[:total]
+		done := codec.StartPhase("read")
+		if _, err := io.ReadFull(in, compData); err != nil {
+			return fmt.Errorf("read compressed payload: %w", err)
+		}
+		done()
+		cur := uint64(0)
+		for k, s := range h.BlockCompSizes[w : w+n] {
+			comps[k] = compData[cur : cur+s]
+			cur += s
+		}
+
+		done = phase()
+		err := forEach(n, threads, func(k int) error {
+			return fn(w+k, comps[k])
+		})
+		if err != nil {
+			return err
+		}
+		done()
+	}
+	return nil
+}
+
+// decompressWhole decodes the member described by h into memory with
+// forEach, resolves its long-range references and writes it to out.
+func decompressWhole(in io.Reader, out io.Writer, h *codec.FileHeader, threads int, forEach func(n, threads int, fn func(idx int) error) error) error {
+	offs := h.RawOffsets()
+	comps, err := readBlocks(in, h)
+	if err != nil {
+		return err
+	}
+
+	outBuf := make([]byte, h.OriginalSize)
+	done := codec.StartPhase("decompress")
+	err = forEach(int(h.NumBlocks), threads, func(idx int) error {
+		s, e := int(offs[idx]), int(offs[idx+1])
+
+		dec, err := decodeMemberBlock(h, idx, comps[idx], e-s)
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		copy(outBuf[s:e], dec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	resolveLongRange(h, outBuf)
+	done()
+
+	defer codec.StartPhase("write")()
+	if _, err := out.Write(outBuf); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	return nil
+}
@@ -2,9 +2,11 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"os"
+
+	"proj3/core/codec"
 )
 
 // DefaultBlockSize is the global block size for sequential compression.
@@ -24,20 +26,24 @@ func SetBlockSizeBytes(n uint32) {
 //   - opens inputPath
 //   - splits into blocks (DefaultBlockSize)
 //   - per block: try LZ tokens (0x00), else raw (0xFF)
+//   - with DefaultChained, matches may reach into the block before
 //   - writes header + block table + blocks
 func SequentialCompressFile(inputPath, outputPath string) error {
-	in, err := os.Open(inputPath)
+	if inputPath == "-" || isURL(inputPath) {
+		return streamCompressFile(inputPath, outputPath, "seq", 1)
+	}
+	in, err := openFile(inputPath)
 	if err != nil {
 		return fmt.Errorf("open input: %w", err)
 	}
-	defer in.Close()
+	defer closeFile(in)
 
 	info, err := in.Stat()
 	if err != nil {
 		return fmt.Errorf("stat input: %w", err)
 	}
 	if !info.Mode().IsRegular() {
-		return fmt.Errorf("input is not a regular file")
+		return streamCompress(in, info.Name(), outputPath, "seq", 1)
 	}
 
 	originalSize := info.Size()
@@ -47,32 +53,56 @@ func SequentialCompressFile(inputPath, outputPath string) error {
 
 	// Empty file edge case.
 	if originalSize == 0 {
-		out, err := os.Create(outputPath)
+		out, err := createArchive(outputPath)
 		if err != nil {
 			return fmt.Errorf("create output: %w", err)
 		}
-		defer out.Close()
+		defer closeFile(out)
 
-		header := &FileHeader{
+		header := &codec.FileHeader{
 			Filename:       info.Name(),
 			OriginalSize:   0,
 			BlockSize:      DefaultBlockSize,
 			NumBlocks:      0,
 			BlockCompSizes: nil,
 		}
-		if err := WriteHeader(out, header); err != nil {
+		emptyDigest(header)
+		if err := codec.WriteEmptyMember(out, header); err != nil {
 			return fmt.Errorf("write header: %w", err)
 		}
-		return nil
+		return commitFile(out)
 	}
 
 	blockSize := int(DefaultBlockSize)
 	numBlocks := (originalSize + int64(blockSize) - 1) / int64(blockSize)
 
-	compressedBlocks := make([][]byte, numBlocks)
-	blockCompSizes := make([]uint64, numBlocks)
+	set := newBlockSet(int(numBlocks))
+	set.chained = DefaultChained
+	bufs := slabFor(blockSize)
+
+	// The pre-pass needs the whole file; the blocks are then cut from it.
+	var data []byte
+	wait := func() {}
+	if DefaultLongRange {
+		if DefaultChained {
+			return fmt.Errorf("chained blocks cannot have long-range references")
+		}
+		data, err = readFile(inputPath)
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
+		}
+		if int64(len(data)) != originalSize {
+			return fmt.Errorf("input changed size while reading")
+		}
+		set.refs = findLongRange(data)
+		set.detect(info.Name())
+		wait = set.hashInput(data)
+	}
 
 	for blockIndex := int64(0); blockIndex < numBlocks; blockIndex++ {
+		if err := codec.CanceledErr(); err != nil {
+			return err
+		}
 		var thisBlockSize int
 		if blockIndex < numBlocks-1 {
 			thisBlockSize = blockSize
@@ -81,129 +111,151 @@ func SequentialCompressFile(inputPath, outputPath string) error {
 			thisBlockSize = int(remaining)
 		}
 
-		buf := make([]byte, thisBlockSize)
+		off := blockIndex * int64(blockSize)
+		if data != nil {
+			done := codec.StartPhase("compress")
+			err := set.encodeAt(int(blockIndex), off, data[off:off+int64(thisBlockSize)])
+			done()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		buf := bufs.get(thisBlockSize)
+		done := codec.StartPhase("read")
 		if _, err := io.ReadFull(in, buf); err != nil {
 			return fmt.Errorf("read block %d: %w", blockIndex, err)
 		}
+		done()
 
-		tokens := lzCompressTokens(buf)
-
-		var encoded []byte
-		if len(tokens)+1 >= len(buf)+1 {
-			encoded = make([]byte, 1+len(buf))
-			encoded[0] = 0xFF
-			copy(encoded[1:], buf)
-		} else {
-			encoded = make([]byte, 1+len(tokens))
-			encoded[0] = 0x00
-			copy(encoded[1:], tokens)
+		hashed := set.hashInput(buf)
+		done = codec.StartPhase("compress")
+		if blockIndex == 0 {
+			set.detect(info.Name())
 		}
-
-		compressedBlocks[blockIndex] = encoded
-		blockCompSizes[blockIndex] = uint64(len(encoded))
-	}
-
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("create output: %w", err)
-	}
-	defer func() { _ = out.Close() }()
-
-	header := &FileHeader{
-		Filename:       info.Name(),
-		OriginalSize:   uint64(originalSize),
-		BlockSize:      uint32(blockSize),
-		NumBlocks:      uint64(numBlocks),
-		BlockCompSizes: blockCompSizes,
-	}
-	if err := WriteHeader(out, header); err != nil {
-		return fmt.Errorf("write header: %w", err)
-	}
-
-	for i := int64(0); i < numBlocks; i++ {
-		if _, err := out.Write(compressedBlocks[i]); err != nil {
-			return fmt.Errorf("write block %d: %w", i, err)
+		err := set.encode(int(blockIndex), buf)
+		done()
+		hashed()
+		bufs.put(buf)
+		if err != nil {
+			return err
 		}
 	}
-	return nil
+	wait()
+
+	header := set.header(info.Name(), uint64(originalSize), uint32(blockSize))
+	return writeArchive(outputPath, header, set.enc)
 }
 
 // SequentialDecompressFile:
 //   - reads header, then per block: 0xFF (raw) or 0x00 (LZ tokens)
+//   - repeats for every concatenated member until the input is exhausted
 func SequentialDecompressFile(compressedPath, outputPath string) error {
-	in, err := os.Open(compressedPath)
+	in, err := openFile(compressedPath)
 	if err != nil {
 		return fmt.Errorf("open input: %w", err)
 	}
-	defer in.Close()
+	defer closeFile(in)
 
-	header, err := ReadHeader(in)
+	header, err := readMemberLead(in, 0)
 	if err != nil {
-		return fmt.Errorf("read header: %w", err)
+		return err
 	}
 
-	out, err := os.Create(outputPath)
+	out, err := createAtomic(outputPath)
 	if err != nil {
 		return fmt.Errorf("create output: %w", err)
 	}
-	defer func() { _ = out.Close() }()
+	defer func() { _ = closeFile(out) }()
 
+	for member := 0; ; member++ {
+		if member > 0 {
+			header, err = readMemberLead(in, member)
+			if err == io.EOF {
+				return commitFile(out)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if header.Flags&codec.FlagTrailer != 0 {
+			err = decompressStreamed("seq", in, out, header, 1)
+		} else {
+			err = decompressPayload(in, out, compressedPath, header, func(payload io.Reader, w io.Writer) error {
+				return sequentialDecompressMember(payload, w, header)
+			})
+		}
+		if err != nil {
+			if member > 0 {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+			return err
+		}
+	}
+}
+
+// sequentialDecompressMember decodes the blocks of one member, reading them
+// from in and writing them to out in order. A member with long-range
+// references is collected in memory and written once they are resolved.
+func sequentialDecompressMember(in io.Reader, out io.Writer, header *codec.FileHeader) error {
 	if header.OriginalSize == 0 || header.NumBlocks == 0 {
 		return nil
 	}
+	if header.Flags&codec.FlagLongRange != 0 {
+		var buf bytes.Buffer
+		buf.Grow(int(header.OriginalSize))
+		lr := *header
+		lr.Flags &^= codec.FlagLongRange
+		if err := sequentialDecompressMember(in, &buf, &lr); err != nil {
+			return err
+		}
+		resolveLongRange(header, buf.Bytes())
+		defer codec.StartPhase("write")()
+		if _, err := out.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("write output: %w", err)
+		}
+		return nil
+	}
 
-	blockSize := int(header.BlockSize)
 	numBlocks := int(header.NumBlocks)
-	originalSize := int64(header.OriginalSize)
+	offs := header.RawOffsets()
+	var dict []byte // chained members only
 
 	for blockIndex := 0; blockIndex < numBlocks; blockIndex++ {
+		if err := codec.CanceledErr(); err != nil {
+			return err
+		}
 		compSize := header.BlockCompSizes[blockIndex]
 		if compSize == 0 {
-			return fmt.Errorf("invalid compressed size for block %d", blockIndex)
+			return corruptf("invalid compressed size for block %d", blockIndex)
 		}
 
 		compBuf := make([]byte, compSize)
+		done := codec.StartPhase("read")
 		if _, err := io.ReadFull(in, compBuf); err != nil {
 			return fmt.Errorf("read compressed block %d: %w", blockIndex, err)
 		}
-		if len(compBuf) == 0 {
-			return fmt.Errorf("empty block %d", blockIndex)
-		}
+		done()
 
-		var expectedOrigSize int
-		if blockIndex < numBlocks-1 {
-			expectedOrigSize = blockSize
+		expectedOrigSize := int(offs[blockIndex+1] - offs[blockIndex])
+
+		done = codec.StartPhase("decompress")
+		var decompressed []byte
+		var err error
+		if header.Flags&codec.FlagChained != 0 {
+			decompressed, dict, err = decodeChainedBlock(header, blockIndex, dict, compBuf, expectedOrigSize)
 		} else {
-			fullBlocksSize := int64(blockSize) * int64(numBlocks-1)
-			remaining := originalSize - fullBlocksSize
-			expectedOrigSize = int(remaining)
+			decompressed, err = decodeMemberBlock(header, blockIndex, compBuf, expectedOrigSize)
 		}
-
-		mode := compBuf[0]
-		data := compBuf[1:]
-
-		switch mode {
-		case 0xFF:
-			if len(data) != expectedOrigSize {
-				return fmt.Errorf("raw block %d size mismatch: got %d, expected %d",
-					blockIndex, len(data), expectedOrigSize)
-			}
-			if _, err := out.Write(data); err != nil {
-				return fmt.Errorf("write raw block %d: %w", blockIndex, err)
-			}
-
-		case 0x00:
-			decompressed, err := lzDecompressTokens(data, expectedOrigSize)
-			if err != nil {
-				return fmt.Errorf("decompress block %d: %w", blockIndex, err)
-			}
-			if _, err := out.Write(decompressed); err != nil {
-				return fmt.Errorf("write block %d: %w", blockIndex, err)
-			}
-
-		default:
-			return fmt.Errorf("unknown block mode 0x%02x in block %d", mode, blockIndex)
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", blockIndex, err)
+		}
+		done()
+		done = codec.StartPhase("write")
+		if _, err := out.Write(decompressed); err != nil {
+			return fmt.Errorf("write block %d: %w", blockIndex, err)
 		}
+		done()
 	}
 	return nil
 }
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// ServerTLS returns the TLS configuration of a server with the certificate
+// and key in the PEM files certFile and keyFile. The files are read again
+// whenever the certificate's changes, so renewals by certbot, lego or any
+// other ACME client take effect without a restart. With clientCA, the
+// PEM file of the authorities that issue client certificates, every
+// client must present one they signed (mutual TLS).
+func ServerTLS(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.get(nil); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: c.get}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// certReloader loads a certificate and key, and again once the certificate
+// file has a new modification time. A reload that fails keeps the old
+// pair and is reported as a warning.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fi, err := os.Stat(c.certFile)
+	if err == nil && c.cert != nil && fi.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile); err == nil {
+			c.cert, c.modTime = &cert, fi.ModTime()
+			return c.cert, nil
+		}
+	}
+	if c.cert == nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	if fi != nil && !fi.ModTime().Equal(c.modTime) {
+		codec.Warnf("reload certificate: %v; keeping the old one", err)
+		c.modTime = fi.ModTime() // warn once per change, not on every handshake
+	}
+	return c.cert, nil
+}
+
+// Tokens is a set of bearer tokens, as read by LoadTokens. Only their
+// SHA-256 digests are kept, and they are compared in constant time.
+type Tokens struct {
+	sums [][32]byte
+}
+
+// LoadTokens reads the tokens in path, one per line. Blank lines and lines
+// starting with # are skipped.
+func LoadTokens(path string) (*Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &Tokens{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t.sums = append(t.sums, sha256.Sum256([]byte(line)))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.sums) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return t, nil
+}
+
+// Valid reports whether token is one of t.
+func (t *Tokens) Valid(token string) bool {
+	sum := sha256.Sum256([]byte(token))
+	ok := 0
+	for i := range t.sums {
+		ok |= subtle.ConstantTimeCompare(sum[:], t.sums[i][:])
+	}
+	return ok == 1
+}
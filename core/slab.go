@@ -0,0 +1,88 @@
+package core
+
+import "sync"
+
+// DefaultSlab hands the compressors their input blocks out of slabs: large
+// regions cut into block-sized buffers, which go back to the slab once a
+// window (or block) is encoded and are handed out again, to later windows
+// and later jobs of the same process. A continuous compressor then
+// allocates its input buffers once instead of once per block, and the
+// garbage collector has that much less to chase.
+var DefaultSlab = true
+
+func SetSlab(on bool) {
+	DefaultSlab = on
+}
+
+// slabRegion is how many bytes a slab allocates at a time; blocks larger
+// than that get a region each.
+const slabRegion = 16 << 20
+
+// slab is a free list of buffers of size bytes. It grows a region at a time
+// and keeps its peak: buffers are never given back to the runtime.
+type slab struct {
+	size int
+	mu   sync.Mutex
+	free [][]byte
+}
+
+var (
+	slabsMu sync.Mutex
+	slabs   = map[int]*slab{}
+)
+
+// slabFor returns the slab of buffers of size bytes, shared by every job
+// of the process, or nil without DefaultSlab. A nil slab allocates on get
+// and drops on put.
+func slabFor(size int) *slab {
+	if !DefaultSlab || size <= 0 {
+		return nil
+	}
+	slabsMu.Lock()
+	defer slabsMu.Unlock()
+	s := slabs[size]
+	if s == nil {
+		s = &slab{size: size}
+		slabs[size] = s
+	}
+	return s
+}
+
+// get returns a buffer of n bytes. Its contents are whatever the last user
+// left there. Buffers larger than the slab's are allocated on their own.
+func (s *slab) get(n int) []byte {
+	if s == nil || n > s.size {
+		return make([]byte, n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.free) == 0 {
+		count := slabRegion / s.size
+		if count < 1 {
+			count = 1
+		}
+		region := make([]byte, count*s.size)
+		for i := 0; i < count; i++ {
+			s.free = append(s.free, region[i*s.size:(i+1)*s.size:(i+1)*s.size])
+		}
+	}
+	b := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	return b[:n]
+}
+
+// put gives bufs back to the slab. The caller must be done with them:
+// nothing may still read or write them. Buffers get did not hand out are
+// left to the garbage collector.
+func (s *slab) put(bufs ...[]byte) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range bufs {
+		if cap(b) == s.size {
+			s.free = append(s.free, b[:s.size])
+		}
+	}
+}
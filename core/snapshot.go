@@ -0,0 +1,649 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"proj3/core/codec"
+)
+
+var (
+	snapshotMagic      = [4]byte{'P', 'C', 'Z', 'S'}
+	snapshotMagicFlags = [4]byte{'P', 'C', 'Z', 'X'} // followed by a uint32 flags word
+)
+
+const (
+	// SnapshotXattrs: every entry carries its extended attributes (see
+	// xattr.go).
+	SnapshotXattrs uint32 = 1 << 0
+	// SnapshotOwner: every entry carries its owner and group (see owner.go).
+	SnapshotOwner uint32 = 1 << 1
+	// SnapshotSHA256: every regular file carries the SHA-256 of its
+	// contents (see manifest.go).
+	SnapshotSHA256 uint32 = 1 << 2
+	// SnapshotSymlinks: the snapshot has symlinks, whose entries carry a
+	// uint16 target length and the target after the mtime. Set only when
+	// there are any, so snapshots without stay readable by older readers.
+	SnapshotSymlinks uint32 = 1 << 3
+
+	knownSnapshotFlags = SnapshotXattrs | SnapshotOwner | SnapshotSHA256 | SnapshotSymlinks
+)
+
+// SnapshotEntry is one file, directory or symlink recorded in a snapshot.
+type SnapshotEntry struct {
+	Path    string // slash-separated, relative to the snapshot root
+	Mode    fs.FileMode
+	ModTime time.Time
+	Target  string            // symlinks: the link's target, as stored
+	Header  *codec.FileHeader // regular files: block store manifest of the contents
+	Xattrs  []Xattr           // SnapshotXattrs
+	Owner   Owner             // SnapshotOwner
+	SHA256  [32]byte          // SnapshotSHA256, regular files
+}
+
+// Snapshot is the manifest of a directory tree whose file contents live in
+// the block store. It is written as
+//
+//	"PCZS" | uint16 parent length, parent | uint32 entry count | entries
+//
+// where each entry is a uint16 path length, the path, uint32 mode, int64
+// mtime (Unix nanoseconds) and, for regular files, the file's header.
+// Snapshots with flags start with "PCZX" and a uint32 flags word instead;
+// with SnapshotSymlinks, a symlink's target follows its mtime, with
+// SnapshotXattrs the attributes of an entry come next, with SnapshotOwner
+// its owner follows them, and with SnapshotSHA256 a regular file's SHA-256
+// comes last.
+type Snapshot struct {
+	Flags   uint32
+	Parent  string // snapshot this one was taken against, if any
+	Entries []SnapshotEntry
+}
+
+// TakeSnapshot records inputPath (a file or directory tree) as a snapshot at
+// outputPath, storing file contents in DefaultStore. Given the previous
+// snapshot at parentPath, files whose size and mtime are unchanged are
+// carried over without being read, and changed files only encode the blocks
+// whose SHA-256 differs from the previous version. Every snapshot is
+// complete on its own: unchanged data simply points at the same objects.
+// The blocks of all changed files are scheduled as one set of tasks, so a
+// small file is one task and a large one several. Symlinks are recorded with
+// their targets; devices, sockets and pipes cannot be, and are reported as
+// warnings and, once the snapshot is written, as an error.
+func TakeSnapshot(inputPath, outputPath, parentPath, impl string, threads int) error {
+	if DefaultStore == "" {
+		return fmt.Errorf("snapshots need a block store (-store)")
+	}
+	prev := map[string]*SnapshotEntry{}
+	parentSums := false
+	if parentPath != "" {
+		parent, err := ReadSnapshot(parentPath)
+		if err != nil {
+			return fmt.Errorf("parent snapshot: %w", err)
+		}
+		parentSums = parent.Flags&SnapshotSHA256 != 0
+		for i := range parent.Entries {
+			prev[parent.Entries[i].Path] = &parent.Entries[i]
+		}
+	}
+
+	snap := &Snapshot{Parent: parentPath}
+	if DefaultXattrs {
+		snap.Flags |= SnapshotXattrs
+	}
+	if DefaultManifest != "" {
+		snap.Flags |= SnapshotSHA256
+	}
+	owners := newOwnerNames()
+	if DefaultOwner {
+		if ownersSupported {
+			snap.Flags |= SnapshotOwner
+		} else {
+			codec.Warnf("ownership not recorded: not supported on this platform")
+		}
+	}
+	root := filepath.Clean(inputPath)
+	entries, err := walkTree(root, threads)
+	if err != nil {
+		return err
+	}
+	var jobs []*snapshotJob
+	var unhashed []int // entries whose SHA-256 is still to be computed
+	var paths []string // of every entry, on disk
+	skipped := 0       // entries of a type a snapshot cannot record
+	for _, w := range entries {
+		info := w.info
+		symlink := info.Mode()&fs.ModeSymlink != 0
+		if !info.IsDir() && !info.Mode().IsRegular() && !symlink {
+			codec.Warnf("%s: %s cannot be recorded in a snapshot; skipped", w.path, fileKind(info.Mode()))
+			skipped++
+			continue
+		}
+		rel, err := filepath.Rel(root, w.path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			if info.IsDir() {
+				continue
+			}
+			rel = filepath.Base(w.path)
+		}
+		name, err := memberPath(filepath.ToSlash(rel))
+		if err != nil {
+			codec.Warnf("%v; skipped", err)
+			continue
+		}
+		e := SnapshotEntry{Path: name, Mode: info.Mode(), ModTime: info.ModTime()}
+		if symlink {
+			if e.Target, err = os.Readlink(w.path); err != nil {
+				return err
+			}
+			snap.Flags |= SnapshotSymlinks
+		}
+		if DefaultXattrs && !symlink {
+			// Setting an attribute leaves the mtime alone, so they are read
+			// even for files carried over from the parent.
+			if e.Xattrs, err = captureXattrs(w.path); err != nil {
+				return err
+			}
+		}
+		if snap.Flags&SnapshotOwner != 0 {
+			e.Owner = owners.capture(info)
+		}
+		if info.Mode().IsRegular() {
+			old := prev[e.Path]
+			if old != nil && old.Header != nil && old.Header.OriginalSize == uint64(info.Size()) && old.ModTime.Equal(e.ModTime) {
+				e.Header = old.Header
+				e.SHA256 = old.SHA256
+				if snap.Flags&SnapshotSHA256 != 0 && !parentSums {
+					unhashed = append(unhashed, len(snap.Entries))
+				}
+			} else {
+				var oldHeader *codec.FileHeader
+				if old != nil {
+					oldHeader = old.Header
+				}
+				jobs = append(jobs, newSnapshotJob(w.path, len(snap.Entries), info.Size(), oldHeader))
+				unhashed = append(unhashed, len(snap.Entries))
+			}
+		}
+		snap.Entries = append(snap.Entries, e)
+		paths = append(paths, w.path)
+	}
+
+	// One task per block of every changed file, so a tree of many small
+	// files keeps all workers busy as well as one large file does.
+	var tasks []snapshotTask
+	for _, j := range jobs {
+		for b := 0; b < len(j.keys); b++ {
+			tasks = append(tasks, snapshotTask{job: j, block: b})
+		}
+	}
+	err = codec.ForEachBlock(impl, len(tasks), threads, func(idx int) error {
+		t := tasks[idx]
+		if err := t.job.store(t.block); err != nil {
+			return fmt.Errorf("%s: %w", t.job.path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		e := &snap.Entries[j.entry]
+		e.Header = j.header(e.Path)
+	}
+	if snap.Flags&SnapshotSHA256 == 0 && !DefaultStrongHash {
+		if err := writeSnapshot(outputPath, snap); err != nil {
+			return err
+		}
+		return snapshotSkipped(skipped)
+	}
+
+	// Whole-file digests do not split into blocks, so new and changed
+	// files are read once more, a file per task. With DefaultStrongHash,
+	// their headers record the digest too.
+	err = codec.ForEachBlock(impl, len(unhashed), threads, func(idx int) error {
+		e := &snap.Entries[unhashed[idx]]
+		n, sum, err := hashFile(paths[unhashed[idx]])
+		if err != nil {
+			return fmt.Errorf("hash %s: %w", e.Path, err)
+		}
+		if uint64(n) != e.Header.OriginalSize {
+			return fmt.Errorf("%s changed while being snapshotted", e.Path)
+		}
+		e.SHA256 = sum
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if DefaultStrongHash {
+		for _, j := range jobs {
+			e := &snap.Entries[j.entry]
+			e.Header.Flags |= codec.FlagSHA256
+			e.Header.SHA256 = e.SHA256
+		}
+	}
+	if err := writeSnapshot(outputPath, snap); err != nil {
+		return err
+	}
+	var manifest []ManifestEntry
+	for _, e := range snap.Entries {
+		if e.Mode.IsRegular() {
+			manifest = append(manifest, ManifestEntry{Path: e.Path, SHA256: e.SHA256})
+		}
+	}
+	if err := writeManifest(manifest); err != nil {
+		return err
+	}
+	return snapshotSkipped(skipped)
+}
+
+// snapshotSkipped fails a snapshot that was written without n entries.
+func snapshotSkipped(n int) error {
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("snapshot written without %d entries that cannot be recorded (devices, sockets, pipes)", n)
+}
+
+// snapshotJob stores the blocks of one new or changed file.
+type snapshotJob struct {
+	path       string
+	entry      int // index in Snapshot.Entries
+	size       int64
+	prev       *codec.FileHeader // the file's manifest in the parent snapshot
+	blockSize  int64
+	candidates int // leading blocks of prev that may be reused
+	set        *blockSet
+	keys       [][32]byte
+}
+
+// snapshotTask is one block of a snapshotJob.
+type snapshotTask struct {
+	job   *snapshotJob
+	block int
+}
+
+func newSnapshotJob(p string, entry int, size int64, prev *codec.FileHeader) *snapshotJob {
+	j := &snapshotJob{path: p, entry: entry, size: size, prev: prev, blockSize: int64(DefaultBlockSize)}
+	if prev != nil && prev.Flags&codec.FlagBlockHashes != 0 {
+		j.blockSize = int64(prev.BlockSize)
+		j.candidates = reusableBlocks(prev)
+	}
+	n := int((size + j.blockSize - 1) / j.blockSize)
+	j.set = newBlockSet(n)
+	j.set.detect(p)
+	j.set.digest = nil // blocks are stored out of order; see TakeSnapshot
+	if j.set.hashes == nil {
+		j.set.hashes = make([][32]byte, n)
+	}
+	j.keys = make([][32]byte, n)
+	return j
+}
+
+// store reads block idx of the file and stores it, unless it matches the
+// same block of the previous version.
+func (j *snapshotJob) store(idx int) error {
+	f, err := openFile(j.path)
+	if err != nil {
+		return err
+	}
+	defer closeFile(f)
+	s := int64(idx) * j.blockSize
+	e := s + j.blockSize
+	if e > j.size {
+		e = j.size
+	}
+	bufs := slabFor(int(j.blockSize))
+	buf := bufs.get(int(e - s))
+	defer bufs.put(buf)
+	if _, err := f.ReadAt(buf, s); err != nil {
+		return fmt.Errorf("read block %d: %w", idx, noEOF(err))
+	}
+
+	sum := sha256.Sum256(buf)
+	j.set.hashes[idx] = sum
+	if idx < j.candidates && sum == j.prev.BlockHashes[idx] {
+		j.set.sizes[idx] = j.prev.BlockCompSizes[idx]
+		j.set.raw[idx] = uint32(len(buf))
+		if j.set.tsizes != nil {
+			j.set.tsizes[idx] = j.prev.TransformSizes[idx]
+		}
+		j.keys[idx] = j.prev.BlockKeys[idx]
+		return nil
+	}
+	t, err := j.set.transformBlock(idx, buf)
+	if err != nil {
+		return err
+	}
+	enc, err := codec.EncodeWith(j.set.codec, j.set.filter.Apply(t))
+	if err != nil {
+		return fmt.Errorf("compress block %d: %w", idx, err)
+	}
+	j.set.set(idx, len(buf), enc)
+	j.set.sealBlock(idx, idx == len(j.keys)-1, uint64(j.size))
+	enc, j.set.enc[idx] = j.set.enc[idx], nil
+	j.keys[idx] = sha256.Sum256(enc)
+	if err := putObject(storePath(DefaultStore, j.keys[idx]), enc); err != nil {
+		return fmt.Errorf("store block %d: %w", idx, err)
+	}
+	return nil
+}
+
+// header returns the file's manifest once all its blocks are stored.
+func (j *snapshotJob) header(name string) *codec.FileHeader {
+	if j.candidates > 0 && j.prev.Flags&codec.FlagExec != 0 {
+		j.set.exec.Store(true)
+	}
+	h := j.set.header(name, uint64(j.size), uint32(j.blockSize))
+	h.Flags |= codec.FlagStore
+	h.BlockKeys = j.keys
+	return h
+}
+
+// RestoreSnapshot recreates the tree recorded in the snapshot at
+// snapshotPath under outputDir, reading file contents from DefaultStore and
+// restoring permissions and modification times, and extended attributes and
+// owners when DefaultXattrs and DefaultOwner are set. Symlinks are created
+// after every file, so no file is written through one, and only get their
+// owner back.
+func RestoreSnapshot(snapshotPath, outputDir, impl string, threads int) error {
+	snap, err := ReadSnapshot(snapshotPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+
+	// Only restore what the snapshot has.
+	r := &snapshotRestore{impl: impl, threads: threads}
+	r.xattrs = DefaultXattrs && snap.Flags&SnapshotXattrs != 0
+	if DefaultOwner {
+		if snap.Flags&SnapshotOwner != 0 {
+			r.owners = newOwnerNames()
+		} else {
+			codec.Warnf("%s records no owners; restored files belong to the current user", snapshotPath)
+		}
+	}
+
+	var dirs, links []*SnapshotEntry
+	for i := range snap.Entries {
+		e := &snap.Entries[i]
+		clean, err := memberPath(e.Path)
+		if err != nil {
+			return fmt.Errorf("snapshot entry: %w", err)
+		}
+		target := filepath.Join(outputDir, filepath.FromSlash(clean))
+		if e.Mode.IsDir() {
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+			continue
+		}
+		if e.Mode&fs.ModeSymlink != 0 {
+			links = append(links, e)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := r.file(target, e); err != nil {
+			return fmt.Errorf("restore %s: %w", e.Path, err)
+		}
+	}
+	for _, e := range links {
+		clean, _ := memberPath(e.Path)
+		target := filepath.Join(outputDir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.Symlink(e.Target, target); err != nil {
+			return fmt.Errorf("restore %s: %w", e.Path, err)
+		}
+		if r.owners != nil {
+			if err := r.owners.restore(target, e.Owner); err != nil {
+				return fmt.Errorf("restore %s: %w", e.Path, err)
+			}
+		}
+	}
+	// Writing files into a directory changes its mtime, so directories go
+	// last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		clean, _ := memberPath(dirs[i].Path)
+		target := filepath.Join(outputDir, filepath.FromSlash(clean))
+		if err := r.metadata(target, dirs[i]); err != nil {
+			return fmt.Errorf("restore %s: %w", dirs[i].Path, err)
+		}
+	}
+	return nil
+}
+
+// snapshotRestore holds the settings and lookups of one RestoreSnapshot.
+type snapshotRestore struct {
+	impl    string
+	threads int
+	xattrs  bool
+	owners  *ownerNames // nil unless owners are restored
+}
+
+// file writes the contents of file entry e to target, then its metadata.
+func (r *snapshotRestore) file(target string, e *SnapshotEntry) error {
+	payload, err := openStore(e.Header)
+	if err != nil {
+		return err
+	}
+	out, err := createAtomic(target)
+	if err != nil {
+		return err
+	}
+	if err = reserve(out, e.Header.OriginalSize); err == nil {
+		err = checkMember(out, e.Header, func(w io.Writer) error {
+			return decompressMember(r.impl, payload, w, e.Header, r.threads)
+		})
+	}
+	if err == nil {
+		err = commitFile(out)
+	} else {
+		closeFile(out)
+	}
+	if err != nil {
+		return err
+	}
+	return r.metadata(target, e)
+}
+
+// metadata gives target the owner, attributes, permissions and mtime of e,
+// in that order: chown clears setuid bits and file capabilities, so it goes
+// first.
+func (r *snapshotRestore) metadata(target string, e *SnapshotEntry) error {
+	if r.owners != nil {
+		if err := r.owners.restore(target, e.Owner); err != nil {
+			return err
+		}
+	}
+	if r.xattrs {
+		if err := restoreXattrs(target, e.Xattrs); err != nil {
+			return err
+		}
+	}
+	mode := e.Mode.Perm()
+	if r.owners != nil && !r.owners.denied {
+		// Setuid and setgid only make sense with the original owner.
+		mode |= e.Mode & (fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.ModTime, e.ModTime)
+}
+
+// writeSnapshot writes snap to path.
+func writeSnapshot(p string, snap *Snapshot) error {
+	le := binary.LittleEndian
+	m := snapshotMagic
+	if snap.Flags != 0 {
+		m = snapshotMagicFlags
+	}
+	b := append([]byte(nil), m[:]...)
+	if snap.Flags != 0 {
+		b = le.AppendUint32(b, snap.Flags)
+	}
+	if len(snap.Parent) > 0xFFFF {
+		return fmt.Errorf("parent path too long")
+	}
+	b = le.AppendUint16(b, uint16(len(snap.Parent)))
+	b = append(b, snap.Parent...)
+	b = le.AppendUint32(b, uint32(len(snap.Entries)))
+	for _, e := range snap.Entries {
+		if len(e.Path) > 0xFFFF {
+			return fmt.Errorf("path too long: %s", e.Path)
+		}
+		b = le.AppendUint16(b, uint16(len(e.Path)))
+		b = append(b, e.Path...)
+		b = le.AppendUint32(b, uint32(e.Mode))
+		b = le.AppendUint64(b, uint64(e.ModTime.UnixNano()))
+		if snap.Flags&SnapshotSymlinks != 0 && e.Mode&fs.ModeSymlink != 0 {
+			if len(e.Target) > 0xFFFF {
+				return fmt.Errorf("symlink target too long: %s", e.Path)
+			}
+			b = le.AppendUint16(b, uint16(len(e.Target)))
+			b = append(b, e.Target...)
+		}
+		if snap.Flags&SnapshotXattrs != 0 {
+			var err error
+			if b, err = appendXattrs(b, e.Xattrs); err != nil {
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+		}
+		if snap.Flags&SnapshotOwner != 0 {
+			var err error
+			if b, err = appendOwner(b, e.Owner); err != nil {
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+		}
+		if snap.Flags&SnapshotSHA256 != 0 && e.Mode.IsRegular() {
+			b = append(b, e.SHA256[:]...)
+		}
+		if e.Header != nil {
+			var err error
+			if b, err = codec.AppendHeader(b, e.Header); err != nil {
+				return fmt.Errorf("%s: %w", e.Path, err)
+			}
+		}
+	}
+
+	out, err := createAtomic(p)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	if _, err := out.Write(b); err != nil {
+		closeFile(out)
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	return commitFile(out)
+}
+
+// ReadSnapshot reads the snapshot at path.
+func ReadSnapshot(p string) (*Snapshot, error) {
+	in, err := openFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("open snapshot: %w", err)
+	}
+	defer closeFile(in)
+
+	d, err := codec.ReadChunk(in, 4)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	var m [4]byte
+	copy(m[:], d.Bytes(4))
+	var flags uint32
+	switch m {
+	case snapshotMagic:
+	case snapshotMagicFlags:
+		if d, err = codec.ReadChunk(in, 4); err != nil {
+			return nil, fmt.Errorf("read snapshot: %w", err)
+		}
+		if flags = d.U32(); flags&^knownSnapshotFlags != 0 {
+			return nil, corruptf("unsupported snapshot flags 0x%x", flags)
+		}
+	default:
+		return nil, corruptf("%s is not a snapshot", p)
+	}
+	if d, err = codec.ReadChunk(in, 2); err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	n := int(d.U16())
+	if d, err = codec.ReadChunk(in, n+4); err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	snap := &Snapshot{Flags: flags, Parent: string(d.Bytes(n))}
+	count := d.U32()
+	for i := uint32(0); i < count; i++ {
+		if d, err = codec.ReadChunk(in, 2); err != nil {
+			return nil, fmt.Errorf("read snapshot entry %d: %w", i, err)
+		}
+		n := int(d.U16())
+		if d, err = codec.ReadChunk(in, n+4+8); err != nil {
+			return nil, fmt.Errorf("read snapshot entry %d: %w", i, err)
+		}
+		e := SnapshotEntry{
+			Path:    string(d.Bytes(n)),
+			Mode:    fs.FileMode(d.U32()),
+			ModTime: time.Unix(0, int64(d.U64())),
+		}
+		symlink := e.Mode.Type() == fs.ModeSymlink && flags&SnapshotSymlinks != 0
+		if !e.Mode.IsRegular() && !e.Mode.IsDir() && !symlink {
+			return nil, corruptf("snapshot entry %s: unsupported mode %v", e.Path, e.Mode)
+		}
+		if symlink {
+			if d, err = codec.ReadChunk(in, 2); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+			n := int(d.U16())
+			if d, err = codec.ReadChunk(in, n); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+			e.Target = string(d.Bytes(n))
+		}
+		if flags&SnapshotXattrs != 0 {
+			if e.Xattrs, err = readXattrs(in); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+		}
+		if flags&SnapshotOwner != 0 {
+			if e.Owner, err = readOwner(in); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+		}
+		if flags&SnapshotSHA256 != 0 && e.Mode.IsRegular() {
+			if d, err = codec.ReadChunk(in, 32); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+			copy(e.SHA256[:], d.Bytes(32))
+		}
+		if e.Mode.IsRegular() {
+			if e.Header, err = codec.ReadHeader(in); err != nil {
+				return nil, fmt.Errorf("read snapshot entry %s: %w", e.Path, noEOF(err))
+			}
+			if e.Header.Flags&codec.FlagStore == 0 {
+				return nil, corruptf("snapshot entry %s has no block store manifest", e.Path)
+			}
+		}
+		snap.Entries = append(snap.Entries, e)
+	}
+	if _, err := in.Read(make([]byte, 1)); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after snapshot")
+	}
+	return snap, nil
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// statsIn and statsOut count the bytes read from inputs and written to
+// outputs by every ioFile since ResetStats.
+var statsIn, statsOut atomic.Uint64
+
+// statsMem is the runtime's memory statistics at ResetStats.
+var statsMem runtime.MemStats
+
+// Stats summarizes a compress or decompress run for the report printed after
+// it, like the one line of zstd -v.
+type Stats struct {
+	Operation      string // "compress" or "decompress"
+	Name           string // of the input
+	OriginalSize   uint64
+	CompressedSize uint64
+	Elapsed        time.Duration
+	Allocated      uint64        // bytes of heap allocated by the process
+	GCs            uint32        // garbage collections run
+	GCPause        time.Duration // the world stopped for them, in total
+}
+
+// ResetStats starts counting the bytes of a new run.
+func ResetStats() {
+	statsIn.Store(0)
+	statsOut.Store(0)
+	runtime.ReadMemStats(&statsMem)
+}
+
+// RunStats returns the Stats of the run since ResetStats: for compress the
+// input read is the original and the archive written the compressed data,
+// for decompress the other way round. Runs that also read other files (a
+// delta base, the archive an incremental run updates) are not summed
+// correctly.
+func RunStats(operation, inputPath string, elapsed time.Duration) Stats {
+	s := Stats{Operation: operation, Name: inputPath, Elapsed: elapsed}
+	if inputPath == "-" {
+		s.Name = "stdin"
+	}
+	s.OriginalSize, s.CompressedSize = statsIn.Load(), statsOut.Load()
+	if operation == "decompress" {
+		s.OriginalSize, s.CompressedSize = s.CompressedSize, s.OriginalSize
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s.Allocated = m.TotalAlloc - statsMem.TotalAlloc
+	s.GCs = m.NumGC - statsMem.NumGC
+	s.GCPause = time.Duration(m.PauseTotalNs - statsMem.PauseTotalNs)
+	return s
+}
+
+// Ratio is the original size over the compressed size.
+func (s Stats) Ratio() float64 {
+	if s.CompressedSize == 0 {
+		return 0
+	}
+	return float64(s.OriginalSize) / float64(s.CompressedSize)
+}
+
+// AllocRate is the bytes of heap allocated per second.
+func (s Stats) AllocRate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Allocated) / s.Elapsed.Seconds()
+}
+
+// Throughput is the original bytes handled per second.
+func (s Stats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.OriginalSize) / s.Elapsed.Seconds()
+}
+
+// String formats the summary line, e.g.
+//
+//	big.bin: 71.2 MiB => 23.4 MiB (32.87%, 3.04x) in 1.23s, 57.9 MiB/s;
+//	allocated 96.3 MiB (78.3 MiB/s), 4 GCs, 1ms paused
+//
+// on one line, with the arrow pointing from the input to the output.
+func (s Stats) String() string {
+	from, to := s.OriginalSize, s.CompressedSize
+	if s.Operation == "decompress" {
+		from, to = to, from
+	}
+	share := 0.0
+	if s.OriginalSize > 0 {
+		share = 100 * float64(s.CompressedSize) / float64(s.OriginalSize)
+	}
+	return fmt.Sprintf("%s: %s => %s (%.2f%%, %.2fx) in %v, %s/s; allocated %s (%s/s), %d GCs, %v paused",
+		s.Name, HumanBytes(from), HumanBytes(to), share, s.Ratio(),
+		s.Elapsed.Round(time.Millisecond), HumanBytes(uint64(s.Throughput())),
+		HumanBytes(s.Allocated), HumanBytes(uint64(s.AllocRate())), s.GCs, s.GCPause.Round(time.Microsecond))
+}
+
+// HumanBytes formats n in binary units: 512 B, 1.5 KiB, 71.2 MiB, ...
+func HumanBytes(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if v < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+		v /= 1024
+	}
+	return ""
+}
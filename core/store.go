@@ -0,0 +1,136 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"proj3/core/codec"
+)
+
+// DefaultStore is the block store directory. When set, compressed blocks
+// are written there, named by their SHA-256, and the archive itself only
+// holds the header: a manifest listing which objects make up the file.
+var DefaultStore string
+
+func SetStore(dir string) {
+	DefaultStore = dir
+}
+
+// storePath names the object for key: <store>/ab/abcdef..., so no single
+// directory grows too large.
+func storePath(dir string, key [32]byte) string {
+	name := hex.EncodeToString(key[:])
+	return filepath.Join(dir, name[:2], name)
+}
+
+// writeStore adds blocks to the store, skipping those it already holds, and
+// records their keys in header. Encoding is deterministic, so an unchanged
+// block of a later backup maps to the same object and is stored only once.
+func writeStore(dir string, header *codec.FileHeader, blocks [][]byte) error {
+	header.Flags |= codec.FlagStore
+	header.BlockKeys = make([][32]byte, len(blocks))
+	for i, b := range blocks {
+		key := sha256.Sum256(b)
+		header.BlockKeys[i] = key
+		if err := putObject(storePath(dir, key), b); err != nil {
+			return fmt.Errorf("store block %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// putObject writes data to path unless it already exists. The object is
+// written to a temporary file first and renamed into place, so a crash
+// never leaves a truncated object under a valid name.
+func putObject(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	f := &ioFile{File: tmp}
+	if err := applyOutputMode(tmp); err != nil {
+		closeFile(f)
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		closeFile(f)
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := closeFile(f); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// storeReader serves the payload of a manifest by reading its objects from
+// the store one at a time, checking each against its key.
+type storeReader struct {
+	dir string
+	h   *codec.FileHeader
+	i   int    // next block to load
+	buf []byte // unread part of the current block
+}
+
+func (r *storeReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.i == len(r.h.BlockKeys) {
+			return 0, io.EOF
+		}
+		b, err := readObject(r.dir, r.h.BlockKeys[r.i], r.h.BlockCompSizes[r.i])
+		if err != nil {
+			return 0, fmt.Errorf("block %d: %w", r.i, err)
+		}
+		r.buf = b
+		r.i++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readObject loads the object for key and verifies its size and hash.
+func readObject(dir string, key [32]byte, size uint64) ([]byte, error) {
+	path := storePath(dir, key)
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFile(f)
+	b := make([]byte, size)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, noEOF(err))
+	}
+	if n, _ := f.Read(make([]byte, 1)); n != 0 || sha256.Sum256(b) != key {
+		return nil, verifyf("%s does not match its name", path)
+	}
+	return b, nil
+}
+
+// openStore returns the payload reader for a manifest.
+func openStore(h *codec.FileHeader) (io.Reader, error) {
+	if DefaultStore == "" {
+		return nil, fmt.Errorf("archive keeps its blocks in a block store; pass -store to read it")
+	}
+	return &storeReader{dir: DefaultStore, h: h}, nil
+}
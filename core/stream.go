@@ -0,0 +1,383 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"proj3/core/codec"
+)
+
+// streamBatchPerThread is how many blocks each worker gets per batch when
+// compressing a stream; it bounds memory to a few blocks per thread.
+const streamBatchPerThread = 4
+
+// DefaultInFlight is how many blocks the streaming paths (pipes, parallel
+// decompression, send/recv, grep) hold between reading and writing them.
+// Zero means streamBatchPerThread per worker thread.
+var DefaultInFlight int
+
+func SetInFlight(n int) error {
+	if n < 0 {
+		return fmt.Errorf("blocks in flight must not be negative")
+	}
+	DefaultInFlight = n
+	return nil
+}
+
+// inFlight returns how many blocks to keep in flight for threads workers.
+func inFlight(threads int) int {
+	if DefaultInFlight > 0 {
+		return DefaultInFlight
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	return threads * streamBatchPerThread
+}
+
+// streamCompressFile compresses an input that cannot be sized or re-read up
+// front: a pipe, FIFO, character device, http(s) URL, or "-" for standard
+// input. Blocks are read until EOF in batches, encoded with the scheduler
+// named by impl, and written as they are done. Since the block table is only known at the
+// end, the member is written with FlagTrailer:
+//
+//	header (FlagTrailer, no blocks) | frames | 0, 0 | trailer header
+//
+// where each frame is uint32 raw size, uint32 compressed size and the
+// compressed block, and the trailer is the complete header of the member.
+func streamCompressFile(inputPath, outputPath, impl string, threads int) error {
+	if inputPath == "-" {
+		return streamCompress(&ioFile{File: os.Stdin}, "stdin", outputPath, impl, threads)
+	}
+	f, err := openFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(f)
+	name := filepath.Base(inputPath)
+	if isURL(inputPath) {
+		name = urlName(inputPath)
+	}
+	return streamCompress(f, name, outputPath, impl, threads)
+}
+
+// streamCompress compresses everything read from in, recording name as the
+// original file name.
+func streamCompress(in io.Reader, name, outputPath, impl string, threads int) error {
+	if DefaultVolumeSize != 0 {
+		return fmt.Errorf("volumes need a regular input file")
+	}
+	if DefaultStore != "" {
+		return fmt.Errorf("a block store needs a regular input file")
+	}
+	if DefaultAlign != 0 {
+		return fmt.Errorf("alignment needs a regular input file")
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+
+	out, err := createArchive(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+
+	blockSize := int(DefaultBlockSize)
+	set := newBlockSet(0)
+	lead := set.header(name, 0, uint32(blockSize))
+	lead.Flags |= codec.FlagTrailer
+	if codec.DefaultEndMarker {
+		lead.Flags |= codec.FlagEndMarker
+	}
+	if err := codec.WriteHeader(out, lead); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	p := newPrefetcher(in, blockSize, inFlight(threads))
+	defer p.close()
+	total := uint64(0)
+	// The last block read is held back until the next window shows whether
+	// it is the member's last, which an encrypted member seals as such.
+	var held []byte
+	for end := false; !end; {
+		done := codec.StartPhase("read")
+		bufs, err := p.next()
+		done()
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
+		}
+		end = len(bufs) == 0
+		if held != nil {
+			bufs = append([][]byte{held}, bufs...)
+			held = nil
+		}
+		if !end {
+			held, bufs = bufs[len(bufs)-1], bufs[:len(bufs)-1]
+		}
+		if len(bufs) == 0 {
+			continue
+		}
+		for _, buf := range bufs {
+			total += uint64(len(buf))
+		}
+
+		// Frames are written as soon as the ones before them are.
+		base := len(set.sizes)
+		if base == 0 {
+			set.detect(name)
+		}
+		set.grow(len(bufs))
+		ow := NewOrderedWriter(out, len(bufs))
+		wait := set.hashInput(bufs...)
+		done = codec.StartPhaseAround("compress", "write")
+		err = codec.ForEachBlock(impl, len(bufs), threads, func(i int) error {
+			if err := set.encode(base+i, bufs[i]); err != nil {
+				return err
+			}
+			set.sealBlock(base+i, end && i == len(bufs)-1, total)
+			enc := set.enc[base+i]
+			frame := make([]byte, 8, 8+len(enc))
+			binary.LittleEndian.PutUint32(frame[:4], uint32(len(bufs[i])))
+			binary.LittleEndian.PutUint32(frame[4:], uint32(len(enc)))
+			set.enc[base+i] = nil
+			if err := ow.WriteIndex(i, append(frame, enc...)); err != nil {
+				return fmt.Errorf("write block %d: %w", base+i, err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = ow.Close(len(bufs))
+		}
+		wait()
+		if err != nil {
+			return err
+		}
+		done()
+		p.release(bufs)
+	}
+
+	var frame [8]byte
+	binary.LittleEndian.PutUint64(frame[:], 0)
+	if _, err := out.Write(frame[:]); err != nil {
+		return fmt.Errorf("write end of blocks: %w", err)
+	}
+	trailer := set.header(name, total, uint32(blockSize))
+	if codec.DefaultEndMarker {
+		trailer.Flags |= codec.FlagEndMarker
+	}
+	if err := codec.WriteHeader(out, trailer); err != nil {
+		return fmt.Errorf("write trailer: %w", err)
+	}
+	if codec.DefaultEndMarker {
+		if _, err := out.Write(codec.AppendEndMarker(nil, trailer.CompOffsets()[trailer.NumBlocks])); err != nil {
+			return fmt.Errorf("write end marker: %w", err)
+		}
+	}
+	return commitFile(out)
+}
+
+// readStreamedMember reads the frames and trailer of a member whose leading
+// header lead has FlagTrailer set. It returns the trailer header, holding
+// the member's payload so openPayload can serve it. The decompressors do
+// not hold the payload; they use decompressStreamed.
+func readStreamedMember(r io.Reader, lead *codec.FileHeader) (*codec.FileHeader, error) {
+	var payload []byte
+	var raws []int64
+	var comps []uint64
+	total := uint64(0)
+	for {
+		raw, comp, err := readFrameSizes(r, lead, len(comps), &total)
+		if err != nil {
+			return nil, err
+		}
+		if comp == 0 {
+			break
+		}
+		start := len(payload)
+		payload = append(payload, make([]byte, comp)...)
+		if _, err := io.ReadFull(r, payload[start:]); err != nil {
+			return nil, fmt.Errorf("read compressed block %d: %w", len(comps), noEOF(err))
+		}
+		raws = append(raws, int64(raw))
+		comps = append(comps, uint64(comp))
+	}
+	h, err := readTrailer(r, lead, raws, comps)
+	if err != nil {
+		return nil, err
+	}
+	h.Payload = payload
+	return h, nil
+}
+
+// readFrameSizes reads the sizes that open frame i of the streamed member
+// lead. It returns 0, 0 at the end of the frames. total is the size of the
+// frames before it, which are limited as one member of that size.
+func readFrameSizes(r io.Reader, lead *codec.FileHeader, i int, total *uint64) (raw, comp uint32, err error) {
+	var frame [8]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		return 0, 0, fmt.Errorf("read block frame %d: %w", i, noEOF(err))
+	}
+	raw = binary.LittleEndian.Uint32(frame[:4])
+	comp = binary.LittleEndian.Uint32(frame[4:])
+	if raw == 0 && comp == 0 {
+		return 0, 0, nil
+	}
+	if comp == 0 || raw > lead.BlockSize || uint64(comp) > lead.MaxCompSize() {
+		return 0, 0, corruptf("invalid block frame %d", i)
+	}
+	*total += uint64(raw)
+	if err := codec.CheckDecodeSize(*total, uint64(i+1)); err != nil {
+		return 0, 0, err
+	}
+	return raw, comp, nil
+}
+
+// streamedFlags are the flags on which the leading header and the trailer
+// of a streamed member must agree: the ones that say how its blocks decode.
+const streamedFlags = codec.FlagFilter | codec.FlagTransform | codec.FlagChained | codec.FlagEncrypted | codec.FlagLongRange | codec.FlagRepcodes | codec.FlagSHA256
+
+// readTrailer reads the trailer of the streamed member lead, whose frames
+// had the sizes raws and comps, and checks it against them.
+func readTrailer(r io.Reader, lead *codec.FileHeader, raws []int64, comps []uint64) (*codec.FileHeader, error) {
+	h, err := codec.ReadHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read trailer: %w", noEOF(err))
+	}
+	if h.Flags&codec.FlagTrailer != 0 || h.NumBlocks != uint64(len(comps)) {
+		return nil, corruptf("trailer does not match the blocks read")
+	}
+	if (h.Flags^lead.Flags)&streamedFlags != 0 || h.Filter != lead.Filter || h.Member != lead.Member {
+		return nil, corruptf("trailer does not match the leading header")
+	}
+	offs := h.RawOffsets()
+	for i := range comps {
+		if h.BlockCompSizes[i] != comps[i] || offs[i+1]-offs[i] != raws[i] {
+			return nil, corruptf("trailer does not match block %d", i)
+		}
+	}
+	if h.NumBlocks > 0 && offs[h.NumBlocks] != int64(h.OriginalSize) {
+		return nil, corruptf("trailer size mismatch")
+	}
+	return h, nil
+}
+
+// decompressStreamed decodes the streamed member whose leading header lead
+// has just been read from in (see readMemberLead) to out, with the
+// scheduler named by impl. As in decompressWindowed, a window of frames is
+// read, decoded in parallel and written in order before the next is read,
+// so memory stays at a few blocks per worker however long the member. The
+// trailer is checked against the frames once they are all written, and
+// the output against its SHA-256. Members whose blocks only decode with
+// the trailer's tables (transformed or chained ones) are read whole first.
+func decompressStreamed(impl string, in io.Reader, out io.Writer, lead *codec.FileHeader, threads int) error {
+	if lead.Flags&(codec.FlagTransform|codec.FlagChained) != 0 {
+		h, err := readStreamedMember(in, lead)
+		if err != nil {
+			return memberHeaderError(0, err)
+		}
+		if err := checkMemberEnd(in, 0, h, true); err != nil {
+			return err
+		}
+		return checkMember(out, h, func(w io.Writer) error {
+			return decompressMember(impl, bytes.NewReader(h.Payload), w, h, threads)
+		})
+	}
+
+	w := out
+	var d hash.Hash
+	if lead.Flags&codec.FlagSHA256 != 0 {
+		d = sha256.New()
+		w = io.MultiWriter(out, d)
+	}
+	window := inFlight(threads)
+	ow := NewOrderedWriter(w, window)
+	var raws []int64
+	var comps []uint64
+	var compData []byte
+	frames := make([][]byte, window)
+	total := uint64(0)
+	// The sizes of the frame after a window are read with it, so the last
+	// block is known as such when it is decoded, as an encrypted member
+	// needs (see blockAD).
+	raw, comp, err := readFrameSizes(in, lead, 0, &total)
+	if err != nil {
+		return corrupt(err)
+	}
+	for comp != 0 {
+		base := len(comps)
+		compData = compData[:0]
+		done := codec.StartPhase("read")
+		for comp != 0 && len(comps)-base < window {
+			start := len(compData)
+			compData = append(compData, make([]byte, comp)...)
+			if _, err := io.ReadFull(in, compData[start:]); err != nil {
+				return corrupt(fmt.Errorf("read compressed block %d: %w", len(comps), noEOF(err)))
+			}
+			raws = append(raws, int64(raw))
+			comps = append(comps, uint64(comp))
+			if raw, comp, err = readFrameSizes(in, lead, len(comps), &total); err != nil {
+				return corrupt(err)
+			}
+		}
+		done()
+		h := lead
+		if comp == 0 {
+			// The member ends with this window.
+			last := *lead
+			last.NumBlocks, last.OriginalSize = uint64(len(comps)), total
+			h = &last
+		}
+		n := len(comps) - base
+		cur := uint64(0)
+		for k, s := range comps[base:] {
+			frames[k] = compData[cur : cur+s]
+			cur += s
+		}
+		done = codec.StartPhaseAround("decompress", "write")
+		err := codec.ForEachBlock(impl, n, threads, func(i int) error {
+			idx := base + i
+			dec, err := decodeMemberBlock(h, idx, frames[i], int(raws[idx]))
+			if err != nil {
+				return fmt.Errorf("decompress block %d: %w", idx, err)
+			}
+			if err := ow.WriteIndex(idx, dec); err != nil {
+				return fmt.Errorf("write block %d: %w", idx, err)
+			}
+			return nil
+		})
+		done()
+		if err != nil {
+			return err
+		}
+	}
+	if err := ow.Close(len(comps)); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+
+	h, err := readTrailer(in, lead, raws, comps)
+	if err != nil {
+		return corrupt(err)
+	}
+	if err := checkMemberEnd(in, 0, h, true); err != nil {
+		return err
+	}
+	if d != nil {
+		return checkDigest(h, d)
+	}
+	return nil
+}
+
+// noEOF reports a clean EOF in the middle of a member as truncation.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
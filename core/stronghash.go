@@ -0,0 +1,86 @@
+package core
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"proj3/core/codec"
+)
+
+// DefaultStrongHash records the SHA-256 of the whole input in the header
+// (FlagSHA256), which every decompressor checks the output against.
+var DefaultStrongHash bool
+
+func SetStrongHash(on bool) {
+	DefaultStrongHash = on
+}
+
+// hashInput feeds bufs, the next bytes of the input, to the set's SHA-256
+// on a goroutine of its own, so hashing overlaps encoding. The returned
+// func waits for it; it must be called before the next hashInput.
+func (s *blockSet) hashInput(bufs ...[]byte) (wait func()) {
+	if s.digest == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, b := range bufs {
+			s.digest.Write(b)
+		}
+	}()
+	return func() { <-done }
+}
+
+// emptyDigest records the SHA-256 of no bytes in h, the header of an empty
+// input, under DefaultStrongHash.
+func emptyDigest(h *codec.FileHeader) {
+	if DefaultStrongHash {
+		h.Flags |= codec.FlagSHA256
+		h.SHA256 = sha256.Sum256(nil)
+	}
+}
+
+// checkMember runs decode, which writes the member h to the writer it is
+// given, and then checks the output against the member's SHA-256, if it
+// has one. Output to a regular file is read back once decode is done, as
+// some decoders write blocks in place or patch them afterwards; anything
+// else is written in order and hashed on the way.
+func checkMember(out io.Writer, h *codec.FileHeader, decode func(w io.Writer) error) error {
+	if h.Flags&codec.FlagSHA256 == 0 {
+		return decode(out)
+	}
+	if f, ok := out.(*ioFile); ok && isRegular(f) {
+		if base, err := f.Seek(0, io.SeekCurrent); err == nil {
+			if err := decode(out); err != nil {
+				return err
+			}
+			defer codec.StartPhase("verify")()
+			d := sha256.New()
+			if _, err := io.Copy(d, io.NewSectionReader(f.File, base, int64(h.OriginalSize))); err != nil {
+				return ioErrorf("read back output: %w", err)
+			}
+			return checkDigest(h, d)
+		}
+	}
+	d := sha256.New()
+	if err := decode(io.MultiWriter(out, d)); err != nil {
+		return err
+	}
+	return checkDigest(h, d)
+}
+
+func isRegular(f *ioFile) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+func checkDigest(h *codec.FileHeader, d hash.Hash) error {
+	var sum [32]byte
+	copy(sum[:], d.Sum(nil))
+	if sum != h.SHA256 {
+		return verifyf("SHA-256 of the output does not match the original's")
+	}
+	return nil
+}
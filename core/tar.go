@@ -0,0 +1,275 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"proj3/core/codec"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scanTar lists the regular files of the tar stream in data, and the offsets
+// at which member headers start.
+func scanTar(data []byte) ([]codec.TarEntry, []int64, error) {
+	cr := &countingReader{r: bytes.NewReader(data)}
+	tr := tar.NewReader(cr)
+
+	var entries []codec.TarEntry
+	var starts []int64
+	next := int64(0) // where the next header begins
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, starts, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read tar: %w", err)
+		}
+		starts = append(starts, next)
+		// tar.Reader reads data lazily, so right after Next the stream sits
+		// at the start of this member's data.
+		off := cr.n
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			// The member stays in the stream either way; a name that cannot
+			// be stored portably is only left out of the index.
+			if name, err := memberPath(hdr.Name); err == nil {
+				entries = append(entries, codec.TarEntry{Name: name, Offset: uint64(off), Size: uint64(hdr.Size)})
+			} else {
+				codec.Warnf("not indexing tar member: %v", err)
+			}
+		}
+		next = off + (hdr.Size+511)/512*512
+	}
+}
+
+// tarBlocks cuts a tar stream of size bytes into blocks of at most
+// blockSize, starting a new block at a member header whenever the current
+// one already holds a quarter block or more. Large files thus start on a
+// block boundary, while runs of small files still share blocks.
+func tarBlocks(size int64, starts []int64, blockSize int64) []int64 {
+	cuts := []int64{0}
+	cur := int64(0)
+	for _, s := range append(starts, size) {
+		if s > size {
+			continue // only hints; a bad size field cannot move a cut past the end
+		}
+		for s-cur > blockSize {
+			cur += blockSize
+			cuts = append(cuts, cur)
+		}
+		if s > cur && (s-cur >= blockSize/4 || s == size) {
+			cur = s
+			cuts = append(cuts, cur)
+		}
+	}
+	return cuts
+}
+
+// TarCompressFile compresses the tar archive at inputPath ("-" for standard
+// input) into outputPath. Block boundaries follow member boundaries where
+// possible and the header records where every regular file's data lives, so
+// TarExtractFile can restore one file by decoding only the blocks it spans.
+// Decompressing the result as usual yields the original tar stream.
+func TarCompressFile(inputPath, outputPath, impl string, threads int) error {
+	var data []byte
+	var err error
+	name := "stdin.tar"
+	if inputPath == "-" {
+		data, err = io.ReadAll(&ioFile{File: os.Stdin})
+	} else {
+		name = path.Base(inputPath)
+		if isURL(inputPath) {
+			name = urlName(inputPath)
+		}
+		data, err = readFile(inputPath)
+	}
+	if err != nil {
+		return fmt.Errorf("read input: %w", err)
+	}
+
+	entries, starts, err := scanTar(data)
+	if err != nil {
+		return err
+	}
+
+	cuts := tarBlocks(int64(len(data)), starts, int64(DefaultBlockSize))
+	numBlocks := len(cuts) - 1
+	set := newBlockSet(numBlocks)
+	wait := set.hashInput(data)
+	err = codec.ForEachBlock(impl, numBlocks, threads, func(idx int) error {
+		return set.encode(idx, data[cuts[idx]:cuts[idx+1]])
+	})
+	wait()
+	if err != nil {
+		return err
+	}
+
+	header := set.header(name, uint64(len(data)), DefaultBlockSize)
+	header.Flags |= codec.FlagTarIndex
+	header.TarEntries = entries
+	manifest, err := tarManifest(data, entries, impl, threads)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		header.Flags |= codec.FlagManifest
+		header.Manifest = string(appendManifest(nil, manifest))
+	}
+	if err := writeArchive(outputPath, header, set.enc); err != nil {
+		return err
+	}
+	return writeManifest(manifest)
+}
+
+// tarManifest hashes the regular files of the tar stream in data when
+// DefaultManifest is set. A file stored more than once is listed as its
+// last copy, the one tar leaves behind.
+func tarManifest(data []byte, entries []codec.TarEntry, impl string, threads int) ([]ManifestEntry, error) {
+	if DefaultManifest == "" {
+		return nil, nil
+	}
+	last := map[string]int{}
+	for i, e := range entries {
+		if e.Offset+e.Size <= uint64(len(data)) {
+			last[e.Name] = i
+		}
+	}
+	manifest := make([]ManifestEntry, 0, len(last))
+	for i, e := range entries {
+		if j, ok := last[e.Name]; ok && j == i {
+			manifest = append(manifest, ManifestEntry{Path: e.Name})
+		}
+	}
+	err := codec.ForEachBlock(impl, len(manifest), threads, func(idx int) error {
+		e := entries[last[manifest[idx].Path]]
+		manifest[idx].SHA256 = sha256.Sum256(data[e.Offset : e.Offset+e.Size])
+		return nil
+	})
+	return manifest, err
+}
+
+// TarExtractFile writes the data of the tar member called name from the
+// .tar.pcz archive at archivePath to outputPath. Only the blocks holding
+// that member are read and decoded.
+func TarExtractFile(archivePath, name, outputPath, impl string, threads int) error {
+	in, err := openFile(archivePath)
+	if err != nil {
+		return fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+
+	h, err := codec.ReadHeader(in)
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	if h.Flags&codec.FlagTarIndex == 0 {
+		return fmt.Errorf("%s has no tar index (create it with -mode tar)", archivePath)
+	}
+
+	// Later entries replace earlier ones, as when tar extracts.
+	var entry *codec.TarEntry
+	want, err := memberPath(name)
+	if err != nil {
+		return err
+	}
+	for i := range h.TarEntries {
+		if p, err := memberPath(h.TarEntries[i].Name); err == nil && p == want {
+			entry = &h.TarEntries[i]
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("%s: no regular file %q", archivePath, name)
+	}
+
+	offs := h.RawOffsets()
+	start, end := int64(entry.Offset), int64(entry.Offset+entry.Size)
+	first, last := 0, 0 // blocks [first, last) overlap [start, end)
+	for first < int(h.NumBlocks) && offs[first+1] <= start {
+		first++
+	}
+	last = first
+	for last < int(h.NumBlocks) && offs[last] < end {
+		last++
+	}
+
+	payload, closeVolumes, err := openPayload(in, archivePath, h)
+	if err != nil {
+		return err
+	}
+	defer closeVolumes()
+	if h.Flags&(codec.FlagVolumes|codec.FlagStore) == 0 {
+		_, err = in.Seek(h.CompOffsets()[first], io.SeekCurrent)
+		if h.Flags&codec.FlagAlign != 0 {
+			payload = newUnpadReader(in, h, first)
+		}
+	} else {
+		skip := uint64(0)
+		for i := 0; i < first; i++ {
+			skip += h.BlockCompSizes[i]
+		}
+		_, err = io.CopyN(io.Discard, payload, int64(skip))
+	}
+	if err != nil {
+		return fmt.Errorf("seek to block %d: %w", first, err)
+	}
+
+	comps := make([][]byte, last-first)
+	for i := range comps {
+		comps[i] = make([]byte, h.BlockCompSizes[first+i])
+		if _, err := io.ReadFull(payload, comps[i]); err != nil {
+			return fmt.Errorf("read compressed block %d: %w", first+i, err)
+		}
+	}
+
+	outBuf := make([]byte, end-start)
+	err = codec.ForEachBlock(impl, len(comps), threads, func(i int) error {
+		idx := first + i
+		dec, err := decodeMemberBlock(h, idx, comps[i], int(offs[idx+1]-offs[idx]))
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		// Copy the part of the block that overlaps the member.
+		s, e := offs[idx], offs[idx+1]
+		if s < start {
+			dec = dec[start-s:]
+			s = start
+		}
+		if e > end {
+			dec = dec[:len(dec)-int(e-end)]
+		}
+		copy(outBuf[s-start:], dec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+	if err := reserve(out, uint64(len(outBuf))); err != nil {
+		return err
+	}
+	if _, err := out.Write(outBuf); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	return commitFile(out)
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultTee lists paths that get a copy of every archive the compressors
+// write, in the same pass: each write goes to the archive and all copies at
+// once, so a backup can land on a local disk and a mounted offsite share
+// without reading the archive back. Any copy failing fails the job.
+var DefaultTee []string
+
+// SetTee sets the copies. Only local paths (including mounts and devices)
+// are supported; there is no object store client here.
+func SetTee(paths []string) error {
+	for _, p := range paths {
+		if strings.Contains(p, "://") {
+			return fmt.Errorf("%s: copies must be local paths", p)
+		}
+	}
+	DefaultTee = paths
+	return nil
+}
+
+// createArchive creates the archive at path, with the copies of DefaultTee.
+// Like createAtomic, the archive and its copies are written under
+// temporary names until commitFile.
+func createArchive(path string) (*ioFile, error) {
+	f, err := createAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range DefaultTee {
+		tmp := tempPath(p)
+		var c *os.File
+		if tmp == "" {
+			c, err = createOutput(p)
+		} else {
+			c, err = createTemp(p, tmp)
+		}
+		if err != nil {
+			closeFile(f)
+			return nil, err
+		}
+		f.tee = append(f.tee, c)
+		if tmp != "" {
+			f.temps = append(f.temps, tempFile{tmp, p})
+		}
+	}
+	return f, nil
+}
+
+// teeWrite writes p to f and its copies concurrently: at off, or at their
+// current offsets when off is negative.
+func (f *ioFile) teeWrite(p []byte, off int64) (int, error) {
+	errs := make([]error, len(f.tee))
+	var wg sync.WaitGroup
+	for i, c := range f.tee {
+		wg.Add(1)
+		go func(i int, c *os.File) {
+			defer wg.Done()
+			_, errs[i] = writeRetry(c, p, off)
+		}(i, c)
+	}
+	n, err := writeRetry(f.File, p, off)
+	wg.Wait()
+	if err != nil {
+		return n, err
+	}
+	for i, e := range errs {
+		if e != nil {
+			return n, fmt.Errorf("copy %s: %w", f.tee[i].Name(), e)
+		}
+	}
+	return n, nil
+}
+
+// Seek moves f and its copies alike.
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.File.Seek(offset, whence)
+	if err != nil || len(f.tee) == 0 {
+		return n, err
+	}
+	for _, c := range f.tee {
+		if _, err := c.Seek(n, io.SeekStart); err != nil {
+			return n, fmt.Errorf("copy %s: %w", c.Name(), err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"proj3/core/codec"
+)
+
+// BlockTransform rewrites blocks around the codec: Encode runs on every
+// uncompressed block before the pre-filter and codec, Decode on every block
+// they return, and must give back exactly what Encode was given. idx is the
+// block's number within its member. Either may change the block's length
+// (Encode may grow it by up to 64 KiB) but neither may modify the block
+// passed in. Typical uses are encryption, redaction and format-specific
+// filters.
+type BlockTransform struct {
+	Encode func(idx int, block []byte) ([]byte, error)
+	Decode func(idx int, block []byte) ([]byte, error)
+}
+
+// transforms holds the registered block transforms by name. There are no
+// built-in ones.
+var transforms = map[string]BlockTransform{}
+
+// RegisterTransform makes a block transform selectable with SetTransform.
+// Members written with it record its name (FlagTransform) and only decode
+// in programs that register a transform of that name.
+func RegisterTransform(name string, t BlockTransform) {
+	transforms[name] = t
+}
+
+// DefaultTransform names the block transform applied when compressing; ""
+// applies none. Delta patches and send do not use transforms, and members
+// written with one have no long-range references.
+var DefaultTransform string
+
+func SetTransform(name string) error {
+	if name != "" {
+		if t, ok := transforms[name]; !ok || t.Encode == nil || t.Decode == nil {
+			names := make([]string, 0, len(transforms))
+			for n := range transforms {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown block transform %q (have %v)", name, names)
+		}
+	}
+	DefaultTransform = name
+	return nil
+}
+
+// transformBlock applies the set's transform to buf, block idx, and records
+// the size of the result.
+func (s *blockSet) transformBlock(idx int, buf []byte) ([]byte, error) {
+	if s.transform == "" {
+		return buf, nil
+	}
+	t, err := transforms[s.transform].Encode(idx, buf)
+	if err != nil {
+		return nil, fmt.Errorf("block transform %q on block %d: %w", s.transform, idx, err)
+	}
+	if len(t) > len(buf)+codec.TransformMaxGrowth {
+		return nil, fmt.Errorf("block transform %q grew block %d from %d to %d bytes", s.transform, idx, len(buf), len(t))
+	}
+	s.tsizes[idx] = uint32(len(t))
+	return t, nil
+}
+
+// memberTransform returns the transform the member h was written with.
+func memberTransform(h *codec.FileHeader) (BlockTransform, error) {
+	t, ok := transforms[h.Transform]
+	if !ok || t.Decode == nil {
+		return t, fmt.Errorf("member needs block transform %q, which is not registered", h.Transform)
+	}
+	return t, nil
+}
+
+// untransformBlock reverses the transform of the member h on dec, the
+// decoded block idx, whose original size is expected.
+func untransformBlock(h *codec.FileHeader, t BlockTransform, idx int, dec []byte, expected int) ([]byte, error) {
+	out, err := t.Decode(idx, dec)
+	if err != nil {
+		return nil, fmt.Errorf("block transform %q: %w", h.Transform, err)
+	}
+	if len(out) != expected {
+		return nil, corruptf("block transform %q returned %d bytes, expected %d", h.Transform, len(out), expected)
+	}
+	return out, nil
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"proj3/core/codec"
+)
+
+// TuneSetting is one block size and level tried by TuneFile, with how it
+// did on the sample.
+type TuneSetting struct {
+	BlockSize  uint32
+	Level      int
+	Ratio      float64 // sample bytes over their compressed size
+	Throughput float64 // projected input bytes per second on the threads given
+}
+
+// Tuning is the outcome of TuneFile.
+type Tuning struct {
+	OriginalSize int64
+	SampledBytes int64
+	Settings     []TuneSetting
+	Best         int // index in Settings of the recommended setting
+}
+
+// Block sizes and levels TuneFile tries when not given any.
+var (
+	TuneBlockSizes = []uint32{64 << 10, 256 << 10, 1 << 20, 4 << 20}
+	TuneLevels     = []int{1, 6, 7, 8, 9}
+)
+
+const (
+	// The sample is up to tuneRegions runs of tuneRegion bytes, each cut
+	// into blocks of every size tried, so all settings see the same bytes.
+	tuneRegion  = 4 << 20
+	tuneRegions = 4
+	// The recommended setting is the best ratio among those at least this
+	// share of the fastest one's throughput.
+	tuneSpeedFloor = 0.5
+)
+
+// distinctLevels returns levels without those that parse like one before
+// them.
+func distinctLevels(levels []int) []int {
+	seen := map[string]bool{}
+	var out []int
+	for _, l := range levels {
+		if l < 1 || l > 9 {
+			out = append(out, l) // SetLevel reports it
+			continue
+		}
+		if p := codec.LevelParse(l); !seen[p] {
+			seen[p] = true
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// TuneFile compresses a sample of the regular file at inputPath with every
+// pair of blockSizes and levels (TuneBlockSizes and TuneLevels if nil) and
+// projects the ratio and throughput of each for a full run on threads
+// workers. A block size above the file's size leaves workers idle, and the
+// projection counts that. Of levels that parse alike (see codec.LevelParse), only
+// the first is tried. Nothing is written, and the settings in force are
+// left as they were. The recommendation depends on measured speed, so runs
+// on the same file may differ.
+func TuneFile(inputPath string, threads int, blockSizes []uint32, levels []int) (*Tuning, error) {
+	if blockSizes == nil {
+		blockSizes = TuneBlockSizes
+	}
+	if levels == nil {
+		levels = TuneLevels
+	}
+	levels = distinctLevels(levels)
+	if threads <= 0 {
+		threads = 1
+	}
+	if inputPath == "-" || isURL(inputPath) {
+		return nil, fmt.Errorf("input is not a regular file")
+	}
+	in, err := openFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("open input: %w", err)
+	}
+	defer closeFile(in)
+	info, err := in.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat input: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("input is not a regular file")
+	}
+
+	size := info.Size()
+	regions, err := tuneSample(in, size)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tuning{OriginalSize: size}
+	for _, r := range regions {
+		t.SampledBytes += int64(len(r))
+	}
+	if t.SampledBytes == 0 {
+		return nil, fmt.Errorf("input is empty")
+	}
+
+	defer func(level int) { codec.DefaultLevel = level }(codec.DefaultLevel)
+	for _, bs := range blockSizes {
+		var blocks [][]byte
+		for _, r := range regions {
+			for off := 0; off < len(r); off += int(bs) {
+				end := off + int(bs)
+				if end > len(r) {
+					end = len(r)
+				}
+				blocks = append(blocks, r[off:end])
+			}
+		}
+		workers := int64(threads)
+		if n := (size + int64(bs) - 1) / int64(bs); n < workers {
+			workers = n
+		}
+		for _, level := range levels {
+			if err := codec.SetLevel(level); err != nil {
+				return nil, err
+			}
+			var mu sync.Mutex
+			var comp int64
+			var busy time.Duration
+			err := codec.WSForEach(len(blocks), threads, func(i int) error {
+				if err := codec.CanceledErr(); err != nil {
+					return err
+				}
+				start := time.Now()
+				enc, err := codec.EncodeBlock(blocks[i])
+				if err != nil {
+					return err
+				}
+				elapsed := time.Since(start)
+				mu.Lock()
+				comp += int64(len(enc))
+				busy += elapsed
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			s := TuneSetting{BlockSize: bs, Level: level, Ratio: float64(t.SampledBytes) / float64(comp)}
+			if busy > 0 {
+				s.Throughput = float64(t.SampledBytes) * float64(workers) / busy.Seconds()
+			}
+			t.Settings = append(t.Settings, s)
+		}
+	}
+
+	fastest := 0.0
+	for _, s := range t.Settings {
+		if s.Throughput > fastest {
+			fastest = s.Throughput
+		}
+	}
+	for i, s := range t.Settings {
+		if s.Throughput < tuneSpeedFloor*fastest {
+			continue
+		}
+		// Equal ratios keep the first setting tried, not the faster one, so
+		// timing only decides which settings make the floor.
+		b := t.Settings[t.Best]
+		if b.Throughput < tuneSpeedFloor*fastest || s.Ratio > b.Ratio {
+			t.Best = i
+		}
+	}
+	return t, nil
+}
+
+// tuneSample reads the sample of a file of size bytes: all of it if it is
+// small, otherwise tuneRegions aligned regions picked with a seed fixed by
+// the size, so repeated runs on the same file compare, in file order.
+func tuneSample(in *ioFile, size int64) ([][]byte, error) {
+	n := int((size + tuneRegion - 1) / tuneRegion)
+	picks := make([]int, n)
+	for i := range picks {
+		picks[i] = i
+	}
+	if n > tuneRegions {
+		picks = rand.New(rand.NewSource(size)).Perm(n)[:tuneRegions]
+		sort.Ints(picks)
+	}
+	var regions [][]byte
+	for _, p := range picks {
+		off := int64(p) * tuneRegion
+		end := off + tuneRegion
+		if end > size {
+			end = size
+		}
+		buf := make([]byte, end-off)
+		if _, err := in.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read input: %w", err)
+		}
+		regions = append(regions, buf)
+	}
+	return regions, nil
+}
@@ -0,0 +1,308 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"proj3/core/codec"
+)
+
+var tunnelMagic = [4]byte{'P', 'C', 'Z', 'T'}
+
+// Tunnel sides, set with the packed argument of Tunnel: which of the two
+// addresses carries the compressed stream.
+const (
+	TunnelPackOut = "out" // near the clients: plain on the listener, compressed to the target
+	TunnelPackIn  = "in"  // near the server: compressed on the listener, plain to the target
+)
+
+// tunnelReadBuffer is the read buffer of the compressed side. Frames wholly
+// in it are decoded together, so it caps how many a batch can hold.
+const tunnelReadBuffer = 4 << 20
+
+// Tunnel listens on listenAddr and forwards every connection to targetAddr,
+// compressing the bytes headed for the compressed side and decompressing the
+// bytes coming from it. Two tunnels make a pair, one TunnelPackOut near the
+// clients and one TunnelPackIn near the server, so only the link between
+// them carries compressed traffic. Each direction is
+//
+//	"PCZT" | frames | 0, 0
+//
+// with frames as in streamed archives: uint32 raw size, uint32 compressed
+// size and the block. Whatever has arrived is sent at once, so interactive
+// traffic is not held back waiting for a full block; under bulk traffic the
+// reads that queue up while a batch is encoded are merged into blocks of up
+// to the block size and encoded in parallel with the scheduler named by
+// impl. A failed connection is reported as a warning and does not stop the
+// tunnel. Connections are admitted within DefaultServerLimits; those turned
+// away are closed at once.
+func Tunnel(listenAddr, targetAddr, packed, impl string, threads int) error {
+	if packed != TunnelPackOut && packed != TunnelPackIn {
+		return fmt.Errorf("unknown tunnel side %q (want %q or %q)", packed, TunnelPackOut, TunnelPackIn)
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	lim := NewLimiter(DefaultServerLimits)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			n, release, err := lim.Acquire(context.Background(), remoteHost(conn), threads)
+			if err != nil {
+				conn.Close()
+				codec.Warnf("tunnel %s: rejected: %v", conn.RemoteAddr(), err)
+				return
+			}
+			defer release()
+			if err := tunnelConn(conn, targetAddr, packed, impl, n); err != nil {
+				codec.Warnf("tunnel %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// tunnelConn forwards one connection until both directions are done.
+func tunnelConn(conn net.Conn, targetAddr, packed, impl string, threads int) error {
+	defer conn.Close()
+	target, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	plain, comp := conn, target
+	if packed == TunnelPackIn {
+		plain, comp = target, conn
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	run := func(f func() error) {
+		defer wg.Done()
+		if err := f(); err != nil {
+			once.Do(func() {
+				firstErr = err
+				// Unblock the other direction.
+				conn.Close()
+				target.Close()
+			})
+		}
+	}
+	wg.Add(2)
+	go run(func() error { return tunnelPack(comp, plain, impl, threads) })
+	go run(func() error { return tunnelUnpack(plain, comp, impl, threads) })
+	wg.Wait()
+	return firstErr
+}
+
+// tunnelPack reads src until EOF and writes it to dst compressed, then
+// closes dst for writing.
+func tunnelPack(dst, src net.Conn, impl string, threads int) error {
+	blockSize := int(DefaultBlockSize)
+	batch := inFlight(threads)
+	chunks := make(chan []byte, batch)
+	stop := make(chan struct{})
+	defer close(stop)
+	var readErr error
+	bufs := slabFor(blockSize)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, blockSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- append(bufs.get(n)[:0], buf[:n]...):
+				case <-stop:
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	w := bufio.NewWriterSize(dst, 1<<20)
+	if _, err := w.Write(tunnelMagic[:]); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var frame [8]byte
+	for {
+		first, ok := <-chunks
+		if !ok {
+			break
+		}
+		// Take whatever else has queued up, without waiting for more.
+		pending := [][]byte{first}
+	drain:
+		for len(pending) < batch {
+			select {
+			case c, ok := <-chunks:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, c)
+			default:
+				break drain
+			}
+		}
+		blocks := mergeChunks(pending, blockSize)
+		enc := make([][]byte, len(blocks))
+		err := codec.ForEachBlock(impl, len(blocks), threads, func(i int) error {
+			e, err := codec.EncodeBlock(blocks[i])
+			if err != nil {
+				return err
+			}
+			enc[i] = e
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, e := range enc {
+			binary.LittleEndian.PutUint32(frame[:4], uint32(len(blocks[i])))
+			binary.LittleEndian.PutUint32(frame[4:], uint32(len(e)))
+			if _, err := w.Write(frame[:]); err != nil {
+				return err
+			}
+			if _, err := w.Write(e); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		bufs.put(pending...)
+	}
+	// chunks is closed, so the reader is done with readErr.
+	if readErr != nil {
+		return readErr
+	}
+	binary.LittleEndian.PutUint64(frame[:], 0)
+	if _, err := w.Write(frame[:]); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return closeWrite(dst)
+}
+
+// mergeChunks concatenates consecutive chunks into blocks of at most
+// blockSize bytes. Chunks are never larger than a block.
+func mergeChunks(chunks [][]byte, blockSize int) [][]byte {
+	var blocks [][]byte
+	var cur []byte
+	for _, c := range chunks {
+		if len(cur)+len(c) > blockSize {
+			blocks = append(blocks, cur)
+			cur = nil
+		}
+		if cur == nil {
+			cur = c
+		} else {
+			cur = append(cur, c...)
+		}
+	}
+	return append(blocks, cur)
+}
+
+// tunnelUnpack reads the compressed stream of a tunnelPack from src and
+// writes it to dst decompressed, then closes dst for writing.
+func tunnelUnpack(dst, src net.Conn, impl string, threads int) error {
+	r := bufio.NewReaderSize(src, tunnelReadBuffer)
+	var m [4]byte
+	if _, err := io.ReadFull(r, m[:]); err != nil {
+		return fmt.Errorf("read tunnel hello: %w", noEOF(err))
+	}
+	if m != tunnelMagic {
+		return fmt.Errorf("peer is not the other end of a tunnel")
+	}
+	batch := inFlight(threads)
+	var frame [8]byte
+	for {
+		// Wait for one frame, then take those already buffered behind it.
+		var raws []int
+		var comps [][]byte
+		done := false
+		for len(comps) == 0 || len(comps) < batch && framed(r) {
+			if _, err := io.ReadFull(r, frame[:]); err != nil {
+				return fmt.Errorf("read tunnel frame: %w", noEOF(err))
+			}
+			raw := binary.LittleEndian.Uint32(frame[:4])
+			size := binary.LittleEndian.Uint32(frame[4:])
+			if raw == 0 && size == 0 {
+				done = true
+				break
+			}
+			// Block sizes never exceed 4 MiB (see SetBlockSizeBytes).
+			if raw == 0 || raw > 4<<20 || size == 0 || size > raw+1 {
+				return corruptf("invalid tunnel frame")
+			}
+			comp := make([]byte, size)
+			if _, err := io.ReadFull(r, comp); err != nil {
+				return fmt.Errorf("read tunnel frame: %w", noEOF(err))
+			}
+			raws = append(raws, int(raw))
+			comps = append(comps, comp)
+		}
+
+		if len(comps) > 0 {
+			decs := make([][]byte, len(comps))
+			err := codec.ForEachBlock(impl, len(comps), threads, func(i int) error {
+				dec, err := codec.DecodeBlock(comps[i], raws[i])
+				decs[i] = dec
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for _, d := range decs {
+				if _, err := dst.Write(d); err != nil {
+					return err
+				}
+			}
+		}
+		if done {
+			return closeWrite(dst)
+		}
+	}
+}
+
+// framed reports whether a whole frame is buffered in r.
+func framed(r *bufio.Reader) bool {
+	if r.Buffered() < 8 {
+		return false
+	}
+	head, _ := r.Peek(8)
+	return r.Buffered() >= 8+int(binary.LittleEndian.Uint32(head[4:]))
+}
+
+// closeWrite signals EOF to the peer of c while its other direction goes on.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"proj3/core/codec"
+)
+
+// DefaultVolumeSize caps the size of each output volume. 0 writes a single file.
+var DefaultVolumeSize uint64
+
+func SetVolumeSize(n uint64) {
+	DefaultVolumeSize = n
+}
+
+// CheckVolumeSize rejects a DefaultVolumeSize too small for the header of a
+// one-block archive and a block of blockSize bytes that did not compress,
+// with what the transform and encryption in force add to it. Checked before
+// compressing, so a bad size fails up front rather than at the first
+// incompressible block.
+func CheckVolumeSize(blockSize uint32) error {
+	if DefaultVolumeSize == 0 {
+		return nil
+	}
+	h := &codec.FileHeader{
+		Flags:          codec.FlagVolumes,
+		BlockSize:      blockSize,
+		NumBlocks:      1,
+		BlockCompSizes: []uint64{0},
+		BlockVolumes:   []uint32{0},
+	}
+	hdr, err := codec.AppendHeader(nil, h)
+	if err != nil {
+		return err
+	}
+	if DefaultTransform != "" {
+		h.Flags |= codec.FlagTransform
+	}
+	if encryption != nil {
+		h.Flags |= codec.FlagEncrypted
+	}
+	if min := uint64(len(hdr)) + h.MaxCompSize(); DefaultVolumeSize < min {
+		return fmt.Errorf("%d is too small for blocks of %d bytes; need at least %d", DefaultVolumeSize, blockSize, min)
+	}
+	return nil
+}
+
+// volumePath names volume v of the archive at path: the first volume is path
+// itself, the following ones are path.002, path.003, ...
+func volumePath(path string, v int) string {
+	if v == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%03d", path, v+1)
+}
+
+// writeArchive writes header and the compressed blocks to outputPath. When
+// DefaultVolumeSize is set, blocks are spread over numbered volumes at block
+// boundaries and the header records the volume of every block. When
+// DefaultStore is set, the blocks go to the store and only the header is
+// written to outputPath. When DefaultAlign is set, the header and every
+// block are padded to it. Single-file archives end with the end marker
+// under DefaultEndMarker.
+func writeArchive(outputPath string, header *codec.FileHeader, blocks [][]byte) error {
+	defer codec.StartPhase("write")()
+	if DefaultAlign != 0 {
+		if DefaultStore != "" || DefaultVolumeSize != 0 {
+			return fmt.Errorf("alignment cannot be combined with volumes or a block store")
+		}
+		setAlignment(header, DefaultAlign)
+	}
+	if DefaultVolumeSize != 0 && len(DefaultTee) > 0 {
+		return fmt.Errorf("copies of the archive cannot be combined with volumes")
+	}
+	if DefaultStore != "" {
+		if DefaultVolumeSize != 0 {
+			return fmt.Errorf("volumes cannot be combined with a block store")
+		}
+		if err := writeStore(DefaultStore, header, blocks); err != nil {
+			return err
+		}
+		blocks = nil
+	}
+	if DefaultVolumeSize == 0 {
+		out, err := createArchive(outputPath)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		defer closeFile(out)
+
+		marker := codec.DefaultEndMarker && header.Flags&codec.FlagStore == 0
+		if marker {
+			header.Flags |= codec.FlagEndMarker
+		}
+		hdr, err := codec.AppendHeader(nil, header)
+		if err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+		comp := header.CompOffsets()
+		size := uint64(len(hdr)) + uint64(comp[len(blocks)])
+		if marker {
+			size += codec.EndMarkerSize
+		}
+		if err := reserve(out, size); err != nil {
+			return err
+		}
+		// Under IOHintDirect, the header and every block of an aligned
+		// archive go out with their padding in one aligned write, so
+		// O_DIRECT takes them.
+		direct := out.direct != nil && header.Flags&codec.FlagAlign != 0 && header.Align%directAlign == 0
+		if direct {
+			hdr = append(alignedBuffer(len(hdr))[:0], hdr...)
+		}
+		if _, err := out.Write(hdr); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+		var pad, buf []byte
+		if header.Flags&codec.FlagAlign != 0 {
+			pad = make([]byte, header.Align)
+		}
+		for i := range blocks {
+			if direct {
+				n := int(comp[i+1] - comp[i])
+				if cap(buf) < n {
+					buf = alignedBuffer(n)
+				}
+				buf = buf[:n]
+				copy(buf[copy(buf, blocks[i]):], pad)
+				if _, err := out.Write(buf); err != nil {
+					return fmt.Errorf("write block %d: %w", i, err)
+				}
+				continue
+			}
+			if _, err := out.Write(blocks[i]); err != nil {
+				return fmt.Errorf("write block %d: %w", i, err)
+			}
+			if n := comp[i+1] - comp[i] - int64(len(blocks[i])); n > 0 {
+				if _, err := out.Write(pad[:n]); err != nil {
+					return fmt.Errorf("write block %d: %w", i, err)
+				}
+			}
+		}
+		if marker {
+			if _, err := out.Write(codec.AppendEndMarker(nil, comp[len(blocks)])); err != nil {
+				return fmt.Errorf("write end marker: %w", err)
+			}
+		}
+		return commitFile(out)
+	}
+
+	header.Flags |= codec.FlagVolumes
+	header.VolumeSize = DefaultVolumeSize
+	header.BlockVolumes = make([]uint32, len(blocks))
+
+	// The header lives in the first volume; its size only depends on the
+	// number of blocks, so measure it before assigning volumes.
+	var hdr bytes.Buffer
+	if err := codec.WriteHeader(&hdr, header); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	used := uint64(hdr.Len())
+	if used > DefaultVolumeSize {
+		return fmt.Errorf("header (%d bytes) exceeds volume size %d", used, DefaultVolumeSize)
+	}
+
+	vol := uint32(0)
+	volBytes := []uint64{used} // bytes per volume, for preallocation
+	for i, b := range blocks {
+		n := uint64(len(b))
+		if n > DefaultVolumeSize {
+			return fmt.Errorf("block %d (%d bytes) exceeds volume size %d", i, n, DefaultVolumeSize)
+		}
+		if i == 0 && used+n > DefaultVolumeSize {
+			// Readers expect a block in every volume, the first included.
+			return fmt.Errorf("header (%d bytes) and block 0 (%d bytes) exceed volume size %d", used, n, DefaultVolumeSize)
+		}
+		if used+n > DefaultVolumeSize && used > 0 {
+			vol++
+			used = 0
+			volBytes = append(volBytes, 0)
+		}
+		header.BlockVolumes[i] = vol
+		used += n
+		volBytes[vol] += n
+	}
+
+	hdr.Reset()
+	if err := codec.WriteHeader(&hdr, header); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer func() { _ = closeFile(out) }()
+	if err := reserve(out, volBytes[0]); err != nil {
+		return err
+	}
+	if _, err := out.Write(hdr.Bytes()); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	cur := uint32(0)
+	for i, b := range blocks {
+		if header.BlockVolumes[i] != cur {
+			if err := commitFile(out); err != nil {
+				return fmt.Errorf("close volume %d: %w", cur+1, err)
+			}
+			cur = header.BlockVolumes[i]
+			out, err = createAtomic(volumePath(outputPath, int(cur)))
+			if err != nil {
+				return fmt.Errorf("create volume %d: %w", cur+1, err)
+			}
+			if err := reserve(out, volBytes[cur]); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(b); err != nil {
+			return fmt.Errorf("write block %d: %w", i, err)
+		}
+	}
+	return commitFile(out)
+}
+
+// openPayload returns a reader over the block payload of a member whose
+// header has just been read from in. For multi-volume archives the reader
+// continues into the numbered volume files next to path; close releases them.
+// Manifests read their blocks from the block store.
+func openPayload(in io.Reader, path string, h *codec.FileHeader) (io.Reader, func(), error) {
+	if h.Payload != nil {
+		return bytes.NewReader(h.Payload), func() {}, nil
+	}
+	if h.Flags&codec.FlagStore != 0 {
+		r, err := openStore(h)
+		return r, func() {}, err
+	}
+	if h.Flags&codec.FlagAlign != 0 {
+		return newUnpadReader(in, h, 0), func() {}, nil
+	}
+	if h.Flags&codec.FlagVolumes == 0 {
+		return in, func() {}, nil
+	}
+
+	// Payload bytes stored in each volume, in order.
+	var sizes []uint64
+	for i := uint64(0); i < h.NumBlocks; i++ {
+		v := int(h.BlockVolumes[i])
+		if v < len(sizes)-1 || v > len(sizes) {
+			return nil, nil, corruptf("block %d: invalid volume %d", i, v+1)
+		}
+		if v == len(sizes) {
+			sizes = append(sizes, 0)
+		}
+		sizes[v] += h.BlockCompSizes[i]
+	}
+	if len(sizes) == 0 {
+		return in, func() {}, nil
+	}
+
+	var files []*ioFile
+	closeAll := func() {
+		for _, f := range files {
+			closeFile(f)
+		}
+	}
+	readers := []io.Reader{io.LimitReader(in, int64(sizes[0]))}
+	for v := 1; v < len(sizes); v++ {
+		f, err := openFile(volumePath(path, v))
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("open volume %d: %w", v+1, err)
+		}
+		files = append(files, f)
+		readers = append(readers, io.LimitReader(f, int64(sizes[v])))
+	}
+	return io.MultiReader(readers...), closeAll, nil
+}
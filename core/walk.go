@@ -0,0 +1,150 @@
+package core
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walkStatChunk is how many directory entries one worker stats at a time,
+// so huge flat directories are spread over the pool too.
+const walkStatChunk = 64
+
+// walkEntry is one file or directory found by walkTree.
+type walkEntry struct {
+	path string
+	info fs.FileInfo // from Lstat: symlinks are not followed
+}
+
+// walkNode is a walked entry with, for directories, its entries.
+type walkNode struct {
+	walkEntry
+	children []*walkNode
+}
+
+// walker reads directories and stats their entries on up to threads
+// goroutines.
+type walker struct {
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+	done bool
+}
+
+// walkTree lists root and, if it is a directory, everything below it, in
+// the same lexical pre-order as filepath.WalkDir. On network filesystems
+// and very large trees the walk itself can dominate, so directories are
+// read and entries stat'ed by a pool of threads goroutines; the order of
+// the result (and so of any archive built from it) does not depend on it.
+func walkTree(root string, threads int) ([]walkEntry, error) {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	top := &walkNode{walkEntry: walkEntry{path: root, info: info}}
+	if info.IsDir() {
+		if threads < 1 {
+			threads = 1
+		}
+		w := &walker{sem: make(chan struct{}, threads-1)}
+		w.dir(top)
+		w.wg.Wait()
+		if w.err != nil {
+			return nil, w.err
+		}
+	}
+
+	var out []walkEntry
+	var flatten func(n *walkNode)
+	flatten = func(n *walkNode) {
+		out = append(out, n.walkEntry)
+		for _, c := range n.children {
+			flatten(c)
+		}
+	}
+	flatten(top)
+	return out, nil
+}
+
+// spawn runs fn on a free pool slot, or right away when none is free.
+func (w *walker) spawn(fn func()) {
+	select {
+	case w.sem <- struct{}{}:
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			fn()
+			<-w.sem
+		}()
+	default:
+		fn()
+	}
+}
+
+// fail records the first error and stops further work.
+func (w *walker) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.done = true
+	w.mu.Unlock()
+}
+
+func (w *walker) stopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done
+}
+
+// dir reads directory n and walks its entries.
+func (w *walker) dir(n *walkNode) {
+	if w.stopped() {
+		return
+	}
+	ents, err := os.ReadDir(n.path)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	n.children = make([]*walkNode, len(ents))
+	for s := 0; s < len(ents); s += walkStatChunk {
+		e := s + walkStatChunk
+		if e > len(ents) {
+			e = len(ents)
+		}
+		chunk, kids := ents[s:e], n.children[s:e]
+		w.spawn(func() {
+			for i, d := range chunk {
+				info, err := d.Info()
+				if err != nil {
+					w.fail(err)
+					return
+				}
+				kids[i] = &walkNode{walkEntry: walkEntry{path: filepath.Join(n.path, d.Name()), info: info}}
+				if d.IsDir() {
+					c := kids[i]
+					w.spawn(func() { w.dir(c) })
+				}
+			}
+		})
+	}
+}
+
+// fileKind names the type of a walked entry that is neither a regular file,
+// a directory nor a symlink, for the warnings of writers that skip them.
+func fileKind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	}
+	return "special file"
+}
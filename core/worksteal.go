@@ -4,11 +4,9 @@ package core
 import (
 	"fmt"
 	"io"
-	"math/rand"
 	"os"
-	"runtime"
-	"sync"
-	"time"
+
+	"proj3/core/codec"
 )
 
 // WorkStealingCompressFile: tasks = blocks; owner pops bottom; thieves steal top.
@@ -17,34 +15,41 @@ func WorkStealingCompressFile(inputPath, outputPath string, threads int) error {
 		threads = 1
 	}
 
+	if inputPath == "-" || isURL(inputPath) {
+		return streamCompressFile(inputPath, outputPath, "ws", threads)
+	}
 	info, err := os.Stat(inputPath)
 	if err != nil {
 		return fmt.Errorf("stat input: %w", err)
 	}
 	if !info.Mode().IsRegular() {
-		return fmt.Errorf("input is not a regular file")
+		return streamCompressFile(inputPath, outputPath, "ws", threads)
 	}
 
 	if info.Size() == 0 {
-		out, err := os.Create(outputPath)
+		out, err := createArchive(outputPath)
 		if err != nil {
 			return fmt.Errorf("create output: %w", err)
 		}
-		defer out.Close()
-		header := &FileHeader{
+		defer closeFile(out)
+		header := &codec.FileHeader{
 			Filename:       info.Name(),
 			OriginalSize:   0,
 			BlockSize:      DefaultBlockSize,
 			NumBlocks:      0,
 			BlockCompSizes: nil,
 		}
-		if err := WriteHeader(out, header); err != nil {
+		emptyDigest(header)
+		if err := codec.WriteEmptyMember(out, header); err != nil {
 			return fmt.Errorf("write header: %w", err)
 		}
-		return nil
+		return commitFile(out)
 	}
 
-	data, err := os.ReadFile(inputPath)
+	if DefaultPrefetch && !DefaultLongRange {
+		return compressPrefetched("ws", inputPath, outputPath, info, threads)
+	}
+	data, err := readFile(inputPath)
 	if err != nil {
 		return fmt.Errorf("read input: %w", err)
 	}
@@ -63,295 +68,170 @@ func WorkStealingCompressFile(inputPath, outputPath string, threads int) error {
 		blocks[i] = data[s:e]
 	}
 
-	if threads > numBlocks {
-		threads = numBlocks
-	}
-	deques := make([]*WSDeque, threads)
-	for i := 0; i < threads; i++ {
-		deques[i] = NewWSDeque((numBlocks + threads - 1) / threads)
-	}
-	for idx := 0; idx < numBlocks; idx++ {
-		deques[idx%threads].PushBottom(idx)
-	}
-
-	compressedBlocks := make([][]byte, numBlocks)
-	blockCompSizes := make([]uint64, numBlocks)
-
-	var wg sync.WaitGroup
-	wg.Add(threads)
-
-	type rngState uint32
-	xorshift := func(r *rngState) int {
-		x := uint32(*r)
-		x ^= x << 13
-		x ^= x >> 17
-		x ^= x << 5
-		*r = rngState(x)
-		return int(x)
-	}
-
-	const stealTries = 10
-
-	for wid := 0; wid < threads; wid++ {
-		go func(id int) {
-			defer wg.Done()
-			dq := deques[id]
-
-			rs := rngState(uint32(time.Now().UnixNano()) ^ uint32(id))
-
-			for {
-				task, ok := dq.PopBottom()
-				if !ok {
-					// Stealing Strategy
-					// 1. Fast Spin
-					for t := 0; t < stealTries; t++ {
-						// Fast random victim
-						victimID := xorshift(&rs) % threads
-						if victimID == id {
-							continue
-						}
-						if val, stolen := deques[victimID].Steal(); stolen {
-							task = val
-							ok = true
-							break
-						}
-					}
-
-					// 2. Yield and retry if still empty
-					if !ok {
-						runtime.Gosched()
-						for t := 0; t < stealTries; t++ {
-							victimID := xorshift(&rs) % threads
-							if victimID == id {
-								continue
-							}
-							if val, stolen := deques[victimID].Steal(); stolen {
-								task = val
-								ok = true
-								break
-							}
-						}
-					}
-
-					// 3. Give up
-					if !ok {
-						return
-					}
-				}
-
-				// Process Task
-				idx := task
-				buf := blocks[idx]
-
-				tokens := lzCompressTokens(buf)
-
-				var enc []byte
-				if len(tokens)+1 >= len(buf)+1 {
-					enc = make([]byte, 1+len(buf))
-					enc[0] = 0xFF
-					copy(enc[1:], buf)
-				} else {
-					enc = make([]byte, 1+len(tokens))
-					enc[0] = 0x00
-					copy(enc[1:], tokens)
-				}
-
-				compressedBlocks[idx] = enc
-				blockCompSizes[idx] = uint64(len(enc))
-			}
-		}(wid)
+	set := newBlockSet(numBlocks)
+	set.detect(info.Name())
+	if DefaultLongRange {
+		set.refs = findLongRange(data)
 	}
-	wg.Wait()
-
-	out, err := os.Create(outputPath)
+	wait := set.hashInput(data)
+	done := codec.StartPhase("compress")
+	err = codec.WSForEach(numBlocks, threads, func(idx int) error {
+		return set.encodeAt(idx, int64(idx)*int64(blockSize), blocks[idx])
+	})
+	done()
+	wait()
 	if err != nil {
-		return fmt.Errorf("create output: %w", err)
+		return err
 	}
-	defer out.Close()
 
-	header := &FileHeader{
-		Filename:       info.Name(),
-		OriginalSize:   uint64(originalSize),
-		BlockSize:      DefaultBlockSize,
-		NumBlocks:      uint64(numBlocks),
-		BlockCompSizes: blockCompSizes,
-	}
-	if err := WriteHeader(out, header); err != nil {
-		return fmt.Errorf("write header: %w", err)
-	}
-	for i := 0; i < numBlocks; i++ {
-		if _, err := out.Write(compressedBlocks[i]); err != nil {
-			return fmt.Errorf("write block %d: %w", i, err)
-		}
-	}
-	return nil
+	header := set.header(info.Name(), uint64(originalSize), DefaultBlockSize)
+	return writeArchive(outputPath, header, set.enc)
 }
 
 // WorkStealingDecompressFile: tasks = blocks; owner pops bottom; thieves steal top.
+// Concatenated members are decoded one after another into the same output.
+// When input and output are seekable files, workers read and write their
+// blocks in place (see wsDecompressAt); otherwise they go through a window.
 func WorkStealingDecompressFile(compressedPath, outputPath string, threads int) error {
 	if threads <= 0 {
 		threads = 1
 	}
 
-	in, err := os.Open(compressedPath)
+	in, err := openFile(compressedPath)
 	if err != nil {
 		return fmt.Errorf("open input: %w", err)
 	}
-	defer in.Close()
+	defer closeFile(in)
 
-	h, err := ReadHeader(in)
+	h, err := readMemberLead(in, 0)
 	if err != nil {
-		return fmt.Errorf("read header: %w", err)
-	}
-
-	if h.OriginalSize == 0 || h.NumBlocks == 0 {
-		out, err := os.Create(outputPath)
-		if err != nil {
-			return fmt.Errorf("create output: %w", err)
-		}
-		defer out.Close()
-		return nil
+		return err
 	}
 
-	numBlocks := int(h.NumBlocks)
-	blockSize := int(h.BlockSize)
-	originalSize := int(h.OriginalSize)
-
-	total := uint64(0)
-	for _, s := range h.BlockCompSizes {
-		total += s
-	}
-	compData := make([]byte, total)
-	if _, err := io.ReadFull(in, compData); err != nil {
-		return fmt.Errorf("read compressed payload: %w", err)
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
 	}
+	defer closeFile(out)
 
-	offs := make([]uint64, numBlocks)
-	cur := uint64(0)
-	for i := 0; i < numBlocks; i++ {
-		offs[i] = cur
-		cur += h.BlockCompSizes[i]
+	for member := 0; ; member++ {
+		if member > 0 {
+			h, err = readMemberLead(in, member)
+			if err == io.EOF {
+				return commitFile(out)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if h.Flags&codec.FlagTrailer != 0 {
+			if err := decompressStreamed("ws", in, out, h, threads); err != nil {
+				if member > 0 {
+					return fmt.Errorf("member %d: %w", member, err)
+				}
+				return err
+			}
+			continue
+		}
+		// checkMember only wraps output that is not a regular file, and
+		// blocks are then written through the wrapper, never in place.
+		// -mmap writes in place its own way, in decompressWindowed.
+		err = checkMember(out, h, func(w io.Writer) error {
+			if data, base, ok := wsPositions(in, out, h); ok && w == io.Writer(out) && !DefaultMmap {
+				if err := reserve(out, h.OriginalSize); err != nil {
+					return err
+				}
+				return wsDecompressAt(in, out, h, data, base, threads)
+			}
+			payload, closeVolumes, err := openPayload(in, compressedPath, h)
+			if err != nil {
+				return err
+			}
+			defer closeVolumes()
+			if err := reserve(out, h.OriginalSize); err != nil {
+				return err
+			}
+			return wsDecompressMember(payload, w, h, threads)
+		})
+		if err != nil {
+			if member > 0 {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+			return err
+		}
 	}
+}
 
-	outBuf := make([]byte, originalSize)
+// wsDecompressMember decodes one member a window of blocks at a time with
+// work-stealing workers and writes the result to out.
+func wsDecompressMember(in io.Reader, out io.Writer, h *codec.FileHeader, threads int) error {
+	return decompressWindowed(in, out, h, threads, codec.WSForEach)
+}
 
-	if threads > numBlocks {
-		threads = numBlocks
+// wsPositions returns the offsets of the payload of member h in in and of
+// its output in out, if its blocks can be read and written in place: both
+// files are seekable, and the payload is in one file and not chained.
+func wsPositions(in, out *ioFile, h *codec.FileHeader) (data, base int64, ok bool) {
+	if h.Flags&(codec.FlagVolumes|codec.FlagChained) != 0 {
+		return 0, 0, false
 	}
-	deques := make([]*WSDeque, threads)
-	for i := 0; i < threads; i++ {
-		deques[i] = NewWSDeque((numBlocks + threads - 1) / threads)
+	data, err := in.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, false
 	}
-	for idx := 0; idx < numBlocks; idx++ {
-		deques[idx%threads].PushBottom(idx)
+	base, err = out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, false
 	}
+	return data, base, true
+}
 
-	var wg sync.WaitGroup
-	wg.Add(threads)
-
-	var firstErr error
-	var mu sync.Mutex
-	const stealTries = 6
-
-	for wid := 0; wid < threads; wid++ {
-		go func(id int) {
-			defer wg.Done()
-			dq := deques[id]
-			r := rand.New(rand.NewSource(int64(id) ^ time.Now().UnixNano()))
-			for {
-				mu.Lock()
-				if firstErr != nil {
-					mu.Unlock()
-					return
-				}
-				mu.Unlock()
-
-				task, ok := dq.PopBottom()
-				if !ok {
-					for t := 0; t < stealTries && !ok; t++ {
-						v := r.Intn(threads)
-						if v == id {
-							continue
-						}
-						if tt, ok2 := deques[v].Steal(); ok2 {
-							task, ok = tt, true
-						}
-					}
-					if !ok {
-						runtime.Gosched()
-						for t := 0; t < stealTries && !ok; t++ {
-							v := r.Intn(threads)
-							if v == id {
-								continue
-							}
-							if tt, ok2 := deques[v].Steal(); ok2 {
-								task, ok = tt, true
-							}
-						}
-					}
-					if !ok {
-						return
-					}
-				}
-
-				idx := task
-				exp := blockSize
-				if idx == numBlocks-1 {
-					exp = originalSize - blockSize*(numBlocks-1)
-				}
-
-				comp := compData[offs[idx] : offs[idx]+h.BlockCompSizes[idx]]
-				if len(comp) == 0 {
-					mu.Lock()
-					if firstErr == nil {
-						firstErr = fmt.Errorf("empty compressed block %d", idx)
-					}
-					mu.Unlock()
-					return
-				}
-
-				mode := comp[0]
-				data := comp[1:]
-				var outBlock []byte
-				var derr error
-
-				switch mode {
-				case 0xFF:
-					if len(data) != exp {
-						derr = fmt.Errorf("raw size mismatch: got %d want %d", len(data), exp)
-					} else {
-						outBlock = data
-					}
-				case 0x00:
-					outBlock, derr = lzDecompressTokens(data, exp)
-				default:
-					derr = fmt.Errorf("unknown mode 0x%02x", mode)
-				}
-
-				if derr != nil {
-					mu.Lock()
-					if firstErr == nil {
-						firstErr = fmt.Errorf("block %d: %w", idx, derr)
-					}
-					mu.Unlock()
-					return
-				}
-				copy(outBuf[idx*blockSize:idx*blockSize+exp], outBlock)
-			}
-		}(wid)
+// wsDecompressAt decodes member h, whose payload starts at data in in, into
+// out from base on. Every worker reads its block with ReadAt, decodes it and
+// writes it at its final offset with WriteAt, so writes overlap decoding,
+// nothing waits for the slowest block of a window, and memory stays at a
+// block per worker. Raw blocks are copied by the kernel where it can (see
+// copyRange). Both files are left positioned after the member.
+func wsDecompressAt(in, out *ioFile, h *codec.FileHeader, data, base int64, threads int) error {
+	comp, offs := h.CompOffsets(), h.RawOffsets()
+	kernelCopy := canCopyRange(out, in)
+	done := codec.StartPhase("decompress")
+	err := codec.WSForEach(int(h.NumBlocks), threads, func(idx int) error {
+		size := offs[idx+1] - offs[idx]
+		if kernelCopy && rawBlockAt(in, h, data, comp, idx, size) &&
+			copyRange(out, base+offs[idx], in, data+comp[idx]+1, size) {
+			return nil
+		}
+		c, err := readBlockAt(in, h, data, comp, idx)
+		if err != nil {
+			return err
+		}
+		dec, err := decodeMemberBlock(h, idx, c, int(size))
+		if err != nil {
+			return fmt.Errorf("decompress block %d: %w", idx, err)
+		}
+		if _, err := out.WriteAt(dec, base+offs[idx]); err != nil {
+			return fmt.Errorf("write block %d: %w", idx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	wg.Wait()
-	if firstErr != nil {
-		return firstErr
+	done()
+	// Long-range references copy from bytes any block may have written.
+	if err := resolveLongRangeAt(h, out, base); err != nil {
+		return err
 	}
-
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("create output: %w", err)
+	if _, err := out.Seek(base+int64(h.OriginalSize), io.SeekStart); err != nil {
+		return err
 	}
-	defer out.Close()
-	if _, err := out.Write(outBuf); err != nil {
-		return fmt.Errorf("write output: %w", err)
+	// The payload is only in in if it was not read with the header or kept
+	// in the block store.
+	if h.Payload == nil && h.Flags&codec.FlagStore == 0 {
+		if _, err := in.Seek(data+comp[h.NumBlocks], io.SeekStart); err != nil {
+			return err
+		}
 	}
 	return nil
 }
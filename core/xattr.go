@@ -0,0 +1,120 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"proj3/core/codec"
+)
+
+// DefaultXattrs records the extended attributes of every file and directory
+// in snapshots (SELinux labels, file capabilities, user.* attributes, ...)
+// and restores them.
+var DefaultXattrs bool
+
+func SetXattrs(on bool) {
+	DefaultXattrs = on
+}
+
+// Xattr is one extended attribute.
+type Xattr struct {
+	Name  string
+	Value []byte
+}
+
+// maxXattrs and maxXattrValue bound what is accepted from a snapshot; Linux
+// allows at most 64 KiB per value.
+const (
+	maxXattrs     = 1 << 16
+	maxXattrValue = 64 << 10
+)
+
+// captureXattrs returns the extended attributes of path. A filesystem
+// without xattr support has none.
+func captureXattrs(path string) ([]Xattr, error) {
+	names, err := listXattrs(path)
+	if xattrSkippable(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list xattrs of %s: %w", path, err)
+	}
+	var attrs []Xattr
+	for _, name := range names {
+		v, err := getXattr(path, name)
+		if xattrSkippable(err) {
+			codec.Warnf("%s: xattr %s not read: %v", path, name, err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read xattr %s of %s: %w", name, path, err)
+		}
+		attrs = append(attrs, Xattr{Name: name, Value: v})
+	}
+	return attrs, nil
+}
+
+// restoreXattrs sets attrs on path, skipping with a warning those the target
+// filesystem or our privileges do not allow.
+func restoreXattrs(path string, attrs []Xattr) error {
+	for _, a := range attrs {
+		err := setXattr(path, a.Name, a.Value)
+		if xattrSkippable(err) {
+			codec.Warnf("%s: xattr %s not restored: %v", path, a.Name, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("set xattr %s: %w", a.Name, err)
+		}
+	}
+	return nil
+}
+
+// appendXattrs encodes attrs as a uint16 count, then per attribute a uint16
+// name length, the name, a uint32 value length and the value.
+func appendXattrs(b []byte, attrs []Xattr) ([]byte, error) {
+	if len(attrs) >= maxXattrs {
+		return nil, fmt.Errorf("too many xattrs")
+	}
+	le := binary.LittleEndian
+	b = le.AppendUint16(b, uint16(len(attrs)))
+	for _, a := range attrs {
+		if len(a.Name) > 0xFFFF || len(a.Value) > maxXattrValue {
+			return nil, fmt.Errorf("xattr %s too large", a.Name)
+		}
+		b = le.AppendUint16(b, uint16(len(a.Name)))
+		b = append(b, a.Name...)
+		b = le.AppendUint32(b, uint32(len(a.Value)))
+		b = append(b, a.Value...)
+	}
+	return b, nil
+}
+
+// readXattrs reads attributes written by appendXattrs.
+func readXattrs(r io.Reader) ([]Xattr, error) {
+	d, err := codec.ReadChunk(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]Xattr, d.U16())
+	for i := range attrs {
+		if d, err = codec.ReadChunk(r, 2); err != nil {
+			return nil, err
+		}
+		n := int(d.U16())
+		if d, err = codec.ReadChunk(r, n+4); err != nil {
+			return nil, err
+		}
+		attrs[i].Name = string(d.Bytes(n))
+		size := d.U32()
+		if n == 0 || size > maxXattrValue {
+			return nil, fmt.Errorf("invalid xattr %q", attrs[i].Name)
+		}
+		if d, err = codec.ReadChunk(r, int(size)); err != nil {
+			return nil, err
+		}
+		attrs[i].Value = d.Bytes(int(size))
+	}
+	return attrs, nil
+}
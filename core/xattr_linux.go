@@ -0,0 +1,58 @@
+//go:build linux
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+func listXattrs(path string) ([]string, error) {
+	buf, err := xattrBuffer(func(b []byte) (int, error) { return syscall.Listxattr(path, b) })
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, n := range bytes.Split(buf, []byte{0}) {
+		if len(n) > 0 {
+			names = append(names, string(n))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return xattrBuffer(func(b []byte) (int, error) { return syscall.Getxattr(path, name, b) })
+}
+
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+// xattrBuffer calls get with a buffer of the size it reports, retrying if
+// the attribute grows in between.
+func xattrBuffer(get func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		buf := make([]byte, n)
+		n, err = get(buf)
+		if err == syscall.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// xattrSkippable reports whether err means the filesystem or our privileges
+// do not allow the attribute, rather than a failure worth stopping for.
+func xattrSkippable(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENODATA)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package core
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func listXattrs(path string) ([]string, error) { return nil, errXattrUnsupported }
+
+func getXattr(path, name string) ([]byte, error) { return nil, errXattrUnsupported }
+
+func setXattr(path, name string, value []byte) error { return errXattrUnsupported }
+
+func xattrSkippable(err error) bool { return errors.Is(err, errXattrUnsupported) }
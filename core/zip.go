@@ -0,0 +1,198 @@
+package core
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"proj3/core/codec"
+)
+
+// zipMember is one file, directory or symlink headed for a .zip archive.
+type zipMember struct {
+	path   string // on disk
+	hdr    zip.FileHeader
+	target string   // of a symlink, stored as its data
+	sum    [32]byte // SHA-256 of the file, with DefaultManifest
+}
+
+// ZipCompress writes inputPath (a file, or a directory tree) to outputPath
+// as a standard .zip archive that any unzip tool can open. method is
+// "deflate" or "store". Members are compressed independently by the
+// scheduler chosen with impl and written in order through an OrderedWriter,
+// which drops each once it is written; a member that deflate does not
+// shrink is stored. Symlinks are stored the way Info-ZIP does, with the
+// unix mode in the external attributes and the target as data; devices,
+// sockets and pipes are skipped with a warning and, once the archive is
+// written, an error. With DefaultManifest set, the manifest is
+// also the archive comment, unless it is too long for one.
+func ZipCompress(inputPath, outputPath, method, impl string, threads int) error {
+	if method != "deflate" && method != "store" {
+		return fmt.Errorf("unknown zip method %q", method)
+	}
+
+	root := filepath.Dir(filepath.Clean(inputPath))
+	entries, err := walkTree(inputPath, threads)
+	if err != nil {
+		return fmt.Errorf("scan input: %w", err)
+	}
+	var members []*zipMember
+	skipped := 0 // entries of a type zip cannot store
+	for _, e := range entries {
+		symlink := e.info.Mode()&fs.ModeSymlink != 0
+		if !e.info.IsDir() && !e.info.Mode().IsRegular() && !symlink {
+			codec.Warnf("%s: %s cannot be stored in a zip archive; skipped", e.path, fileKind(e.info.Mode()))
+			skipped++
+			continue
+		}
+		rel, err := filepath.Rel(root, e.path)
+		if err != nil {
+			return fmt.Errorf("scan input: %w", err)
+		}
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil {
+			return fmt.Errorf("scan input: %w", err)
+		}
+		if hdr.Name, err = memberPath(filepath.ToSlash(rel)); err != nil {
+			codec.Warnf("%v; skipped", err)
+			continue
+		}
+		if e.info.IsDir() {
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			hdr.UncompressedSize64 = 0 // FileInfoHeader copies the directory's size
+		}
+		m := &zipMember{path: e.path, hdr: *hdr}
+		if symlink {
+			if m.target, err = os.Readlink(e.path); err != nil {
+				return fmt.Errorf("scan input: %w", err)
+			}
+		}
+		members = append(members, m)
+	}
+
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+
+	// Members are compressed a window at a time and written in order as
+	// they complete, so only the members of one window are held in memory.
+	window := inFlight(threads)
+	zw := zip.NewWriter(out)
+	ow := NewOrderedWriter(&zipMemberWriter{zw: zw, members: members}, window)
+	for w := 0; w < len(members); w += window {
+		n := len(members) - w
+		if n > window {
+			n = window
+		}
+		err := codec.ForEachBlock(impl, n, threads, func(i int) error {
+			idx := w + i
+			data, err := zipMemberData(members[idx], method)
+			if err != nil {
+				return err
+			}
+			return ow.WriteIndex(idx, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := ow.Close(len(members)); err != nil {
+		return err
+	}
+
+	var manifest []ManifestEntry
+	if DefaultManifest != "" {
+		for _, m := range members {
+			if m.hdr.Mode().IsRegular() {
+				manifest = append(manifest, ManifestEntry{Path: m.hdr.Name, SHA256: m.sum})
+			}
+		}
+	}
+	if comment := appendManifest(nil, manifest); len(comment) > 0xFFFF {
+		codec.Warnf("manifest of %d files is too long for a zip comment; not embedded", len(manifest))
+	} else if err := zw.SetComment(string(comment)); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write zip directory: %w", err)
+	}
+	if err := commitFile(out); err != nil {
+		return err
+	}
+	if err := writeManifest(manifest); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return fmt.Errorf("zip written without %d entries that cannot be stored (devices, sockets, pipes)", skipped)
+	}
+	return nil
+}
+
+// zipMemberData reads and compresses the file of m, filling in its header,
+// and returns the bytes to store for it. Directories have none, and a
+// symlink's target is its data.
+func zipMemberData(m *zipMember, method string) ([]byte, error) {
+	if m.hdr.Mode().IsDir() {
+		return nil, nil
+	}
+	if m.hdr.Mode()&fs.ModeSymlink != 0 {
+		data := []byte(m.target)
+		m.hdr.CRC32 = crc32.ChecksumIEEE(data)
+		m.hdr.Method = zip.Store
+		m.hdr.UncompressedSize64 = uint64(len(data))
+		m.hdr.CompressedSize64 = uint64(len(data))
+		return data, nil
+	}
+	data, err := readFile(m.path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", m.path, err)
+	}
+	m.hdr.CRC32 = crc32.ChecksumIEEE(data)
+	if DefaultManifest != "" {
+		m.sum = sha256.Sum256(data)
+	}
+	m.hdr.UncompressedSize64 = uint64(len(data))
+	m.hdr.Method = zip.Store
+	if method == "deflate" {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		fw.Write(data)
+		fw.Close()
+		if buf.Len() < len(data) {
+			m.hdr.Method = zip.Deflate
+			data = buf.Bytes()
+		}
+	}
+	m.hdr.CompressedSize64 = uint64(len(data))
+	return data, nil
+}
+
+// zipMemberWriter is the io.Writer behind the OrderedWriter of ZipCompress:
+// each Write is the data of the next member, in order.
+type zipMemberWriter struct {
+	zw      *zip.Writer
+	members []*zipMember
+	next    int
+}
+
+func (z *zipMemberWriter) Write(data []byte) (int, error) {
+	m := z.members[z.next]
+	w, err := z.zw.CreateRaw(&m.hdr)
+	if err != nil {
+		return 0, fmt.Errorf("zip %s: %w", m.hdr.Name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, fmt.Errorf("zip %s: %w", m.hdr.Name, err)
+	}
+	z.next++
+	return len(data), nil
+}
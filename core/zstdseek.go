@@ -0,0 +1,106 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"proj3/core/codec"
+)
+
+const (
+	zstdSkippableMagic = 0x184D2A5E
+	zstdSeekableMagic  = 0x8F92EAB1
+	zstdSeekChecksums  = 1 << 7 // seek table descriptor: entries carry checksums
+)
+
+// ZstdCompress writes inputPath ("-" for standard input, or an http(s)
+// URL) to outputPath in the zstd seekable format:
+//
+//	frame | frame | ... | skippable frame holding the seek table
+//
+// Every block of DefaultBlockSize bytes is a zstd frame of its own, encoded
+// by the scheduler named by impl, and the seek table lists the compressed
+// and raw size and the checksum of each. Any zstd decoder reads the output
+// as one stream, skipping the table; seekable readers use the table to
+// decode only the frames a range needs.
+func ZstdCompress(inputPath, outputPath, impl string, threads int) error {
+	if threads <= 0 {
+		threads = 1
+	}
+	var in io.Reader
+	if inputPath == "-" {
+		in = &ioFile{File: os.Stdin}
+	} else {
+		f, err := openFile(inputPath)
+		if err != nil {
+			return fmt.Errorf("open input: %w", err)
+		}
+		defer closeFile(f)
+		in = f
+	}
+	out, err := createAtomic(outputPath)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer closeFile(out)
+
+	p := newPrefetcher(in, int(DefaultBlockSize), inFlight(threads))
+	defer p.close()
+	var table []byte
+	frames := 0
+	for {
+		done := codec.StartPhase("read")
+		bufs, err := p.next()
+		done()
+		if err != nil {
+			return fmt.Errorf("read input: %w", err)
+		}
+		if len(bufs) == 0 {
+			break
+		}
+
+		entries := make([][12]byte, len(bufs))
+		ow := NewOrderedWriter(out, len(bufs))
+		done = codec.StartPhaseAround("compress", "write")
+		err = codec.ForEachBlock(impl, len(bufs), threads, func(i int) error {
+			if err := codec.CanceledErr(); err != nil {
+				return err
+			}
+			sum := uint32(codec.XXH64(bufs[i]))
+			frame := codec.AppendZstdFrame(nil, bufs[i], sum)
+			binary.LittleEndian.PutUint32(entries[i][0:], uint32(len(frame)))
+			binary.LittleEndian.PutUint32(entries[i][4:], uint32(len(bufs[i])))
+			binary.LittleEndian.PutUint32(entries[i][8:], sum)
+			if err := ow.WriteIndex(i, frame); err != nil {
+				return fmt.Errorf("write frame %d: %w", frames+i, err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = ow.Close(len(bufs))
+		}
+		done()
+		p.release(bufs)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			table = append(table, e[:]...)
+		}
+		frames += len(bufs)
+	}
+
+	// The footer closes the table, so readers find it from the end.
+	seek := binary.LittleEndian.AppendUint32(nil, zstdSkippableMagic)
+	seek = binary.LittleEndian.AppendUint32(seek, uint32(len(table)+9))
+	seek = append(seek, table...)
+	seek = binary.LittleEndian.AppendUint32(seek, uint32(frames))
+	seek = append(seek, zstdSeekChecksums)
+	seek = binary.LittleEndian.AppendUint32(seek, zstdSeekableMagic)
+	if _, err := out.Write(seek); err != nil {
+		return fmt.Errorf("write seek table: %w", err)
+	}
+	return commitFile(out)
+}
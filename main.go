@@ -1,52 +1,1807 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"proj3/core"
+	"proj3/core/codec"
+	"proj3/perf"
 )
 
+// Exit codes, so scripts can tell bad flags from a damaged archive. cmp and
+// grep keep their own 0/1 (same/differ, match/no match) and report trouble
+// with the codes from exitUsage up.
+const (
+	exitOK       = 0
+	exitError    = 1   // any other failure
+	exitUsage    = 2   // bad flags or arguments, as the flag package exits
+	exitIO       = 3   // reading or writing a file, device or connection failed
+	exitCorrupt  = 4   // the archive is damaged, truncated or not an archive
+	exitVerify   = 5   // a checksum or hash did not match, or -impl all runs disagree
+	exitLimit    = 6   // an archive is over -max-output-size, -max-blocks or -max-ratio
+	exitCanceled = 130 // interrupted, or an existing output was not overwritten
+)
+
+// errDeclined is returned when the user chose not to overwrite an output.
+var errDeclined = errors.New("not overwritten")
+
+// exitCode maps the error of a run to its exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, context.Canceled), errors.Is(err, errDeclined):
+		return exitCanceled
+	case errors.Is(err, core.ErrVerify):
+		return exitVerify
+	case errors.Is(err, core.ErrLimitExceeded):
+		return exitLimit
+	case errors.Is(err, core.ErrCorrupt), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		// An input ending too soon is a truncated archive.
+		return exitCorrupt
+	case core.IsIOError(err):
+		return exitIO
+	}
+	return exitError
+}
+
+// troubleCode is exitCode for cmp and grep, where 1 has its own meaning.
+func troubleCode(err error) int {
+	if c := exitCode(err); c != exitError {
+		return c
+	}
+	return exitUsage
+}
+
+// fail prints err and exits with its code.
+func fail(err error) {
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "interrupted")
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// usagef prints a usage error and exits with exitUsage.
+func usagef(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintln(os.Stderr, "run with -h for the list of flags")
+	os.Exit(exitUsage)
+}
+
+// cancelOnInterrupt cancels the runs on SIGINT or SIGTERM, so the workers
+// stop and the process exits with exitCanceled. A run blocked where nothing
+// checks the context (a write to a stalled pipe, say) is ended after a
+// grace period, or at once by a second signal.
+func cancelOnInterrupt() {
+	ctx, cancel := context.WithCancel(context.Background())
+	codec.SetContext(ctx)
+	stderr := os.Stderr
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+		select {
+		case <-sig:
+		case <-time.After(3 * time.Second):
+		}
+		fmt.Fprintln(stderr, "interrupted")
+		os.Exit(exitCanceled)
+	}()
+}
+
+func knownMode(mode string) bool {
+	switch mode {
+	case "compress", "decompress", "cmp", "estimate", "delta", "apply", "tar", "extract", "zip",
+		"zstd", "snapshot", "restore", "send", "recv", "serve", "tunnel", "info", "index", "rebuild", "grep", "matchstats",
+		"analyze", "verify-manifest", "perfbaseline", "perfcheck":
+		return true
+	}
+	return false
+}
+
+func knownImpl(impl string) bool {
+	switch impl {
+	case "seq", "bsp", "ws", "fj", "pool", "all":
+		return true
+	}
+	return false
+}
+
 func main() {
-	mode := flag.String("mode", "", "Mode: compress or decompress")
-	inPath := flag.String("in", "", "Input file path")
-	outPath := flag.String("out", "", "Output file path")
-	impl := flag.String("impl", "seq", "Implementation: seq, bsp, or ws")
+	mode := flag.String("mode", "", "Mode: compress, decompress, cmp, estimate, delta, apply, tar, extract, zip, zstd, snapshot, restore, send, recv, serve, tunnel, info, index, rebuild, grep, matchstats, analyze, verify-manifest, perfbaseline or perfcheck (default: decompress archives, compress anything else)")
+	inPath := flag.String("in", "", "Input file path or http(s) URL (listen address for -mode recv and tunnel)")
+	httpParallel := flag.Int("http-parallel", 1, "Input from an http(s) URL: fetch this many blocks at once with ranged requests")
+	var outs listFlag
+	flag.Var(&outs, "out", "Output file path (receiver address for -mode send, listen address for -mode serve, target address for -mode tunnel); repeat to write copies of an archive")
+	impl := flag.String("impl", "seq", "Implementation: seq, bsp, ws, fj (fork-join) or pool (channel worker pool); all runs compress/decompress with each and checks they agree")
 	threads := flag.Int("threads", 4, "Number of worker threads for parallel implementations")
+	filter := flag.String("filter", "none", "Compress: block pre-filter for numeric data: none, delta, transpose or delta+transpose")
+	stride := flag.Int("stride", 4, "Element size in bytes for -filter")
+	member := flag.String("member", "", "File to restore from a .tar.pcz with -mode extract")
+	zipMethod := flag.String("zip-method", "deflate", "Member method for -mode zip: deflate or store")
+	basePath := flag.String("base", "", "Base file for -mode delta and -mode apply; previous snapshot for -mode snapshot")
+	indexPath := flag.String("index", "", "JSON index written by -mode index, for -mode rebuild")
+	codecName := flag.String("codec", "auto", "Block codec: auto, lz, lzh, rle, fast, raw (or store) or exec")
+	prefetch := flag.Bool("prefetch", true, "Compress: read the next window of blocks while workers compress the current one (false reads whole files first)")
+	slab := flag.Bool("slab", true, "Compress: take input blocks from slabs of recycled buffers instead of allocating each (false to compare the allocation line of the summary)")
+	endMarker := flag.Bool("end-marker", true, "Compress: end every member with a marker that lets readers report a truncated archive up front (false for readers that predate it)")
+	mmap := flag.Bool("mmap", false, "Decompress: map regular output files and decode blocks straight into the mapping (bsp, ws, fj, pool)")
+	detect := flag.Bool("detect", true, "Compress with -codec auto: store files that look already compressed (.zip, .jpg, .mp4, ... or a random-looking first block) without an LZ pass")
+	level := flag.Int("level", 6, "Compression level 1-9; 9 spends much more CPU on an optimal LZ parse")
+	blockSize := flag.String("block-size", "", "Compress: block size, 4K to 4M (default 1M)")
+	tune := flag.Bool("tune", false, "Compress: try a sample of the input at several block sizes and levels, print how each did and use the best; with -mode estimate, only recommend it")
+	perfSize := flag.String("perf-size", "16M", "perfbaseline: bytes of each generated corpus")
+	perfThreshold := flag.Float64("perf-threshold", 10, "perfcheck: percent of throughput or ratio a result may lose against the baseline")
+	matchFinder := flag.String("match-finder", "", "Compress: LZ match finder instead of the level's: hash, dual, chain or bt (binary tree)")
+	chained := flag.Bool("chained", false, "Compress with -impl seq: let the LZ window run on across block boundaries (better ratio; blocks then decode only in order)")
+	repcodes := flag.Bool("repcodes", false, "Compress: let LZ blocks reuse the last two match offsets in 2-byte tokens (archives need a reader that knows them)")
+	longRange := flag.Bool("long-range", false, "Compress: find repeats of 64K or more anywhere in the file and store them as references")
+	execCmd := flag.String("exec-cmd", "", "External compressor for -codec exec (e.g. \"zstd -q -c\"); also needed to decompress its blocks")
+	keyfile := flag.String("keyfile", "", "Key file of 32 bytes (raw or 64 hex digits): archives written are encrypted with it; also needed to decrypt them")
+	kmsCmd := flag.String("kms-cmd", "", "External KMS command, run as \"cmd wrap KEYID\" or \"cmd unwrap KEYID\" with the key on stdin; also needed to decrypt archives it wrapped")
+	kmsKey := flag.String("kms-key", "", "Encrypt archives written, with the data key wrapped by -kms-cmd under this key id")
+	var encryptTo listFlag
+	flag.Var(&encryptTo, "encrypt-to", "Encrypt archives written to this age recipient (age1..., ssh-...) or OpenPGP key (via gpg); repeat for more")
+	ageIdentity := flag.String("age-identity", "", "age identity file to decrypt archives encrypted to age recipients")
+	incremental := flag.Bool("incremental", false, "Compress: reuse unchanged blocks of an existing archive at -out (append-only inputs)")
+	blockHashes := flag.Bool("block-hashes", false, "Compress: record the SHA-256 of every block in the header")
+	strongHash := flag.Bool("strong-hash", false, "Compress: record the SHA-256 of the whole input in the header; decompression then checks the output against it")
+	parse := flag.String("parse", "normal", "Reading archives: normal; strict, rejecting anything a writer would not produce; or lenient, warning about recoverable oddities and going on")
+	heatmap := flag.Bool("heatmap", false, "Analyze: also draw the blocks' compressibility as an ASCII heatmap on stderr, with the load of every worker")
+	maxOutput := flag.String("max-output-size", "", "Reading archives: refuse members that decode to more than this many bytes, e.g. 10G")
+	maxBlocks := flag.Uint64("max-blocks", 0, "Reading archives: refuse members with more blocks than this; 0 for no limit")
+	maxRatio := flag.Float64("max-ratio", 0, "Reading archives: refuse members that expand more than this many times (original over compressed size); 0 for no limit")
+	manifest := flag.String("manifest", "", "Tar, zip and snapshot: write the SHA-256 of every archived file to this file (sha256sum format) and embed them in the archive")
+	ioHint := flag.String("io-hint", "none", "Page cache hint for input/output files: none, sequential, dontneed or direct")
+	limitRate := flag.String("limit-rate", "", "Cap file I/O throughput, in bytes per second (e.g. 100M)")
+	limitRateOn := flag.String("limit-rate-on", "both", "Apply -limit-rate to read, write or both")
+	retries := flag.Int("retries", 7, "Retry reads, writes, HTTP requests and send connections that fail with a transient error (EINTR, EAGAIN, timeouts, HTTP 5xx) this many times")
+	retryDelay := flag.Duration("retry-delay", time.Second, "Pause before the first retry; pauses double up to 30s")
+	adaptiveThreads := flag.Bool("adaptive-threads", false, "Park parallel workers while other processes need the CPUs")
+	store := flag.String("store", "", "Block store directory: compressed blocks are kept there by hash and the archive is a small manifest; also needed to read such archives")
+	owner := flag.Bool("owner", false, "Snapshot/restore: record and restore file owners and groups (restoring needs root)")
+	xattrs := flag.Bool("xattrs", false, "Snapshot/restore: record and restore extended attributes (SELinux labels, capabilities, user.*)")
+	blockCache := flag.String("block-cache", "64M", "Decoded block cache per archive for random-access reads (-mode serve)")
+	stats := flag.Bool("stats", false, "Print block cache statistics to stderr when -mode serve stops")
+	pprofAddr := flag.String("pprof", "", "Serve, recv and tunnel: expose CPU, heap and other profiles (net/http/pprof) on this admin address, e.g. localhost:6060")
+	tlsCert := flag.String("tls-cert", "", "Serve: HTTPS with the certificate in this PEM file (reloaded when it changes, e.g. by an ACME client); needs -tls-key")
+	tlsKey := flag.String("tls-key", "", "Serve: private key of -tls-cert, a PEM file")
+	tlsClientCA := flag.String("tls-client-ca", "", "Serve with -tls-cert: require client certificates issued by the CAs in this PEM file (mutual TLS)")
+	tokenFile := flag.String("token-file", "", "Serve: require an \"Authorization: Bearer TOKEN\" header with one of the tokens in this file, one per line")
+	maxRequest := flag.String("max-request-size", "", "Serve and recv: refuse requests that read (serve) or send (recv) more than this many bytes, e.g. 1G")
+	maxJobs := flag.Int("max-jobs", 0, "Serve, recv and tunnel: jobs (serve requests, recv and tunnel connections) running at once; 0 for no limit")
+	maxClientJobs := flag.Int("max-client-jobs", 0, "Serve, recv and tunnel: jobs one client host may have running or queued; 0 for no limit")
+	maxThreads := flag.Int("max-threads", 0, "Serve, recv and tunnel: worker threads across running jobs, and at most -threads each; 0 for no limit")
+	queue := flag.Int("queue", 0, "Serve, recv and tunnel: jobs that wait for a free slot under -max-jobs or -max-threads before more are turned away")
+	tunnelPacked := flag.String("tunnel-packed", "out", "Side of -mode tunnel whose traffic is compressed: out (to -out, near the clients) or in (on -in, near the server)")
+	jsonOut := flag.Bool("json", false, "Print -mode info as JSON")
+	volumeSize := flag.String("volume-size", "", "Split compressed output into volumes of at most this size (e.g. 4G)")
+	outMode := flag.String("out-mode", "", "Permission mode of created output files in octal (e.g. 0600), applied regardless of the umask")
+	align := flag.String("align", "", "Compress: pad the header and every block to a multiple of this size (e.g. 4K) for direct I/O")
+	inFlight := flag.Int("in-flight", 0, "Blocks held between reading and writing in streaming paths (pipes, decompression, send/recv, grep); 0 means 4 per thread")
+	maxProcs := flag.Int("gomaxprocs", 0, "Set GOMAXPROCS for the run (0 keeps the Go runtime's default)")
+	lockThreads := flag.Bool("lock-threads", false, "Lock every bsp/ws worker to its own OS thread (runtime.LockOSThread)")
+	wsSeed := flag.String("ws-seed", "stripe", "How -impl ws deals blocks to workers at the start: stripe (round-robin) or range (contiguous runs)")
+	tracePath := flag.String("trace", "", "Write every task the bsp/ws schedulers ran (worker, start/end, stolen) to this file as a Chrome trace")
+	yes := flag.Bool("y", false, "Overwrite existing output files without asking")
+	flag.BoolVar(yes, "yes", false, "Same as -y")
+	tui := flag.Bool("tui", false, "Show a full-screen live view of the run with a progress bar per worker (needs a terminal on stderr)")
+	quiet := flag.Bool("q", false, "Do not print the size, ratio and speed summary after compress, decompress and tar")
+	timing := flag.Bool("timing", false, "Print wall and CPU time spent reading, compressing/decompressing and writing (and per BSP superstep) to stderr")
 
-	flag.Parse()
+	gz := gzipOptionsFor(os.Args[0])
+	flag.BoolVar(&gz.decompress, "d", gz.decompress, "gzip style: decompress")
+	flag.BoolVar(&gz.stdout, "c", gz.stdout, "gzip style: write to standard output and keep the input files")
+	flag.BoolVar(&gz.keep, "k", false, "gzip style: keep the input files (always done, except when run as gzip or gunzip)")
+	flag.BoolVar(&gz.test, "t", false, "gzip style: test archives by decompressing them and discarding the output")
+	flag.BoolVar(yes, "f", false, "gzip style: same as -y")
+	for n := 1; n <= 9; n++ {
+		flag.Var(levelFlag{level, n}, strconv.Itoa(n), fmt.Sprintf("gzip style: same as -level %d", n))
+	}
 
-	if *mode == "" || *inPath == "" || *outPath == "" {
-		os.Exit(1)
+	flag.CommandLine.Parse(expandShortFlags(os.Args[1:]))
+	outPath := new(string)
+	if len(outs) > 0 {
+		*outPath = outs[0]
 	}
 
-	switch *mode {
-	case "compress":
-		switch *impl {
-		case "seq":
-			core.SequentialCompressFile(*inPath, *outPath)
-		case "bsp":
-			core.BSPCompressFile(*inPath, *outPath, *threads)
-		case "ws":
-			core.WorkStealingCompressFile(*inPath, *outPath, *threads)
-		default:
-			os.Exit(1)
+	args := flag.Args()
+	if *mode == "" {
+		args = parseAfterFiles(args)
+	}
+	var jobs []job
+	switch {
+	case *mode != "":
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "d" || f.Name == "c" || f.Name == "t" {
+				usagef("-d, -c and -t pick the mode themselves; leave out -mode")
+			}
+		})
+	case gz.shaped() || *inPath == "" && len(args) > 1:
+		if *inPath != "" {
+			args = append([]string{*inPath}, args...)
+		}
+		jobs = gzipJobs(gz, args, *outPath)
+		*mode, *inPath, *outPath = jobs[0].mode, jobs[0].in, jobs[0].out
+		args = nil
+	case *mode == "":
+		if *inPath == "" && len(args) == 1 {
+			*inPath, args = args[0], nil
+		}
+		m, out, err := inferMode(*inPath, *outPath)
+		if err != nil {
+			fail(err)
 		}
+		*mode, *outPath = m, out
+	}
 
-	case "decompress":
-		switch *impl {
-		case "seq":
-			core.SequentialDecompressFile(*inPath, *outPath)
-		case "bsp":
-			core.BSPDecompressFile(*inPath, *outPath, *threads)
-		case "ws":
-			core.WorkStealingDecompressFile(*inPath, *outPath, *threads)
-		default:
-			os.Exit(1)
+	if *limitRate != "" {
+		n, err := parseSize(*limitRate)
+		if err == nil {
+			err = core.SetRateLimit(n, *limitRateOn)
+		}
+		if err != nil {
+			usagef("-limit-rate: %v", err)
+		}
+	}
+	core.SetAdaptiveThreads(*adaptiveThreads)
+	core.SetStore(*store)
+	core.SetXattrs(*xattrs)
+	core.SetOwner(*owner)
+	codec.SetTiming(*timing)
+	codec.SetTrace(*tracePath != "")
+	codec.SetLockThreads(*lockThreads)
+	// A failed block dooms the whole job, so the others can stop at once;
+	// recv, serve and tunnel go on serving after a failed request.
+	codec.SetAbortOnError(*mode != "recv" && *mode != "serve" && *mode != "tunnel")
+	if *mode != "recv" && *mode != "serve" && *mode != "tunnel" {
+		cancelOnInterrupt()
+	}
+	if err := codec.SetWSSeed(*wsSeed); err != nil {
+		usagef("-ws-seed: %v", err)
+	}
+	if *maxProcs < 0 {
+		usagef("-gomaxprocs: must not be negative")
+	}
+	if *maxProcs > 0 {
+		runtime.GOMAXPROCS(*maxProcs)
+	}
+	if err := core.SetInFlight(*inFlight); err != nil {
+		usagef("-in-flight: %v", err)
+	}
+	codec.SetWarnings(os.Stderr)
+	if err := codec.SetParse(*parse); err != nil {
+		usagef("-parse: %v", err)
+	}
+	decodeLimits := codec.DecodeLimits{MaxBlocks: *maxBlocks, MaxRatio: *maxRatio}
+	if *maxOutput != "" {
+		n, err := parseSize(*maxOutput)
+		if err != nil {
+			usagef("-max-output-size: %v", err)
+		}
+		decodeLimits.MaxOutputSize = n
+	}
+	if err := codec.SetDecodeLimits(decodeLimits); err != nil {
+		var le *codec.DecodeLimitError
+		if !errors.As(err, &le) {
+			usagef("%v", err)
+		}
+		name := map[string]string{"MaxOutputSize": "-max-output-size", "MaxBlocks": "-max-blocks", "MaxRatio": "-max-ratio"}[le.Field]
+		usagef("%s: %v", name, le.Err)
+	}
+	if err := core.SetIOHint(*ioHint); err != nil {
+		usagef("-io-hint: %v", err)
+	}
+	if err := core.SetRetry(*retries, *retryDelay); err != nil {
+		usagef("-retries: %v", err)
+	}
+	if err := codec.SetLevel(*level); err != nil {
+		usagef("-level: %v", err)
+	}
+	if err := codec.SetMatchFinder(*matchFinder); err != nil {
+		usagef("-match-finder: %v", err)
+	}
+	if *blockSize != "" {
+		n, err := parseSize(*blockSize)
+		if err == nil && (n < 4<<10 || n > 4<<20) {
+			err = fmt.Errorf("must be between 4K and 4M")
+		}
+		if err != nil {
+			usagef("-block-size: %v", err)
+		}
+		core.SetBlockSizeBytes(uint32(n))
+	}
+	// -tune leaves alone what was set on the command line.
+	var tuneSizes []uint32
+	var tuneLevels []int
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "block-size":
+			tuneSizes = []uint32{core.DefaultBlockSize}
+		case "level", "1", "2", "3", "4", "5", "6", "7", "8", "9":
+			tuneLevels = []int{*level}
+		}
+	})
+	if err := core.SetExecCommand(*execCmd); err != nil {
+		usagef("-exec-cmd: %v", err)
+	}
+	if err := core.SetKeyfile(*keyfile); err != nil {
+		usagef("-keyfile: %v", err)
+	}
+	if err := core.SetKMSCommand(*kmsCmd); err != nil {
+		usagef("-kms-cmd: %v", err)
+	}
+	core.SetAgeIdentity(*ageIdentity)
+
+	if *mode == "cmp" {
+		os.Exit(runCompare(*inPath, flag.Args(), *impl, *threads))
+	}
+	if *mode == "perfbaseline" || *mode == "perfcheck" {
+		// Warnings about the generated corpora, such as random being
+		// stored, would only interleave with the table.
+		codec.SetWarnings(nil)
+		var impls []string
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "impl" && *impl != "all" {
+				impls = []string{*impl}
+			}
+		})
+		if *mode == "perfcheck" {
+			os.Exit(runPerfCheck(*inPath, *perfThreshold))
+		}
+		size, err := parseSize(*perfSize)
+		if err != nil || size == 0 || size > 1<<30 {
+			usagef("-perf-size: want a size up to 1G")
+		}
+		os.Exit(runPerfBaseline(*outPath, perf.Config{Impls: impls, Size: int(size), Threads: *threads}))
+	}
+	if *mode == "verify-manifest" {
+		os.Exit(runVerifyManifest(*inPath, flag.Args(), *impl, *threads))
+	}
+	if *mode == "estimate" {
+		code := runEstimate(*inPath, *threads)
+		if code == exitOK && *tune {
+			code = runTune(*inPath, *threads, tuneSizes, tuneLevels)
+		}
+		os.Exit(code)
+	}
+	if *mode == "grep" {
+		os.Exit(runGrep(*inPath, flag.Args(), *impl, *threads))
+	}
+	if *mode == "info" {
+		os.Exit(runInfo(*inPath, flag.Args(), *jsonOut))
+	}
+
+	if *mode == "decompress" && len(args) > 0 {
+		archives := args
+		if *inPath != "" {
+			archives = append([]string{*inPath}, archives...)
+		}
+		if *outPath == "" {
+			usagef("usage: -mode decompress [-impl X -threads N] -out dir archive.pcz...")
+		}
+		if err := core.BatchDecompress(archives, *outPath, *impl, *threads); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	if !knownMode(*mode) {
+		usagef("unknown -mode %q", *mode)
+	}
+	if *inPath == "" || (*outPath == "" && *mode != "matchstats" && *mode != "analyze") {
+		usagef("usage: -mode %s -in input -out output [flags]", *mode)
+	}
+	switch {
+	case !knownImpl(*impl):
+		usagef("unknown -impl %q (want seq, bsp, ws, fj, pool or all)", *impl)
+	case *impl == "all" && len(jobs) > 1:
+		usagef("-impl all takes a single input")
+	case *impl == "all" && (*mode != "compress" && *mode != "decompress" || *incremental):
+		usagef("-impl all needs -mode compress or decompress, and not -incremental")
+	case (*mode == "delta" || *mode == "apply") && *basePath == "":
+		usagef("-mode %s needs -base", *mode)
+	case *mode == "extract" && *member == "":
+		usagef("-mode extract needs -member")
+	case *mode == "rebuild" && *indexPath == "":
+		usagef("-mode rebuild needs -index")
+	case *manifest != "" && *mode != "tar" && *mode != "zip" && *mode != "snapshot":
+		usagef("-manifest needs -mode tar, zip or snapshot")
+	case *pprofAddr != "" && *mode != "serve" && *mode != "recv" && *mode != "tunnel":
+		usagef("-pprof needs -mode serve, recv or tunnel")
+	case (*maxRequest != "" || *maxJobs != 0 || *maxClientJobs != 0 || *maxThreads != 0 || *queue != 0) &&
+		*mode != "serve" && *mode != "recv" && *mode != "tunnel":
+		usagef("-max-request-size, -max-jobs, -max-client-jobs, -max-threads and -queue need -mode serve, recv or tunnel")
+	case (*tlsCert != "" || *tlsKey != "" || *tlsClientCA != "" || *tokenFile != "") && *mode != "serve":
+		usagef("-tls-cert, -tls-key, -tls-client-ca and -token-file need -mode serve")
+	case (*tlsCert == "") != (*tlsKey == ""):
+		usagef("-tls-cert and -tls-key go together")
+	case *tlsClientCA != "" && *tlsCert == "":
+		usagef("-tls-client-ca needs -tls-cert")
+	case *tune && (*mode != "compress" || *incremental || *impl == "all"):
+		usagef("-tune needs -mode compress or estimate, and not -incremental or -impl all")
+	}
+	encrypts := *mode == "compress" || *mode == "tar" || *mode == "delta" || *mode == "snapshot"
+	switch {
+	case (*kmsKey != "" || len(encryptTo) > 0) && !encrypts:
+		usagef("-kms-key and -encrypt-to need -mode compress, tar, delta or snapshot")
+	case *kmsKey != "" && *kmsCmd == "":
+		usagef("-kms-key needs -kms-cmd")
+	case *kmsKey != "" && *keyfile != "" || len(encryptTo) > 0 && (*kmsKey != "" || *keyfile != ""):
+		usagef("-keyfile, -kms-key and -encrypt-to do not mix")
+	case (*kmsKey != "" || *keyfile != "" || len(encryptTo) > 0) && encrypts && *impl == "all":
+		usagef("-impl all cannot compare encrypted archives; every run seals them differently")
+	}
+	if encrypts {
+		var err error
+		switch {
+		case len(encryptTo) > 0:
+			err = core.SetRecipients(encryptTo)
+		case *kmsKey != "":
+			err = core.SetEncryption("exec", *kmsKey)
+		case *keyfile != "":
+			err = core.SetEncryption("keyfile", "")
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	if len(outs) > 1 {
+		if (*mode != "compress" && *mode != "tar" && *mode != "delta") || *impl == "all" {
+			usagef("several -out need -mode compress, tar or delta, and not -impl all")
+		}
+		if err := core.SetTee(outs[1:]); err != nil {
+			fail(fmt.Errorf("-out: %w", err))
+		}
+	}
+	if jobs == nil {
+		jobs = []job{{mode: *mode, in: *inPath, out: *outPath}}
+	}
+	if !*yes && replacesOutput(*mode, *incremental) {
+		targets := outs
+		if len(outs) <= 1 {
+			targets = nil
+			for _, j := range jobs {
+				targets = append(targets, j.out)
+			}
+		}
+		if *manifest != "" {
+			targets = append(targets, *manifest)
+		}
+		for _, t := range targets {
+			if err := confirmOverwrite(t, *inPath == "-" || *inPath == "/dev/stdin"); err != nil {
+				fail(err)
+			}
+		}
+	}
+
+	if *volumeSize != "" {
+		n, err := parseSize(*volumeSize)
+		if err == nil && n == 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			usagef("-volume-size: %v", err)
+		}
+		core.SetVolumeSize(n)
+		if err := core.CheckVolumeSize(core.DefaultBlockSize); err != nil {
+			usagef("-volume-size: %v", err)
+		}
+		// -tune only tries block sizes whose blocks fit a volume.
+		if tuneSizes == nil {
+			for _, b := range core.TuneBlockSizes {
+				if core.CheckVolumeSize(b) == nil {
+					tuneSizes = append(tuneSizes, b)
+				}
+			}
+			if tuneSizes == nil {
+				tuneSizes = []uint32{core.DefaultBlockSize}
+			}
+		}
+	}
+	if *outMode != "" {
+		n, err := strconv.ParseUint(*outMode, 8, 32)
+		if err == nil {
+			err = core.SetOutputMode(n)
+		}
+		if err != nil {
+			usagef("-out-mode: %v", err)
+		}
+	}
+	if *align != "" {
+		n, err := parseSize(*align)
+		if err == nil {
+			err = core.SetAlign(n)
+		}
+		if err != nil {
+			usagef("-align: %v", err)
+		}
+	}
+
+	core.SetBlockHashes(*blockHashes)
+	core.SetManifest(*manifest)
+	core.SetStrongHash(*strongHash)
+	core.SetLongRange(*longRange)
+	codec.SetRepcodes(*repcodes)
+	if *chained && *mode == "compress" && *impl != "seq" {
+		usagef("-chained needs -impl seq")
+	}
+	if *chained && *longRange {
+		usagef("-chained and -long-range do not mix")
+	}
+	core.SetChained(*chained)
+	core.SetDetect(*detect)
+	core.SetPrefetch(*prefetch)
+	core.SetSlab(*slab)
+	codec.SetEndMarker(*endMarker)
+	core.SetMmap(*mmap)
+	if err := core.SetHTTPParallel(*httpParallel); err != nil {
+		usagef("-http-parallel: %v", err)
+	}
+	if err := codec.SetCodec(*codecName); err != nil {
+		usagef("-codec: %v", err)
+	}
+	if *codecName == "exec" && *execCmd == "" {
+		usagef("-codec exec needs -exec-cmd")
+	}
+	if err := codec.SetFilter(*filter, *stride); err != nil {
+		usagef("-filter: %v", err)
+	}
+	if *mode == "serve" {
+		n, err := parseSize(*blockCache)
+		if err != nil {
+			usagef("-block-cache: %v", err)
+		}
+		core.SetBlockCacheSize(n)
+	}
+
+	limits := core.ServerLimits{MaxJobs: *maxJobs, MaxJobsPerClient: *maxClientJobs, MaxThreads: *maxThreads, QueueLength: *queue}
+	if *maxRequest != "" {
+		n, err := parseSize(*maxRequest)
+		if err != nil {
+			usagef("-max-request-size: %v", err)
+		}
+		limits.MaxRequestSize = int64(n)
+	}
+	if err := core.SetServerLimits(limits); err != nil {
+		usagef("%v", err)
+	}
+
+	var serveTLS *tls.Config
+	var tokens *core.Tokens
+	if *tlsCert != "" {
+		var err error
+		if serveTLS, err = core.ServerTLS(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			fail(fmt.Errorf("-tls-cert: %w", err))
+		}
+	}
+	if *tokenFile != "" {
+		var err error
+		if tokens, err = core.LoadTokens(*tokenFile); err != nil {
+			fail(fmt.Errorf("-token-file: %w", err))
+		}
+		if serveTLS == nil {
+			fmt.Fprintln(os.Stderr, "warning: -token-file without -tls-cert sends tokens in the clear")
+		}
+	}
+
+	if *pprofAddr != "" {
+		if err := servePprof(*pprofAddr); err != nil {
+			fail(fmt.Errorf("-pprof: %w", err))
+		}
+	}
+
+	if *impl == "all" {
+		os.Exit(runAll(*mode, *inPath, *outPath, *threads))
+	}
+
+	begin := time.Now()
+	code := exitOK
+	for _, j := range jobs {
+		*inPath, *outPath = j.in, j.out
+		spooled := func(err error) error { return err }
+		if j.out == "/dev/stdout" && stdoutIsFile() {
+			var err error
+			if *outPath, spooled, err = spoolStdout(); err != nil {
+				fail(err)
+			}
+		}
+		stopView := func() {}
+		if *tui {
+			if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+				fmt.Fprintln(os.Stderr, "-tui: stderr is not a terminal; running without the view")
+			} else {
+				n := *threads
+				if *impl == "seq" {
+					n = 1
+				}
+				codec.SetProgress(n)
+				var total uint64
+				if fi, err := os.Stat(*inPath); err == nil && fi.Mode().IsRegular() {
+					total = uint64(fi.Size())
+				}
+				stopView = startTUI(fmt.Sprintf("%s %s -impl %s -threads %d", *mode, *inPath, *impl, n), total)
+			}
+		}
+		if *tune && j.mode == "compress" {
+			tuneInput(*inPath, *threads, tuneSizes, tuneLevels, *quiet)
+		}
+		core.ResetStats()
+		start := time.Now()
+		var err error
+		switch *mode {
+		case "compress":
+			if *incremental {
+				_, err = core.IncrementalCompressFile(*inPath, *outPath, *impl, *threads)
+				break
+			}
+			switch *impl {
+			case "seq":
+				err = core.SequentialCompressFile(*inPath, *outPath)
+			case "bsp":
+				err = core.BSPCompressFile(*inPath, *outPath, *threads)
+			case "ws":
+				err = core.WorkStealingCompressFile(*inPath, *outPath, *threads)
+			case "fj":
+				err = core.ForkJoinCompressFile(*inPath, *outPath, *threads)
+			case "pool":
+				err = core.PoolCompressFile(*inPath, *outPath, *threads)
+			}
+
+		case "decompress":
+			switch *impl {
+			case "seq":
+				err = core.SequentialDecompressFile(*inPath, *outPath)
+			case "bsp":
+				err = core.BSPDecompressFile(*inPath, *outPath, *threads)
+			case "ws":
+				err = core.WorkStealingDecompressFile(*inPath, *outPath, *threads)
+			case "fj":
+				err = core.ForkJoinDecompressFile(*inPath, *outPath, *threads)
+			case "pool":
+				err = core.PoolDecompressFile(*inPath, *outPath, *threads)
+			}
+
+		case "delta":
+			err = core.DeltaCompressFile(*basePath, *inPath, *outPath, *impl, *threads)
+
+		case "apply":
+			err = core.ApplyDeltaFile(*basePath, *inPath, *outPath, *impl, *threads)
+
+		case "tar":
+			err = core.TarCompressFile(*inPath, *outPath, *impl, *threads)
+
+		case "extract":
+			err = core.TarExtractFile(*inPath, *member, *outPath, *impl, *threads)
+
+		case "zip":
+			err = core.ZipCompress(*inPath, *outPath, *zipMethod, *impl, *threads)
+
+		case "zstd":
+			err = core.ZstdCompress(*inPath, *outPath, *impl, *threads)
+
+		case "index":
+			err = core.ExportIndex(*inPath, *outPath)
+
+		case "rebuild":
+			err = core.RebuildArchive(*inPath, *indexPath, *outPath)
+
+		case "snapshot":
+			err = core.TakeSnapshot(*inPath, *outPath, *basePath, *impl, *threads)
+
+		case "restore":
+			err = core.RestoreSnapshot(*inPath, *outPath, *impl, *threads)
+
+		case "send":
+			err = core.SendFile(*inPath, *outPath, *impl, *threads)
+
+		case "recv":
+			err = core.ReceiveFile(*inPath, *outPath, *impl, *threads)
+
+		case "tunnel":
+			err = core.Tunnel(*inPath, *outPath, *tunnelPacked, *impl, *threads)
+
+		case "serve":
+			err = runServe(*inPath, *outPath, *stats, serveTLS, tokens)
+
+		case "matchstats":
+			var ms *core.MatchStats
+			if ms, err = core.MatchStatsFile(*inPath, *threads); err == nil {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(ms)
+			}
+			if err != nil {
+				err = fmt.Errorf("matchstats: %w", err)
+			}
+
+		case "analyze":
+			err = runAnalyze(*inPath, *outPath, *impl, *threads, *heatmap)
+		}
+		stopView()
+		err = spooled(err)
+		if err != nil {
+			if len(jobs) == 1 {
+				fail(err)
+			}
+			// Like gzip, go on with the other files and fail at the end.
+			fmt.Fprintf(os.Stderr, "%s: %v\n", j.in, err)
+			if code == exitOK {
+				code = exitCode(err)
+			}
+			if errors.Is(err, context.Canceled) {
+				break
+			}
+			continue
+		}
+
+		if !*quiet {
+			switch {
+			case *mode == "compress" && !*incremental, *mode == "tar", *mode == "zstd":
+				fmt.Fprintln(os.Stderr, core.RunStats("compress", *inPath, time.Since(start)))
+			case *mode == "decompress":
+				fmt.Fprintln(os.Stderr, core.RunStats("decompress", *inPath, time.Since(start)))
+			}
+		}
+		if j.removeIn {
+			if err := os.Remove(j.in); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	if *timing {
+		n := *threads
+		if *impl == "seq" {
+			n = 1
+		}
+		printTiming(time.Since(begin), n)
+	}
+	if *tracePath != "" {
+		if err := writeTrace(*tracePath); err != nil {
+			fail(fmt.Errorf("-trace: %w", err))
+		}
+	}
+	os.Exit(code)
+}
+
+// startTUI shows the progress view on the terminal on stderr while the run
+// goes on. Whatever is printed to os.Stderr meanwhile would be drawn over or
+// lost with the alternate screen, so it is held back and printed once the
+// returned function has restored the screen.
+func startTUI(title string, total uint64) func() {
+	term := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+	held := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		held <- b
+	}()
+	os.Stderr = w
+	codec.SetWarnings(w)
+	stop := core.StartProgressView(term, title, total, 200*time.Millisecond)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stop()
+			os.Stderr = term
+			codec.SetWarnings(term)
+			w.Close()
+			term.Write(<-held)
+			r.Close()
+		})
+	}
+}
+
+// runAnalyze implements -mode analyze: it writes the per-block report of
+// inPath as CSV to outPath, or to standard output without one, and with
+// heatmap draws it on stderr.
+func runAnalyze(inPath, outPath, impl string, threads int, heatmap bool) error {
+	reports, err := core.AnalyzeFile(inPath, impl, threads)
+	if err != nil {
+		return fmt.Errorf("analyze: %w", err)
+	}
+	w := io.Writer(os.Stdout)
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := core.WriteBlockCSV(w, reports); err != nil {
+		return err
+	}
+	if heatmap {
+		return core.WriteHeatmap(os.Stderr, reports, 64)
+	}
+	return nil
+}
+
+// writeTrace writes the scheduler trace of the run to path.
+func writeTrace(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := codec.WriteTrace(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printTiming reports where the run spent its time, and whether it was
+// bound by I/O or by the CPU.
+func printTiming(total time.Duration, threads int) {
+	var phases, steps []codec.PhaseTiming
+	var tasks, stolen int
+	for _, p := range codec.Timings() {
+		if p.Threads > 0 {
+			steps = append(steps, p)
+		} else if p.Tasks > 0 {
+			tasks, stolen = tasks+p.Tasks, stolen+p.Stolen
+		} else {
+			phases = append(phases, p)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "timing: %v total\n", total.Round(time.Microsecond))
+	fmt.Fprintf(os.Stderr, "  %-16s %6s %12s %12s %8s\n", "phase", "count", "wall", "cpu", "cpu/wall")
+	var io, work, workCPU time.Duration
+	for _, p := range phases {
+		util := 0.0
+		if p.Wall > 0 {
+			util = p.CPU.Seconds() / p.Wall.Seconds()
+		}
+		fmt.Fprintf(os.Stderr, "  %-16s %6d %12v %12v %8.2f\n",
+			p.Name, p.Count, p.Wall.Round(time.Microsecond), p.CPU.Round(time.Microsecond), util)
+		switch p.Name {
+		case "read", "write":
+			io += p.Wall
+		case "compress", "decompress", "long-range":
+			work += p.Wall
+			workCPU += p.CPU
+		}
+	}
+	if len(steps) > 0 {
+		// Per superstep: the spread of partition times across threads, and
+		// the share of thread time lost waiting for the slowest one.
+		fmt.Fprintf(os.Stderr, "  %-16s %7s %12s %12s %12s %6s\n", "bsp superstep", "threads", "compute min", "compute max", "barrier wait", "wait%")
+		for _, p := range steps {
+			share := 0.0
+			if p.Compute+p.Wait > 0 {
+				share = 100 * p.Wait.Seconds() / (p.Compute + p.Wait).Seconds()
+			}
+			fmt.Fprintf(os.Stderr, "  %-16s %7d %12v %12v %12v %5.1f%%\n", p.Name, p.Threads,
+				p.MinCompute.Round(time.Microsecond), p.MaxCompute.Round(time.Microsecond), p.Wait.Round(time.Microsecond), share)
+		}
+	}
+	if tasks > 0 {
+		fmt.Fprintf(os.Stderr, "  work stealing: %d tasks, %d stolen (%.1f%%)\n",
+			tasks, stolen, 100*float64(stolen)/float64(tasks))
+	}
+	if io+work == 0 {
+		return
+	}
+	if io > work {
+		fmt.Fprintf(os.Stderr, "I/O-bound: %.0f%% of the time went to reading and writing; more -threads will not help\n",
+			100*io.Seconds()/(io+work).Seconds())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "CPU-bound: %.0f%% of the time went to compressing or decompressing, on %.1f CPUs on average (-threads %d)\n",
+		100*work.Seconds()/(io+work).Seconds(), workCPU.Seconds()/work.Seconds(), threads)
+}
+
+// runServe implements -mode serve: it serves the archive until interrupted,
+// then optionally reports the block cache statistics.
+func runServe(archive, addr string, stats bool, tlsConfig *tls.Config, tokens *core.Tokens) error {
+	afs, err := core.OpenArchiveFS(archive)
+	if err != nil {
+		return err
+	}
+	defer afs.Close()
+
+	var h http.Handler = limitServe(afs, core.NewLimiter(core.DefaultServerLimits))
+	if tokens != nil {
+		h = requireToken(h, tokens)
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+	if tlsConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	if stats {
+		st := afs.CacheStats()
+		ratio := 0.0
+		if st.Hits+st.Misses > 0 {
+			ratio = 100 * float64(st.Hits) / float64(st.Hits+st.Misses)
+		}
+		fmt.Fprintf(os.Stderr, "block cache: %d hits, %d misses (%.1f%% hit rate), %d evictions, %d bytes held\n",
+			st.Hits, st.Misses, ratio, st.Evictions, st.Bytes)
+	}
+	return nil
+}
+
+// requireToken passes on the requests to h that carry one of tokens as a
+// bearer token, and answers the others with 401.
+func requireToken(h http.Handler, tokens *core.Tokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") || !tokens.Valid(strings.TrimSpace(auth[7:])) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pczip"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitServe serves afs to the clients lim admits. Requests for more than
+// the request size fail with 413, those of a client over its job limit
+// with 429 and those the server has no room for with 503, the last two
+// with a Retry-After.
+func limitServe(afs *core.ArchiveFS, lim *core.Limiter) http.Handler {
+	files := http.FileServer(servedFS{afs})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := lim.CheckSize(requestSize(afs, r)); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		_, release, err := lim.Acquire(r.Context(), client, 1)
+		if err != nil {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, core.ErrClientBusy) {
+				status = http.StatusTooManyRequests
+			}
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), status)
+			return
 		}
+		defer release()
+		files.ServeHTTP(w, r)
+	})
+}
+
+// servedFS reports the read errors of the files it opens as warnings:
+// http.FileServer drops them, since the response has started by then and
+// all it can do is cut the body short.
+type servedFS struct{ fs http.FileSystem }
+
+func (s servedFS) Open(name string) (http.File, error) {
+	f, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return servedFile{f, name}, nil
+}
+
+type servedFile struct {
+	http.File
+	name string
+}
+
+func (f servedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil && err != io.EOF {
+		codec.Warnf("serve %s: %v", f.name, err)
+	}
+	return n, err
+}
+
+// requestSize is how many bytes of afs a GET of r reads: the file, or the
+// range when it asks for a single one.
+func requestSize(afs *core.ArchiveFS, r *http.Request) int64 {
+	if r.Method != http.MethodGet {
+		return 0
+	}
+	f, err := afs.Open(path.Clean("/" + r.URL.Path))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return 0
+	}
+	size := fi.Size()
+	spec := r.Header.Get("Range")
+	first, last, single := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	if !strings.HasPrefix(spec, "bytes=") || !single || strings.Contains(spec, ",") {
+		return size
+	}
+	start, err1 := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	end, err2 := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	switch {
+	case first == "" && err2 == nil: // the last bytes
+		if end < size {
+			return end
+		}
+	case err1 == nil && err2 == nil && start <= end:
+		if end-start+1 < size {
+			return end - start + 1
+		}
+	case err1 == nil && last == "" && start < size:
+		return size - start
+	}
+	return size
+}
+
+// servePprof serves the net/http/pprof handlers on addr, on a mux of their
+// own so they never show up on the ports of serve, recv or tunnel. The
+// address is bound before it returns, so a bad one fails the run up front.
+func servePprof(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	fmt.Fprintf(os.Stderr, "pprof: profiles at http://%s/debug/pprof/\n", ln.Addr())
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// runInfo implements -mode info: it prints the headers and block tables of
+// an archive, for people or (with -json) for tools.
+func runInfo(archive string, args []string, asJSON bool) int {
+	if archive == "" && len(args) == 1 {
+		archive = args[0]
+	}
+	if archive == "" {
+		fmt.Fprintln(os.Stderr, "usage: -mode info [-json] archive.pcz")
+		return exitUsage
+	}
+	info, err := core.InspectArchive(archive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "info: %v\n", err)
+		return exitCode(err)
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			fmt.Fprintf(os.Stderr, "info: %v\n", err)
+			return exitCode(err)
+		}
+		return exitOK
+	}
 
+	for i, m := range info.Members {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("member %d at offset %d\n", i, m.Offset)
+		flags := "none"
+		if len(m.FlagNames) > 0 {
+			flags = strings.Join(m.FlagNames, ", ")
+		}
+		fmt.Printf("  format:        %s (flags 0x%x: %s)\n", m.Format, m.Flags, flags)
+		fmt.Printf("  filename:      %q\n", m.Filename)
+		fmt.Printf("  original size: %d\n", m.OriginalSize)
+		fmt.Printf("  block size:    %d\n", m.BlockSize)
+		fmt.Printf("  blocks:        %d\n", m.NumBlocks)
+		fmt.Printf("  compressed:    %d", m.CompressedSize)
+		if m.CompressedSize > 0 {
+			fmt.Printf(" (ratio %.2fx)", float64(m.OriginalSize)/float64(m.CompressedSize))
+		}
+		fmt.Println()
+		if m.VolumeSize > 0 {
+			fmt.Printf("  volume size:   %d\n", m.VolumeSize)
+		}
+		if m.Align > 0 {
+			fmt.Printf("  alignment:     %d\n", m.Align)
+		}
+		if len(m.LongRange) > 0 {
+			n := uint64(0)
+			for _, r := range m.LongRange {
+				n += r.Len
+			}
+			fmt.Printf("  long-range:    %d references, %d bytes\n", len(m.LongRange), n)
+		}
+		if m.SHA256 != "" {
+			fmt.Printf("  sha256:        %s\n", m.SHA256)
+		}
+		if m.BaseSHA256 != "" {
+			fmt.Printf("  delta base:    %d bytes, sha256 %s\n", m.BaseSize, m.BaseSHA256)
+		}
+		if m.Filter != "" {
+			fmt.Printf("  filter:        %s, stride %d\n", m.Filter, m.FilterStride)
+		}
+		if m.ExecCommand != "" {
+			fmt.Printf("  exec command:  %q\n", m.ExecCommand)
+		}
+		if m.Transform != "" {
+			fmt.Printf("  transform:     %q\n", m.Transform)
+		}
+		if m.KMS != "" {
+			fmt.Printf("  encryption:    AES-256-GCM, data key wrapped by %s for %s\n", m.KMS, strings.ReplaceAll(m.KeyID, "\n", ", "))
+		}
+		if m.Manifest != "" {
+			fmt.Printf("  manifest:      %d files (SHA-256)\n", strings.Count(m.Manifest, "\n"))
+		}
+		if len(m.TarEntries) > 0 {
+			fmt.Printf("  tar entries:   %d\n", len(m.TarEntries))
+			for _, e := range m.TarEntries {
+				fmt.Printf("    %12d %12d  %s\n", e.Offset, e.Size, e.Name)
+			}
+		}
+		if len(m.Blocks) == 0 {
+			continue
+		}
+		fmt.Printf("  %6s %12s %8s %4s %12s %9s %-6s %s\n", "block", "offset", "size", "vol", "comp-offset", "comp-size", "codec", "checksum")
+		for j, b := range m.Blocks {
+			sum := b.SHA256
+			if b.Object != "" {
+				sum = "object " + b.Object
+			}
+			if sum == "" {
+				sum = "-"
+			}
+			fmt.Printf("  %6d %12d %8d %4d %12d %9d %-6s %s\n", j, b.Offset, b.Size, b.Volume+1, b.CompOffset, b.CompSize, b.Codec, sum)
+		}
+	}
+	return exitOK
+}
+
+// runAll implements -impl all: it runs mode with every implementation,
+// prints their timings and fails if their outputs differ.
+func runAll(mode, inPath, outPath string, threads int) int {
+	var inSize int64
+	if fi, err := os.Stat(inPath); err == nil {
+		inSize = fi.Size()
+	}
+	runs, err := core.CrossCheckFile(mode, inPath, outPath, threads)
+	for _, r := range runs {
+		rate := 0.0
+		if s := r.Elapsed.Seconds(); s > 0 {
+			rate = float64(inSize) / s / (1 << 20)
+		}
+		fmt.Printf("%-4s %12v %10.1f MB/s %12d bytes  sha256 %x\n",
+			r.Impl, r.Elapsed.Round(time.Microsecond), rate, r.Size, r.SHA256[:8])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", mode, err)
+		return exitCode(err)
+	}
+	fmt.Printf("all %d implementations produced identical output\n", len(runs))
+	return exitOK
+}
+
+// parseSize parses a byte count with an optional K/M/G/T suffix (powers of 1024).
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// runCompare implements -mode cmp archive.pcz original. Like cmp(1) it
+// returns 0 when the contents match, 1 when they differ and 2 or more on
+// trouble (see troubleCode).
+func runCompare(archive string, args []string, impl string, threads int) int {
+	if archive == "" && len(args) > 0 {
+		archive, args = args[0], args[1:]
+	}
+	if archive == "" || len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: -mode cmp [-impl X -threads N] archive.pcz original")
+		return exitUsage
+	}
+	original := args[0]
+
+	res, err := core.CompareFile(archive, original, impl, threads)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cmp: %v\n", err)
+		return troubleCode(err)
+	}
+	switch {
+	case res.Equal:
+		return 0
+	case res.Offset == res.OriginalSize:
+		fmt.Printf("%s %s differ: EOF on %s after byte %d\n", archive, original, original, res.Offset)
+	case res.Block < 0:
+		fmt.Printf("%s %s differ: EOF on %s after byte %d\n", archive, original, archive, res.Offset)
 	default:
-		os.Exit(1)
+		fmt.Printf("%s %s differ: offset %d, member %d, block %d\n", archive, original, res.Offset, res.Member, res.Block)
 	}
+	return 1
+}
+
+// runVerifyManifest implements -mode verify-manifest manifest dir: like
+// sha256sum -c, it prints OK or FAILED for every file the manifest lists,
+// reading it from a sha256sum file or from a .tar.pcz, .zip or snapshot
+// written with -manifest. It returns 0 when all files match, 1 when one
+// differs or is missing and 2 or more on trouble (see troubleCode).
+func runVerifyManifest(manifest string, args []string, impl string, threads int) int {
+	if manifest == "" && len(args) > 0 {
+		manifest, args = args[0], args[1:]
+	}
+	if manifest == "" || len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: -mode verify-manifest [-impl X -threads N] manifest dir")
+		return exitUsage
+	}
+	entries, err := core.LoadManifest(manifest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify-manifest: %v\n", err)
+		return troubleCode(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	failed, err := core.VerifyManifest(entries, args[0], impl, threads, func(c core.ManifestCheck) {
+		switch {
+		case c.Err == nil:
+			fmt.Fprintf(out, "%s: OK\n", c.Path)
+		case errors.Is(c.Err, core.ErrVerify):
+			fmt.Fprintf(out, "%s: FAILED\n", c.Path)
+		case errors.Is(c.Err, os.ErrNotExist):
+			fmt.Fprintf(out, "%s: FAILED open or read (missing)\n", c.Path)
+		default:
+			fmt.Fprintf(out, "%s: FAILED open or read (%v)\n", c.Path, c.Err)
+		}
+	})
+	if err != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "verify-manifest: %v\n", err)
+		return troubleCode(err)
+	}
+	if failed > 0 {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "verify-manifest: %d of %d files did not match\n", failed, len(entries))
+		return 1
+	}
+	return 0
+}
 
+// runGrep implements -mode grep: it prints every line of the archives'
+// contents matching the pattern as name:line:offset:text, prefixed with the
+// archive when there are several. Like grep, it returns 0 when a line
+// matched, 1 when none did and 2 or more on errors (see troubleCode).
+func runGrep(archive string, args []string, impl string, threads int) int {
+	if len(args) == 0 || (archive == "" && len(args) < 2) {
+		fmt.Fprintln(os.Stderr, "usage: -mode grep [-impl X -threads N] pattern archive.pcz...")
+		return exitUsage
+	}
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "grep: %v\n", err)
+		return exitUsage
+	}
+	archives := args[1:]
+	if archive != "" {
+		archives = append([]string{archive}, archives...)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	status := 1
+	for _, a := range archives {
+		err := core.GrepFile(a, re, impl, threads, func(hit core.GrepHit) {
+			if len(archives) > 1 {
+				fmt.Fprintf(out, "%s:", a)
+			}
+			fmt.Fprintf(out, "%s:%d:%d:%s\n", hit.Name, hit.Line, hit.Offset, hit.Text)
+			status = 0
+		})
+		if err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "grep: %s: %v\n", a, err)
+			return troubleCode(err)
+		}
+	}
+	return status
+}
+
+// runEstimate implements -mode estimate: it samples the input and prints the
+// projected ratio and runtime without writing any output.
+func runEstimate(inPath string, threads int) int {
+	if inPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: -mode estimate -in file [-threads N]")
+		return exitUsage
+	}
+	est, err := core.EstimateFile(inPath, threads)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "estimate: %v\n", err)
+		return exitCode(err)
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+
+	fmt.Printf("input:      %s (%d bytes, %d blocks)\n", inPath, est.OriginalSize, est.NumBlocks)
+	fmt.Printf("sampled:    %d blocks (%d bytes)\n", est.SampledBlocks, est.SampledBytes)
+	if est.OriginalSize == 0 {
+		return exitOK
+	}
+	fmt.Printf("compressed: ~%d bytes (ratio %.2fx, %.1f%%)\n",
+		est.CompressedSize, est.Ratio(), 100*float64(est.CompressedSize)/float64(est.OriginalSize))
+	fmt.Printf("time:       ~%v single-threaded, ~%v with %d threads\n",
+		est.SeqTime.Round(time.Millisecond), (est.SeqTime / time.Duration(threads)).Round(time.Millisecond), threads)
+	return exitOK
+}
+
+// runPerfBaseline implements -mode perfbaseline: it measures cfg and saves
+// the results to outPath for perfcheck.
+func runPerfBaseline(outPath string, cfg perf.Config) int {
+	if outPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: -mode perfbaseline -out baseline.json [-impl X] [-threads N] [-perf-size 16M]")
+		return exitUsage
+	}
+	printPerfHeader()
+	b, err := perf.Measure(cfg, func(r perf.Result) { printPerfResult(r, "") })
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "perfbaseline: %v\n", err)
+		return exitCode(err)
+	}
+	if err := perf.Save(outPath, b); err != nil {
+		fmt.Fprintf(os.Stderr, "perfbaseline: %v\n", err)
+		return exitIO
+	}
+	fmt.Printf("baseline of %d results written to %s\n", len(b.Results), outPath)
+	return exitOK
+}
+
+// runPerfCheck implements -mode perfcheck: it measures again what the
+// baseline at inPath measured and returns 1 if anything regressed by more
+// than threshold percent, like cmp for a difference.
+func runPerfCheck(inPath string, threshold float64) int {
+	if inPath == "" || threshold < 0 {
+		fmt.Fprintln(os.Stderr, "usage: -mode perfcheck -in baseline.json [-perf-threshold 10]")
+		return exitUsage
+	}
+	base, err := perf.Load(inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "perfcheck: %v\n", err)
+		return troubleCode(err)
+	}
+	if !base.SameMachine() {
+		fmt.Fprintf(os.Stderr, "perfcheck: baseline taken on %s/%s with %d CPUs, this is %s/%s with %d; throughput will not compare\n",
+			base.GOOS, base.GOARCH, base.NumCPU, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	}
+	was := map[string]perf.Result{}
+	for _, r := range base.Results {
+		was[r.Key()] = r
+	}
+	printPerfHeader()
+	now, err := perf.Measure(base.Config, func(r perf.Result) {
+		change := ""
+		if b, ok := was[r.Key()]; ok && b.Throughput > 0 {
+			change = fmt.Sprintf("%+6.1f%%", 100*(r.Throughput/b.Throughput-1))
+		}
+		printPerfResult(r, change)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "perfcheck: %v\n", err)
+		return troubleCode(err)
+	}
+	regs := perf.Compare(base, now, threshold/100)
+	for _, r := range regs {
+		fmt.Printf("REGRESSION %s %s: %.1f%% (%s)\n", r.Now.Key(), r.Metric, 100*r.Change, perfValue(r.Metric, r.Base)+" => "+perfValue(r.Metric, r.Now))
+	}
+	if len(regs) > 0 {
+		fmt.Printf("%d of %d results regressed by more than %g%% against %s\n", len(regs), len(now.Results), threshold, inPath)
+		return 1
+	}
+	fmt.Printf("no regressions beyond %g%% against %s\n", threshold, inPath)
+	return exitOK
+}
+
+func printPerfHeader() {
+	fmt.Printf("%-10s %-4s %-10s %12s %7s\n", "corpus", "impl", "op", "throughput", "ratio")
+}
+
+func printPerfResult(r perf.Result, change string) {
+	fmt.Printf("%-10s %-4s %-10s %10s/s %6.2fx %s\n", r.Corpus, r.Impl, r.Op, core.HumanBytes(uint64(r.Throughput)), r.Ratio, change)
+}
+
+func perfValue(metric string, r perf.Result) string {
+	if metric == "ratio" {
+		return fmt.Sprintf("%.2fx", r.Ratio)
+	}
+	return core.HumanBytes(uint64(r.Throughput)) + "/s"
+}
+
+// runTune implements -tune for -mode estimate: it prints how every setting
+// did on the sample and the one it recommends.
+func runTune(inPath string, threads int, sizes []uint32, levels []int) int {
+	t, err := core.TuneFile(inPath, threads, sizes, levels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tune: %v\n", err)
+		return exitCode(err)
+	}
+	fmt.Println()
+	printTuning(os.Stdout, t)
+	best := t.Settings[t.Best]
+	fmt.Printf("recommended: -level %d -block-size %s\n", best.Level, formatBlockSize(best.BlockSize))
+	return exitOK
+}
+
+// tuneInput implements -tune for a compress job: it tunes on the job's
+// input and applies the best setting, printing the table on stderr unless
+// quiet. An input that cannot be sampled (a pipe, a URL) keeps the settings
+// in force.
+func tuneInput(inPath string, threads int, sizes []uint32, levels []int, quiet bool) {
+	t, err := core.TuneFile(inPath, threads, sizes, levels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-tune: %s: %v; keeping -level %d -block-size %s\n",
+			inPath, err, codec.DefaultLevel, formatBlockSize(core.DefaultBlockSize))
+		return
+	}
+	best := t.Settings[t.Best]
+	core.SetBlockSizeBytes(best.BlockSize)
+	codec.SetLevel(best.Level)
+	if !quiet {
+		printTuning(os.Stderr, t)
+		fmt.Fprintf(os.Stderr, "tune: using -level %d -block-size %s\n", best.Level, formatBlockSize(best.BlockSize))
+	}
+}
+
+// printTuning writes the table of a core.Tuning, the recommended setting
+// marked with a star.
+func printTuning(w io.Writer, t *core.Tuning) {
+	fmt.Fprintf(w, "tune: sampled %s of %s\n", core.HumanBytes(uint64(t.SampledBytes)), core.HumanBytes(uint64(t.OriginalSize)))
+	fmt.Fprintf(w, "  %10s %5s %8s %12s\n", "block-size", "level", "ratio", "throughput")
+	for i, s := range t.Settings {
+		mark := ""
+		if i == t.Best {
+			mark = " *"
+		}
+		fmt.Fprintf(w, "  %10s %5d %7.2fx %10s/s%s\n", formatBlockSize(s.BlockSize), s.Level, s.Ratio, core.HumanBytes(uint64(s.Throughput)), mark)
+	}
+}
+
+// formatBlockSize writes n the way -block-size takes it: 64K, 1M.
+func formatBlockSize(n uint32) string {
+	switch {
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+// replacesOutput reports whether mode writes -out as a new file, replacing
+// whatever is there.
+func replacesOutput(mode string, incremental bool) bool {
+	switch mode {
+	case "compress":
+		return !incremental
+	case "decompress", "tar", "extract", "zip", "zstd", "delta", "apply", "snapshot", "recv", "index", "rebuild", "analyze":
+		return true
+	}
+	return false
+}
+
+// confirmOverwrite lets the run replace the regular file at path only if the
+// user agrees to on a terminal. Devices, pipes and missing files are fine.
+// Without a terminal to ask on, or when standard input is the data being
+// compressed, it refuses and -y is needed, as with gzip and zstd.
+func confirmOverwrite(path string, stdinIsInput bool) error {
+	if path == "/dev/stdout" {
+		return nil // the shell's redirection already chose the file
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	tty := false
+	if st, err := os.Stdin.Stat(); err == nil {
+		tty = st.Mode()&os.ModeCharDevice != 0
+	}
+	if !tty || stdinIsInput {
+		usagef("%s already exists; pass -y to overwrite it", path)
+	}
+	fmt.Fprintf(os.Stderr, "%s already exists; overwrite? [y/N] ", path)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("%s: %w", path, errDeclined)
+}
+
+// listFlag is a flag that may be given several times, such as -out.
+type listFlag []string
+
+func (o *listFlag) String() string { return strings.Join(*o, ",") }
+
+func (o *listFlag) Set(v string) error {
+	*o = append(*o, v)
+	return nil
+}
+
+// inferMode picks the mode when -mode is not given, like gzip and zstd do:
+// archives (by their magic) are decompressed and anything else compressed.
+// Without -out the output is named by outputName. Standard input is
+// compressed and needs -out.
+func inferMode(in, out string) (string, string, error) {
+	if in == "" {
+		usagef("usage: [-mode M] [-out output] input")
+	}
+	if in == "-" {
+		if out == "" {
+			usagef("compressing standard input needs -out")
+		}
+		return "compress", out, nil
+	}
+	archive, err := core.IsArchive(in)
+	if err != nil {
+		return "", "", err
+	}
+	if out == "" {
+		out = outputName(in, archive)
+	}
+	if !archive {
+		return "compress", out, nil
+	}
+	return "decompress", out, nil
+}
+
+// outputName names the output of in when -out is not given: file <->
+// file.pcz, or file.out for an archive not ending in .pcz. A URL's output
+// lands in the current directory, named after the last element of its path.
+func outputName(in string, decompress bool) string {
+	local := in
+	if u, err := url.Parse(in); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		local = path.Base(u.Path)
+		if local == "/" || local == "." {
+			local = "download"
+		}
+	}
+	if !decompress {
+		return local + ".pcz"
+	}
+	out := strings.TrimSuffix(local, ".pcz")
+	if out == local || strings.HasSuffix(out, "/") || out == "" {
+		out = local + ".out"
+	}
+	return out
+}
+
+// job is one input to run the mode on; gzip-style invocations may name
+// several.
+type job struct {
+	mode, in, out string
+	removeIn      bool // delete the input once done, as gzip does
+}
+
+// gzipOptions are the gzip-style flags -d, -c, -k and -t. Installed (or
+// linked) as gzip, gunzip or zcat, the binary also behaves like that
+// command: gunzip implies -d, zcat -d -c, and inputs are deleted once
+// handled unless -k, -c or -t is given.
+type gzipOptions struct {
+	decompress, stdout, keep, test bool
+	asGzip                         bool // run as gzip, gunzip or zcat
+}
+
+// gzipOptionsFor returns the defaults for the binary run as argv0.
+func gzipOptionsFor(argv0 string) gzipOptions {
+	var o gzipOptions
+	switch strings.TrimSuffix(filepath.Base(argv0), ".exe") {
+	case "gzip":
+		o.asGzip = true
+	case "gunzip":
+		o.asGzip, o.decompress = true, true
+	case "zcat":
+		o.asGzip, o.decompress, o.stdout = true, true, true
+	}
+	return o
+}
+
+// shaped reports whether the invocation is gzip-shaped: files after the
+// flags, with the mode given by -d and -t rather than -mode.
+func (o gzipOptions) shaped() bool {
+	return o.decompress || o.stdout || o.test || o.asGzip
+}
+
+// gzipJobs turns the files of a gzip-shaped invocation into jobs, all of
+// the same mode. No files, or "-", means standard input, written to
+// standard output.
+func gzipJobs(o gzipOptions, files []string, out string) []job {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	if out != "" && len(files) > 1 {
+		usagef("-out names the output of a single file")
+	}
+	mode := "compress"
+	if o.decompress || o.test {
+		mode = "decompress"
+	}
+	jobs := make([]job, len(files))
+	for i, f := range files {
+		j := job{mode: mode, in: f, out: out}
+		if f == "-" && mode == "decompress" {
+			j.in = "/dev/stdin"
+		}
+		switch {
+		case o.test:
+			j.out = os.DevNull
+		case o.stdout || f == "-":
+			j.out = "/dev/stdout"
+		case j.out == "":
+			j.out = outputName(f, mode == "decompress")
+		}
+		j.removeIn = o.asGzip && !o.keep && !o.stdout && !o.test && f != "-" && !strings.Contains(f, "://")
+		jobs[i] = j
+	}
+	return jobs
+}
+
+// parseAfterFiles parses the flags that follow file names, as gzip allows
+// (gzip file -9), and returns the file names. Everything after "--" is a
+// file name.
+func parseAfterFiles(args []string) []string {
+	var files, rest []string
+	for i, a := range args {
+		if a == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+	for len(args) > 0 {
+		if args[0] == "-" || !strings.HasPrefix(args[0], "-") {
+			files, args = append(files, args[0]), args[1:]
+			continue
+		}
+		flag.CommandLine.Parse(expandShortFlags(args))
+		args = flag.Args()
+	}
+	return append(files, rest...)
+}
+
+// stdoutIsFile reports whether standard output is redirected to a regular
+// file.
+func stdoutIsFile() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// spoolStdout stands in for writing to /dev/stdout when that is a regular
+// file: opening it again would truncate it, losing what earlier files of a
+// gzip -c run wrote or what a >> redirection holds, and the parallel
+// writers would write at offsets from its start. The run writes to the
+// returned temporary file instead, and done, called with the run's error,
+// appends it to standard output and removes it.
+func spoolStdout() (string, func(error) error, error) {
+	f, err := os.CreateTemp("", "pcz-stdout-*")
+	if err != nil {
+		return "", nil, err
+	}
+	name := f.Name()
+	f.Close()
+	done := func(err error) error {
+		defer os.Remove(name)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+	return name, done, nil
+}
+
+// levelFlag is one of -1 ... -9, which set -level like gzip's.
+type levelFlag struct {
+	level *int
+	n     int
+}
+
+func (l levelFlag) String() string   { return "" }
+func (l levelFlag) IsBoolFlag() bool { return true }
+
+func (l levelFlag) Set(v string) error {
+	if v != "true" {
+		return fmt.Errorf("takes no value")
+	}
+	*l.level = l.n
+	return nil
+}
+
+// expandShortFlags splits bundled gzip-style flags such as -dc or -9k into
+// one argument each, leaving flags the flag package knows, their values and
+// everything from the first file name on as they are.
+func expandShortFlags(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || a == "-" || !strings.HasPrefix(a, "-") {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(a, "-")
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			out = append(out, a)
+			continue
+		}
+		if f := flag.Lookup(name); f != nil {
+			out = append(out, a)
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); (!ok || !b.IsBoolFlag()) && i+1 < len(args) {
+				i++
+				out = append(out, args[i])
+			}
+			continue
+		}
+		if strings.Trim(name, "cdfkqty123456789") != "" {
+			out = append(out, a) // let flag.Parse report it
+			continue
+		}
+		for _, c := range name {
+			out = append(out, "-"+string(c))
+		}
+	}
+	return out
 }
@@ -0,0 +1,135 @@
+package perf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Corpus is one standard input of the harness. Generate is deterministic:
+// the same size always gives the same bytes, so baselines taken on one
+// build compare with runs of the next.
+type Corpus struct {
+	Name     string
+	Generate func(size int) []byte
+}
+
+// Corpora are the standard inputs, covering what the codecs and schedulers
+// see in practice: text, incompressible data, sparse images, a mix of
+// kinds and numeric series.
+var Corpora = []Corpus{
+	{"text", genText},
+	{"random", genRandom},
+	{"fragmented", genFragmented},
+	{"mixed", genMixed},
+	{"floats", genFloats},
+}
+
+// CorpusNamed returns the corpus called name.
+func CorpusNamed(name string) (Corpus, error) {
+	for _, c := range Corpora {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Corpus{}, fmt.Errorf("unknown corpus %q", name)
+}
+
+var words = strings.Fields(`the of and to in is that for it as was with be by on not he this are or
+	his from at which but have an they you were her she there been one all we their has would when
+	what will more if no out so said who up can its about into them than only other new some could
+	time these two may then do first any my now such like our over man me even most made after also
+	block worker thread archive header window match offset length codec buffer queue steal barrier`)
+
+// genText is English-like prose: words drawn with a skewed distribution,
+// in sentences and lines.
+func genText(size int) []byte {
+	r := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	b.Grow(size + 64)
+	line := 0
+	for b.Len() < size {
+		w := words[int(float64(len(words))*math.Pow(r.Float64(), 2))]
+		b.WriteString(w)
+		line += len(w) + 1
+		switch {
+		case line > 72:
+			b.WriteByte('\n')
+			line = 0
+		case r.Intn(12) == 0:
+			b.WriteString(". ")
+		default:
+			b.WriteByte(' ')
+		}
+	}
+	return []byte(b.String()[:size])
+}
+
+// genRandom is incompressible.
+func genRandom(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(2)).Read(b)
+	return b
+}
+
+// genFragmented is a sparse disk image, as in benchmark.py: random islands
+// of 10% at either end around zeros.
+func genFragmented(size int) []byte {
+	b := make([]byte, size)
+	r := rand.New(rand.NewSource(3))
+	island := size / 10
+	r.Read(b[:island])
+	r.Read(b[size-island:])
+	return b
+}
+
+// genMixed interleaves 64 KiB segments of text, JSON-like records, zeros,
+// random bytes and a repeated media-like pattern.
+func genMixed(size int) []byte {
+	const segment = 64 << 10
+	r := rand.New(rand.NewSource(4))
+	text := genText(segment)
+	var records strings.Builder
+	for i := 0; records.Len() < segment; i++ {
+		fmt.Fprintf(&records, `{"id":%d,"user":"%s","score":%d,"tags":["%s","%s"]}`+"\n",
+			i, words[r.Intn(len(words))], r.Intn(1000), words[r.Intn(len(words))], words[r.Intn(len(words))])
+	}
+	pattern := make([]byte, 4096)
+	r.Read(pattern)
+
+	b := make([]byte, 0, size+segment)
+	for k := 0; len(b) < size; k++ {
+		switch k % 5 {
+		case 0:
+			b = append(b, text...)
+		case 1:
+			b = append(b, records.String()[:segment]...)
+		case 2:
+			b = append(b, make([]byte, segment)...)
+		case 3:
+			seg := make([]byte, segment)
+			r.Read(seg)
+			b = append(b, seg...)
+		case 4:
+			for n := 0; n < segment; n += len(pattern) {
+				b = append(b, pattern...)
+				pattern[r.Intn(len(pattern))]++
+			}
+		}
+	}
+	return b[:size]
+}
+
+// genFloats is a slowly varying float64 series, the input -filter is for.
+func genFloats(size int) []byte {
+	r := rand.New(rand.NewSource(5))
+	b := make([]byte, size+8)
+	v := 1000.0
+	for i := 0; i < size; i += 8 {
+		v += r.NormFloat64()
+		binary.LittleEndian.PutUint64(b[i:], math.Float64bits(math.Round(v*100)/100))
+	}
+	return b[:size]
+}
@@ -0,0 +1,207 @@
+// Package perf measures the throughput of the compressor on standard
+// corpora, records it as a baseline and checks later builds against it, so
+// scheduler and codec changes that slow things down are caught.
+package perf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"proj3/core"
+)
+
+// Impls are the schedulers measured when Config.Impls is empty.
+var Impls = []string{"seq", "bsp", "ws", "fj", "pool"}
+
+// Config selects what Measure runs. Zero fields take the defaults: every
+// corpus and scheduler, 16 MiB per corpus, 4 threads, best of 3 runs.
+type Config struct {
+	Corpora []string
+	Impls   []string
+	Size    int
+	Threads int
+	Repeat  int
+}
+
+func (c *Config) defaults() {
+	if len(c.Corpora) == 0 {
+		for _, corpus := range Corpora {
+			c.Corpora = append(c.Corpora, corpus.Name)
+		}
+	}
+	if len(c.Impls) == 0 {
+		c.Impls = Impls
+	}
+	if c.Size <= 0 {
+		c.Size = 16 << 20
+	}
+	if c.Threads <= 0 {
+		c.Threads = 4
+	}
+	if c.Repeat <= 0 {
+		c.Repeat = 3
+	}
+}
+
+// Result is the throughput of one operation of one scheduler on a corpus.
+type Result struct {
+	Corpus     string
+	Impl       string
+	Op         string  // "compress" or "decompress"
+	Throughput float64 // original bytes per second, best of the runs
+	Ratio      float64 // original size over compressed size
+}
+
+// Key identifies the measurement, the same across baselines.
+func (r Result) Key() string {
+	return r.Corpus + "/" + r.Impl + "/" + r.Op
+}
+
+// Baseline is a set of results with the configuration and machine they
+// were taken with, as saved by Save.
+type Baseline struct {
+	Created   time.Time
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	NumCPU    int
+	Config    Config
+	Results   []Result
+}
+
+// SameMachine reports whether b was taken on a machine like the current
+// one: throughput from another says little.
+func (b *Baseline) SameMachine() bool {
+	return b.GOOS == runtime.GOOS && b.GOARCH == runtime.GOARCH && b.NumCPU == runtime.NumCPU()
+}
+
+// Measure compresses and decompresses every corpus of cfg in memory with
+// every scheduler, cfg.Repeat times each, and keeps the best throughput.
+// Every decompressed result is checked against the corpus. fn, if not nil,
+// is called with each result as it is ready.
+func Measure(cfg Config, fn func(Result)) (*Baseline, error) {
+	cfg.defaults()
+	b := &Baseline{
+		Created:   time.Now().UTC().Round(time.Second),
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+		Config:    cfg,
+	}
+	for _, name := range cfg.Corpora {
+		corpus, err := CorpusNamed(name)
+		if err != nil {
+			return nil, err
+		}
+		data := corpus.Generate(cfg.Size)
+		for _, impl := range cfg.Impls {
+			comp, dec := Result{Corpus: name, Impl: impl, Op: "compress"}, Result{Corpus: name, Impl: impl, Op: "decompress"}
+			for i := 0; i < cfg.Repeat; i++ {
+				start := time.Now()
+				archive, err := core.CompressBytes(data, impl, cfg.Threads)
+				if err != nil {
+					return nil, fmt.Errorf("%s: compress with %s: %w", name, impl, err)
+				}
+				comp.Throughput = best(comp.Throughput, len(data), time.Since(start))
+
+				start = time.Now()
+				out, err := core.DecompressBytes(archive, impl, cfg.Threads)
+				if err != nil {
+					return nil, fmt.Errorf("%s: decompress with %s: %w", name, impl, err)
+				}
+				dec.Throughput = best(dec.Throughput, len(data), time.Since(start))
+				if !bytes.Equal(out, data) {
+					return nil, fmt.Errorf("%s: %s does not round-trip", name, impl)
+				}
+				comp.Ratio = float64(len(data)) / float64(len(archive))
+				dec.Ratio = comp.Ratio
+			}
+			b.Results = append(b.Results, comp, dec)
+			if fn != nil {
+				fn(comp)
+				fn(dec)
+			}
+		}
+	}
+	return b, nil
+}
+
+// best is the higher of prev and the throughput of n bytes in d.
+func best(prev float64, n int, d time.Duration) float64 {
+	if d <= 0 {
+		d = time.Nanosecond
+	}
+	if t := float64(n) / d.Seconds(); t > prev {
+		return t
+	}
+	return prev
+}
+
+// Save writes b to path as JSON.
+func Save(path string, b *Baseline) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Load reads a baseline written by Save.
+func Load(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(b.Results) == 0 {
+		return nil, fmt.Errorf("%s: no results", path)
+	}
+	return &b, nil
+}
+
+// Regression is a result of a check that fell short of its baseline.
+type Regression struct {
+	Base, Now Result
+	Metric    string  // "throughput" or "ratio"
+	Change    float64 // relative, e.g. -0.15 for 15% lower
+}
+
+// Compare returns the results of now that are below those of base with
+// the same Key by more than threshold (0.1 for 10%), in throughput or in
+// ratio. Results only one of them has are not compared.
+func Compare(base, now *Baseline, threshold float64) []Regression {
+	was := map[string]Result{}
+	for _, r := range base.Results {
+		was[r.Key()] = r
+	}
+	var regs []Regression
+	for _, r := range now.Results {
+		b, ok := was[r.Key()]
+		if !ok {
+			continue
+		}
+		if c := change(b.Throughput, r.Throughput); c < -threshold {
+			regs = append(regs, Regression{b, r, "throughput", c})
+		}
+		if c := change(b.Ratio, r.Ratio); c < -threshold {
+			regs = append(regs, Regression{b, r, "ratio", c})
+		}
+	}
+	return regs
+}
+
+// change is the relative change from was to now.
+func change(was, now float64) float64 {
+	if was == 0 {
+		return 0
+	}
+	return now/was - 1
+}